@@ -23,6 +23,7 @@ package agent
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -38,36 +39,80 @@ import (
 // AGENT_VERSION is a super-pooper shared number that is used to identify if we need a agent update
 const AGENT_VERSION = 1
 
+// ErrUpdateRequired is returned by PollTasks (and other methods) if server refuses to give tasks
+// to agent because its version is lower than required. Agent should update
+// itself before polling again.
+var ErrUpdateRequired = errors.New("agent update required")
+
 // Wrapper class that takes care of all boilerplate required for agent session.
 type Client struct {
 	baseURL            string
 	authHeader         string
+	name               string
 	h                  http.Client
 	SupportedTaskTypes []string
+
+	// If TrustedKeys is not nil, only tasks signed by one of these keys
+	// are accepted (see SignTask), except for tasks with types listed in
+	// UnsignedTaskTypes.
+	TrustedKeys       map[string]ed25519.PublicKey
+	UnsignedTaskTypes []string
+	// NonceFile is where nonces of executed signed tasks are saved so they
+	// can't be replayed after agent restart.
+	NonceFile string
+	nonces    *nonceStore
+
+	// If Policy is not nil, tasks not allowed by it are rejected by
+	// PollTasks.
+	Policy *Policy
+
+	// If DisableWebSocket is true, only long polling is used to receive
+	// tasks.
+	DisableWebSocket bool
+	ws               *wsState
+	tasks            *taskTracker
+
+	// OutboxDir is where task results are kept until server confirms
+	// delivery. If empty, results are lost if they can't be sent.
+	OutboxDir string
+	outbox    *outbox
+
+	// If Cache is not nil, files downloaded by DownloadFile are saved in it
+	// and not downloaded again.
+	Cache *Cache
+	// If UsePeers is true, DownloadFile gets files from server's filedrop
+	// using other agents in the same subnet (see ServePeers) when possible.
+	UsePeers bool
+	peers    *peerState
+
+	// Reconnect controls delays between retries in NextTask.
+	Reconnect Backoff
+	// OnCredentialsRevoked is called by NextTask if server rejects agent's
+	// credentials.
+	OnCredentialsRevoked func()
 }
 
 func NewClient(baseURL string) Client {
-	return Client{baseURL: baseURL, h: http.Client{}}
+	return Client{baseURL: baseURL, h: http.Client{}, ws: &wsState{}, tasks: &taskTracker{}, outbox: &outbox{}, peers: &peerState{}, nonces: &nonceStore{}}
 }
 
 func (c *Client) RegisterAgent(name, hwid string) error {
+	c.name = name
+
 	// It's not necessary to do GET /agents_selfreg, server will reject request
 	// anyway if registration is disabled.
 	req, err := http.NewRequest("POST", c.baseURL+"/agents?name="+url.QueryEscape(name)+"&hwid="+url.QueryEscape(hwid), nil)
 	if err != nil {
 		return fmt.Errorf("request create: %v", err)
 	}
-	req.Header.Set("Authorization", c.authHeader)
-	req.Header.Set("Version", strconv.Itoa(AGENT_VERSION))
+	c.setHeaders(req)
 	resp, err := c.h.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 { // check for non 2xx code, not just 200.
-		if resp.StatusCode == 403 {
-			return errors.New("access denied")
-		}
-		return errors.New(errorMessage(resp))
+		return httpError(resp)
 	}
 	return nil
 }
@@ -76,41 +121,106 @@ func (c *Client) UseAccount(token string) {
 	c.authHeader = token
 }
 
+// setHeaders adds authorization and capabilities headers to request.
+//
+// Server uses Version and Task-Types to reject tasks agent can't execute
+// before they are queued, so SupportedTaskTypes should be set before
+// RegisterAgent is called.
+func (c *Client) setHeaders(req *http.Request) {
+	req.Header.Set("Authorization", c.authHeader)
+	req.Header.Set("Version", strconv.Itoa(AGENT_VERSION))
+	if c.SupportedTaskTypes != nil {
+		req.Header.Set("Task-Types", strings.Join(c.advertisedTaskTypes(), ","))
+	}
+}
+
+// Tasks of these types are created by server itself (they refer to sessions
+// server opened), so admin can't sign them.
+var serverTaskTypes = []string{"shell", "tunnel"}
+
+// advertisedTaskTypes returns SupportedTaskTypes without types agent would
+// reject anyway because they can't be signed. This way server refuses to
+// start shell session or tunnel right away instead of waiting for agent.
+func (c *Client) advertisedTaskTypes() []string {
+	if c.TrustedKeys == nil {
+		return c.SupportedTaskTypes
+	}
+	res := make([]string, 0, len(c.SupportedTaskTypes))
+	for _, t := range c.SupportedTaskTypes {
+		if contains(serverTaskTypes, t) && !contains(c.UnsignedTaskTypes, t) {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
 // PollTasks requests first task from server's queue.
 //
+// Persistent WebSocket connection is used if server supports it, otherwise
+// long polling is used.
+//
 // It may block for up to 26 seconds. And also note that it returns error for tasks
-// with type not in SupportedTaskTypes (if SupportTaskTypes is not nil).
+// with type not in SupportedTaskTypes (if SupportTaskTypes is not nil) and
+// for tasks without valid signature (if TrustedKeys is not nil) or not
+// allowed by Policy. Signed tasks are returned unwrapped.
+//
+// ErrUpdateRequired is returned if server considers agent version outdated.
 //
 // This function will return id=-1 if no tasks received.
 func (c *Client) PollTasks() (id int, type_ string, body map[string]interface{}, err error) {
+	// Deliver results left from previous run.
+	c.startOutbox()
+
+	var conn *wsConn
+	if !c.DisableWebSocket {
+		conn, err = c.wsConnect()
+		if err != nil {
+			return -1, "", nil, err
+		}
+	}
+	if conn != nil {
+		body, err = c.wsNextTask(conn)
+	} else {
+		body, err = c.longpollTask()
+	}
+	if err != nil {
+		return -1, "", nil, err
+	}
+
+	if len(body) == 0 {
+		return -1, "", nil, nil
+	}
+	return c.parseTask(body)
+}
+
+func (c *Client) longpollTask() (body map[string]interface{}, err error) {
 	req, err := http.NewRequest("GET", c.baseURL+"/tasks", nil)
 	if err != nil {
-		return -1, "", nil, fmt.Errorf("request create: %v", err)
+		return nil, fmt.Errorf("request create: %v", err)
 	}
-	req.Header.Set("Authorization", c.authHeader)
-	req.Header.Set("Version", strconv.Itoa(AGENT_VERSION))
+	c.setHeaders(req)
 	resp, err := c.h.Do(req)
 	if err != nil {
-		return -1, "", nil, err
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 { // check for non 2xx code, not just 200.
-		if resp.StatusCode == 403 {
-			return -1, "", nil, errors.New("access denied")
-		}
-		return -1, "", nil, errors.New(errorMessage(resp))
+		return nil, httpError(resp)
 	}
 
 	rawBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return -1, "", nil, fmt.Errorf("response body read: %v", err)
+		return nil, fmt.Errorf("response body read: %v", err)
 	}
 	if err := json.Unmarshal(rawBody, &body); err != nil {
-		return -1, "", nil, fmt.Errorf("response body parse: %v", err)
+		return nil, fmt.Errorf("response body parse: %v", err)
 	}
+	return body, nil
+}
 
-	if len(body) == 0 {
-		return -1, "", nil, nil
-	}
+// parseTask checks task received from server.
+func (c *Client) parseTask(body map[string]interface{}) (id int, type_ string, _ map[string]interface{}, err error) {
 
 	if body["id"] == nil {
 		return -1, "", body, errors.New("missing id field in response")
@@ -122,6 +232,7 @@ func (c *Client) PollTasks() (id int, type_ string, body map[string]interface{},
 		return -1, "", body, errors.New("non-numeric task ID")
 	}
 	id = int(floatId)
+	c.tasks.start(id)
 
 	if body["type"] == nil {
 		return id, "", body, errors.New("missing task type in response")
@@ -131,39 +242,28 @@ func (c *Client) PollTasks() (id int, type_ string, body map[string]interface{},
 		return id, "", body, errors.New("non-string task type")
 	}
 
-	if c.SupportedTaskTypes != nil {
-		for _, v := range c.SupportedTaskTypes {
-			if v == type_ {
-				return
-			}
-		}
+	if !c.supportsTask(type_) {
+		return id, type_, body, errors.New("unsupported task type")
 	}
-	return id, type_, body, errors.New("unsupported task type")
-}
 
-func (c *Client) UploadFile(src io.Reader) (string, error) {
-	req, err := http.NewRequest("POST", c.baseURL+"/filedrop/agent_upload", src)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Authorization", c.authHeader)
-	req.Header.Set("Version", strconv.Itoa(AGENT_VERSION))
-	resp, err := c.h.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		if resp.StatusCode == 403 {
-			return "", errors.New("access denied")
+	if c.TrustedKeys != nil {
+		body, err = c.verifyTask(id, type_, body)
+		if err != nil {
+			return id, type_, nil, err
 		}
-		return "", errors.New("HTTP " + resp.Status)
 	}
-	urlBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+
+	if c.Policy != nil {
+		if err := c.Policy.Check(type_, body); err != nil {
+			log.Println("Task", id, "rejected by local policy:", err)
+			return id, type_, nil, fmt.Errorf("denied by local policy: %v", err)
+		}
 	}
-	return string(urlBytes), nil
+	return id, type_, body, nil
+}
+
+func (c *Client) supportsTask(type_ string) bool {
+	return c.SupportedTaskTypes == nil || contains(c.SupportedTaskTypes, type_)
 }
 
 func (c *Client) Download(url string) (io.ReadCloser, error) {
@@ -172,48 +272,81 @@ func (c *Client) Download(url string) (io.ReadCloser, error) {
 		return nil, err
 	}
 	if strings.HasPrefix(url, c.baseURL) {
-		req.Header.Set("Authorization", c.authHeader)
-		req.Header.Set("Version", strconv.Itoa(AGENT_VERSION))
+		c.setHeaders(req)
 	}
 	resp, err := c.h.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode/100 != 2 {
-		resp.Body.Close()
-		if resp.StatusCode == 403 {
-			return nil, errors.New("access denied")
-		}
-		return resp.Body, errors.New("HTTP " + resp.Status)
+		defer resp.Body.Close()
+		return nil, httpError(resp)
 	}
 	return resp.Body, nil
 }
 
+// SendTaskResult reports task result to server using WebSocket connection
+// if there is one, or HTTP request otherwise.
+//
+// If OutboxDir is set, result is saved there first and removed only after
+// server confirms it. Results that can't be delivered now are retried in
+// background (including ones left from previous agent runs), nil is returned
+// in this case.
 func (c *Client) SendTaskResult(taskID int, result map[string]interface{}) error {
-	resJson, err := json.Marshal(result)
-	if err != nil {
-		return fmt.Errorf("json format: %v", err)
-	}
+	c.tasks.finish(taskID)
 
 	if _, prs := result["error"]; !prs {
 		result["error"] = false
 	}
 
+	if c.OutboxDir != "" {
+		if err := c.outbox.put(c.OutboxDir, taskID, result); err != nil {
+			log.Println("Failed to save task result to outbox:", err)
+		} else {
+			defer c.startOutbox()
+		}
+	}
+
+	if conn := c.ws.current(); conn != nil {
+		err := conn.send(WSMessage{Kind: "result", ID: taskID, Result: result})
+		if err == nil {
+			// Result will be removed from outbox when server acknowledges it.
+			return nil
+		}
+		log.Println("Failed to send task result using WebSocket, retrying using HTTP:", err)
+	}
+
+	if err := c.postTaskResult(taskID, result); err != nil {
+		if c.OutboxDir != "" && c.outbox.has(c.OutboxDir, taskID) {
+			log.Printf("Failed to send task %d result, will retry later: %v", taskID, err)
+			return nil
+		}
+		return err
+	}
+	if c.OutboxDir != "" {
+		c.outbox.remove(c.OutboxDir, taskID)
+	}
+	return nil
+}
+
+func (c *Client) postTaskResult(taskID int, result map[string]interface{}) error {
+	resJson, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("json format: %v", err)
+	}
+
 	req, err := http.NewRequest("POST", c.baseURL+"/task_result?id="+strconv.Itoa(taskID), bytes.NewReader(resJson))
 	if err != nil {
 		return fmt.Errorf("request create: %v", err)
 	}
-	req.Header.Set("Authorization", c.authHeader)
-	req.Header.Set("Version", strconv.Itoa(AGENT_VERSION))
+	c.setHeaders(req)
 	resp, err := c.h.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 { // check for non 2xx code, not just 200.
-		if resp.StatusCode == 403 {
-			return errors.New("access denied")
-		}
-		return errors.New(errorMessage(resp))
+		return httpError(resp)
 	}
 	return nil
 }
@@ -0,0 +1,792 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ArchiveOptions describes directory archive created by UploadDir.
+type ArchiveOptions struct {
+	Dir string
+	// Format is "zip" (default) or "tar.gz".
+	Format string
+	// Include and Exclude are glob patterns (see path.Match) matched
+	// against paths relative to Dir using "/" as separator. Patterns
+	// without "/" are matched against names, so they apply at any depth.
+	// If Include is not empty, only files matching one of patterns are
+	// archived. Excluded directories are skipped with all contents.
+	Include []string
+	Exclude []string
+}
+
+// ArchiveResult describes archive uploaded by UploadDir.
+type ArchiveResult struct {
+	URL string
+	// Files is count of archived files and symlinks, Size is their total
+	// size before compression.
+	Files int
+	Size  int64
+}
+
+func parseStringList(body map[string]interface{}, field string) ([]string, error) {
+	val, prs := body[field]
+	if !prs {
+		return nil, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, errors.New(field + " should be array of strings")
+	}
+	res := make([]string, len(list))
+	for i, entry := range list {
+		if res[i], ok = entry.(string); !ok {
+			return nil, errors.New(field + " should be array of strings")
+		}
+		if _, err := path.Match(res[i], ""); err != nil {
+			return nil, errors.New("invalid pattern in " + field + ": " + res[i])
+		}
+	}
+	return res, nil
+}
+
+// ParseUploadDir reads fields of uploaddir task.
+func ParseUploadDir(body map[string]interface{}) (ArchiveOptions, error) {
+	opts := ArchiveOptions{Format: "zip"}
+	var ok bool
+	if opts.Dir, ok = body["dir"].(string); !ok || opts.Dir == "" {
+		return opts, errors.New("dir should be non-empty string")
+	}
+	if val, prs := body["format"]; prs {
+		if opts.Format, ok = val.(string); !ok || (opts.Format != "zip" && opts.Format != "tar.gz") {
+			return opts, errors.New("format should be \"zip\" or \"tar.gz\"")
+		}
+	}
+	var err error
+	if opts.Include, err = parseStringList(body, "include"); err != nil {
+		return opts, err
+	}
+	if opts.Exclude, err = parseStringList(body, "exclude"); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func matchArchivePatterns(patterns []string, rel string) bool {
+	if runtime.GOOS == "windows" {
+		rel = strings.ToLower(rel)
+	}
+	for _, pattern := range patterns {
+		if runtime.GOOS == "windows" {
+			pattern = strings.ToLower(pattern)
+		}
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveWriter hides differences between zip and tar.gz.
+type archiveWriter interface {
+	add(rel string, info os.FileInfo, link string, data io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (z zipArchive) add(rel string, info os.FileInfo, link string, data io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	w, err := z.w.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	// Symlinks are stored as files with target as contents.
+	if link != "" {
+		data = strings.NewReader(link)
+	}
+	if data != nil {
+		_, err = io.Copy(w, data)
+	}
+	return err
+}
+
+func (z zipArchive) Close() error {
+	return z.w.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (t tarGzArchive) add(rel string, info os.FileInfo, link string, data io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := t.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if data != nil && hdr.Typeflag == tar.TypeReg {
+		// File may grow while we read it, tar header is already written.
+		_, err = io.Copy(t.w, io.LimitReader(data, hdr.Size))
+	}
+	return err
+}
+
+func (t tarGzArchive) Close() error {
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// writeArchive writes archive of opts.Dir to w.
+func writeArchive(ctx context.Context, w io.Writer, opts ArchiveOptions, res *ArchiveResult) error {
+	var archive archiveWriter
+	switch opts.Format {
+	case "", "zip":
+		archive = zipArchive{zip.NewWriter(w)}
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		archive = tarGzArchive{gz, tar.NewWriter(gz)}
+	default:
+		return fmt.Errorf("unknown archive format: %s", opts.Format)
+	}
+
+	err := filepath.Walk(opts.Dir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opts.Dir, fullPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if matchArchivePatterns(opts.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			// Parent directories are created during extraction anyway, so
+			// we store only directories that may be empty.
+			if len(opts.Include) != 0 {
+				return nil
+			}
+			return archive.add(rel, info, "", nil)
+		}
+		if len(opts.Include) != 0 && !matchArchivePatterns(opts.Include, rel) {
+			return nil
+		}
+
+		res.Files++
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(fullPath)
+			if err != nil {
+				return err
+			}
+			return archive.add(rel, info, link, nil)
+		case info.Mode().IsRegular():
+			f, err := os.Open(fullPath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			res.Size += info.Size()
+			return archive.add(rel, info, "", f)
+		default:
+			// Devices, sockets, etc.
+			res.Files--
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// UploadDir uploads archive of directory to server (see UploadFile).
+// Archive is streamed as it's created, without temporary files.
+func (c *Client) UploadDir(ctx context.Context, opts ArchiveOptions, taskID int) (ArchiveResult, error) {
+	res := ArchiveResult{}
+	stat, err := os.Stat(opts.Dir)
+	if err != nil {
+		return res, err
+	}
+	if !stat.IsDir() {
+		return res, fmt.Errorf("%s is not a directory", opts.Dir)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		buf := bufio.NewWriterSize(pw, uploadChunkSize)
+		err := writeArchive(ctx, buf, opts, &res)
+		if err == nil {
+			err = buf.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	res.URL, err = c.UploadFile(pr, -1, taskID)
+	// Stop archiving if upload failed.
+	pr.CloseWithError(errors.New("upload aborted"))
+	return res, err
+}
+
+// DefaultMaxExtractSize is used if ExtractOptions.MaxSize is not set.
+const DefaultMaxExtractSize = 8 << 30
+
+// ExtractOptions describes archive extracted by DownloadArchive.
+type ExtractOptions struct {
+	// Archive verification and caching, see DownloadFile.
+	DownloadOptions
+
+	URL string
+	Dir string
+	// Format is "zip", "tar.gz" or "tar". If empty, it's detected using
+	// archive contents.
+	Format string
+	// If Clean is true, contents of Dir are removed before extraction.
+	Clean bool
+	// MaxSize limits total size of extracted files to protect against
+	// archive bombs, DefaultMaxExtractSize is used if it's zero.
+	MaxSize int64
+}
+
+// ExtractResult describes outcome of DownloadArchive.
+type ExtractResult struct {
+	// Archive download details.
+	DownloadResult
+
+	Files int
+	Dirs  int
+	Links int
+	// Size is total size of extracted files.
+	Size int64
+	// Skipped is count of entries of unsupported types (e.g. hard links
+	// and devices).
+	Skipped int
+}
+
+// ParseDownloadArchive reads fields of downloadarchive task.
+func ParseDownloadArchive(body map[string]interface{}) (ExtractOptions, error) {
+	opts := ExtractOptions{}
+	var ok bool
+	// url can be omitted if archive with specified sha256 is cached.
+	if val, prs := body["url"]; prs {
+		if opts.URL, ok = val.(string); !ok {
+			return opts, errors.New("url should be string")
+		}
+	}
+	if opts.Dir, ok = body["dir"].(string); !ok || opts.Dir == "" {
+		return opts, errors.New("dir should be non-empty string")
+	}
+	if val, prs := body["sha256"]; prs {
+		if opts.SHA256, ok = val.(string); !ok {
+			return opts, errors.New("sha256 should be string")
+		}
+	}
+	if val, prs := body["size"]; prs {
+		size, ok := val.(float64)
+		if !ok || size < 0 {
+			return opts, errors.New("size should be non-negative number")
+		}
+		opts.Size = int64(size)
+	}
+	if val, prs := body["format"]; prs {
+		if opts.Format, ok = val.(string); !ok || (opts.Format != "zip" && opts.Format != "tar.gz" && opts.Format != "tar") {
+			return opts, errors.New("format should be \"zip\", \"tar.gz\" or \"tar\"")
+		}
+	}
+	if val, prs := body["clean"]; prs {
+		if opts.Clean, ok = val.(bool); !ok {
+			return opts, errors.New("clean should be boolean")
+		}
+	}
+	if val, prs := body["max_size"]; prs {
+		size, ok := val.(float64)
+		if !ok || size <= 0 {
+			return opts, errors.New("max_size should be positive number")
+		}
+		opts.MaxSize = int64(size)
+	}
+	return opts, nil
+}
+
+// archiveEntry is entry of zip or tar archive.
+type archiveEntry struct {
+	Name     string
+	Mode     os.FileMode
+	Modified time.Time
+	// Size is uncompressed size claimed by archive, actual contents may be
+	// bigger.
+	Size int64
+	// Link is target of symlink.
+	Link string
+	// Reader of file contents, valid only during walkArchive callback.
+	open func() (io.ReadCloser, error)
+}
+
+// detectArchiveFormat guesses format using magic numbers.
+func detectArchiveFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", errors.New("unknown archive format")
+	}
+	switch {
+	case bytes.Equal(magic, []byte("PK\x03\x04")), bytes.Equal(magic, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.Equal(magic[:2], []byte("\x1f\x8b")):
+		return "tar.gz", nil
+	}
+	return "tar", nil
+}
+
+// walkArchive calls f for each entry of archive.
+func walkArchive(path, format string, f func(archiveEntry) error) error {
+	if format == "zip" {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for _, file := range r.File {
+			file := file
+			e := archiveEntry{
+				Name:     file.Name,
+				Mode:     file.Mode(),
+				Modified: file.Modified,
+				Size:     int64(file.UncompressedSize64),
+				open:     file.Open,
+			}
+			if e.Mode&os.ModeSymlink != 0 {
+				link, err := readZipLink(file)
+				if err != nil {
+					return err
+				}
+				e.Link = link
+			}
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var src io.Reader = file
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+	r := tar.NewReader(src)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := archiveEntry{
+			Name:     hdr.Name,
+			Mode:     hdr.FileInfo().Mode(),
+			Modified: hdr.ModTime,
+			Size:     hdr.Size,
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(r), nil
+			},
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			e.Link = hdr.Linkname
+		} else if hdr.Typeflag == tar.TypeLink {
+			// Hard links are not supported.
+			e.Mode = os.ModeIrregular
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+}
+
+func readZipLink(file *zip.File) (string, error) {
+	r, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	link, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+	return string(link), err
+}
+
+// cleanArchivePath converts name of archive entry to safe relative path
+// with "/" separators. Empty string is returned for root directory.
+func cleanArchivePath(name string) (string, error) {
+	name = strings.Replace(name, `\`, "/", -1)
+	// Colons are used for drive letters and alternate data streams.
+	if strings.HasPrefix(name, "/") || (runtime.GOOS == "windows" && strings.Contains(name, ":")) {
+		return "", fmt.Errorf("unsafe path in archive: %s", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", nil
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("unsafe path in archive: %s", name)
+	}
+	return cleaned, nil
+}
+
+// checkArchiveEntry returns error if extracting entry could write outside of
+// target directory.
+//
+// Symlink targets can't contain ".." at all: checking them as text is not
+// enough since link may point to another link, e.g. "d/s" -> ".." and
+// "x" -> "d/s/..". Without ".." every link points to descendant of
+// directory it's in, so chains of them can't leave target directory either.
+func checkArchiveEntry(e archiveEntry) error {
+	if _, err := cleanArchivePath(e.Name); err != nil {
+		return err
+	}
+	if e.Mode&os.ModeSymlink == 0 {
+		return nil
+	}
+	link := strings.Replace(e.Link, `\`, "/", -1)
+	if link == "" || path.IsAbs(link) || filepath.IsAbs(e.Link) || filepath.VolumeName(e.Link) != "" ||
+		(runtime.GOOS == "windows" && strings.Contains(link, ":")) {
+		return fmt.Errorf("unsafe symlink in archive: %s -> %s", e.Name, e.Link)
+	}
+	for _, part := range strings.Split(link, "/") {
+		if part == ".." {
+			return fmt.Errorf("unsafe symlink in archive: %s -> %s", e.Name, e.Link)
+		}
+	}
+	return nil
+}
+
+// checkNoSymlinks returns error if any existing parent of rel inside dir is
+// a symlink, so extraction can't be redirected outside of dir by links that
+// were there before.
+func checkNoSymlinks(dir, rel string) error {
+	parts := strings.Split(rel, "/")
+	cur := dir
+	for _, part := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, part)
+		stat, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", cur)
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", cur)
+		}
+	}
+	return nil
+}
+
+// checkLinkTarget returns error if symlink at rel would point to existing
+// symlink that was not created by extraction, since it can lead anywhere.
+func checkLinkTarget(dir, rel, link string, extracted map[string]bool) error {
+	target := path.Join(path.Dir(rel), strings.Replace(link, `\`, "/", -1))
+	cur := ""
+	for _, part := range strings.Split(target, "/") {
+		cur = path.Join(cur, part)
+		stat, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(cur)))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 && !extracted[cur] {
+			return fmt.Errorf("unsafe symlink in archive: %s -> %s points to existing symlink", rel, link)
+		}
+	}
+	return nil
+}
+
+// removeContents removes everything inside of dir.
+func removeContents(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadArchive downloads archive (see DownloadFile) and extracts it to
+// opts.Dir, creating it if needed.
+//
+// Whole archive is checked before anything is extracted: entries with
+// absolute paths or paths outside of opts.Dir, symlinks with absolute
+// targets or targets containing ".." and archives with files bigger than
+// opts.MaxSize in total are not allowed. Existing symlinks in target
+// directory are not followed. Only permission bits are restored, owners are
+// not.
+func (c *Client) DownloadArchive(opts ExtractOptions) (ExtractResult, error) {
+	res := ExtractResult{}
+	tmpDir, err := ioutil.TempDir("", "sutrc-archive-")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive")
+	res.DownloadResult, err = c.DownloadFile(opts.URL, archivePath, opts.DownloadOptions)
+	if err != nil {
+		return res, err
+	}
+	return res, extractArchive(archivePath, opts, &res)
+}
+
+var errExtractLimit = errors.New("archive is too big to extract")
+
+// extractArchive extracts archive file to opts.Dir, see DownloadArchive.
+func extractArchive(archivePath string, opts ExtractOptions, res *ExtractResult) error {
+	maxSize := opts.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxExtractSize
+	}
+
+	format := opts.Format
+	if format == "" {
+		var err error
+		if format, err = detectArchiveFormat(archivePath); err != nil {
+			return err
+		}
+	}
+	declaredSize := int64(0)
+	err := walkArchive(archivePath, format, func(e archiveEntry) error {
+		if err := checkArchiveEntry(e); err != nil {
+			return err
+		}
+		if e.Mode.IsRegular() {
+			declaredSize += e.Size
+			if e.Size < 0 || declaredSize > maxSize {
+				return errExtractLimit
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return err
+	}
+	if opts.Clean {
+		if err := removeContents(opts.Dir); err != nil {
+			return err
+		}
+	}
+
+	type dirMode struct {
+		path     string
+		mode     os.FileMode
+		modified time.Time
+	}
+	// Directory permissions and times are applied after extraction, so
+	// read-only directories don't prevent creation of files inside.
+	var dirs []dirMode
+	// Symlinks created during extraction, other links may point anywhere.
+	links := make(map[string]bool)
+	err = walkArchive(archivePath, format, func(e archiveEntry) error {
+		rel, _ := cleanArchivePath(e.Name)
+		if rel == "" {
+			return nil
+		}
+		if err := checkNoSymlinks(opts.Dir, rel); err != nil {
+			return err
+		}
+		target := filepath.Join(opts.Dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		perm := e.Mode.Perm()
+
+		switch {
+		case e.Mode.IsDir():
+			if perm == 0 {
+				perm = 0755
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, perm, e.Modified})
+			res.Dirs++
+		case e.Mode&os.ModeSymlink != 0:
+			if err := checkLinkTarget(opts.Dir, rel, e.Link, links); err != nil {
+				return err
+			}
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(filepath.FromSlash(e.Link), target); err != nil {
+				return err
+			}
+			links[rel] = true
+			res.Links++
+		case e.Mode.IsRegular():
+			if perm == 0 {
+				perm = 0644
+			}
+			// Sizes in headers can't be trusted.
+			n, err := extractFile(e, target, perm, maxSize-res.Size)
+			res.Size += n
+			if err != nil {
+				return err
+			}
+			res.Files++
+		default:
+			res.Skipped++
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].path, dirs[i].mode)
+		if !dirs[i].modified.IsZero() {
+			os.Chtimes(dirs[i].path, dirs[i].modified, dirs[i].modified)
+		}
+	}
+	return err
+}
+
+// removeNonDir removes file or symlink at path if it exists, existing
+// directories are reported as errors.
+func removeNonDir(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return os.Remove(path)
+}
+
+// extractFile writes contents of archive entry to target, at most limit
+// bytes are written.
+func extractFile(e archiveEntry, target string, perm os.FileMode, limit int64) (int64, error) {
+	// Existing symlink should be replaced, not written through.
+	if err := removeNonDir(target); err != nil {
+		return 0, err
+	}
+	src, err := e.open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	if err == nil && n > limit {
+		err = errExtractLimit
+	}
+	if err != nil {
+		dst.Close()
+		return n, err
+	}
+	if err := dst.Close(); err != nil {
+		return n, err
+	}
+	// Permissions passed to OpenFile are affected by umask.
+	if err := os.Chmod(target, perm); err != nil {
+		return n, err
+	}
+	if !e.Modified.IsZero() {
+		return n, os.Chtimes(target, e.Modified, e.Modified)
+	}
+	return n, nil
+}
@@ -0,0 +1,381 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testEntry is entry of archive built by tests. Link is set for symlinks,
+// names ending with "/" are directories.
+type testEntry struct {
+	Name string
+	Data string
+	Link string
+}
+
+func buildTar(t *testing.T, entries []testEntry) string {
+	buf := bytes.Buffer{}
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0644, Size: int64(len(e.Data)), Typeflag: tar.TypeReg}
+		switch {
+		case e.Link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.Link, 0
+		case strings.HasSuffix(e.Name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.Data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeTestArchive(t, buf.Bytes())
+}
+
+func buildZip(t *testing.T, entries []testEntry) string {
+	buf := bytes.Buffer{}
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.Name, Method: zip.Deflate}
+		hdr.SetMode(0644)
+		data := e.Data
+		if e.Link != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			data = e.Link
+		}
+		f, err := w.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeTestArchive(t, buf.Bytes())
+}
+
+func writeTestArchive(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "sutrc-test-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sutrc-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Temporary directory is behind symlink on some systems (e.g. macOS),
+	// file tasks report resolved paths.
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	return dir
+}
+
+// listTree returns sorted list of paths relative to dir.
+func listTree(t *testing.T, dir string) []string {
+	var res []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		res = append(res, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func skipSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+}
+
+func TestExtractRejectsUnsafe(t *testing.T) {
+	cases := []struct {
+		name     string
+		entries  []testEntry
+		symlinks bool
+	}{
+		{"parent dir", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: "../evil.txt", Data: "evil"}}, false},
+		{"nested parent dir", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: "a/../../evil.txt", Data: "evil"}}, false},
+		{"absolute path", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: "/tmp/evil.txt", Data: "evil"}}, false},
+		{"backslashes", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: `..\evil.txt`, Data: "evil"}}, false},
+		{"absolute symlink", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: "link", Link: "/etc"}}, true},
+		{"symlink to parent", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: "link", Link: "../x"}}, true},
+		{"chained symlinks", []testEntry{{Name: "d/s", Link: ".."}, {Name: "x", Link: "d/s/.."}}, true},
+		{"symlink inside dir", []testEntry{{Name: "ok.txt", Data: "ok"}, {Name: "a/link", Link: "b/../../.."}}, true},
+		{"write through symlink", []testEntry{{Name: "link", Link: "."}, {Name: "link/file", Data: "x"}}, true},
+	}
+	for _, build := range []struct {
+		name string
+		f    func(*testing.T, []testEntry) string
+	}{{"tar", buildTar}, {"zip", buildZip}} {
+		for _, c := range cases {
+			t.Run(build.name+"/"+c.name, func(t *testing.T) {
+				if c.symlinks {
+					skipSymlinks(t)
+				}
+				archive := build.f(t, c.entries)
+				defer os.Remove(archive)
+				parent := tempDir(t)
+				defer os.RemoveAll(parent)
+				dir := filepath.Join(parent, "out")
+
+				err := extractArchive(archive, ExtractOptions{Dir: dir}, &ExtractResult{})
+				if err == nil {
+					t.Fatal("unsafe archive was extracted:", listTree(t, parent))
+				}
+				t.Log(err)
+				// Nothing should be written if archive is rejected during
+				// check, "write through symlink" is rejected later but
+				// still can't write outside.
+				if tree := listTree(t, parent); len(tree) > 1 && c.name != "write through symlink" {
+					t.Fatal("files written:", tree)
+				}
+				if _, err := os.Lstat(filepath.Join(parent, "evil.txt")); err == nil {
+					t.Fatal("file written outside of target dir")
+				}
+			})
+		}
+	}
+}
+
+func TestExtractExistingSymlinks(t *testing.T) {
+	skipSymlinks(t)
+	parent := tempDir(t)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "out")
+	outside := filepath.Join(parent, "outside")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "file"), filepath.Join(dir, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buildTar(t, []testEntry{{Name: "sub/evil.txt", Data: "evil"}})
+	defer os.Remove(archive)
+	if err := extractArchive(archive, ExtractOptions{Dir: dir}, &ExtractResult{}); err == nil {
+		t.Fatal("extracted through existing symlink")
+	}
+
+	archive2 := buildTar(t, []testEntry{{Name: "link", Link: "sub/x"}})
+	defer os.Remove(archive2)
+	if err := extractArchive(archive2, ExtractOptions{Dir: dir}, &ExtractResult{}); err == nil {
+		t.Fatal("created symlink pointing through existing symlink")
+	}
+
+	// Existing symlink should be replaced, not written through.
+	archive3 := buildTar(t, []testEntry{{Name: "file", Data: "data"}})
+	defer os.Remove(archive3)
+	if err := extractArchive(archive3, ExtractOptions{Dir: dir}, &ExtractResult{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); err == nil {
+		t.Fatal("file written through existing symlink")
+	}
+	if tree := listTree(t, outside); len(tree) != 0 {
+		t.Fatal("files written outside:", tree)
+	}
+}
+
+func TestExtractSafeSymlinks(t *testing.T) {
+	skipSymlinks(t)
+	archive := buildTar(t, []testEntry{
+		{Name: "lib/libfoo.so.1.2", Data: "elf"},
+		{Name: "lib/libfoo.so.1", Link: "libfoo.so.1.2"},
+		{Name: "lib/libfoo.so", Link: "libfoo.so.1"},
+		{Name: "current", Link: "lib"},
+	})
+	defer os.Remove(archive)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	res := ExtractResult{}
+	if err := extractArchive(archive, ExtractOptions{Dir: dir}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 1 || res.Links != 3 {
+		t.Fatalf("wrong result: %+v", res)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "current", "libfoo.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "elf" {
+		t.Fatalf("wrong contents: %q", data)
+	}
+}
+
+func TestExtractSizeLimit(t *testing.T) {
+	big := strings.Repeat("0", 1<<20)
+	for _, build := range []func(*testing.T, []testEntry) string{buildTar, buildZip} {
+		archive := build(t, []testEntry{{Name: "a", Data: big}, {Name: "b", Data: big}})
+		defer os.Remove(archive)
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		err := extractArchive(archive, ExtractOptions{Dir: dir, MaxSize: 1<<20 + 1}, &ExtractResult{})
+		if err != errExtractLimit {
+			t.Fatal("expected size limit error, got", err)
+		}
+		if tree := listTree(t, dir); len(tree) != 0 {
+			t.Fatal("files written:", tree)
+		}
+		if err := extractArchive(archive, ExtractOptions{Dir: dir, MaxSize: 2 << 20}, &ExtractResult{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractLyingHeader(t *testing.T) {
+	// Declared size is checked before extraction, actual size of written
+	// data is checked too in case archive lies.
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := archiveEntry{open: func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(strings.Repeat("0", 100))), nil
+	}}
+	n, err := extractFile(e, filepath.Join(dir, "a"), 0644, 50)
+	if err != errExtractLimit || n > 51 {
+		t.Fatal("limit is not enforced:", n, err)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	files := map[string]string{
+		"a.txt":           "hello",
+		"run.sh":          "#!/bin/sh",
+		"sub/deep/b.log":  "log",
+		"skipme/c.txt":    "x",
+		"sub/keep/d.conf": "conf",
+	}
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"zip", "tar.gz"} {
+		t.Run(format, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			res := ArchiveResult{}
+			opts := ArchiveOptions{Dir: src, Format: format, Exclude: []string{"skipme", "*.log"}}
+			if err := writeArchive(context.Background(), &buf, opts, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Files != 3 || res.Size != int64(len("hello#!/bin/shconf")) {
+				t.Fatalf("wrong result: %+v", res)
+			}
+			archive := writeTestArchive(t, buf.Bytes())
+			defer os.Remove(archive)
+
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, "stale"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			// Format is detected automatically.
+			if err := extractArchive(archive, ExtractOptions{Dir: dir, Clean: true}, &ExtractResult{}); err != nil {
+				t.Fatal(err)
+			}
+			tree := strings.Join(listTree(t, dir), " ")
+			want := "a.txt empty run.sh sub sub/deep sub/keep sub/keep/d.conf"
+			if tree != want {
+				t.Fatalf("wrong files extracted:\n%s\nwant:\n%s", tree, want)
+			}
+			if runtime.GOOS != "windows" {
+				stat, err := os.Stat(filepath.Join(dir, "run.sh"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stat.Mode().Perm() != 0755 {
+					t.Fatal("permissions are not restored:", stat.Mode())
+				}
+			}
+		})
+	}
+
+	buf := bytes.Buffer{}
+	res := ArchiveResult{}
+	opts := ArchiveOptions{Dir: src, Include: []string{"*.txt", "sub/deep/*"}}
+	if err := writeArchive(context.Background(), &buf, opts, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 3 {
+		t.Fatalf("wrong count of included files: %+v", res)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache is content-addressed storage of downloaded files. Files are named by
+// their SHA-256, so the same file pushed to agent repeatedly is downloaded
+// only once.
+//
+// Modification time of cached file is used as last access time, least
+// recently used files are removed when MaxSize is exceeded.
+type Cache struct {
+	Dir string
+	// MaxSize limits total size of cached files. Zero means no limit.
+	MaxSize int64
+
+	lock sync.Mutex
+}
+
+// CacheEntry describes single cached file.
+type CacheEntry struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// Last time file was added to cache or used (Unix timestamp).
+	Used int64 `json:"used"`
+}
+
+func (cc *Cache) path(sum string) (string, error) {
+	sum = strings.ToLower(sum)
+	if raw, err := hex.DecodeString(sum); err != nil || len(raw) != 32 {
+		return "", fmt.Errorf("invalid sha256 value: %s", sum)
+	}
+	return filepath.Join(cc.Dir, sum), nil
+}
+
+// Stat returns information about cached file with specified hash.
+// os.ErrNotExist is returned if there is no such file.
+func (cc *Cache) Stat(sum string) (CacheEntry, error) {
+	path, err := cc.path(sum)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	return CacheEntry{SHA256: stat.Name(), Size: stat.Size(), Used: stat.ModTime().Unix()}, nil
+}
+
+// Open opens cached file with specified hash and marks it as recently used.
+//
+// Cache doesn't verify content of files, caller should check it and call
+// Remove if file is corrupted.
+func (cc *Cache) Open(sum string) (*os.File, error) {
+	path, err := cc.path(sum)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Println("Failed to update cache entry access time:", err)
+	}
+	return f, nil
+}
+
+// Add copies file to cache, sum should be SHA-256 of its contents. Files
+// bigger than MaxSize are not cached.
+func (cc *Cache) Add(srcPath, sum string) error {
+	path, err := cc.path(sum)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if cc.MaxSize != 0 && stat.Size() > cc.MaxSize {
+		return nil
+	}
+
+	if err := os.MkdirAll(cc.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(cc.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	cc.evict()
+	return nil
+}
+
+// Remove removes file from cache.
+func (cc *Cache) Remove(sum string) error {
+	path, err := cc.path(sum)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Entries returns all cached files, most recently used first, and their
+// total size.
+func (cc *Cache) Entries() ([]CacheEntry, int64, error) {
+	files, err := ioutil.ReadDir(cc.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []CacheEntry{}, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	res := []CacheEntry{}
+	total := int64(0)
+	for _, f := range files {
+		// Skip temporary files.
+		if _, err := cc.path(f.Name()); err != nil || f.IsDir() {
+			continue
+		}
+		res = append(res, CacheEntry{SHA256: f.Name(), Size: f.Size(), Used: f.ModTime().Unix()})
+		total += f.Size()
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Used > res[j].Used
+	})
+	return res, total, nil
+}
+
+// evict removes least recently used files until total size fits in MaxSize.
+func (cc *Cache) evict() {
+	if cc.MaxSize == 0 {
+		return
+	}
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	entries, total, err := cc.Entries()
+	if err != nil {
+		log.Println("Failed to list cache entries:", err)
+		return
+	}
+	for i := len(entries) - 1; i >= 0 && total > cc.MaxSize; i-- {
+		if err := cc.Remove(entries[i].SHA256); err != nil {
+			// File may be in use (on Windows).
+			log.Println("Failed to evict cache entry:", err)
+			continue
+		}
+		log.Println("Evicted", entries[i].SHA256, "from cache")
+		total -= entries[i].Size
+	}
+}
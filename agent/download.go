@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DownloadOptions control verification in DownloadFile.
+type DownloadOptions struct {
+	// Expected SHA-256 of file (hex-encoded), not checked if empty.
+	SHA256 string
+	// Expected size of file, not checked if zero.
+	Size int64
+	// If Backup is true, existing file is kept as OUTPATH.bak.
+	Backup bool
+}
+
+// DownloadResult describes file saved by DownloadFile.
+type DownloadResult struct {
+	SHA256 string
+	Size   int64
+	// BackupPath is path of previous version of file, empty if there was
+	// no file or backup was not requested.
+	BackupPath string
+	// Cached is true if file was taken from Client.Cache.
+	Cached bool
+	// FromPeers is amount of data received from other agents.
+	FromPeers int64
+}
+
+// DownloadFile downloads file from url and saves it to outPath.
+//
+// Data is written to temporary file in the same directory and moved to
+// outPath only after it is completely received and verified, so failed
+// download never leaves truncated file behind. Permissions and owner of
+// replaced file are preserved. If outPath is a symlink, file it points to is
+// replaced.
+//
+// If Client.Cache is set and opts.SHA256 is not empty, file is copied from
+// cache if it's there (url may be empty in this case). Downloaded files are
+// added to cache.
+func (c *Client) DownloadFile(url, outPath string, opts DownloadOptions) (DownloadResult, error) {
+	res := DownloadResult{}
+	if url == "" && opts.SHA256 == "" {
+		return res, errors.New("url is not specified")
+	}
+	expectedSum := []byte(nil)
+	if opts.SHA256 != "" {
+		var err error
+		expectedSum, err = hex.DecodeString(opts.SHA256)
+		if err != nil || len(expectedSum) != sha256.Size {
+			return res, fmt.Errorf("invalid sha256 value: %s", opts.SHA256)
+		}
+	}
+
+	// Policy is checked against resolved path, and symlink should not be
+	// replaced by regular file anyway.
+	outPath, err := resolvePath(outPath)
+	if err != nil {
+		return res, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(outPath), "."+filepath.Base(outPath)+".download-")
+	if err != nil {
+		return res, err
+	}
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if c.Cache != nil && expectedSum != nil {
+		res.Cached, err = c.copyFromCache(tmp, &res, opts)
+		if err != nil {
+			return res, err
+		}
+	}
+	if !res.Cached {
+		if url == "" {
+			return res, fmt.Errorf("file %s is not cached and url is not specified", opts.SHA256)
+		}
+		var peers *peerReader
+		// Only files from server's filedrop can be shared.
+		if c.UsePeers && strings.HasPrefix(url, c.baseURL) {
+			peers, err = c.openPeers(url, opts)
+			if err != nil {
+				log.Println("Can't download", url, "from peers:", err)
+			}
+		}
+
+		var remoteFile io.ReadCloser
+		if peers != nil {
+			remoteFile = peers
+		} else {
+			remoteFile, err = c.Download(url)
+			if err != nil {
+				return res, err
+			}
+		}
+		defer remoteFile.Close()
+		res.SHA256, res.Size, err = copyVerified(tmp, remoteFile, opts)
+		if peers != nil {
+			res.FromPeers = peers.fromPeers
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return res, err
+	}
+	if err := tmp.Close(); err != nil {
+		return res, err
+	}
+
+	oldStat, err := os.Stat(outPath)
+	exists := err == nil
+	if exists {
+		if oldStat.IsDir() {
+			return res, fmt.Errorf("%s is a directory", outPath)
+		}
+		if err := os.Chmod(tmp.Name(), oldStat.Mode().Perm()); err != nil {
+			return res, err
+		}
+		if err := copyFileSecurity(outPath, tmp.Name()); err != nil {
+			return res, err
+		}
+	}
+
+	if c.Cache != nil && !res.Cached {
+		if err := c.Cache.Add(tmp.Name(), res.SHA256); err != nil {
+			log.Println("Failed to add downloaded file to cache:", err)
+		} else if c.peers.servePort() != 0 {
+			go func() {
+				if err := c.announceCache(); err != nil {
+					log.Println("Failed to announce cache contents:", err)
+				}
+			}()
+		}
+	}
+
+	if res.BackupPath, err = replaceFile(tmp.Name(), outPath, exists && opts.Backup); err != nil {
+		return res, err
+	}
+
+	success = true
+	return res, nil
+}
+
+// copyFromCache copies file from cache to dst. false is returned if there
+// is no such file in cache. Corrupted files are removed from cache.
+func (c *Client) copyFromCache(dst *os.File, res *DownloadResult, opts DownloadOptions) (bool, error) {
+	src, err := c.Cache.Open(opts.SHA256)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to open cached file:", err)
+		}
+		return false, nil
+	}
+	defer src.Close()
+
+	res.SHA256, res.Size, err = copyVerified(dst, src, opts)
+	if err == nil {
+		return true, nil
+	}
+	log.Println("Cached file", opts.SHA256, "is broken, removing:", err)
+	src.Close()
+	if err := c.Cache.Remove(opts.SHA256); err != nil {
+		log.Println("Failed to remove broken cached file:", err)
+	}
+
+	// Start over, file will be downloaded.
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return false, dst.Truncate(0)
+}
+
+// copyVerified copies data from src to dst checking size and SHA-256 if they
+// are specified in opts.
+func copyVerified(dst io.Writer, src io.Reader, opts DownloadOptions) (sum string, size int64, err error) {
+	if opts.Size != 0 {
+		// Read one more byte to detect files bigger than expected without
+		// downloading them completely.
+		src = io.LimitReader(src, opts.Size+1)
+	}
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return "", size, err
+	}
+	sum = hex.EncodeToString(hash.Sum(nil))
+	if opts.Size != 0 && size != opts.Size {
+		if size > opts.Size {
+			return sum, size, fmt.Errorf("size mismatch: got more than %d bytes", opts.Size)
+		}
+		return sum, size, fmt.Errorf("size mismatch: got %d bytes, expected %d", size, opts.Size)
+	}
+	if opts.SHA256 != "" && sum != strings.ToLower(opts.SHA256) {
+		return sum, size, fmt.Errorf("checksum mismatch: got %s, expected %s", sum, strings.ToLower(opts.SHA256))
+	}
+	return sum, size, nil
+}
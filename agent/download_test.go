@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestDownloadFileBackup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tool.exe")
+	if err := ioutil.WriteFile(path, []byte("old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(srv.URL)
+	res, err := c.DownloadFile(srv.URL+"/tool.exe", path, DownloadOptions{SHA256: sha256Hex("new"), Backup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BackupPath != path+".bak" {
+		t.Error("wrong backup path:", res.BackupPath)
+	}
+	if data := readTestFile(t, path); data != "new" {
+		t.Error("file not replaced:", data)
+	}
+	if bak := readTestFile(t, path+".bak"); bak != "old" {
+		t.Error("wrong backup contents:", bak)
+	}
+	if runtime.GOOS != "windows" {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != 0700 {
+			t.Error("permissions not preserved:", stat.Mode().Perm())
+		}
+	}
+
+	// Failed download leaves both files untouched.
+	if _, err := c.DownloadFile(srv.URL+"/tool.exe", path, DownloadOptions{SHA256: sha256Hex("other"), Backup: true}); err == nil {
+		t.Fatal("hash mismatch not detected")
+	}
+	if data := readTestFile(t, path); data != "new" {
+		t.Error("file changed by failed download:", data)
+	}
+	if bak := readTestFile(t, path+".bak"); bak != "old" {
+		t.Error("backup changed by failed download:", bak)
+	}
+	if files := listTree(t, dir); !reflect.DeepEqual(files, []string{"tool.exe", "tool.exe.bak"}) {
+		t.Error("unexpected files left:", files)
+	}
+}
+
+// Downloading to symlink replaces file it points to, link is kept.
+func TestDownloadFileSymlink(t *testing.T) {
+	skipSymlinks(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "tool-1.2")
+	link := filepath.Join(dir, "tool")
+	if err := ioutil.WriteFile(target, []byte("old"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tool-1.2", link); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(srv.URL)
+	if _, err := c.DownloadFile(srv.URL+"/tool", link, DownloadOptions{SHA256: sha256Hex("new")}); err != nil {
+		t.Fatal(err)
+	}
+	if dest, err := os.Readlink(link); err != nil || dest != "tool-1.2" {
+		t.Fatal("symlink is replaced:", dest, err)
+	}
+	if data := readTestFile(t, target); data != "new" {
+		t.Error("file not replaced:", data)
+	}
+	if stat, err := os.Stat(target); err != nil || stat.Mode().Perm() != 0750 {
+		t.Error("permissions not preserved:", stat.Mode().Perm(), err)
+	}
+	if files := listTree(t, dir); !reflect.DeepEqual(files, []string{"tool", "tool-1.2"}) {
+		t.Error("unexpected files left:", files)
+	}
+}
@@ -0,0 +1,425 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output of commands is truncated to this size (per stream).
+const maxCommandOutput = 1 << 20
+
+// How long RunCommand waits for output pipes to be closed after command is
+// killed. Processes that escaped killing (e.g. started new session) may keep
+// them open forever.
+var killedOutputWait = 5 * time.Second
+
+// Command describes command executed by RunCommand.
+type Command struct {
+	Cmd string
+	// Shell used to interpret Cmd: "cmd", "powershell", "sh", "bash" or
+	// "none" (Cmd is split into arguments and executed directly). Empty
+	// string means "cmd" on Windows and "sh" on other systems.
+	Shell string
+	Stdin string
+	// Env contains variables added to agent's environment.
+	Env map[string]string
+	// Working directory, agent's one if empty.
+	Dir string
+	// Command is killed together with all its children after Timeout.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// Stream is set if task asks to stream output while command runs (see
+	// Client.OutputStream), RunCommand ignores it.
+	Stream bool
+	// If Output is not nil, it's called with each piece of output as it's
+	// written by command (stream is "stdout" or "stderr"). It's not
+	// affected by output size limit.
+	Output func(stream string, data []byte)
+
+	// If argv is set, it's executed directly instead of Cmd (see
+	// RunScript).
+	argv []string
+}
+
+// CommandResult is outcome of RunCommand. Output fields contain at most
+// 1 MiB, rest is discarded and corresponding *Truncated field is set.
+type CommandResult struct {
+	StatusCode int
+	Stdout     []byte
+	Stderr     []byte
+	// Output is stdout and stderr interleaved as they were written.
+	Output []byte
+
+	StdoutTruncated bool
+	StderrTruncated bool
+	OutputTruncated bool
+
+	Duration time.Duration
+	// Killed is true if command was killed because of timeout or context
+	// cancellation.
+	Killed bool
+}
+
+// limitedBuffer discards everything written after max bytes, so process
+// is never blocked on full pipe.
+type limitedBuffer struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+// bytes returns copy of buffer contents, buffer may be still written to.
+func (b *limitedBuffer) bytes() ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.truncated
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if left := b.max - b.buf.Len(); len(p) > left {
+		b.buf.Write(p[:left])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+type outputFunc struct {
+	stream string
+	f      func(stream string, data []byte)
+}
+
+func (o outputFunc) Write(p []byte) (int, error) {
+	o.f(o.stream, p)
+	return len(p), nil
+}
+
+func shellCommand(shell, cmd string) (*exec.Cmd, error) {
+	if shell == "" {
+		shell = defaultShell
+	}
+	switch shell {
+	case "cmd":
+		return exec.Command("cmd", "/C", cmd), nil
+	case "powershell":
+		return exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", cmd), nil
+	case "sh":
+		return exec.Command("/bin/sh", "-c", cmd), nil
+	case "bash":
+		return exec.Command("bash", "-c", cmd), nil
+	case "none":
+		args, err := splitArgs(cmd)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, errors.New("empty command")
+		}
+		return exec.Command(args[0], args[1:]...), nil
+	}
+	return nil, fmt.Errorf("unknown shell: %s", shell)
+}
+
+// splitArgs splits command line into arguments by spaces, double quotes
+// can be used to include spaces in argument.
+func splitArgs(cmd string) ([]string, error) {
+	args := []string{}
+	cur := strings.Builder{}
+	inArg, quoted := false, false
+	for _, r := range cmd {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// ParseCommand reads fields of execute_cmd task.
+func ParseCommand(body map[string]interface{}) (Command, error) {
+	c := Command{}
+	var ok bool
+	if c.Cmd, ok = body["cmd"].(string); !ok {
+		return c, errors.New("cmd should be string")
+	}
+	if c.Cmd == "" {
+		return c, errors.New("empty command is not allowed")
+	}
+	if val, prs := body["shell"]; prs {
+		if c.Shell, ok = val.(string); !ok {
+			return c, errors.New("shell should be string")
+		}
+	}
+	return c, parseCommandOptions(body, &c)
+}
+
+// parseCommandOptions reads optional fields of execute_cmd task that are
+// shared with other tasks running commands.
+func parseCommandOptions(body map[string]interface{}, c *Command) error {
+	var ok bool
+	if val, prs := body["stdin"]; prs {
+		if c.Stdin, ok = val.(string); !ok {
+			return errors.New("stdin should be string")
+		}
+	}
+	if val, prs := body["cwd"]; prs {
+		if c.Dir, ok = val.(string); !ok {
+			return errors.New("cwd should be string")
+		}
+	}
+	if val, prs := body["env"]; prs {
+		env, ok := val.(map[string]interface{})
+		if !ok {
+			return errors.New("env should be object")
+		}
+		c.Env = make(map[string]string, len(env))
+		for k, v := range env {
+			if c.Env[k], ok = v.(string); !ok || k == "" || strings.Contains(k, "=") {
+				return errors.New("env should contain string values with valid names")
+			}
+		}
+	}
+	if val, prs := body["stream"]; prs {
+		if c.Stream, ok = val.(bool); !ok {
+			return errors.New("stream should be boolean")
+		}
+	}
+	if val, prs := body["timeout"]; prs {
+		secs, ok := val.(float64)
+		if !ok || secs < 0 {
+			return errors.New("timeout should be non-negative number")
+		}
+		c.Timeout = time.Duration(secs * float64(time.Second))
+	}
+	return nil
+}
+
+// command creates exec.Cmd for command, without stdin and output set.
+func (c Command) command() (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	if len(c.argv) != 0 {
+		cmd = exec.Command(c.argv[0], c.argv[1:]...)
+	} else {
+		var err error
+		cmd, err = shellCommand(c.Shell, c.Cmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd.Dir = c.Dir
+	if len(c.Env) != 0 {
+		cmd.Env = os.Environ()
+		for k, v := range c.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	return cmd, nil
+}
+
+// RunCommand executes command and waits for it to finish. Command is killed
+// along with all processes it started if timeout passes or ctx is cancelled,
+// output written after that by processes that escaped killing may be lost.
+//
+// Error is returned only if command can't be started, non-zero exit codes
+// are reported in result.
+func RunCommand(ctx context.Context, c Command) (CommandResult, error) {
+	res := CommandResult{}
+	cmd, err := c.command()
+	if err != nil {
+		return res, err
+	}
+	cmd.Stdin = strings.NewReader(c.Stdin)
+
+	stdout := &limitedBuffer{max: maxCommandOutput}
+	stderr := &limitedBuffer{max: maxCommandOutput}
+	output := &limitedBuffer{max: maxCommandOutput}
+	stdoutW := io.MultiWriter(stdout, output)
+	stderrW := io.MultiWriter(stderr, output)
+	if c.Output != nil {
+		stdoutW = io.MultiWriter(stdoutW, outputFunc{"stdout", c.Output})
+		stderrW = io.MultiWriter(stderrW, outputFunc{"stderr", c.Output})
+	}
+	// Pipes are created here instead of exec package, so we can close them
+	// if nobody else does (see killedOutputWait).
+	pipes, err := newOutputPipes(cmd)
+	if err != nil {
+		return res, err
+	}
+	setProcessGroup(cmd)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		pipes.closeAll()
+		return res, err
+	}
+	pipes.closeWriters()
+	copied := pipes.copy(stdoutW, stderrW)
+
+	type waitResult struct {
+		err    error
+		status int
+	}
+	done := make(chan waitResult, 1)
+	go func() {
+		err := cmd.Wait()
+		<-copied
+		done <- waitResult{err, cmd.ProcessState.ExitCode()}
+	}()
+
+	var timeout <-chan time.Time
+	if c.Timeout != 0 {
+		timer := time.NewTimer(c.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var wres waitResult
+	select {
+	case wres = <-done:
+	case <-timeout:
+		res.Killed = true
+	case <-ctx.Done():
+		res.Killed = true
+	}
+	if res.Killed {
+		if err := killProcessTree(cmd.Process); err != nil {
+			log.Println("Failed to kill process tree of", cmd.Process.Pid, ":", err)
+		}
+		select {
+		case wres = <-done:
+		case <-time.After(killedOutputWait):
+			log.Println("Output of killed process", cmd.Process.Pid, "is still open, closing it")
+			pipes.closeReaders()
+			select {
+			case wres = <-done:
+			case <-time.After(time.Second):
+				// Reading is not interrupted on some systems, leave it
+				// alone and report what we have.
+				wres = waitResult{status: -1}
+			}
+		}
+	}
+	res.Duration = time.Since(start)
+
+	if wres.err != nil {
+		if _, ok := wres.err.(*exec.ExitError); !ok {
+			return res, wres.err
+		}
+	}
+	res.StatusCode = wres.status
+	res.Stdout, res.StdoutTruncated = stdout.bytes()
+	res.Stderr, res.StderrTruncated = stderr.bytes()
+	res.Output, res.OutputTruncated = output.bytes()
+	return res, nil
+}
+
+// outputPipes are stdout and stderr pipes of command.
+type outputPipes struct {
+	stdoutR, stdoutW *os.File
+	stderrR, stderrW *os.File
+}
+
+func newOutputPipes(cmd *exec.Cmd) (*outputPipes, error) {
+	p := &outputPipes{}
+	var err error
+	p.stdoutR, p.stdoutW, err = os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stderrR, p.stderrW, err = os.Pipe()
+	if err != nil {
+		p.stdoutR.Close()
+		p.stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = p.stdoutW, p.stderrW
+	return p, nil
+}
+
+// closeWriters closes our copies of write ends, should be called after
+// process is started so reading ends when process (and its children) exit.
+func (p *outputPipes) closeWriters() {
+	p.stdoutW.Close()
+	p.stderrW.Close()
+}
+
+func (p *outputPipes) closeReaders() {
+	p.stdoutR.Close()
+	p.stderrR.Close()
+}
+
+func (p *outputPipes) closeAll() {
+	p.closeWriters()
+	p.closeReaders()
+}
+
+// copy starts copying output to writers, returned channel is closed when
+// both pipes are closed.
+func (p *outputPipes) copy(stdout, stderr io.Writer) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stdout, p.stdoutR)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(stderr, p.stderrR)
+	}()
+	go func() {
+		wg.Wait()
+		p.closeReaders()
+		close(done)
+	}()
+	return done
+}
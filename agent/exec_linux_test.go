@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunCommandOutput(t *testing.T) {
+	res, err := RunCommand(context.Background(), Command{Cmd: "echo out; echo err >&2; exit 3", Stdin: "in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 3 || res.Killed {
+		t.Error("unexpected status:", res.StatusCode, res.Killed)
+	}
+	if string(res.Stdout) != "out\n" || string(res.Stderr) != "err\n" {
+		t.Errorf("unexpected output: %q, %q", res.Stdout, res.Stderr)
+	}
+}
+
+func TestRunCommandEscapedChild(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid is not available")
+	}
+	defer func(prev time.Duration) { killedOutputWait = prev }(killedOutputWait)
+	killedOutputWait = 100 * time.Millisecond
+
+	// Child in new session is not killed with process group, but keeps
+	// stdout open.
+	start := time.Now()
+	res, err := RunCommand(context.Background(), Command{
+		Cmd:     "setsid sh -c 'echo $$; exec sleep 30' & sleep 30",
+		Timeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("RunCommand returned after", elapsed)
+	}
+	if !res.Killed {
+		t.Error("command is not reported as killed")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(res.Stdout)))
+	if err != nil {
+		t.Fatalf("unexpected output: %q", res.Stdout)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+}
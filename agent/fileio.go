@@ -0,0 +1,329 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxInlineFileSize is max size of file contents carried inside of readfile
+// and writefile tasks. Bigger files should be transferred using filedrop.
+const MaxInlineFileSize = 1 << 20
+
+// InlineFile is file read by ReadInlineFile.
+type InlineFile struct {
+	Data     []byte
+	SHA256   string
+	Modified time.Time
+}
+
+// ReadInlineFile reads whole file if it's not bigger than MaxInlineFileSize.
+func ReadInlineFile(path string) (InlineFile, error) {
+	res := InlineFile{}
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return res, err
+	}
+	if stat.IsDir() {
+		return res, fmt.Errorf("%s is a directory", path)
+	}
+	if stat.Size() > MaxInlineFileSize {
+		return res, fmt.Errorf("file is too big (%d bytes), max size is %d bytes", stat.Size(), MaxInlineFileSize)
+	}
+	// Size reported for special files may be wrong.
+	res.Data, err = ioutil.ReadAll(io.LimitReader(f, MaxInlineFileSize+1))
+	if err != nil {
+		return res, err
+	}
+	if len(res.Data) > MaxInlineFileSize {
+		return res, fmt.Errorf("file is too big, max size is %d bytes", MaxInlineFileSize)
+	}
+	sum := sha256.Sum256(res.Data)
+	res.SHA256 = hex.EncodeToString(sum[:])
+	res.Modified = stat.ModTime()
+	return res, nil
+}
+
+// WriteFileOptions describes writefile task.
+type WriteFileOptions struct {
+	Path string
+	Data []byte
+	// If CheckPrevious is true, file is written only if SHA-256 of its
+	// current contents is PreviousSHA256. Empty PreviousSHA256 means that
+	// file should not exist.
+	CheckPrevious  bool
+	PreviousSHA256 string
+	// Backup is same as DownloadOptions.Backup.
+	Backup bool
+}
+
+// WriteFileResult describes outcome of WriteInlineFile.
+type WriteFileResult struct {
+	SHA256     string
+	Size       int64
+	BackupPath string
+}
+
+// FileChangedError is returned by WriteInlineFile if file contents don't
+// match WriteFileOptions.PreviousSHA256.
+type FileChangedError struct {
+	Path string
+	// SHA256 is hash of current file contents, empty if file doesn't exist.
+	SHA256 string
+}
+
+func (e FileChangedError) Error() string {
+	if e.SHA256 == "" {
+		return fmt.Sprintf("%s was changed: file doesn't exist", e.Path)
+	}
+	return fmt.Sprintf("%s was changed: current sha256 is %s", e.Path, e.SHA256)
+}
+
+// ParseWriteFile reads fields of writefile task.
+func ParseWriteFile(body map[string]interface{}) (WriteFileOptions, error) {
+	opts := WriteFileOptions{}
+	var ok bool
+	if opts.Path, ok = body["path"].(string); !ok || opts.Path == "" {
+		return opts, errors.New("path should be non-empty string")
+	}
+	data, ok := body["data"].(string)
+	if !ok {
+		return opts, errors.New("data should be base64-encoded string")
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > MaxInlineFileSize+2 {
+		return opts, fmt.Errorf("data is too big, max size is %d bytes", MaxInlineFileSize)
+	}
+	var err error
+	if opts.Data, err = base64.StdEncoding.DecodeString(data); err != nil {
+		return opts, errors.New("data should be base64-encoded string")
+	}
+	if len(opts.Data) > MaxInlineFileSize {
+		return opts, fmt.Errorf("data is too big, max size is %d bytes", MaxInlineFileSize)
+	}
+	if val, prs := body["expected_sha256"]; prs {
+		if opts.PreviousSHA256, ok = val.(string); !ok {
+			return opts, errors.New("expected_sha256 should be string")
+		}
+		opts.PreviousSHA256 = strings.ToLower(opts.PreviousSHA256)
+		if sum, err := hex.DecodeString(opts.PreviousSHA256); opts.PreviousSHA256 != "" && (err != nil || len(sum) != sha256.Size) {
+			return opts, fmt.Errorf("invalid sha256 value: %s", opts.PreviousSHA256)
+		}
+		opts.CheckPrevious = true
+	}
+	if val, prs := body["backup"]; prs {
+		if opts.Backup, ok = val.(bool); !ok {
+			return opts, errors.New("backup should be boolean")
+		}
+	}
+	return opts, nil
+}
+
+// currentSHA256 returns hash of file contents or empty string if it doesn't
+// exist.
+func currentSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileLock serializes WriteInlineFile calls so concurrent tasks can't
+// both pass precondition check.
+var writeFileLock sync.Mutex
+
+// replaceFile renames tmp to path. If backup is set, current file at path is
+// hard-linked (or copied if links are not supported) to path.bak first, so
+// path never disappears, even for a moment. Returns path of backup, empty if
+// backup is not set.
+func replaceFile(tmp, path string, backup bool) (string, error) {
+	if !backup {
+		return "", os.Rename(tmp, path)
+	}
+
+	bakPath := path + ".bak"
+	if err := os.Remove(bakPath); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("backup: %v", err)
+	}
+	if err := os.Link(path, bakPath); err != nil {
+		if err := copyBackup(path, bakPath); err != nil {
+			return "", fmt.Errorf("backup: %v", err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(bakPath)
+		return "", err
+	}
+	return bakPath, nil
+}
+
+// copyBackup copies file at path to bakPath, keeping it's permissions.
+func copyBackup(path, bakPath string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".bak-")
+	if err != nil {
+		return err
+	}
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := io.Copy(tmp, src); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), stat.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := copyFileSecurity(path, tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), bakPath); err != nil {
+		return err
+	}
+	success = true
+	return nil
+}
+
+// WriteInlineFile atomically replaces contents of file.
+//
+// Data is written to temporary file in the same directory which is then
+// renamed to opts.Path, so readers never see partially written file.
+// Permissions and owner of replaced file are preserved (on Windows, it's ACL
+// is copied, inherited entries are taken from directory as usual). If
+// opts.Path is a symlink, file it points to is replaced. If
+// opts.CheckPrevious is set and file doesn't match expected hash,
+// FileChangedError is returned and nothing is changed.
+func WriteInlineFile(opts WriteFileOptions) (WriteFileResult, error) {
+	res := WriteFileResult{}
+	writeFileLock.Lock()
+	defer writeFileLock.Unlock()
+
+	// Policy is checked against resolved path, and symlink should not be
+	// replaced by regular file anyway.
+	path, err := resolvePath(opts.Path)
+	if err != nil {
+		return res, err
+	}
+
+	oldStat, err := os.Stat(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return res, err
+	}
+	if exists && oldStat.IsDir() {
+		return res, fmt.Errorf("%s is a directory", opts.Path)
+	}
+	if opts.CheckPrevious {
+		sum, err := currentSHA256(path)
+		if err != nil {
+			return res, err
+		}
+		if sum != opts.PreviousSHA256 {
+			return res, FileChangedError{Path: opts.Path, SHA256: sum}
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".write-")
+	if err != nil {
+		return res, err
+	}
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(opts.Data); err != nil {
+		return res, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return res, err
+	}
+	if err := tmp.Close(); err != nil {
+		return res, err
+	}
+	perm := os.FileMode(0644)
+	if exists {
+		perm = oldStat.Mode().Perm()
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return res, err
+	}
+	if exists {
+		if err := copyFileSecurity(path, tmp.Name()); err != nil {
+			return res, err
+		}
+	}
+
+	if res.BackupPath, err = replaceFile(tmp.Name(), path, exists && opts.Backup); err != nil {
+		return res, err
+	}
+
+	success = true
+	sum := sha256.Sum256(opts.Data)
+	res.SHA256 = hex.EncodeToString(sum[:])
+	res.Size = int64(len(opts.Data))
+	return res, nil
+}
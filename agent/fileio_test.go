@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(blob)
+}
+
+func TestWriteInlineFileConflict(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{sha256Hex("other"), ""} {
+		_, err := WriteInlineFile(WriteFileOptions{
+			Path:           path,
+			Data:           []byte("new"),
+			CheckPrevious:  true,
+			PreviousSHA256: expected,
+		})
+		changedErr, ok := err.(FileChangedError)
+		if !ok {
+			t.Fatalf("expected FileChangedError for %q, got %v", expected, err)
+		}
+		if changedErr.SHA256 != sha256Hex("old") {
+			t.Error("wrong current hash in error:", changedErr.SHA256)
+		}
+		if data := readTestFile(t, path); data != "old" {
+			t.Error("file changed despite conflict:", data)
+		}
+	}
+
+	res, err := WriteInlineFile(WriteFileOptions{
+		Path:           path,
+		Data:           []byte("new"),
+		CheckPrevious:  true,
+		PreviousSHA256: sha256Hex("old"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SHA256 != sha256Hex("new") || res.Size != 3 {
+		t.Error("wrong result:", res)
+	}
+	if data := readTestFile(t, path); data != "new" {
+		t.Error("file not replaced:", data)
+	}
+}
+
+func TestWriteInlineFileMissing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "new.conf")
+
+	_, err := WriteInlineFile(WriteFileOptions{
+		Path:           path,
+		Data:           []byte("data"),
+		CheckPrevious:  true,
+		PreviousSHA256: sha256Hex("old"),
+	})
+	if changedErr, ok := err.(FileChangedError); !ok || changedErr.SHA256 != "" {
+		t.Fatal("expected FileChangedError for missing file, got", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("file created despite conflict")
+	}
+
+	res, err := WriteInlineFile(WriteFileOptions{
+		Path:          path,
+		Data:          []byte("data"),
+		CheckPrevious: true,
+		Backup:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BackupPath != "" {
+		t.Error("backup of missing file reported:", res.BackupPath)
+	}
+	if data := readTestFile(t, path); data != "data" {
+		t.Error("wrong contents:", data)
+	}
+	if files := listTree(t, dir); !reflect.DeepEqual(files, []string{"new.conf"}) {
+		t.Error("unexpected files left:", files)
+	}
+}
+
+func TestWriteInlineFileBackup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("v1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, data := range []string{"v2", "v3"} {
+		res, err := WriteInlineFile(WriteFileOptions{Path: path, Data: []byte(data), Backup: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.BackupPath != path+".bak" {
+			t.Error("wrong backup path:", res.BackupPath)
+		}
+		if bak := readTestFile(t, path+".bak"); bak != "v"+string(rune('1'+i)) {
+			t.Errorf("wrong backup contents after write %d: %s", i, bak)
+		}
+		if cur := readTestFile(t, path); cur != data {
+			t.Errorf("wrong contents after write %d: %s", i, cur)
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		for _, p := range []string{path, path + ".bak"} {
+			stat, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Mode().Perm() != 0600 {
+				t.Errorf("permissions of %s not preserved: %v", p, stat.Mode().Perm())
+			}
+		}
+	}
+	if files := listTree(t, dir); !reflect.DeepEqual(files, []string{"hosts", "hosts.bak"}) {
+		t.Error("unexpected files left:", files)
+	}
+}
+
+// Writing through symlink replaces file it points to, link is kept.
+func TestWriteInlineFileSymlink(t *testing.T) {
+	skipSymlinks(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "real.conf")
+	link := filepath.Join(dir, "link.conf")
+	if err := ioutil.WriteFile(target, []byte("v1"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real.conf", link); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := WriteInlineFile(WriteFileOptions{Path: link, Data: []byte("v2"), Backup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BackupPath != target+".bak" {
+		t.Error("wrong backup path:", res.BackupPath)
+	}
+	if dest, err := os.Readlink(link); err != nil || dest != "real.conf" {
+		t.Fatal("symlink is replaced:", dest, err)
+	}
+	if data := readTestFile(t, target); data != "v2" {
+		t.Error("wrong contents:", data)
+	}
+	if bak := readTestFile(t, target+".bak"); bak != "v1" {
+		t.Error("wrong backup contents:", bak)
+	}
+	if stat, err := os.Stat(target); err != nil || stat.Mode().Perm() != 0640 {
+		t.Error("permissions not preserved:", stat.Mode().Perm(), err)
+	}
+	if files := listTree(t, dir); !reflect.DeepEqual(files, []string{"link.conf", "real.conf", "real.conf.bak"}) {
+		t.Error("unexpected files left:", files)
+	}
+}
+
+// Backup is copied if hard links are not supported.
+func TestCopyBackup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("v1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".bak", []byte("v0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyBackup(path, path+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if bak := readTestFile(t, path+".bak"); bak != "v1" {
+		t.Error("wrong backup contents:", bak)
+	}
+	// Backup is a copy, not a link.
+	if err := ioutil.WriteFile(path, []byte("v2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if bak := readTestFile(t, path+".bak"); bak != "v1" {
+		t.Error("backup changed with original:", bak)
+	}
+	if runtime.GOOS != "windows" {
+		stat, err := os.Stat(path + ".bak")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != 0600 {
+			t.Error("permissions not preserved:", stat.Mode().Perm())
+		}
+	}
+	if files := listTree(t, dir); !reflect.DeepEqual(files, []string{"hosts", "hosts.bak"}) {
+		t.Error("unexpected files left:", files)
+	}
+}
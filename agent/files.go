@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// FileEntry describes file in dircontents and findfiles results.
+type FileEntry struct {
+	Name     string `json:"name"`
+	Dir      bool   `json:"dir"`
+	FullPath string `json:"fullpath"`
+	Size     int64  `json:"size"`
+	// Mode is permissions in ls format, e.g. "-rw-r--r--".
+	Mode string `json:"mode"`
+	// Owner is user name (DOMAIN\user on Windows), empty if unknown.
+	Owner string `json:"owner"`
+	// Modified is UNIX timestamp of last modification.
+	Modified int64 `json:"modified"`
+	// Target of symlink, empty for other files.
+	Link string `json:"link,omitempty"`
+}
+
+// fileEntry describes file without following symlinks. owners caches names
+// of users.
+func fileEntry(path string, info os.FileInfo, owners map[string]string) FileEntry {
+	e := FileEntry{
+		Name:     info.Name(),
+		Dir:      info.IsDir(),
+		FullPath: path,
+		Size:     info.Size(),
+		Mode:     info.Mode().String(),
+		Owner:    fileOwner(path, info, owners),
+		Modified: info.ModTime().Unix(),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		e.Link, _ = os.Readlink(path)
+	}
+	return e
+}
+
+// ListDir returns contents of directory, symlinks are not followed.
+func ListDir(dir string) ([]FileEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	res := make([]FileEntry, 0, len(infos))
+	for _, info := range infos {
+		res = append(res, fileEntry(filepath.Join(dir, info.Name()), info, owners))
+	}
+	return res, nil
+}
+
+// Limits on amount of results returned by FindFiles.
+const (
+	defaultFindLimit = 1000
+	maxFindLimit     = 10000
+)
+
+// FindOptions describes files searched by FindFiles. Zero values mean no
+// filtering.
+type FindOptions struct {
+	Dir string
+	// Name is glob pattern (see filepath.Match) matched against file names,
+	// case-insensitively on Windows.
+	Name string
+	// Regex is matched against full paths.
+	Regex *regexp.Regexp
+	// Type is "file" or "dir".
+	Type    string
+	MinSize int64
+	// Negative means no limit.
+	MaxSize int64
+	// UNIX timestamps.
+	ModifiedAfter  int64
+	ModifiedBefore int64
+	// Limit is maximum amount of returned files.
+	Limit int
+
+	// If Skip is not nil, directories it returns true for are not walked.
+	Skip func(path string) bool
+}
+
+// FindResult is outcome of FindFiles.
+type FindResult struct {
+	Files []FileEntry
+	// TotalSize is sum of sizes of found files.
+	TotalSize int64
+	// Truncated is true if search was stopped because Limit was reached.
+	Truncated bool
+	// Scanned is count of checked files, Errors is count of files and
+	// directories that can't be read.
+	Scanned int
+	Errors  int
+}
+
+// ParseFindFiles reads fields of findfiles task.
+func ParseFindFiles(body map[string]interface{}) (FindOptions, error) {
+	opts := FindOptions{MaxSize: -1, Limit: defaultFindLimit}
+	var ok bool
+	if opts.Dir, ok = body["dir"].(string); !ok || opts.Dir == "" {
+		return opts, errors.New("dir should be non-empty string")
+	}
+	if val, prs := body["name"]; prs {
+		if opts.Name, ok = val.(string); !ok {
+			return opts, errors.New("name should be string")
+		}
+		if _, err := filepath.Match(opts.Name, ""); err != nil {
+			return opts, errors.New("invalid name pattern")
+		}
+	}
+	if val, prs := body["regex"]; prs {
+		expr, ok := val.(string)
+		if !ok {
+			return opts, errors.New("regex should be string")
+		}
+		var err error
+		if opts.Regex, err = regexp.Compile(expr); err != nil {
+			return opts, errors.New("invalid regex: " + err.Error())
+		}
+	}
+	if val, prs := body["type"]; prs {
+		if opts.Type, ok = val.(string); !ok || (opts.Type != "file" && opts.Type != "dir") {
+			return opts, errors.New("type should be \"file\" or \"dir\"")
+		}
+	}
+
+	ints := map[string]*int64{
+		"min_size":        &opts.MinSize,
+		"max_size":        &opts.MaxSize,
+		"modified_after":  &opts.ModifiedAfter,
+		"modified_before": &opts.ModifiedBefore,
+	}
+	for field, dst := range ints {
+		val, prs := body[field]
+		if !prs {
+			continue
+		}
+		num, ok := val.(float64)
+		if !ok || num < 0 {
+			return opts, errors.New(field + " should be non-negative number")
+		}
+		*dst = int64(num)
+	}
+	if val, prs := body["limit"]; prs {
+		limit, ok := val.(float64)
+		if !ok || limit < 1 || limit > maxFindLimit {
+			return opts, errors.New("limit should be number between 1 and 10000")
+		}
+		opts.Limit = int(limit)
+	}
+	return opts, nil
+}
+
+func (opts FindOptions) matches(path string, info os.FileInfo) bool {
+	if opts.Type == "file" && info.IsDir() || opts.Type == "dir" && !info.IsDir() {
+		return false
+	}
+	if opts.Name != "" {
+		pattern, name := opts.Name, info.Name()
+		if runtime.GOOS == "windows" {
+			pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+		}
+		if matched, _ := filepath.Match(pattern, name); !matched {
+			return false
+		}
+	}
+	if opts.Regex != nil && !opts.Regex.MatchString(path) {
+		return false
+	}
+	if info.Size() < opts.MinSize || (opts.MaxSize >= 0 && info.Size() > opts.MaxSize) {
+		return false
+	}
+	mtime := info.ModTime().Unix()
+	if (opts.ModifiedAfter != 0 && mtime < opts.ModifiedAfter) || (opts.ModifiedBefore != 0 && mtime > opts.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+var errFindLimit = errors.New("limit reached")
+
+// FindFiles walks directory tree and returns files matching opts. Symlinks
+// are not followed. Unreadable directories are skipped.
+func FindFiles(ctx context.Context, opts FindOptions) (FindResult, error) {
+	res := FindResult{Files: []FileEntry{}}
+	if opts.Limit == 0 {
+		opts.Limit = defaultFindLimit
+	}
+	if _, err := os.Stat(opts.Dir); err != nil {
+		return res, err
+	}
+
+	owners := make(map[string]string)
+	err := filepath.Walk(opts.Dir, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			res.Errors++
+			return nil
+		}
+		if info.IsDir() && path != opts.Dir && opts.Skip != nil && opts.Skip(path) {
+			return filepath.SkipDir
+		}
+		res.Scanned++
+		if !opts.matches(path, info) {
+			return nil
+		}
+		if len(res.Files) == opts.Limit {
+			res.Truncated = true
+			return errFindLimit
+		}
+		res.Files = append(res.Files, fileEntry(path, info, owners))
+		if !info.IsDir() {
+			res.TotalSize += info.Size()
+		}
+		return nil
+	})
+	if err != nil && err != errFindLimit {
+		return res, err
+	}
+	return res, nil
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// chownTestFile creates file owned by uid and gid, root is required.
+func chownTestFile(t *testing.T, path string, uid, gid int) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("changing file owner requires root")
+	}
+	if err := ioutil.WriteFile(path, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkOwner fails test if path is not owned by uid and gid.
+func checkOwner(t *testing.T, path string, uid, gid int) {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys := stat.Sys().(*syscall.Stat_t)
+	if int(sys.Uid) != uid || int(sys.Gid) != gid {
+		t.Errorf("owner of %s is not preserved: %d:%d", path, sys.Uid, sys.Gid)
+	}
+}
+
+func TestWriteInlineFileOwner(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	chownTestFile(t, path, 1234, 5678)
+
+	if _, err := WriteInlineFile(WriteFileOptions{Path: path, Data: []byte("v2")}); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, path, 1234, 5678)
+	// Used if hard links are not supported.
+	if err := copyBackup(path, path+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, path+".bak", 1234, 5678)
+}
+
+func TestDownloadFileOwner(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tool")
+	chownTestFile(t, path, 1234, 5678)
+
+	c := NewClient(srv.URL)
+	if _, err := c.DownloadFile(srv.URL+"/tool", path, DownloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, path, 1234, 5678)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modAdvapi32               = syscall.NewLazyDLL("advapi32.dll")
+	procGetNamedSecurityInfoW = modAdvapi32.NewProc("GetNamedSecurityInfoW")
+	procSetNamedSecurityInfoW = modAdvapi32.NewProc("SetNamedSecurityInfoW")
+)
+
+// SE_FILE_OBJECT, OWNER_SECURITY_INFORMATION and DACL_SECURITY_INFORMATION
+const (
+	seFileObject             = 1
+	ownerSecurityInformation = 1
+	daclSecurityInformation  = 4
+)
+
+// copyFileSecurity copies access rights (DACL) of file from to file to.
+// os.Chmod only changes read-only attribute on Windows, so ACL of replaced
+// file would be lost without it.
+func copyFileSecurity(from, to string) error {
+	from16, err := syscall.UTF16PtrFromString(from)
+	if err != nil {
+		return err
+	}
+	to16, err := syscall.UTF16PtrFromString(to)
+	if err != nil {
+		return err
+	}
+	var dacl uintptr
+	var descriptor syscall.Handle
+	r1, _, _ := procGetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(from16)), seFileObject, daclSecurityInformation,
+		0, 0, uintptr(unsafe.Pointer(&dacl)), 0, uintptr(unsafe.Pointer(&descriptor)))
+	if r1 != 0 {
+		return syscall.Errno(r1)
+	}
+	// dacl points into descriptor.
+	defer syscall.LocalFree(descriptor)
+
+	r1, _, _ = procSetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(to16)), seFileObject, daclSecurityInformation,
+		0, 0, dacl, 0)
+	if r1 != 0 {
+		return syscall.Errno(r1)
+	}
+	return nil
+}
+
+var procLockFileEx = modKernel32.NewProc("LockFileEx")
+
+// LOCKFILE_EXCLUSIVE_LOCK
+const lockfileExclusiveLock = 2
+
+// lockFile opens (creating if needed) file at path and waits until it gets
+// exclusive lock on it. Lock is shared between processes and is released by
+// returned function.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	overlapped := syscall.Overlapped{}
+	r1, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r1 == 0 {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// fileOwner returns name of file owner, owners caches names of users.
+func fileOwner(path string, _ os.FileInfo, owners map[string]string) string {
+	path16, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return ""
+	}
+	var owner *syscall.SID
+	var descriptor syscall.Handle
+	r1, _, _ := procGetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(path16)), seFileObject, ownerSecurityInformation,
+		uintptr(unsafe.Pointer(&owner)), 0, 0, 0, uintptr(unsafe.Pointer(&descriptor)))
+	if r1 != 0 {
+		return ""
+	}
+	// owner points into descriptor.
+	defer syscall.LocalFree(descriptor)
+
+	sid, err := owner.String()
+	if err != nil {
+		return ""
+	}
+	if name, ok := owners[sid]; ok {
+		return name
+	}
+	name := sid
+	if account, domain, _, err := owner.LookupAccount(""); err == nil {
+		name = domain + `\` + account
+	}
+	owners[sid] = name
+	return name
+}
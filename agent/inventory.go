@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Disk is a mounted filesystem (or drive on Windows) in inventory.
+type Disk struct {
+	Mount string `json:"mount"`
+	// Size in bytes.
+	Total uint64 `json:"total"`
+}
+
+type NetInterface struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac"`
+	// IP addresses in CIDR notation.
+	Addrs []string `json:"addrs"`
+}
+
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Inventory describes hardware and software of agent's machine. Fields that
+// can't be determined are left empty.
+type Inventory struct {
+	Hostname string `json:"hostname"`
+	// Human-readable OS name and version, like "Ubuntu 18.04.1 LTS".
+	OS string `json:"os"`
+	// Kernel release (Linux) or build number (Windows).
+	Kernel   string `json:"kernel"`
+	Arch     string `json:"arch"`
+	CPUModel string `json:"cpu_model"`
+	CPUCores int    `json:"cpu_cores"`
+	// Size of RAM in bytes.
+	MemTotal   uint64         `json:"mem_total"`
+	Disks      []Disk         `json:"disks"`
+	Interfaces []NetInterface `json:"interfaces"`
+	// Sorted by name.
+	Packages []Package `json:"packages"`
+}
+
+// CollectInventory gathers information about machine. Error is returned if
+// some information can't be collected, other fields are still filled in this
+// case.
+func CollectInventory() (Inventory, error) {
+	inv := Inventory{
+		Arch:       runtime.GOARCH,
+		CPUCores:   runtime.NumCPU(),
+		Disks:      []Disk{},
+		Interfaces: []NetInterface{},
+		Packages:   []Package{},
+	}
+	inv.Hostname, _ = os.Hostname()
+
+	ifaces, ifaceErr := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ni := NetInterface{Name: iface.Name, MAC: iface.HardwareAddr.String(), Addrs: []string{}}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ni.Addrs = append(ni.Addrs, addr.String())
+		}
+		inv.Interfaces = append(inv.Interfaces, ni)
+	}
+
+	err := collectInventory(&inv)
+	sort.Slice(inv.Packages, func(i, j int) bool {
+		if inv.Packages[i].Name != inv.Packages[j].Name {
+			return inv.Packages[i].Name < inv.Packages[j].Name
+		}
+		return inv.Packages[i].Version < inv.Packages[j].Version
+	})
+
+	if err == nil && ifaceErr != nil {
+		err = fmt.Errorf("network interfaces: %v", ifaceErr)
+	}
+	return inv, err
+}
+
+// SendInventory reports inventory to server, it is saved as a snapshot if it
+// differs from previous one.
+func (c *Client) SendInventory(inv Inventory) error {
+	blob, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("json format: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/inventory", bytes.NewReader(blob))
+	if err != nil {
+		return fmt.Errorf("request create: %v", err)
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpError(resp)
+	}
+	return nil
+}
+
+// StartInventory collects and sends inventory every interval in background,
+// starting right now.
+func (c *Client) StartInventory(interval time.Duration) {
+	go func() {
+		for {
+			inv, err := CollectInventory()
+			if err != nil {
+				log.Println("Failed to collect some inventory:", err)
+			}
+			if err := c.SendInventory(inv); err != nil {
+				log.Println("Failed to send inventory:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
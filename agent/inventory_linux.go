@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Locations of files inventory is read from. Can be changed to point to
+// fixtures.
+var (
+	osReleasePath  = "/etc/os-release"
+	dpkgStatusPath = "/var/lib/dpkg/status"
+	// First existing one is used. rpmdb.sqlite is used since rpm 4.16
+	// (Fedora keeps it in /usr/lib/sysimage), Packages (Berkeley DB) before.
+	rpmDBPaths = []string{
+		"/var/lib/rpm/rpmdb.sqlite",
+		"/usr/lib/sysimage/rpm/rpmdb.sqlite",
+		"/var/lib/rpm/Packages",
+	}
+)
+
+func collectInventory(inv *Inventory) error {
+	var errs []string
+
+	var err error
+	if inv.OS, err = readOSRelease(); err != nil {
+		errs = append(errs, "os: "+err.Error())
+	}
+	if kernel, err := ioutil.ReadFile(filepath.Join(procRoot, "sys/kernel/osrelease")); err != nil {
+		errs = append(errs, "kernel: "+err.Error())
+	} else {
+		inv.Kernel = strings.TrimSpace(string(kernel))
+	}
+	if inv.CPUModel, err = readCPUModel(); err != nil {
+		errs = append(errs, "cpu: "+err.Error())
+	}
+	if inv.MemTotal, _, err = readMemInfo(); err != nil {
+		errs = append(errs, "memory: "+err.Error())
+	}
+
+	disks, err := readDisks()
+	if err != nil {
+		errs = append(errs, "disks: "+err.Error())
+	}
+	for _, d := range disks {
+		inv.Disks = append(inv.Disks, Disk{Mount: d.Mount, Total: d.Total})
+	}
+
+	if inv.Packages, err = readPackages(); err != nil {
+		errs = append(errs, "packages: "+err.Error())
+	}
+
+	if errs != nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// readOSRelease returns PRETTY_NAME from os-release file.
+func readOSRelease() (string, error) {
+	f, err := os.Open(osReleasePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := scnr.Text()
+		if !strings.HasPrefix(line, "PRETTY_NAME=") {
+			continue
+		}
+		value := strings.TrimPrefix(line, "PRETTY_NAME=")
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted, nil
+		}
+		return strings.Trim(value, `'"`), nil
+	}
+	if err := scnr.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("PRETTY_NAME missing")
+}
+
+func readCPUModel() (string, error) {
+	f, err := os.Open(filepath.Join(procRoot, "cpuinfo"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		parts := strings.SplitN(scnr.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		// "model name" on x86, "Model" on some ARM boards.
+		key := strings.TrimSpace(parts[0])
+		if key == "model name" || key == "Model" {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("CPU model is not listed")
+}
+
+// readPackages lists installed packages using dpkg status file or rpm
+// database if there is no dpkg.
+func readPackages() ([]Package, error) {
+	pkgs, err := readDpkgStatus()
+	if err == nil || !os.IsNotExist(err) {
+		return pkgs, err
+	}
+
+	for _, path := range rpmDBPaths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		return readRpmDB(path)
+	}
+	return []Package{}, errors.New("neither dpkg nor rpm database found")
+}
+
+// readDpkgStatus parses /var/lib/dpkg/status. It consists of paragraphs
+// separated by empty lines with "Field: value" lines.
+func readDpkgStatus() ([]Package, error) {
+	f, err := os.Open(dpkgStatusPath)
+	if err != nil {
+		return []Package{}, err
+	}
+	defer f.Close()
+
+	pkgs := []Package{}
+	current := Package{}
+	installed := false
+	flush := func() {
+		if installed && current.Name != "" {
+			pkgs = append(pkgs, current)
+		}
+		current = Package{}
+		installed = false
+	}
+
+	scnr := bufio.NewScanner(f)
+	// Descriptions can have long lines.
+	scnr.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scnr.Scan() {
+		line := scnr.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		// Continuation lines of multi-line fields.
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "Package":
+			current.Name = value
+		case "Version":
+			current.Version = value
+		case "Status":
+			// "install ok installed", packages that are removed but not
+			// purged have "deinstall ok config-files".
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	flush()
+	return pkgs, scnr.Err()
+}
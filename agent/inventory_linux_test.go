@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadOSRelease(t *testing.T) {
+	defer func(prev string) { osReleasePath = prev }(osReleasePath)
+
+	for file, expected := range map[string]string{
+		"ubuntu":  "Ubuntu 22.04.3 LTS",
+		"alpine":  "Alpine Linux v3.18",
+		"escaped": `Test "Quoted" Linux`,
+	} {
+		osReleasePath = filepath.Join("testdata", "os-release", file)
+		name, err := readOSRelease()
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if name != expected {
+			t.Errorf("%s: expected %q, got %q", file, expected, name)
+		}
+	}
+
+	osReleasePath = filepath.Join("testdata", "os-release", "no-pretty-name")
+	if _, err := readOSRelease(); err == nil {
+		t.Error("no error for missing PRETTY_NAME")
+	}
+	osReleasePath = filepath.Join("testdata", "os-release", "missing")
+	if _, err := readOSRelease(); err == nil {
+		t.Error("no error for missing file")
+	}
+}
+
+func TestReadDpkgStatus(t *testing.T) {
+	defer func(prev string) { dpkgStatusPath = prev }(dpkgStatusPath)
+	dpkgStatusPath = filepath.Join("testdata", "dpkg", "status")
+
+	pkgs, err := readDpkgStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Package{
+		{Name: "adduser", Version: "3.118ubuntu5"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.1"},
+		{Name: "zlib1g", Version: "1:1.2.11.dfsg-2ubuntu9.2"},
+	}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Errorf("expected %v, got %v", expected, pkgs)
+	}
+}
+
+func TestReadPackagesRpm(t *testing.T) {
+	defer func(prevDpkg string, prevRpm []string) {
+		dpkgStatusPath, rpmDBPaths = prevDpkg, prevRpm
+	}(dpkgStatusPath, rpmDBPaths)
+
+	dpkgStatusPath = filepath.Join("testdata", "dpkg", "missing")
+	rpmDBPaths = []string{
+		filepath.Join("testdata", "rpmdb", "missing.sqlite"),
+		filepath.Join("testdata", "rpmdb", "Packages"),
+	}
+	pkgs, err := readPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortPkgs(pkgs)
+	if !reflect.DeepEqual(pkgs, rpmFixturePkgs) {
+		t.Errorf("wrong packages: %v", pkgs)
+	}
+
+	rpmDBPaths = rpmDBPaths[:1]
+	if _, err := readPackages(); err == nil {
+		t.Error("no error without package databases")
+	}
+}
+
+func TestReadCPUModel(t *testing.T) {
+	useProcFixture(t, "proc")
+	model, err := readCPUModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model != "Intel(R) Core(TM) i5-8400 CPU @ 2.80GHz" {
+		t.Error("wrong CPU model:", model)
+	}
+}
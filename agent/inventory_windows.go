@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"errors"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+func collectInventory(inv *Inventory) error {
+	var errs []string
+
+	if err := readWindowsVersion(inv); err != nil {
+		errs = append(errs, "os: "+err.Error())
+	}
+
+	cpuKey, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DESCRIPTION\System\CentralProcessor\0`, registry.QUERY_VALUE)
+	if err != nil {
+		errs = append(errs, "cpu: "+err.Error())
+	} else {
+		model, _, err := cpuKey.GetStringValue("ProcessorNameString")
+		cpuKey.Close()
+		if err != nil {
+			errs = append(errs, "cpu: "+err.Error())
+		}
+		inv.CPUModel = strings.TrimSpace(model)
+	}
+
+	mem := memoryStatusEx{}
+	mem.Length = uint32(unsafe.Sizeof(mem))
+	if r1, _, e1 := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&mem))); r1 == 0 {
+		errs = append(errs, "memory: "+e1.Error())
+	} else {
+		inv.MemTotal = mem.TotalPhys
+	}
+
+	disks, err := readDisks()
+	if err != nil {
+		errs = append(errs, "disks: "+err.Error())
+	}
+	for _, d := range disks {
+		inv.Disks = append(inv.Disks, Disk{Mount: d.Mount, Total: d.Total})
+	}
+
+	if inv.Packages, err = readInstalledPrograms(); err != nil {
+		errs = append(errs, "packages: "+err.Error())
+	}
+
+	if errs != nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func readWindowsVersion(inv *Inventory) error {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, registry.QUERY_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	product, _, err := k.GetStringValue("ProductName")
+	if err != nil {
+		return err
+	}
+	inv.OS = product
+	// ReleaseId is missing on Windows older than 10.
+	if release, _, err := k.GetStringValue("ReleaseId"); err == nil {
+		inv.OS += " " + release
+	}
+	inv.Kernel, _, _ = k.GetStringValue("CurrentBuild")
+	return nil
+}
+
+// Programs listed in "Programs and Features" are registered under these keys.
+var uninstallKeys = []string{
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`,
+	// 32-bit programs on 64-bit Windows.
+	`SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+}
+
+func readInstalledPrograms() ([]Package, error) {
+	pkgs := []Package{}
+	seen := make(map[Package]bool)
+	var lastErr error
+	for _, path := range uninstallKeys {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		names, err := k.ReadSubKeyNames(-1)
+		k.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, name := range names {
+			sub, err := registry.OpenKey(registry.LOCAL_MACHINE, path+`\`+name, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			pkg := Package{}
+			pkg.Name, _, _ = sub.GetStringValue("DisplayName")
+			pkg.Version, _, _ = sub.GetStringValue("DisplayVersion")
+			// Updates and components are hidden in "Programs and Features".
+			sysComponent, _, _ := sub.GetIntegerValue("SystemComponent")
+			sub.Close()
+			if pkg.Name == "" || sysComponent == 1 || seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	if len(pkgs) == 0 && lastErr != nil {
+		return pkgs, lastErr
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,492 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Jobs manages detached commands (jobs). Each job is supervised by separate
+// agent process (see RunJobSupervisor), so job continues to run and its
+// exit status is recorded even if agent is restarted.
+//
+// Each job has a directory in Dir with journal (job.json) and output of
+// command (stdout.log and stderr.log, stdin is kept in stdin). Journals of jobs finished more than
+// MaxAge ago are removed.
+type Jobs struct {
+	Dir string
+	// Zero means 7 days.
+	MaxAge time.Duration
+
+	lock sync.Mutex
+}
+
+// JobInfo is journal of job.
+type JobInfo struct {
+	ID      string            `json:"id"`
+	Cmd     string            `json:"cmd"`
+	Shell   string            `json:"shell,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Dir     string            `json:"cwd,omitempty"`
+	Timeout float64           `json:"timeout,omitempty"`
+
+	// Unix timestamps.
+	Created  int64  `json:"created"`
+	Started  int64  `json:"started,omitempty"`
+	Finished *int64 `json:"finished"`
+
+	// PID of supervisor and command.
+	SupervisorPID int `json:"supervisor_pid,omitempty"`
+	PID           int `json:"pid,omitempty"`
+	// Start time of supervisor process (UNIX timestamp), used to tell it
+	// from unrelated process that got the same PID. Zero if unknown.
+	SupervisorStarted int64 `json:"supervisor_started,omitempty"`
+
+	StatusCode *int `json:"status_code"`
+	// Killed is true if command was killed by Jobs.Kill or because of
+	// timeout.
+	Killed bool `json:"killed"`
+	// Error is set if command can't be started or supervisor disappeared
+	// before command finished (e.g. machine was rebooted).
+	Error string `json:"error,omitempty"`
+
+	// Filled by Jobs.Status.
+	Running    bool  `json:"running"`
+	StdoutSize int64 `json:"stdout_size"`
+	StderrSize int64 `json:"stderr_size"`
+}
+
+// ErrUnknownJob is returned for job IDs without journal.
+var ErrUnknownJob = errors.New("unknown job")
+
+// MaxJobOutputChunk is maximum amount of output returned by single
+// job_output task.
+const MaxJobOutputChunk = 1 << 20
+
+// Passed as first argument to agent executable to start job supervisor.
+const jobSupervisorFlag = "-sutrc-job-supervisor"
+
+func (j *Jobs) dir(id string) (string, error) {
+	if raw, err := hex.DecodeString(id); err != nil || len(raw) != 8 {
+		return "", ErrUnknownJob
+	}
+	return filepath.Join(j.Dir, id), nil
+}
+
+func readJobInfo(dir string) (JobInfo, error) {
+	info := JobInfo{}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "job.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info, ErrUnknownJob
+		}
+		return info, err
+	}
+	return info, json.Unmarshal(blob, &info)
+}
+
+// writeJobInfo replaces journal atomically, so readers never see partially
+// written one.
+func writeJobInfo(dir string, info JobInfo) error {
+	info.Running, info.StdoutSize, info.StderrSize = false, 0, 0
+	blob, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "job.json.tmp")
+	if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "job.json"))
+}
+
+// Spawn starts command as a job and returns its ID. Output callback of
+// Command is not used.
+func (j *Jobs) Spawn(c Command) (string, error) {
+	j.prune()
+
+	// Check command before starting supervisor, so error is reported now.
+	if _, err := c.command(); err != nil {
+		return "", err
+	}
+
+	rawID := make([]byte, 8)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(rawID)
+	dir := filepath.Join(j.Dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	info := JobInfo{
+		ID:      id,
+		Cmd:     c.Cmd,
+		Shell:   c.Shell,
+		Env:     c.Env,
+		Dir:     c.Dir,
+		Timeout: c.Timeout.Seconds(),
+		Created: time.Now().Unix(),
+	}
+	// Stdin is not necessary valid UTF-8, so it can't go to journal.
+	if err := ioutil.WriteFile(filepath.Join(dir, "stdin"), []byte(c.Stdin), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := writeJobInfo(dir, info); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	supervisor := exec.Command(exe, jobSupervisorFlag, dir)
+	detachProcess(supervisor)
+	if err := supervisor.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	// Supervisor is not our business anymore, but it should be reaped.
+	go supervisor.Wait()
+	return id, nil
+}
+
+// Status returns journal of job with running state and output sizes.
+func (j *Jobs) Status(id string) (JobInfo, error) {
+	dir, err := j.dir(id)
+	if err != nil {
+		return JobInfo{}, err
+	}
+	return j.status(dir)
+}
+
+func (j *Jobs) status(dir string) (JobInfo, error) {
+	info, err := readJobInfo(dir)
+	if err != nil {
+		return info, err
+	}
+	if info.Finished == nil {
+		// Supervisor records PID before anything else, give it some time.
+		if info.SupervisorPID == 0 && time.Since(time.Unix(info.Created, 0)) < time.Minute {
+			info.Running = true
+		} else if info.SupervisorPID != 0 && supervisorAlive(info) {
+			info.Running = true
+		} else {
+			// Supervisor disappeared without recording result.
+			now := time.Now().Unix()
+			info.Finished = &now
+			info.Error = "job supervisor disappeared, exit status is unknown"
+			if err := writeJobInfo(dir, info); err != nil {
+				return info, err
+			}
+		}
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "stdout.log")); err == nil {
+		info.StdoutSize = stat.Size()
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "stderr.log")); err == nil {
+		info.StderrSize = stat.Size()
+	}
+	return info, nil
+}
+
+// supervisorAlive checks whether supervisor of job is still running.
+func supervisorAlive(info JobInfo) bool {
+	if !processAlive(info.SupervisorPID) {
+		return false
+	}
+	return info.SupervisorStarted == 0 || processStarted(info.SupervisorPID) == info.SupervisorStarted
+}
+
+// lockJob takes lock on job directory. Kill and supervisor hold it while
+// they check whether command is started, so command is either never started
+// or its PID is seen by Kill.
+func lockJob(dir string) (func(), error) {
+	return lockFile(filepath.Join(dir, "lock"))
+}
+
+// List returns journals of all jobs, newest first.
+func (j *Jobs) List() ([]JobInfo, error) {
+	j.prune()
+	entries, err := ioutil.ReadDir(j.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []JobInfo{}, nil
+		}
+		return nil, err
+	}
+	res := make([]JobInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := j.status(filepath.Join(j.Dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, k int) bool {
+		return res[i].Created > res[k].Created
+	})
+	return res, nil
+}
+
+// Output reads up to limit bytes of job's output stream ("stdout" or
+// "stderr") starting at offset, negative offset is counted from the end.
+// Returns read data and offset it starts at.
+func (j *Jobs) Output(id, stream string, offset, limit int64) ([]byte, int64, error) {
+	dir, err := j.dir(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if stream != "stdout" && stream != "stderr" {
+		return nil, 0, errors.New("stream should be stdout or stderr")
+	}
+	if _, err := readJobInfo(dir); err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, stream+".log"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []byte{}, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset < 0 {
+		offset += stat.Size()
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset > stat.Size() {
+		offset = stat.Size()
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, limit))
+	return data, offset, err
+}
+
+// Kill kills job's command and all processes it started. Returns false if
+// job is already finished.
+func (j *Jobs) Kill(id string) (bool, error) {
+	dir, err := j.dir(id)
+	if err != nil {
+		return false, err
+	}
+	if _, err := readJobInfo(dir); err != nil {
+		return false, err
+	}
+	unlock, err := lockJob(dir)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	info, err := j.status(dir)
+	if err != nil {
+		return false, err
+	}
+	if !info.Running {
+		return false, nil
+	}
+	// Supervisor checks it to distinguish kill from crash.
+	if err := ioutil.WriteFile(filepath.Join(dir, "killed"), nil, 0600); err != nil {
+		return false, err
+	}
+	if info.PID == 0 {
+		// Not started yet, supervisor will not start it.
+		return true, nil
+	}
+	proc, err := os.FindProcess(info.PID)
+	if err != nil {
+		return false, err
+	}
+	return true, killProcessTree(proc)
+}
+
+// prune removes journals of jobs finished more than MaxAge ago.
+func (j *Jobs) prune() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	maxAge := j.MaxAge
+	if maxAge == 0 {
+		maxAge = 7 * 24 * time.Hour
+	}
+	entries, err := ioutil.ReadDir(j.Dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(j.Dir, entry.Name())
+		info, err := readJobInfo(dir)
+		if err != nil || info.Finished == nil {
+			continue
+		}
+		if time.Since(time.Unix(*info.Finished, 0)) > maxAge {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Println("Failed to remove old job", info.ID+":", err)
+			}
+		}
+	}
+}
+
+// RunJobSupervisor runs job and exits if process was started by Jobs.Spawn
+// as job supervisor, otherwise it returns immediately. Agents using Jobs
+// should call it first thing in main.
+func RunJobSupervisor() {
+	if len(os.Args) != 3 || os.Args[1] != jobSupervisorFlag {
+		return
+	}
+	if err := superviseJob(os.Args[2]); err != nil {
+		// Nobody will see it, but journal is probably broken anyway.
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func superviseJob(dir string) error {
+	info, err := readJobInfo(dir)
+	if err != nil {
+		return err
+	}
+	info.SupervisorPID = os.Getpid()
+	info.SupervisorStarted = processStarted(info.SupervisorPID)
+	if err := writeJobInfo(dir, info); err != nil {
+		return err
+	}
+
+	finish := func() error {
+		now := time.Now().Unix()
+		info.Finished = &now
+		if _, err := os.Stat(filepath.Join(dir, "killed")); err == nil {
+			info.Killed = true
+		}
+		return writeJobInfo(dir, info)
+	}
+	fail := func(err error) error {
+		info.Error = err.Error()
+		return finish()
+	}
+
+	c := Command{
+		Cmd:     info.Cmd,
+		Shell:   info.Shell,
+		Env:     info.Env,
+		Dir:     info.Dir,
+		Timeout: time.Duration(info.Timeout * float64(time.Second)),
+	}
+	cmd, err := c.command()
+	if err != nil {
+		return fail(err)
+	}
+	stdin, err := os.Open(filepath.Join(dir, "stdin"))
+	if err != nil {
+		return fail(err)
+	}
+	defer stdin.Close()
+	cmd.Stdin = stdin
+	// Command writes directly to files, so output is not lost even if
+	// supervisor is killed.
+	stdout, err := os.OpenFile(filepath.Join(dir, "stdout.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fail(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.OpenFile(filepath.Join(dir, "stderr.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fail(err)
+	}
+	defer stderr.Close()
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	setProcessGroup(cmd)
+
+	unlock, err := lockJob(dir)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "killed")); err == nil {
+		// Killed before it was started.
+		unlock()
+		return finish()
+	}
+	if err := cmd.Start(); err != nil {
+		unlock()
+		return fail(err)
+	}
+	info.PID = cmd.Process.Pid
+	info.Started = time.Now().Unix()
+	if err := writeJobInfo(dir, info); err != nil {
+		unlock()
+		killProcessTree(cmd.Process)
+		return err
+	}
+	unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var timeout <-chan time.Time
+	if c.Timeout != 0 {
+		timeout = time.After(c.Timeout)
+	}
+	select {
+	case err = <-done:
+	case <-timeout:
+		killProcessTree(cmd.Process)
+		err = <-done
+		info.Killed = true
+	}
+
+	status, err := exitStatus(err)
+	if err != nil {
+		return fail(err)
+	}
+	info.StatusCode = &status
+	return finish()
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockJob(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	unlock, err := lockJob(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockJob(dir)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock taken twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not released")
+	}
+}
+
+func TestKillReusedSupervisorPID(t *testing.T) {
+	started := processStarted(os.Getpid())
+	if started == 0 {
+		t.Skip("process start time is not available on this platform")
+	}
+	jobs := Jobs{Dir: tempDir(t)}
+	defer os.RemoveAll(jobs.Dir)
+	id := "0123456789abcdef"
+	dir := filepath.Join(jobs.Dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Our PID is alive, but it doesn't belong to supervisor started then.
+	info := JobInfo{
+		ID:                id,
+		Cmd:               "sleep 100",
+		Created:           started - 100,
+		SupervisorPID:     os.Getpid(),
+		SupervisorStarted: started - 100,
+	}
+	if err := writeJobInfo(dir, info); err != nil {
+		t.Fatal(err)
+	}
+	killed, err := jobs.Kill(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if killed {
+		t.Fatal("Kill killed process with reused PID")
+	}
+	status, err := jobs.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || status.Finished == nil || status.Error == "" {
+		t.Error("job not marked as finished:", status)
+	}
+
+	info.SupervisorStarted = started
+	info.Finished, info.Error = nil, ""
+	if err := writeJobInfo(dir, info); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := jobs.Status(id); err != nil || !status.Running {
+		t.Error("job with live supervisor is not running:", status, err)
+	}
+}
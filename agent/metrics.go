@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DiskUsage describes single mounted filesystem (or drive on Windows).
+type DiskUsage struct {
+	Mount string `json:"mount"`
+	// Sizes are in bytes.
+	Total uint64 `json:"total"`
+	Used  uint64 `json:"used"`
+}
+
+// Metrics is a system health snapshot sent to server with each heartbeat.
+type Metrics struct {
+	// CPU utilization over ~1 second in percents (0-100).
+	CPULoad float64 `json:"cpu_load"`
+	// Memory sizes are in bytes.
+	MemTotal uint64      `json:"mem_total"`
+	MemUsed  uint64      `json:"mem_used"`
+	Disks    []DiskUsage `json:"disks"`
+	// Uptime in seconds.
+	Uptime int64 `json:"uptime"`
+	// Names of logged-in users.
+	Users []string `json:"users"`
+	// Count of tasks being executed by agent.
+	Tasks int `json:"tasks"`
+}
+
+// CollectMetrics gathers system health metrics. It takes about one second
+// because CPU utilization is measured.
+//
+// Error is returned if some metrics can't be collected, other fields are
+// still filled in this case.
+func (c *Client) CollectMetrics() (Metrics, error) {
+	m := Metrics{Disks: []DiskUsage{}, Users: []string{}}
+	err := collectMetrics(&m)
+
+	c.tasks.lock.Lock()
+	m.Tasks = len(c.tasks.ctxs)
+	c.tasks.lock.Unlock()
+	return m, err
+}
+
+// SendHeartbeat reports metrics to server. It also tells server that agent
+// is alive.
+func (c *Client) SendHeartbeat(m Metrics) error {
+	blob, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("json format: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/heartbeat", bytes.NewReader(blob))
+	if err != nil {
+		return fmt.Errorf("request create: %v", err)
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpError(resp)
+	}
+	return nil
+}
+
+// StartHeartbeats collects and sends metrics every interval in background.
+// Errors are logged, failed heartbeats are not retried.
+func (c *Client) StartHeartbeats(interval time.Duration) {
+	go func() {
+		collectErrLogged := false
+		for {
+			m, err := c.CollectMetrics()
+			if err != nil && !collectErrLogged {
+				// Most likely will happen every time, don't spam log.
+				log.Println("Failed to collect some metrics:", err)
+				collectErrLogged = true
+			}
+			if err := c.SendHeartbeat(m); err != nil {
+				log.Println("Failed to send heartbeat:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
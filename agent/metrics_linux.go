@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Locations of files metrics are read from. Can be changed to point to
+// fixtures.
+var (
+	procRoot = "/proc"
+	utmpPath = "/var/run/utmp"
+)
+
+func collectMetrics(m *Metrics) error {
+	var errs []string
+
+	idle1, total1, err := readCPUTimes()
+	if err == nil {
+		time.Sleep(time.Second)
+		var idle2, total2 uint64
+		idle2, total2, err = readCPUTimes()
+		if err == nil && total2 > total1 {
+			m.CPULoad = 100 * (1 - float64(idle2-idle1)/float64(total2-total1))
+		}
+	}
+	if err != nil {
+		errs = append(errs, "cpu: "+err.Error())
+	}
+
+	if m.MemTotal, m.MemUsed, err = readMemInfo(); err != nil {
+		errs = append(errs, "memory: "+err.Error())
+	}
+	if m.Uptime, err = readUptime(); err != nil {
+		errs = append(errs, "uptime: "+err.Error())
+	}
+	if m.Disks, err = readDisks(); err != nil {
+		errs = append(errs, "disks: "+err.Error())
+	}
+	if m.Users, err = readUsers(); err != nil {
+		errs = append(errs, "users: "+err.Error())
+	}
+
+	if errs != nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// readCPUTimes returns idle and total CPU time from /proc/stat in jiffies.
+func readCPUTimes() (idle, total uint64, err error) {
+	blob, err := ioutil.ReadFile(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	line := blob
+	if i := bytes.IndexByte(blob, '\n'); i != -1 {
+		line = blob[:i]
+	}
+
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("malformed stat file")
+	}
+	for i, f := range fields[1:] {
+		// guest time is already included in user time.
+		if i >= 8 {
+			break
+		}
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("malformed stat file")
+		}
+		total += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return idle, total, nil
+}
+
+func readMemInfo() (total, used uint64, err error) {
+	f, err := os.Open(filepath.Join(procRoot, "meminfo"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		// MemTotal:       16314400 kB
+		fields := strings.Fields(scnr.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			v *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	if err := scnr.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	total = values["MemTotal"]
+	if total == 0 {
+		return 0, 0, errors.New("MemTotal missing")
+	}
+	avail, prs := values["MemAvailable"]
+	if !prs {
+		// Kernels older than 3.14.
+		avail = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if avail > total {
+		avail = total
+	}
+	return total, total - avail, nil
+}
+
+func readUptime() (int64, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(procRoot, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(blob))
+	if len(fields) == 0 {
+		return 0, errors.New("malformed uptime file")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, errors.New("malformed uptime file")
+	}
+	return int64(secs), nil
+}
+
+// readMounts returns mount points of block devices from /proc/mounts.
+func readMounts() ([]string, error) {
+	f, err := os.Open(filepath.Join(procRoot, "mounts"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []string{}
+	seenDevs := make(map[string]bool)
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		// /dev/sda1 / ext4 rw,relatime 0 0
+		fields := strings.Fields(scnr.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		// Skip pseudo filesystems and bind mounts of same device.
+		if !strings.HasPrefix(fields[0], "/") || seenDevs[fields[0]] {
+			continue
+		}
+		seenDevs[fields[0]] = true
+		mounts = append(mounts, unescapeMountPath(fields[1]))
+	}
+	return mounts, scnr.Err()
+}
+
+// unescapeMountPath decodes octal escapes (like \040 for space) used in
+// /proc/mounts.
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func readDisks() ([]DiskUsage, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return []DiskUsage{}, err
+	}
+
+	disks := []DiskUsage{}
+	for _, mount := range mounts {
+		stat := syscall.Statfs_t{}
+		if err := syscall.Statfs(mount, &stat); err != nil {
+			continue
+		}
+		bsize := uint64(stat.Bsize)
+		disks = append(disks, DiskUsage{
+			Mount: mount,
+			Total: stat.Blocks * bsize,
+			Used:  (stat.Blocks - stat.Bfree) * bsize,
+		})
+	}
+	return disks, nil
+}
+
+// Layout of struct utmp on Linux (glibc).
+const (
+	utmpRecordSize  = 384
+	utmpUserOffset  = 44
+	utmpUserSize    = 32
+	utmpUserProcess = 7
+)
+
+// readUsers returns names of users logged in according to utmp.
+func readUsers() ([]string, error) {
+	blob, err := ioutil.ReadFile(utmpPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// No login sessions were ever recorded.
+			return []string{}, nil
+		}
+		return []string{}, err
+	}
+
+	users := []string{}
+	seen := make(map[string]bool)
+	for off := 0; off+utmpRecordSize <= len(blob); off += utmpRecordSize {
+		rec := blob[off : off+utmpRecordSize]
+		// ut_type is short, we support only little-endian here.
+		if int(rec[0])|int(rec[1])<<8 != utmpUserProcess {
+			continue
+		}
+		user := rec[utmpUserOffset : utmpUserOffset+utmpUserSize]
+		if i := bytes.IndexByte(user, 0); i != -1 {
+			user = user[:i]
+		}
+		if len(user) == 0 || seen[string(user)] {
+			continue
+		}
+		seen[string(user)] = true
+		users = append(users, string(user))
+	}
+	return users, nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useProcFixture points procRoot to testdata directory until test ends.
+func useProcFixture(t *testing.T, dir string) {
+	prev := procRoot
+	procRoot = filepath.Join("testdata", dir)
+	t.Cleanup(func() { procRoot = prev })
+}
+
+func TestReadCPUTimes(t *testing.T) {
+	useProcFixture(t, "proc")
+	idle, total, err := readCPUTimes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sum of first 8 fields, guest time is not counted twice.
+	if total != 60377929 {
+		t.Error("wrong total:", total)
+	}
+	// idle + iowait
+	if idle != 46845166 {
+		t.Error("wrong idle:", idle)
+	}
+
+	useProcFixture(t, "proc-old")
+	if _, _, err := readCPUTimes(); err == nil {
+		t.Error("no error for missing stat file")
+	}
+}
+
+func TestReadMemInfo(t *testing.T) {
+	useProcFixture(t, "proc")
+	total, used, err := readMemInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 16314400*1024 || used != (16314400-8157200)*1024 {
+		t.Error("wrong values:", total, used)
+	}
+
+	// No MemAvailable on kernels older than 3.14.
+	useProcFixture(t, "proc-old")
+	total, used, err = readMemInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2048000*1024 || used != (2048000-512000-128000-384000)*1024 {
+		t.Error("wrong values (old kernel):", total, used)
+	}
+}
+
+func TestReadUptime(t *testing.T) {
+	useProcFixture(t, "proc")
+	uptime, err := readUptime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uptime != 350735 {
+		t.Error("wrong uptime:", uptime)
+	}
+}
+
+func TestReadMounts(t *testing.T) {
+	useProcFixture(t, "proc")
+	mounts, err := readMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pseudo filesystems and second mount of /dev/sda2 are skipped.
+	expected := []string{"/", "/boot/efi", "/mnt/Shared Files"}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %q, got %q", expected, mounts)
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	for escaped, expected := range map[string]string{
+		`/mnt/a\040b`:   "/mnt/a b",
+		`/mnt/tab\011`:  "/mnt/tab\t",
+		`/mnt/back\134`: `/mnt/back\`,
+		`/mnt/short\04`: `/mnt/short\04`,
+		`/mnt/bad\999`:  `/mnt/bad\999`,
+		`/plain`:        "/plain",
+	} {
+		if res := unescapeMountPath(escaped); res != expected {
+			t.Errorf("%s: expected %q, got %q", escaped, expected, res)
+		}
+	}
+}
+
+func TestReadUsers(t *testing.T) {
+	defer func(prev string) { utmpPath = prev }(utmpPath)
+
+	// Fixture has boot, runlevel, login and dead process records, that are
+	// skipped, user process records (one user twice) and truncated record at
+	// the end.
+	utmpPath = filepath.Join("testdata", "utmp")
+	users, err := readUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alice", "bob", strings.Repeat("a", 32)}
+	if !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected %q, got %q", expected, users)
+	}
+
+	utmpPath = filepath.Join("testdata", "missing-utmp")
+	users, err = readUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Error("users listed without utmp:", users)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modKernel32              = syscall.NewLazyDLL("kernel32.dll")
+	procGetSystemTimes       = modKernel32.NewProc("GetSystemTimes")
+	procGlobalMemoryStatusEx = modKernel32.NewProc("GlobalMemoryStatusEx")
+	procGetTickCount64       = modKernel32.NewProc("GetTickCount64")
+	procGetLogicalDriveStrs  = modKernel32.NewProc("GetLogicalDriveStringsW")
+	procGetDriveType         = modKernel32.NewProc("GetDriveTypeW")
+	procGetDiskFreeSpaceEx   = modKernel32.NewProc("GetDiskFreeSpaceExW")
+	modWtsapi32              = syscall.NewLazyDLL("wtsapi32.dll")
+	procWTSEnumerateSessions = modWtsapi32.NewProc("WTSEnumerateSessionsW")
+	procWTSQuerySessionInfo  = modWtsapi32.NewProc("WTSQuerySessionInformationW")
+	procWTSFreeMemory        = modWtsapi32.NewProc("WTSFreeMemory")
+)
+
+const (
+	driveFixed  = 3
+	wtsUserName = 5
+)
+
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+type wtsSessionInfo struct {
+	SessionID      uint32
+	WinStationName *uint16
+	State          uint32
+}
+
+func collectMetrics(m *Metrics) error {
+	var errs []string
+
+	idle1, total1, err := readCPUTimes()
+	if err == nil {
+		time.Sleep(time.Second)
+		var idle2, total2 uint64
+		idle2, total2, err = readCPUTimes()
+		if err == nil && total2 > total1 {
+			m.CPULoad = 100 * (1 - float64(idle2-idle1)/float64(total2-total1))
+		}
+	}
+	if err != nil {
+		errs = append(errs, "cpu: "+err.Error())
+	}
+
+	mem := memoryStatusEx{}
+	mem.Length = uint32(unsafe.Sizeof(mem))
+	if r1, _, e1 := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&mem))); r1 == 0 {
+		errs = append(errs, "memory: "+e1.Error())
+	} else {
+		m.MemTotal = mem.TotalPhys
+		m.MemUsed = mem.TotalPhys - mem.AvailPhys
+	}
+
+	ticks, _, _ := procGetTickCount64.Call()
+	m.Uptime = int64(ticks / 1000)
+
+	if m.Disks, err = readDisks(); err != nil {
+		errs = append(errs, "disks: "+err.Error())
+	}
+	if m.Users, err = readUsers(); err != nil {
+		errs = append(errs, "users: "+err.Error())
+	}
+
+	if errs != nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func filetimeToUint64(ft syscall.Filetime) uint64 {
+	return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+}
+
+func readCPUTimes() (idle, total uint64, err error) {
+	var idleFt, kernelFt, userFt syscall.Filetime
+	r1, _, e1 := procGetSystemTimes.Call(
+		uintptr(unsafe.Pointer(&idleFt)),
+		uintptr(unsafe.Pointer(&kernelFt)),
+		uintptr(unsafe.Pointer(&userFt)))
+	if r1 == 0 {
+		return 0, 0, e1
+	}
+	// Kernel time includes idle time.
+	return filetimeToUint64(idleFt), filetimeToUint64(kernelFt) + filetimeToUint64(userFt), nil
+}
+
+func readDisks() ([]DiskUsage, error) {
+	buf := make([]uint16, 256)
+	r1, _, e1 := procGetLogicalDriveStrs.Call(uintptr(len(buf)), uintptr(unsafe.Pointer(&buf[0])))
+	if r1 == 0 {
+		return []DiskUsage{}, e1
+	}
+
+	// Buffer contains list of null-terminated strings like "C:\".
+	drives := []string{}
+	start := 0
+	for i := 0; i < int(r1) && i < len(buf); i++ {
+		if buf[i] == 0 {
+			if i > start {
+				drives = append(drives, syscall.UTF16ToString(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+
+	disks := []DiskUsage{}
+	for _, drive := range drives {
+		drivePtr, err := syscall.UTF16PtrFromString(drive)
+		if err != nil {
+			continue
+		}
+		if t, _, _ := procGetDriveType.Call(uintptr(unsafe.Pointer(drivePtr))); t != driveFixed {
+			continue
+		}
+		var freeAvail, total, totalFree uint64
+		r1, _, _ := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(drivePtr)),
+			uintptr(unsafe.Pointer(&freeAvail)),
+			uintptr(unsafe.Pointer(&total)),
+			uintptr(unsafe.Pointer(&totalFree)))
+		if r1 == 0 {
+			continue
+		}
+		disks = append(disks, DiskUsage{Mount: drive, Total: total, Used: total - totalFree})
+	}
+	return disks, nil
+}
+
+// utf16PtrToString converts null-terminated UTF-16 string allocated by
+// Windows to Go string.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	s := []uint16{}
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(s)
+}
+
+// readUsers returns names of users with Terminal Services sessions (this
+// includes console session).
+func readUsers() ([]string, error) {
+	var sessions *wtsSessionInfo
+	var count uint32
+	r1, _, e1 := procWTSEnumerateSessions.Call(0, 0, 1, uintptr(unsafe.Pointer(&sessions)), uintptr(unsafe.Pointer(&count)))
+	if r1 == 0 {
+		return []string{}, e1
+	}
+	defer procWTSFreeMemory.Call(uintptr(unsafe.Pointer(sessions)))
+
+	users := []string{}
+	seen := make(map[string]bool)
+	infos := (*[1 << 16]wtsSessionInfo)(unsafe.Pointer(sessions))[:count:count]
+	for _, info := range infos {
+
+		var name *uint16
+		var nameLen uint32
+		r1, _, _ := procWTSQuerySessionInfo.Call(0, uintptr(info.SessionID), wtsUserName,
+			uintptr(unsafe.Pointer(&name)), uintptr(unsafe.Pointer(&nameLen)))
+		if r1 == 0 {
+			continue
+		}
+		user := utf16PtrToString(name)
+		procWTSFreeMemory.Call(uintptr(unsafe.Pointer(name)))
+		if user == "" || seen[user] {
+			continue
+		}
+		seen[user] = true
+		users = append(users, user)
+	}
+	return users, nil
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results sent using WebSocket are not retried until this time passes to
+// give server chance to acknowledge them.
+const outboxAckWait = 30 * time.Second
+
+// outbox is a directory with undelivered task results, one file per task
+// named TASKID.json.
+type outbox struct {
+	lock    sync.Mutex
+	running bool
+}
+
+func outboxFile(dir string, taskID int) string {
+	return filepath.Join(dir, strconv.Itoa(taskID)+".json")
+}
+
+func (o *outbox) put(dir string, taskID int, result map[string]interface{}) error {
+	blob, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Write to temporary file first so we will not end up with partially
+	// written result if agent is killed.
+	tmp := outboxFile(dir, taskID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, outboxFile(dir, taskID))
+}
+
+func (o *outbox) has(dir string, taskID int) bool {
+	_, err := os.Stat(outboxFile(dir, taskID))
+	return err == nil
+}
+
+func (o *outbox) remove(dir string, taskID int) {
+	if err := os.Remove(outboxFile(dir, taskID)); err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove result from outbox:", err)
+	}
+}
+
+// pending returns IDs of tasks in outbox that were saved before olderThan,
+// oldest first.
+func (o *outbox) pending(dir string, olderThan time.Time) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") || f.ModTime().After(olderThan) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (o *outbox) load(dir string, taskID int) (map[string]interface{}, error) {
+	blob, err := ioutil.ReadFile(outboxFile(dir, taskID))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{})
+	return res, json.Unmarshal(blob, &res)
+}
+
+// startOutbox starts retrying delivery of results from OutboxDir in
+// background unless it is already running. It is called by PollTasks and
+// SendTaskResult so results left from previous runs are not forgotten.
+func (c *Client) startOutbox() {
+	if c.OutboxDir == "" {
+		return
+	}
+
+	c.outbox.lock.Lock()
+	defer c.outbox.lock.Unlock()
+	if c.outbox.running {
+		return
+	}
+	c.outbox.running = true
+	go c.outboxLoop()
+}
+
+func (c *Client) outboxLoop() {
+	retry := Backoff{Min: 5 * time.Second, Max: 5 * time.Minute}
+	for {
+		time.Sleep(retry.Next())
+
+		// Lock is held while checking for emptiness so result put by
+		// SendTaskResult right now will not be left without retries.
+		c.outbox.lock.Lock()
+		all, err := c.outbox.pending(c.OutboxDir, time.Now())
+		if err != nil {
+			log.Println("Failed to read outbox:", err)
+		} else if len(all) == 0 {
+			c.outbox.running = false
+			c.outbox.lock.Unlock()
+			return
+		}
+		c.outbox.lock.Unlock()
+
+		ids, _ := c.outbox.pending(c.OutboxDir, time.Now().Add(-outboxAckWait))
+
+		failed := false
+		for _, id := range ids {
+			if err := c.resendResult(id); err != nil {
+				log.Printf("Failed to deliver task %d result: %v", id, err)
+				failed = true
+				break
+			}
+		}
+
+		if !failed {
+			retry.Reset()
+		}
+	}
+}
+
+func (c *Client) resendResult(taskID int) error {
+	result, err := c.outbox.load(c.OutboxDir, taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Acknowledged in the meantime.
+			return nil
+		}
+		log.Printf("Dropping corrupted task %d result from outbox: %v", taskID, err)
+		c.outbox.remove(c.OutboxDir, taskID)
+		return nil
+	}
+
+	err = c.postTaskResult(taskID, result)
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.Status == http.StatusBadRequest {
+		// Server will never accept it, no point in retrying.
+		log.Printf("Server rejected task %d result, dropping it: %v", taskID, err)
+		c.outbox.remove(c.OutboxDir, taskID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.outbox.remove(c.OutboxDir, taskID)
+	return nil
+}
@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agents serving files to each other (peers), see ServePeers and
+// Client.UsePeers. Server tells which peers have file and SHA-256 of each
+// chunk, every chunk received from peer is checked against it.
+//
+// Peers serve files only to agents that got ticket from server (see
+// PeerTicket), server gives them out along with list of peers. Each peer
+// gets own key for tickets when it announces cache contents.
+
+// Cache contents are announced to server this often, server forgets
+// announcements after 30 minutes.
+const peerAnnounceInterval = 10 * time.Minute
+
+// Chunks are served to at most maxPeerUploads peers at once, others get 503
+// and try other peer or server.
+const maxPeerUploads = 4
+
+// Max. length of single chunk request.
+const maxPeerChunk = 8 << 20
+
+var peerClient = http.Client{Timeout: 30 * time.Second}
+
+// peerState is shared by copies of Client.
+type peerState struct {
+	lock sync.Mutex
+	port int
+	// key is used to check tickets, it's received from server in response
+	// to cache announcement.
+	key []byte
+}
+
+func (ps *peerState) servePort() int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.port
+}
+
+func (ps *peerState) ticketKey() []byte {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.key
+}
+
+// PeerTicket computes ticket that allows to download file with specified
+// SHA-256 from peer with key until expires (Unix time).
+func PeerTicket(key []byte, sum string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", strings.ToLower(sum), expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServePeers starts serving files from Cache to other agents on specified
+// address and periodically announces cache contents to server. If host is
+// omitted (e.g. ":18091"), address used to connect to server is used, so
+// chunks are not served on other networks.
+//
+// Only agents with ticket issued by server can download files.
+func (c *Client) ServePeers(addr string) error {
+	if c.Cache == nil {
+		return errors.New("cache is required to serve peers")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		ip, err := c.localIP()
+		if err != nil {
+			return fmt.Errorf("can't determine address to listen on: %v", err)
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c.peers.lock.Lock()
+	c.peers.port = l.Addr().(*net.TCPAddr).Port
+	c.peers.lock.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/p2p/chunk", c.peerChunkHandler(make(chan struct{}, maxPeerUploads)))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Println("Peer server stopped:", err)
+		}
+	}()
+	go func() {
+		for {
+			if err := c.announceCache(); err != nil {
+				log.Println("Failed to announce cache contents:", err)
+			}
+			time.Sleep(peerAnnounceInterval)
+		}
+	}()
+	log.Println("Serving cached files to peers on", l.Addr())
+	return nil
+}
+
+// localIP returns address of interface used to connect to server.
+func (c *Client) localIP() (net.IP, error) {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	// No packets are sent, UDP "connection" only selects route.
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// checkTicket returns error if request doesn't contain valid ticket for
+// file.
+func (c *Client) checkTicket(sum string, query url.Values) error {
+	key := c.peers.ticketKey()
+	if key == nil {
+		return errors.New("no ticket key")
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return errors.New("invalid expires value")
+	}
+	if time.Now().Unix() > expires {
+		return errors.New("ticket expired")
+	}
+	if !hmac.Equal([]byte(PeerTicket(key, sum, expires)), []byte(query.Get("ticket"))) {
+		return errors.New("invalid ticket")
+	}
+	return nil
+}
+
+// peerChunkHandler handles
+// GET /p2p/chunk?sha256=HEX&offset=N&length=N&expires=UNIX&ticket=HEX.
+func (c *Client) peerChunkHandler(slots chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		sum := r.URL.Query().Get("sha256")
+		if err := c.checkTicket(sum, r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		length, err := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+		if err != nil || length <= 0 || length > maxPeerChunk {
+			http.Error(w, "invalid length", http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			http.Error(w, "too many requests", http.StatusServiceUnavailable)
+			return
+		}
+
+		file, err := c.Cache.Open(sum)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, io.LimitReader(file, length))
+	}
+}
+
+// announceCache sends list of cached files to server.
+func (c *Client) announceCache() error {
+	entries, _, err := c.Cache.Entries()
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, entry.SHA256)
+	}
+	blob, err := json.Marshal(map[string]interface{}{"port": c.peers.servePort(), "files": files})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/p2p", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpError(resp)
+	}
+	reply := struct {
+		Key string `json:"key"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("response decode: %v", err)
+	}
+	key, err := hex.DecodeString(reply.Key)
+	if err != nil || len(key) == 0 {
+		return errors.New("invalid ticket key received")
+	}
+	c.peers.lock.Lock()
+	c.peers.key = key
+	c.peers.lock.Unlock()
+	return nil
+}
+
+// peerTicket is address of peer and ticket for downloading file from it.
+type peerTicket struct {
+	Addr   string `json:"addr"`
+	Ticket string `json:"ticket"`
+}
+
+type chunkManifest struct {
+	SHA256    string       `json:"sha256"`
+	Size      int64        `json:"size"`
+	ChunkSize int64        `json:"chunk_size"`
+	Chunks    []string     `json:"chunks"`
+	Peers     []peerTicket `json:"peers"`
+	// Expires is when tickets expire (Unix time).
+	Expires int64 `json:"expires"`
+}
+
+// peerReader reads file chunk by chunk from peers, falling back to server
+// for chunks peers failed to provide.
+type peerReader struct {
+	c       *Client
+	fileURL string
+	m       chunkManifest
+
+	next int
+	buf  []byte
+	// Peers that failed too many times or sent bad data are not used.
+	failures map[string]int
+
+	fromPeers int64
+}
+
+// openPeers requests list of peers that have file. nil is returned if there
+// are none.
+func (c *Client) openPeers(fileURL string, opts DownloadOptions) (*peerReader, error) {
+	req, err := http.NewRequest("GET", c.baseURL+"/p2p?"+url.Values{"url": {fileURL}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, httpError(resp)
+	}
+	m := chunkManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("response decode: %v", err)
+	}
+
+	if opts.SHA256 != "" && m.SHA256 != strings.ToLower(opts.SHA256) {
+		return nil, fmt.Errorf("file checksum is %s, expected %s", m.SHA256, opts.SHA256)
+	}
+	if m.ChunkSize <= 0 || m.ChunkSize > maxPeerChunk || int64(len(m.Chunks)) != (m.Size+m.ChunkSize-1)/m.ChunkSize {
+		return nil, errors.New("invalid chunk manifest")
+	}
+	if len(m.Peers) == 0 {
+		return nil, nil
+	}
+	return &peerReader{c: c, fileURL: fileURL, m: m, failures: make(map[string]int)}, nil
+}
+
+func (pr *peerReader) Read(b []byte) (int, error) {
+	if len(pr.buf) == 0 {
+		if pr.next == len(pr.m.Chunks) {
+			return 0, io.EOF
+		}
+		chunk, err := pr.fetchChunk(pr.next)
+		if err != nil {
+			return 0, err
+		}
+		pr.buf = chunk
+		pr.next++
+	}
+	n := copy(b, pr.buf)
+	pr.buf = pr.buf[n:]
+	return n, nil
+}
+
+func (pr *peerReader) Close() error {
+	return nil
+}
+
+func (pr *peerReader) fetchChunk(i int) ([]byte, error) {
+	offset := int64(i) * pr.m.ChunkSize
+	length := pr.m.Size - offset
+	if length > pr.m.ChunkSize {
+		length = pr.m.ChunkSize
+	}
+	query := url.Values{}
+	query.Set("sha256", pr.m.SHA256)
+	query.Set("offset", strconv.FormatInt(offset, 10))
+	query.Set("length", strconv.FormatInt(length, 10))
+	query.Set("expires", strconv.FormatInt(pr.m.Expires, 10))
+
+	// Start from different peers for different chunks to spread load.
+	for j := range pr.m.Peers {
+		peer := pr.m.Peers[(i+j)%len(pr.m.Peers)].Addr
+		if pr.failures[peer] >= 2 {
+			continue
+		}
+		query.Set("ticket", pr.m.Peers[(i+j)%len(pr.m.Peers)].Ticket)
+		req, err := http.NewRequest("GET", "http://"+peer+"/p2p/chunk?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := getChunk(&peerClient, req, length, pr.m.Chunks[i])
+		if err == nil {
+			pr.fromPeers += length
+			return chunk, nil
+		}
+		if err == errChunkMismatch {
+			log.Println("Peer", peer, "sent corrupted chunk", i, "of", pr.m.SHA256+", not using it anymore")
+			pr.failures[peer] = 2
+		} else {
+			log.Println("Failed to get chunk", i, "from peer", peer+":", err)
+			pr.failures[peer]++
+		}
+	}
+
+	query.Del("sha256")
+	query.Del("expires")
+	query.Del("ticket")
+	query.Set("url", pr.fileURL)
+	req, err := http.NewRequest("GET", pr.c.baseURL+"/p2p_chunk?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	pr.c.setHeaders(req)
+	chunk, err := getChunk(&pr.c.h, req, length, pr.m.Chunks[i])
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %v", i, err)
+	}
+	return chunk, nil
+}
+
+var errChunkMismatch = errors.New("chunk checksum mismatch")
+
+func getChunk(h *http.Client, req *http.Request, length int64, sum string) ([]byte, error) {
+	resp, err := h.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, httpError(resp)
+	}
+	chunk, err := ioutil.ReadAll(io.LimitReader(resp.Body, length+1))
+	if err != nil {
+		return nil, err
+	}
+	actualSum := sha256.Sum256(chunk)
+	if int64(len(chunk)) != length || hex.EncodeToString(actualSum[:]) != sum {
+		return nil, errChunkMismatch
+	}
+	return chunk, nil
+}
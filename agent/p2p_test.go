@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testChunkSize = 64 << 10
+
+// fakeP2PServer implements parts of server API used by peers.
+type fakeP2PServer struct {
+	lock  sync.Mutex
+	file  []byte
+	sum   string
+	addrs map[string]string
+	keys  map[string][]byte
+
+	fileDownloads  int
+	chunkDownloads int
+}
+
+func (s *fakeP2PServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agentID := r.Header.Get("Authorization")
+
+	switch {
+	case r.URL.Path == "/p2p" && r.Method == http.MethodPost:
+		req := struct {
+			Port int `json:"port"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.keys[agentID] == nil {
+			s.keys[agentID] = make([]byte, 32)
+			rand.Read(s.keys[agentID])
+		}
+		s.addrs[agentID] = "127.0.0.1:" + strconv.Itoa(req.Port)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": false, "key": hex.EncodeToString(s.keys[agentID])})
+	case r.URL.Path == "/p2p":
+		expires := time.Now().Add(time.Hour).Unix()
+		m := chunkManifest{SHA256: s.sum, Size: int64(len(s.file)), ChunkSize: testChunkSize, Chunks: []string{}, Expires: expires}
+		for offset := 0; offset < len(s.file); offset += testChunkSize {
+			end := offset + testChunkSize
+			if end > len(s.file) {
+				end = len(s.file)
+			}
+			sum := sha256.Sum256(s.file[offset:end])
+			m.Chunks = append(m.Chunks, hex.EncodeToString(sum[:]))
+		}
+		for peerID, addr := range s.addrs {
+			if peerID != agentID {
+				m.Peers = append(m.Peers, peerTicket{Addr: addr, Ticket: PeerTicket(s.keys[peerID], s.sum, expires)})
+			}
+		}
+		json.NewEncoder(w).Encode(m)
+	case r.URL.Path == "/p2p_chunk":
+		s.chunkDownloads++
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		length, _ := strconv.Atoi(r.URL.Query().Get("length"))
+		w.Write(s.file[offset : offset+length])
+	case r.URL.Path == "/filedrop/test-uuid":
+		s.fileDownloads++
+		w.Write(s.file)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeP2PServer) peersCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.addrs)
+}
+
+// newTestPeer creates agent with file in cache, if data is not nil.
+func newTestPeer(t *testing.T, baseURL, id string, data []byte, sum string) *Client {
+	dir := tempDir(t)
+	c := NewClient(baseURL)
+	c.UseAccount(id)
+	c.Cache = &Cache{Dir: filepath.Join(dir, "cache")}
+	c.UsePeers = true
+	if data != nil {
+		src := filepath.Join(dir, "src")
+		if err := ioutil.WriteFile(src, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Cache.Add(src, sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &c
+}
+
+func TestPeersDownload(t *testing.T) {
+	data := make([]byte, 5*testChunkSize+123)
+	rand.Read(data)
+	rawSum := sha256.Sum256(data)
+	sum := hex.EncodeToString(rawSum[:])
+
+	fake := &fakeP2PServer{file: data, sum: sum, addrs: make(map[string]string), keys: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	var peers []*Client
+	for _, id := range []string{"peer1", "peer2"} {
+		peer := newTestPeer(t, srv.URL, id, data, sum)
+		defer os.RemoveAll(filepath.Dir(peer.Cache.Dir))
+		if err := peer.ServePeers("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+	}
+	for start := time.Now(); fake.peersCount() != 2 || peers[0].peers.ticketKey() == nil || peers[1].peers.ticketKey() == nil; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("peers didn't announce themselves")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c := newTestPeer(t, srv.URL, "downloader", nil, "")
+	defer os.RemoveAll(filepath.Dir(c.Cache.Dir))
+	out := filepath.Join(filepath.Dir(c.Cache.Dir), "out")
+	res, err := c.DownloadFile(srv.URL+"/filedrop/test-uuid", out, DownloadOptions{SHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FromPeers != int64(len(data)) {
+		t.Fatalf("%d bytes received from peers, expected %d", res.FromPeers, len(data))
+	}
+	if fake.fileDownloads != 0 || fake.chunkDownloads != 0 {
+		t.Fatal("file was downloaded from server")
+	}
+	received, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != string(data) {
+		t.Fatal("wrong file contents")
+	}
+
+	// Requests without valid ticket are rejected.
+	peerAddr := "http://127.0.0.1:" + strconv.Itoa(peers[0].peers.servePort())
+	key := peers[0].peers.ticketKey()
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	otherSum := hex.EncodeToString(make([]byte, 32))
+	cases := []struct {
+		name    string
+		sum     string
+		expires int64
+		ticket  string
+		status  int
+	}{
+		{"no ticket", sum, future, "", http.StatusForbidden},
+		{"wrong key", sum, future, PeerTicket([]byte("wrong"), sum, future), http.StatusForbidden},
+		{"expired", sum, past, PeerTicket(key, sum, past), http.StatusForbidden},
+		{"other file", sum, future, PeerTicket(key, otherSum, future), http.StatusForbidden},
+		{"extended expiry", sum, future + 1, PeerTicket(key, sum, future), http.StatusForbidden},
+		{"valid", sum, future, PeerTicket(key, sum, future), http.StatusOK},
+	}
+	for _, c := range cases {
+		resp, err := http.Get(peerAddr + "/p2p/chunk?sha256=" + c.sum + "&offset=0&length=10&expires=" +
+			strconv.FormatInt(c.expires, 10) + "&ticket=" + c.ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, expected %d", c.name, resp.StatusCode, c.status)
+		}
+	}
+}
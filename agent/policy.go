@@ -0,0 +1,405 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Policy restricts tasks agent is allowed to execute. It is read from local
+// file so it can't be changed through server.
+//
+// Example:
+//
+//	deny_tasks: [screenshot]
+//	allow_commands:
+//	  - 'ipconfig( /all)?'
+//	  - 'shutdown /r /t \d+'
+//	allow_paths:
+//	  - 'C:\Users\Public'
+//	deny_paths:
+//	  - 'C:\Users\Public\Secret'
+//	allow_tunnels:
+//	  - '127.0.0.1:5900'
+//	  - '10.1.2.0/24:80-443'
+type Policy struct {
+	// If AllowTasks is not empty, only listed task types are allowed.
+	AllowTasks []string `yaml:"allow_tasks"`
+	DenyTasks  []string `yaml:"deny_tasks"`
+
+	// If AllowCommands is not empty, commands must fully match one of these
+	// regular expressions. DenyCommands is checked after it. If either is
+	// set, fields listed in RestrictedCommandFields and InteractiveTasks
+	// can't be used since they would bypass the check.
+	AllowCommands []string `yaml:"allow_commands"`
+	DenyCommands  []string `yaml:"deny_commands"`
+
+	// If AllowPaths is not empty, file tasks can only access files inside
+	// of these directories. DenyPaths is checked after it.
+	AllowPaths []string `yaml:"allow_paths"`
+	DenyPaths  []string `yaml:"deny_paths"`
+
+	// If AllowTunnels is not empty, tunnels can be opened only to addresses
+	// matching one of these "HOST:PORT" patterns. DenyTunnels is checked
+	// after it. HOST is IP address, CIDR subnet, host name or "*", PORT is
+	// port number, range ("8000-8100") or "*". IPv6 addresses should be
+	// enclosed in brackets.
+	AllowTunnels []string `yaml:"allow_tunnels"`
+	DenyTunnels  []string `yaml:"deny_tunnels"`
+
+	allowCmds    []*regexp.Regexp
+	denyCmds     []*regexp.Regexp
+	allowTunnels []tunnelRule
+	denyTunnels  []tunnelRule
+}
+
+// CommandFields lists task fields checked against AllowCommands and
+// DenyCommands.
+var CommandFields = map[string][]string{
+	"execute_cmd": {"cmd"},
+	"spawn_job":   {"cmd"},
+}
+
+// RestrictedCommandFields lists task fields that change how command is
+// interpreted (e.g. PATH in environment) or feed it commands that are not
+// checked (stdin of allowed interpreter), they are not allowed if
+// AllowCommands or DenyCommands is set.
+var RestrictedCommandFields = map[string][]string{
+	"execute_cmd": {"env", "shell", "stdin"},
+	"spawn_job":   {"env", "shell", "stdin"},
+}
+
+// InteractiveTasks lists task types that allow running arbitrary commands
+// without checking them, they are not allowed if AllowCommands or
+// DenyCommands is set.
+var InteractiveTasks = []string{"shell", "run_script"}
+
+// PathFields lists task fields checked against AllowPaths and DenyPaths.
+// Agents implementing own file tasks should add them here.
+var PathFields = map[string][]string{
+	"deletefile":      {"path"},
+	"movefile":        {"frompath", "topath"},
+	"downloadfile":    {"out"},
+	"uploadfile":      {"path"},
+	"uploaddir":       {"dir"},
+	"downloadarchive": {"dir"},
+	"readfile":        {"path"},
+	"writefile":       {"path"},
+	"dircontents":     {"dir"},
+	"findfiles":       {"dir"},
+	"execute_cmd":     {"cwd"},
+	"shell":           {"cwd"},
+	"spawn_job":       {"cwd"},
+	"run_script":      {"cwd"},
+}
+
+// LoadPolicy reads policy from YAML file.
+func LoadPolicy(path string) (*Policy, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := Policy{}
+	if err := yaml.UnmarshalStrict(blob, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	p.allowCmds, err = compileCommands(p.AllowCommands)
+	if err != nil {
+		return nil, fmt.Errorf("%s: allow_commands: %v", path, err)
+	}
+	p.denyCmds, err = compileCommands(p.DenyCommands)
+	if err != nil {
+		return nil, fmt.Errorf("%s: deny_commands: %v", path, err)
+	}
+	p.allowTunnels, err = parseTunnelRules(p.AllowTunnels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: allow_tunnels: %v", path, err)
+	}
+	p.denyTunnels, err = parseTunnelRules(p.DenyTunnels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: deny_tunnels: %v", path, err)
+	}
+	return &p, nil
+}
+
+func compileCommands(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		// Pattern should match entire command, otherwise 'ipconfig' would
+		// allow 'ipconfig & del /Q C:\'.
+		re, err := regexp.Compile(`^(?:` + expr + `)$`)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Check returns error if task is not allowed by policy.
+func (p *Policy) Check(type_ string, body map[string]interface{}) error {
+	if len(p.AllowTasks) != 0 && !contains(p.AllowTasks, type_) {
+		return errors.New("task type " + type_ + " is not allowed")
+	}
+	if contains(p.DenyTasks, type_) {
+		return errors.New("task type " + type_ + " is denied")
+	}
+
+	for _, field := range CommandFields[type_] {
+		cmd, ok := body[field].(string)
+		if !ok {
+			continue
+		}
+		if err := p.checkCommand(cmd); err != nil {
+			return err
+		}
+	}
+
+	if len(p.allowCmds) != 0 || len(p.denyCmds) != 0 {
+		if contains(InteractiveTasks, type_) {
+			return errors.New("task type " + type_ + " can't be used with restricted commands")
+		}
+		for _, field := range RestrictedCommandFields[type_] {
+			if _, prs := body[field]; prs {
+				return errors.New(field + " can't be used with restricted commands")
+			}
+		}
+	}
+
+	for _, field := range PathFields[type_] {
+		val, prs := body[field]
+		if !prs {
+			continue
+		}
+		path, ok := val.(string)
+		if !ok {
+			return errors.New(field + " should be string")
+		}
+		if err := p.CheckPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Policy) checkCommand(cmd string) error {
+	if len(p.allowCmds) != 0 {
+		allowed := false
+		for _, re := range p.allowCmds {
+			if re.MatchString(cmd) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("command is not allowed: " + cmd)
+		}
+	}
+	for _, re := range p.denyCmds {
+		if re.MatchString(cmd) {
+			return errors.New("command is denied: " + cmd)
+		}
+	}
+	return nil
+}
+
+// CheckPath returns error if access to path is not allowed by policy.
+func (p *Policy) CheckPath(path string) error {
+	if len(p.AllowPaths) == 0 && len(p.DenyPaths) == 0 {
+		return nil
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+
+	if len(p.AllowPaths) != 0 {
+		allowed := false
+		for _, dir := range p.AllowPaths {
+			if pathInside(resolved, dir) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("access to " + path + " is not allowed")
+		}
+	}
+	for _, dir := range p.DenyPaths {
+		if pathInside(resolved, dir) {
+			return errors.New("access to " + path + " is denied")
+		}
+	}
+	return nil
+}
+
+// resolvePath makes path absolute and resolves symlinks so they can't be
+// used to escape allowed directories. For non-existent files (i.e.
+// destination of download) nearest existing parent is resolved.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+func pathInside(path, dir string) bool {
+	dir, err := resolvePath(dir)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		path, dir = strings.ToLower(path), strings.ToLower(dir)
+	}
+	if path == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir)
+}
+
+type tunnelRule struct {
+	// Empty host and nil subnet match everything.
+	host     string
+	subnet   *net.IPNet
+	fromPort int
+	toPort   int
+}
+
+func parseTunnelRules(patterns []string) ([]tunnelRule, error) {
+	res := make([]tunnelRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		host, port, err := net.SplitHostPort(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rule := tunnelRule{fromPort: 1, toPort: 65535}
+		switch {
+		case host == "*":
+		case strings.Contains(host, "/"):
+			_, rule.subnet, err = net.ParseCIDR(host)
+			if err != nil {
+				return nil, err
+			}
+		case net.ParseIP(host) != nil:
+			ip := net.ParseIP(host)
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rule.subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		default:
+			rule.host = strings.ToLower(host)
+		}
+
+		if port != "*" {
+			parts := strings.SplitN(port, "-", 2)
+			if rule.fromPort, err = strconv.Atoi(parts[0]); err != nil {
+				return nil, fmt.Errorf("invalid port in %s", pattern)
+			}
+			rule.toPort = rule.fromPort
+			if len(parts) == 2 {
+				if rule.toPort, err = strconv.Atoi(parts[1]); err != nil {
+					return nil, fmt.Errorf("invalid port in %s", pattern)
+				}
+			}
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+func (r tunnelRule) match(host string, ip net.IP, port int) bool {
+	if port < r.fromPort || port > r.toPort {
+		return false
+	}
+	if r.subnet != nil {
+		return r.subnet.Contains(ip)
+	}
+	return r.host == "" || r.host == strings.ToLower(host)
+}
+
+// CheckTunnel returns error if tunnel to host:port is not allowed by policy.
+// ip is address host resolves to, it's what will be actually used, so host
+// name can't be used to reach denied subnet.
+func (p *Policy) CheckTunnel(host string, ip net.IP, port int) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if len(p.allowTunnels) != 0 {
+		allowed := false
+		for _, rule := range p.allowTunnels {
+			if rule.match(host, ip, port) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("tunnel to " + addr + " is not allowed")
+		}
+	}
+	for _, rule := range p.denyTunnels {
+		if rule.match(host, ip, port) {
+			return errors.New("tunnel to " + addr + " is denied")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
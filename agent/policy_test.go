@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyRestrictedCommandFields(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yml")
+	if err := ioutil.WriteFile(path, []byte("allow_commands: ['sh', 'ipconfig']\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, type_ := range []string{"execute_cmd", "spawn_job"} {
+		if err := p.Check(type_, map[string]interface{}{"cmd": "ipconfig"}); err != nil {
+			t.Errorf("%s: allowed command denied: %v", type_, err)
+		}
+		if err := p.Check(type_, map[string]interface{}{"cmd": "del C:\\boot.ini"}); err == nil {
+			t.Errorf("%s: command not in allow_commands accepted", type_)
+		}
+		for _, field := range []string{"env", "shell", "stdin"} {
+			body := map[string]interface{}{"cmd": "sh", field: "rm -rf /"}
+			if err := p.Check(type_, body); err == nil {
+				t.Errorf("%s: %s accepted with restricted commands", type_, field)
+			}
+		}
+	}
+}
+
+func TestPolicyDenyCommandsInteractive(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yml")
+	if err := ioutil.WriteFile(path, []byte("deny_commands: ['del .*']\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Check("execute_cmd", map[string]interface{}{"cmd": "ipconfig"}); err != nil {
+		t.Error("command not in deny_commands denied:", err)
+	}
+	if err := p.Check("execute_cmd", map[string]interface{}{"cmd": "del C:\\boot.ini"}); err == nil {
+		t.Error("command in deny_commands accepted")
+	}
+	if err := p.Check("execute_cmd", map[string]interface{}{"cmd": "cmd", "stdin": "del C:\\boot.ini"}); err == nil {
+		t.Error("stdin accepted with deny_commands")
+	}
+	for _, type_ := range InteractiveTasks {
+		if err := p.Check(type_, map[string]interface{}{"script": "del C:\\boot.ini"}); err == nil {
+			t.Errorf("%s accepted with deny_commands", type_)
+		}
+	}
+}
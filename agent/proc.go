@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Process describes OS process.
+type Process struct {
+	PID  int    `json:"id"`
+	PPID int    `json:"ppid"`
+	Name string `json:"name"`
+	User string `json:"user"`
+	// Command line, only path to executable is available on Windows.
+	Cmdline string `json:"cmdline"`
+	// CPU is load created by process in percents of one CPU core.
+	CPU float64 `json:"cpu"`
+	// Memory is resident set size (working set on Windows) in bytes.
+	Memory uint64 `json:"memory"`
+	// Started is UNIX timestamp, zero if unknown.
+	Started int64 `json:"started"`
+
+	// Total CPU time used by process, used to calculate CPU.
+	cpuTime time.Duration
+}
+
+// ListProcesses returns all processes sorted by PID. It takes about a second
+// because CPU load is measured.
+func ListProcesses() ([]Process, error) {
+	before, err := readProcesses()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	time.Sleep(time.Second)
+	procs, err := readProcesses()
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	type procKey struct {
+		pid     int
+		started int64
+	}
+	cpuTimes := make(map[procKey]time.Duration, len(before))
+	for _, p := range before {
+		cpuTimes[procKey{p.PID, p.Started}] = p.cpuTime
+	}
+	for i, p := range procs {
+		prev, ok := cpuTimes[procKey{p.PID, p.Started}]
+		if !ok || p.cpuTime < prev {
+			continue
+		}
+		procs[i].CPU = 100 * float64(p.cpuTime-prev) / float64(elapsed)
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].PID < procs[j].PID
+	})
+	return procs, nil
+}
+
+// KillOptions describes processes killed by KillProcesses.
+type KillOptions struct {
+	// PID of process, if zero, Name is used.
+	PID int
+	// Name is glob pattern (see path.Match) matched against process names,
+	// case-insensitively on Windows.
+	Name string
+	// Signal is "term" (default), "kill", "int", "hup", "quit", "usr1" or
+	// "usr2". Only "term" and "kill" are supported on Windows, both
+	// terminate process forcibly.
+	Signal string
+	// If Tree is true, all descendants of matched processes are killed too.
+	Tree bool
+}
+
+// KillResult describes outcome of KillProcesses. Processes are listed in
+// order signals were sent.
+type KillResult struct {
+	Killed []Process
+	// Errors maps PIDs of processes that can't be killed to errors.
+	Errors map[int]string
+}
+
+// ParseKillProc reads fields of killproc task.
+func ParseKillProc(body map[string]interface{}) (KillOptions, error) {
+	opts := KillOptions{}
+	var ok bool
+	if val, prs := body["pid"]; prs {
+		pid, ok := val.(float64)
+		if !ok || pid <= 0 || pid != float64(int(pid)) {
+			return opts, errors.New("pid should be positive integer")
+		}
+		opts.PID = int(pid)
+	}
+	if val, prs := body["name"]; prs {
+		if opts.Name, ok = val.(string); !ok {
+			return opts, errors.New("name should be string")
+		}
+		if _, err := path.Match(opts.Name, ""); err != nil {
+			return opts, errors.New("invalid name pattern")
+		}
+	}
+	if (opts.PID == 0) == (opts.Name == "") {
+		return opts, errors.New("either pid or name should be specified")
+	}
+	if val, prs := body["signal"]; prs {
+		if opts.Signal, ok = val.(string); !ok {
+			return opts, errors.New("signal should be string")
+		}
+		if _, ok := processSignals[opts.Signal]; !ok {
+			return opts, fmt.Errorf("unknown signal: %s", opts.Signal)
+		}
+	}
+	if val, prs := body["tree"]; prs {
+		if opts.Tree, ok = val.(bool); !ok {
+			return opts, errors.New("tree should be boolean")
+		}
+	}
+	return opts, nil
+}
+
+func matchProcessName(pattern, name string) bool {
+	if runtime.GOOS == "windows" {
+		pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// KillProcesses sends signal to processes matching opts. Agent never kills
+// itself. Error is returned only if no processes matched or process list
+// can't be read, failures to kill particular processes are reported in
+// result.
+func KillProcesses(opts KillOptions) (KillResult, error) {
+	res := KillResult{Killed: []Process{}, Errors: map[int]string{}}
+	if opts.Signal == "" {
+		opts.Signal = "term"
+	}
+	sig, ok := processSignals[opts.Signal]
+	if !ok {
+		return res, fmt.Errorf("unknown signal: %s", opts.Signal)
+	}
+
+	procs, err := readProcesses()
+	if err != nil {
+		return res, err
+	}
+	targets := killTargets(procs, opts, os.Getpid())
+	if len(targets) == 0 {
+		return res, errors.New("no matching processes")
+	}
+
+	for _, p := range targets {
+		if err := signalProcess(p.PID, sig); err != nil {
+			res.Errors[p.PID] = err.Error()
+		} else {
+			res.Killed = append(res.Killed, p)
+		}
+	}
+	return res, nil
+}
+
+// killTargets returns processes matching opts in order they should be
+// signalled. Parents go before children, so they have less chances to
+// restart killed children. Process self is never included.
+func killTargets(procs []Process, opts KillOptions, self int) []Process {
+	children := make(map[int][]Process)
+	var queue []Process
+	for _, p := range procs {
+		if p.PID == self {
+			continue
+		}
+		if p.PPID != p.PID {
+			children[p.PPID] = append(children[p.PPID], p)
+		}
+		if (opts.PID != 0 && p.PID == opts.PID) || (opts.Name != "" && matchProcessName(opts.Name, p.Name)) {
+			queue = append(queue, p)
+		}
+	}
+
+	var targets []Process
+	seen := make(map[int]bool)
+	for len(queue) != 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p.PID] {
+			continue
+		}
+		seen[p.PID] = true
+		targets = append(targets, p)
+
+		if !opts.Tree {
+			continue
+		}
+		for _, child := range children[p.PID] {
+			// Parent of orphaned process exited and it's PID was reused
+			// by process started later, which is not a real parent.
+			if p.Started != 0 && child.Started != 0 && child.Started < p.Started {
+				continue
+			}
+			queue = append(queue, child)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Process times in /proc are in clock ticks, USER_HZ is 100 on all
+// architectures.
+const clockTicks = 100
+
+func readProcesses() ([]Process, error) {
+	bootTime, err := readBootTime()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	procs := make([]Process, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		p, err := readProcess(pid, bootTime, users)
+		if err != nil {
+			// Process exited while we were reading it.
+			continue
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+func readProcess(pid int, bootTime int64, users map[string]string) (Process, error) {
+	p := Process{PID: pid}
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return p, err
+	}
+	// Name may contain spaces and parentheses, so we look for last ')'.
+	nameStart, nameEnd := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if nameStart == -1 || nameEnd < nameStart {
+		return p, errors.New("malformed stat file")
+	}
+	p.Name = string(stat[nameStart+1 : nameEnd])
+	// Fields starting from 3rd (state).
+	fields := strings.Fields(string(stat[nameEnd+1:]))
+	if len(fields) < 22 {
+		return p, errors.New("malformed stat file")
+	}
+	nums := make(map[int]uint64)
+	for _, i := range []int{1, 11, 12, 19, 21} {
+		nums[i], err = strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return p, errors.New("malformed stat file")
+		}
+	}
+	p.PPID = int(nums[1])
+	p.cpuTime = time.Duration(nums[11]+nums[12]) * time.Second / clockTicks
+	p.Started = bootTime + int64(nums[19]/clockTicks)
+	p.Memory = nums[21] * uint64(os.Getpagesize())
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return p, err
+	}
+	p.Cmdline = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+
+	uid, err := readProcessUID(filepath.Join(dir, "status"))
+	if err != nil {
+		return p, err
+	}
+	if name, ok := users[uid]; ok {
+		p.User = name
+	} else {
+		p.User = uid
+		if u, err := user.LookupId(uid); err == nil {
+			p.User = u.Username
+		}
+		users[uid] = p.User
+	}
+	return p, nil
+}
+
+// readProcessUID returns real UID of process from status file.
+func readProcessUID(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		fields := strings.Fields(scnr.Text())
+		if len(fields) >= 2 && fields[0] == "Uid:" {
+			return fields[1], nil
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no Uid in status file")
+}
+
+// readBootTime returns UNIX timestamp of system boot from /proc/stat.
+func readBootTime() (int64, error) {
+	f, err := os.Open(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		fields := strings.Fields(scnr.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no btime in stat file")
+}
+
+// processStarted returns start time of process as UNIX timestamp, zero if
+// it's unknown.
+func processStarted(pid int) int64 {
+	bootTime, err := readBootTime()
+	if err != nil {
+		return 0
+	}
+	p, err := readProcess(pid, bootTime, map[string]string{})
+	if err != nil {
+		return 0
+	}
+	return p.Started
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const fixtureBootTime = 1546300800
+
+func TestReadProcesses(t *testing.T) {
+	useProcFixture(t, "proc")
+	procs, err := readProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byPID := make(map[int]Process)
+	for _, p := range procs {
+		byPID[p.PID] = p
+	}
+	if _, ok := byPID[500]; ok {
+		t.Error("process with malformed stat listed")
+	}
+	if len(procs) != 7 {
+		t.Fatal("expected 7 processes, got", len(procs))
+	}
+
+	p := byPID[201]
+	expected := Process{
+		PID:     201,
+		PPID:    200,
+		Name:    "my (weird) name",
+		User:    "4242",
+		Cmdline: "./my (weird) name --flag",
+		Memory:  800 * uint64(os.Getpagesize()),
+		Started: fixtureBootTime + 1000,
+		cpuTime: 20 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("expected %+v, got %+v", expected, p)
+	}
+
+	if p := byPID[1]; p.User != "root" || p.Cmdline != "/sbin/init splash" || p.Started != fixtureBootTime {
+		t.Errorf("wrong init process: %+v", p)
+	}
+	if p := byPID[2]; p.Cmdline != "" || p.Name != "kthreadd" {
+		t.Errorf("wrong kernel thread: %+v", p)
+	}
+}
+
+func TestKillTargetsFixture(t *testing.T) {
+	useProcFixture(t, "proc")
+	procs, err := readProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pids := func(procs []Process) []int {
+		res := []int{}
+		for _, p := range procs {
+			res = append(res, p.PID)
+		}
+		return res
+	}
+
+	// 201 started in the same second as 200, it's still a child.
+	if targets := pids(killTargets(procs, KillOptions{PID: 100, Tree: true}, 0)); !reflect.DeepEqual(targets, []int{100, 200, 201}) {
+		t.Error("wrong targets for sshd tree:", targets)
+	}
+	// 300 is older than 400, PID of it's parent was reused.
+	if targets := pids(killTargets(procs, KillOptions{PID: 400, Tree: true}, 0)); !reflect.DeepEqual(targets, []int{400}) {
+		t.Error("wrong targets for reused PID:", targets)
+	}
+	// Agent itself is never killed.
+	if targets := pids(killTargets(procs, KillOptions{PID: 100, Tree: true}, 200)); !reflect.DeepEqual(targets, []int{100}) {
+		t.Error("wrong targets with agent in tree:", targets)
+	}
+}
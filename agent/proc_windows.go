@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	procQueryFullProcessImageName = modKernel32.NewProc("QueryFullProcessImageNameW")
+	procK32GetProcessMemoryInfo   = modKernel32.NewProc("K32GetProcessMemoryInfo")
+)
+
+// PROCESS_QUERY_LIMITED_INFORMATION is missing in syscall package. Unlike
+// PROCESS_QUERY_INFORMATION it's granted for most processes of other users.
+const processQueryLimitedInformation = 0x1000
+
+// PROCESS_MEMORY_COUNTERS
+type processMemoryCounters struct {
+	CB                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+func readProcesses() ([]Process, error) {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	entry := syscall.ProcessEntry32{}
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	if err := syscall.Process32First(snapshot, &entry); err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	procs := []Process{}
+	for {
+		p := Process{
+			PID:  int(entry.ProcessID),
+			PPID: int(entry.ParentProcessID),
+			Name: syscall.UTF16ToString(entry.ExeFile[:]),
+		}
+		readProcessDetails(&p, users)
+		procs = append(procs, p)
+
+		if err := syscall.Process32Next(snapshot, &entry); err != nil {
+			if err == syscall.ERROR_NO_MORE_FILES {
+				break
+			}
+			return nil, err
+		}
+	}
+	return procs, nil
+}
+
+// readProcessDetails fills fields of Process that require opening process.
+// Some system processes can't be opened even by SYSTEM, these fields are
+// left empty for them.
+func readProcessDetails(p *Process, users map[string]string) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(p.PID))
+	if err != nil {
+		return
+	}
+	defer syscall.CloseHandle(h)
+
+	var created, exited, kernelTime, userTime syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &created, &exited, &kernelTime, &userTime); err == nil {
+		if created.HighDateTime != 0 || created.LowDateTime != 0 {
+			p.Started = created.Nanoseconds() / int64(time.Second)
+		}
+		// FILETIME durations are in 100-nanosecond intervals.
+		p.cpuTime = time.Duration(filetimeToUint64(kernelTime)+filetimeToUint64(userTime)) * 100
+	}
+
+	counters := processMemoryCounters{}
+	counters.CB = uint32(unsafe.Sizeof(counters))
+	r1, _, _ := procK32GetProcessMemoryInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&counters)), uintptr(counters.CB))
+	if r1 != 0 {
+		p.Memory = uint64(counters.WorkingSetSize)
+	}
+
+	buf := make([]uint16, 1024)
+	size := uint32(len(buf))
+	r1, _, _ = procQueryFullProcessImageName.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r1 != 0 {
+		p.Cmdline = syscall.UTF16ToString(buf[:size])
+	}
+
+	var token syscall.Token
+	if err := syscall.OpenProcessToken(h, syscall.TOKEN_QUERY, &token); err != nil {
+		return
+	}
+	defer token.Close()
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		return
+	}
+	sid, err := tokenUser.User.Sid.String()
+	if err != nil {
+		return
+	}
+	if name, ok := users[sid]; ok {
+		p.User = name
+		return
+	}
+	p.User = sid
+	if account, domain, _, err := tokenUser.User.Sid.LookupAccount(""); err == nil {
+		p.User = domain + `\` + account
+	}
+	users[sid] = p.User
+}
+
+// processStarted returns start time of process as UNIX timestamp, zero if
+// it's unknown.
+func processStarted(pid int) int64 {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return 0
+	}
+	defer syscall.CloseHandle(h)
+	var created, exited, kernelTime, userTime syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &created, &exited, &kernelTime, &userTime); err != nil {
+		return 0
+	}
+	if created.HighDateTime == 0 && created.LowDateTime == 0 {
+		return 0
+	}
+	return created.Nanoseconds() / int64(time.Second)
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrAccessDenied is returned when server rejects agent's credentials (HTTP
+// 403). Usually it means that agent was removed by admin.
+var ErrAccessDenied = errors.New("access denied")
+
+// HTTPError is returned when server responds with unexpected status code.
+type HTTPError struct {
+	Status int
+	Msg    string
+	// RetryAfter is set if server sent Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return e.Msg
+}
+
+// Temporary reports whether request may succeed if retried later.
+func (e *HTTPError) Temporary() bool {
+	return e.Status/100 == 5 || e.Status == http.StatusTooManyRequests
+}
+
+// httpError converts non-2xx response to error.
+func httpError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusForbidden:
+		return ErrAccessDenied
+	case http.StatusUpgradeRequired:
+		return ErrUpdateRequired
+	}
+	err := &HTTPError{Status: resp.StatusCode, Msg: errorMessage(resp)}
+	if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+		err.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return err
+}
+
+// Backoff computes delays between retries: exponential growth from Min to
+// Max with random jitter, so agents don't reconnect in lockstep after server
+// restart.
+type Backoff struct {
+	// 1 second by default.
+	Min time.Duration
+	// 5 minutes by default.
+	Max time.Duration
+
+	attempt uint
+}
+
+// Next returns delay before next attempt.
+func (b *Backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min == 0 {
+		min = time.Second
+	}
+	if max == 0 {
+		max = 5 * time.Minute
+	}
+
+	d := min
+	for i := uint(0); i < b.attempt && d < max; i++ {
+		// Compare with max/2 instead of doubling first to avoid overflow.
+		if d >= max/2 {
+			d = max
+			break
+		}
+		d *= 2
+	}
+	if d >= max {
+		d = max
+	} else {
+		// No need to count attempts after reaching max.
+		b.attempt++
+	}
+
+	// "Equal jitter": half of delay is fixed, other half is random.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Reset should be called after successful attempt.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// NextTask calls PollTasks until task is received, retrying failed requests
+// with delays computed by c.Reconnect:
+//   - Network errors are retried with exponential backoff.
+//   - 5xx errors are retried with exponential backoff, but not sooner than
+//     server asked in Retry-After.
+//   - Other unexpected responses are retried after maximum delay since they
+//     probably will not go away soon.
+//   - Tasks rejected by PollTasks are reported to server as failed.
+//
+// ErrAccessDenied is returned after OnCredentialsRevoked hook is called.
+// ErrUpdateRequired is returned as is.
+func (c *Client) NextTask() (id int, type_ string, body map[string]interface{}, err error) {
+	for {
+		id, type_, body, err = c.PollTasks()
+		if err == nil {
+			c.Reconnect.Reset()
+			if id == -1 {
+				continue
+			}
+			return id, type_, body, nil
+		}
+
+		if id != -1 {
+			// Server is fine, it's task that is bad.
+			log.Printf("Rejected task %d: %v", id, err)
+			c.Reconnect.Reset()
+			go c.SendTaskResult(id, map[string]interface{}{"error": true, "msg": err.Error()})
+			continue
+		}
+
+		switch err {
+		case ErrAccessDenied:
+			if c.OnCredentialsRevoked != nil {
+				c.OnCredentialsRevoked()
+			}
+			return -1, "", nil, err
+		case ErrUpdateRequired:
+			return -1, "", nil, err
+		}
+
+		delay := c.Reconnect.Next()
+		if httpErr, ok := err.(*HTTPError); ok {
+			if !httpErr.Temporary() {
+				delay = c.Reconnect.Max
+				if delay == 0 {
+					delay = 5 * time.Minute
+				}
+			} else if httpErr.RetryAfter > delay {
+				delay = httpErr.RetryAfter
+			}
+		}
+		log.Printf("Error during task polling: %v, retrying in %v", err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNoOverflow(t *testing.T) {
+	for _, b := range []Backoff{
+		{},
+		{Min: 5 * time.Second},
+		{Min: time.Minute, Max: time.Hour},
+		{Min: time.Second, Max: 1<<63 - 1},
+		{Min: time.Hour, Max: time.Minute},
+	} {
+		max := b.Max
+		if max == 0 {
+			max = 5 * time.Minute
+		}
+		for i := 0; i < 100; i++ {
+			d := b.Next()
+			if d <= 0 || d > max {
+				t.Fatalf("Min=%v Max=%v: attempt %d: delay %v out of range", b.Min, b.Max, i, d)
+			}
+		}
+	}
+}
+
+func TestBackoffGrowth(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: time.Minute}
+	prevMax := time.Duration(0)
+	for i := 0; i < 10; i++ {
+		d := b.Next()
+		// Delay is between d/2 and d for current step.
+		if d < prevMax/2 {
+			t.Fatalf("attempt %d: delay %v is smaller than expected", i, d)
+		}
+		prevMax = d
+	}
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Fatalf("delay after Reset is %v, want <= 1s", d)
+	}
+}
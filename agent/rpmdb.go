@@ -0,0 +1,557 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// RPM database is parsed directly so inventory doesn't depend on rpm binary.
+// Two formats are supported: SQLite (rpmdb.sqlite, used since rpm 4.16) and
+// Berkeley DB hash (Packages, used before). Both just store package headers
+// as blobs, only what is needed to get them is implemented here.
+
+// Tags and types of RPM header entries.
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// Sanity limit for size of single header.
+const rpmMaxHeaderSize = 64 << 20
+
+// readRpmDB returns packages listed in RPM database file, format is
+// detected using file name.
+func readRpmDB(path string) ([]Package, error) {
+	var blobs [][]byte
+	var err error
+	if strings.HasSuffix(path, ".sqlite") {
+		blobs, err = readRpmSqlite(path)
+	} else {
+		blobs, err = readRpmBDB(path)
+	}
+	if err != nil {
+		return []Package{}, err
+	}
+
+	pkgs := make([]Package, 0, len(blobs))
+	for _, blob := range blobs {
+		pkg, err := parseRpmHeader(blob)
+		if err != nil {
+			return []Package{}, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// parseRpmHeader extracts package name and version (VERSION-RELEASE, same
+// as rpm -q shows) from header blob as stored in database.
+//
+// Blob starts with number of index entries and size of data (big-endian
+// uint32), then 16-byte index entries (tag, type, offset, count) follow,
+// then data.
+func parseRpmHeader(blob []byte) (Package, error) {
+	pkg := Package{}
+	if len(blob) < 8 {
+		return pkg, errors.New("rpm header is too short")
+	}
+	il := uint64(binary.BigEndian.Uint32(blob[0:4]))
+	dl := uint64(binary.BigEndian.Uint32(blob[4:8]))
+	dataStart := 8 + il*16
+	if dataStart+dl > uint64(len(blob)) {
+		return pkg, errors.New("rpm header is truncated")
+	}
+	data := blob[dataStart : dataStart+dl]
+
+	release := ""
+	for i := uint64(0); i < il; i++ {
+		entry := blob[8+i*16 : 8+i*16+16]
+		tag := binary.BigEndian.Uint32(entry[0:4])
+		if tag != rpmTagName && tag != rpmTagVersion && tag != rpmTagRelease {
+			continue
+		}
+		switch binary.BigEndian.Uint32(entry[4:8]) {
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+		default:
+			return pkg, fmt.Errorf("rpm header: unexpected type of tag %d", tag)
+		}
+		offset := binary.BigEndian.Uint32(entry[8:12])
+		if uint64(offset) >= dl {
+			return pkg, errors.New("rpm header: offset out of bounds")
+		}
+		end := bytes.IndexByte(data[offset:], 0)
+		if end == -1 {
+			return pkg, errors.New("rpm header: unterminated string")
+		}
+		value := string(data[offset : offset+uint32(end)])
+
+		switch tag {
+		case rpmTagName:
+			pkg.Name = value
+		case rpmTagVersion:
+			pkg.Version = value
+		case rpmTagRelease:
+			release = value
+		}
+	}
+	if pkg.Name == "" {
+		return pkg, errors.New("rpm header: package name is missing")
+	}
+	if release != "" {
+		pkg.Version += "-" + release
+	}
+	return pkg, nil
+}
+
+// sqliteFile reads table B-trees of SQLite database, see
+// https://www.sqlite.org/fileformat.html.
+//
+// Only main database file is read, changes that are still in WAL file are
+// not seen. rpm checkpoints WAL when transaction is finished, so it is
+// usually empty.
+type sqliteFile struct {
+	f        *os.File
+	pageSize int
+	// Page size without reserved space at the end of each page.
+	usable int
+	pages  int64
+}
+
+func readRpmSqlite(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, 100)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, fmt.Errorf("sqlite header: %v", err)
+	}
+	if string(hdr[:16]) != "SQLite format 3\x00" {
+		return nil, errors.New("not a SQLite database")
+	}
+	db := &sqliteFile{f: f, pageSize: int(binary.BigEndian.Uint16(hdr[16:18]))}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 {
+		return nil, errors.New("invalid SQLite page size")
+	}
+	db.usable = db.pageSize - int(hdr[20])
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	db.pages = stat.Size() / int64(db.pageSize)
+
+	// Schema table (sqlite_master) has columns type, name, tbl_name,
+	// rootpage, sql and is stored starting at page 1.
+	root := int64(0)
+	err = db.walkTable(1, make(map[int64]bool), func(payload []byte) error {
+		rec, err := sqliteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(rec) < 4 {
+			return nil
+		}
+		typ, _ := rec[0].([]byte)
+		name, _ := rec[1].([]byte)
+		if string(typ) == "table" && string(name) == "Packages" {
+			root, _ = rec[3].(int64)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == 0 {
+		return nil, errors.New("Packages table is missing")
+	}
+
+	// Packages table has columns hnum (INTEGER PRIMARY KEY, stored as rowid
+	// and NULL in record) and blob.
+	var blobs [][]byte
+	err = db.walkTable(root, make(map[int64]bool), func(payload []byte) error {
+		rec, err := sqliteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(rec) < 2 {
+			return errors.New("unexpected Packages table format")
+		}
+		blob, ok := rec[1].([]byte)
+		if !ok {
+			return errors.New("unexpected Packages table format")
+		}
+		blobs = append(blobs, blob)
+		return nil
+	})
+	return blobs, err
+}
+
+func (db *sqliteFile) readPage(n int64) ([]byte, error) {
+	if n < 1 || n > db.pages {
+		return nil, fmt.Errorf("sqlite: page %d out of bounds", n)
+	}
+	page := make([]byte, db.pageSize)
+	_, err := db.f.ReadAt(page, (n-1)*int64(db.pageSize))
+	return page, err
+}
+
+// walkTable calls fn for payload of each row of table B-tree with root at
+// page n. visited protects from loops in corrupted files.
+func (db *sqliteFile) walkTable(n int64, visited map[int64]bool, fn func(payload []byte) error) error {
+	if visited[n] {
+		return errors.New("sqlite: loop in B-tree")
+	}
+	visited[n] = true
+	page, err := db.readPage(n)
+	if err != nil {
+		return err
+	}
+	hdr := page
+	if n == 1 {
+		hdr = page[100:]
+	}
+	cells := int(binary.BigEndian.Uint16(hdr[3:5]))
+
+	switch hdr[0] {
+	case 0x05: // Interior table page.
+		ptrs := hdr[12:]
+		if len(ptrs) < cells*2 {
+			return errors.New("sqlite: invalid cells count")
+		}
+		for i := 0; i < cells; i++ {
+			off := int(binary.BigEndian.Uint16(ptrs[i*2:]))
+			if off+4 > len(page) {
+				return errors.New("sqlite: cell out of bounds")
+			}
+			if err := db.walkTable(int64(binary.BigEndian.Uint32(page[off:])), visited, fn); err != nil {
+				return err
+			}
+		}
+		return db.walkTable(int64(binary.BigEndian.Uint32(hdr[8:12])), visited, fn)
+	case 0x0D: // Leaf table page.
+		ptrs := hdr[8:]
+		if len(ptrs) < cells*2 {
+			return errors.New("sqlite: invalid cells count")
+		}
+		for i := 0; i < cells; i++ {
+			off := int(binary.BigEndian.Uint16(ptrs[i*2:]))
+			if off >= len(page) {
+				return errors.New("sqlite: cell out of bounds")
+			}
+			payload, err := db.cellPayload(page[off:])
+			if err != nil {
+				return err
+			}
+			if err := fn(payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("sqlite: unexpected page type %d", hdr[0])
+	}
+}
+
+// cellPayload returns payload of leaf table cell, reading overflow pages if
+// needed.
+func (db *sqliteFile) cellPayload(cell []byte) ([]byte, error) {
+	size, n := sqliteVarint(cell)
+	if n == 0 {
+		return nil, errors.New("sqlite: invalid cell")
+	}
+	if size > rpmMaxHeaderSize {
+		return nil, errors.New("sqlite: cell is too big")
+	}
+	cell = cell[n:]
+	if _, n = sqliteVarint(cell); n == 0 { // rowid
+		return nil, errors.New("sqlite: invalid cell")
+	}
+	cell = cell[n:]
+
+	// How much of payload is stored on page itself.
+	local := int(size)
+	maxLocal := db.usable - 35
+	if local > maxLocal {
+		minLocal := (db.usable-12)*32/255 - 23
+		local = minLocal + (int(size)-minLocal)%(db.usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if local > len(cell) || (local < int(size) && local+4 > len(cell)) {
+		return nil, errors.New("sqlite: cell out of bounds")
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+	if local == int(size) {
+		return payload, nil
+	}
+
+	next := int64(binary.BigEndian.Uint32(cell[local:]))
+	for len(payload) < int(size) {
+		if next == 0 {
+			return nil, errors.New("sqlite: overflow chain is too short")
+		}
+		page, err := db.readPage(next)
+		if err != nil {
+			return nil, err
+		}
+		chunk := page[4:db.usable]
+		if rest := int(size) - len(payload); len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+		payload = append(payload, chunk...)
+		next = int64(binary.BigEndian.Uint32(page))
+	}
+	return payload, nil
+}
+
+// sqliteVarint decodes SQLite variable-length integer, n is 0 if b is too
+// short.
+func sqliteVarint(b []byte) (v uint64, n int) {
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// sqliteRecord decodes row record. Values are nil, int64 or []byte (for
+// both text and blobs), floats are returned as raw bytes.
+func sqliteRecord(payload []byte) ([]interface{}, error) {
+	hdrLen, n := sqliteVarint(payload)
+	if n == 0 || hdrLen > uint64(len(payload)) {
+		return nil, errors.New("sqlite: invalid record")
+	}
+	var types []uint64
+	for p := n; p < int(hdrLen); {
+		t, n := sqliteVarint(payload[p:hdrLen])
+		if n == 0 {
+			return nil, errors.New("sqlite: invalid record")
+		}
+		types = append(types, t)
+		p += n
+	}
+
+	body := payload[hdrLen:]
+	rec := make([]interface{}, 0, len(types))
+	for _, t := range types {
+		size := 0
+		switch {
+		case t == 0 || t == 8 || t == 9:
+		case t <= 4:
+			size = int(t)
+		case t == 5:
+			size = 6
+		case t == 6 || t == 7:
+			size = 8
+		case t >= 12:
+			size = int((t - 12) / 2)
+		default:
+			return nil, errors.New("sqlite: invalid record")
+		}
+		if size > len(body) {
+			return nil, errors.New("sqlite: invalid record")
+		}
+		value := body[:size]
+		body = body[size:]
+
+		switch {
+		case t == 0:
+			rec = append(rec, nil)
+		case t == 8 || t == 9:
+			rec = append(rec, int64(t-8))
+		case t <= 6:
+			i := int64(int8(value[0]))
+			for _, b := range value[1:] {
+				i = i<<8 | int64(b)
+			}
+			rec = append(rec, i)
+		default:
+			rec = append(rec, value)
+		}
+	}
+	return rec, nil
+}
+
+// Berkeley DB constants, see dbinc/db_page.h.
+const (
+	bdbHashMagic = 0x061561
+
+	bdbPageHashUnsorted = 2
+	bdbPageOverflow     = 7
+	bdbPageHash         = 13
+
+	bdbItemKeyData = 1
+	bdbItemOffPage = 3
+
+	bdbPageHeaderSize = 26
+)
+
+// readRpmBDB reads values of Berkeley DB hash database. Pages are just
+// scanned in order instead of following hash buckets, rpm needs nothing
+// else.
+func readRpmBDB(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta := make([]byte, 512)
+	if _, err := io.ReadFull(f, meta); err != nil {
+		return nil, fmt.Errorf("bdb metadata: %v", err)
+	}
+	// Byte order is one of machine that created database.
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(meta[12:16]) != bdbHashMagic {
+		order = binary.BigEndian
+		if order.Uint32(meta[12:16]) != bdbHashMagic {
+			return nil, errors.New("not a Berkeley DB hash database")
+		}
+	}
+	pageSize := order.Uint32(meta[20:24])
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 {
+		return nil, errors.New("invalid Berkeley DB page size")
+	}
+	lastPage := order.Uint32(meta[32:36])
+
+	readPage := func(n uint32, page []byte) error {
+		_, err := f.ReadAt(page, int64(n)*int64(pageSize))
+		return err
+	}
+
+	var blobs [][]byte
+	page := make([]byte, pageSize)
+	for n := uint32(1); n <= lastPage; n++ {
+		if err := readPage(n, page); err != nil {
+			return nil, err
+		}
+		if page[25] != bdbPageHash && page[25] != bdbPageHashUnsorted {
+			continue
+		}
+
+		entries := int(order.Uint16(page[20:22]))
+		if bdbPageHeaderSize+entries*2 > len(page) {
+			return nil, errors.New("bdb: invalid entries count")
+		}
+		// Items are stored from the end of page, length of item is distance
+		// to previous one.
+		item := func(i int) ([]byte, error) {
+			start := int(order.Uint16(page[bdbPageHeaderSize+i*2:]))
+			end := len(page)
+			if i != 0 {
+				end = int(order.Uint16(page[bdbPageHeaderSize+(i-1)*2:]))
+			}
+			if start >= end || end > len(page) {
+				return nil, errors.New("bdb: item out of bounds")
+			}
+			return page[start:end], nil
+		}
+
+		// Entries are key/value pairs.
+		for i := 0; i+1 < entries; i += 2 {
+			key, err := item(i)
+			if err != nil {
+				return nil, err
+			}
+			value, err := item(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			// Record with key 0 is not a package, rpm keeps next header
+			// number there.
+			if key[0] == bdbItemKeyData && bytes.Equal(key[1:], []byte{0, 0, 0, 0}) {
+				continue
+			}
+
+			switch value[0] {
+			case bdbItemKeyData:
+				blobs = append(blobs, append([]byte(nil), value[1:]...))
+			case bdbItemOffPage:
+				if len(value) < 12 {
+					return nil, errors.New("bdb: invalid off-page item")
+				}
+				blob, err := readBDBOverflow(readPage, pageSize, order, order.Uint32(value[4:8]), order.Uint32(value[8:12]))
+				if err != nil {
+					return nil, err
+				}
+				blobs = append(blobs, blob)
+			default:
+				return nil, fmt.Errorf("bdb: unexpected item type %d", value[0])
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// readBDBOverflow reads value of total length size stored in chain of
+// overflow pages starting at page n.
+func readBDBOverflow(readPage func(uint32, []byte) error, pageSize uint32, order binary.ByteOrder, n, size uint32) ([]byte, error) {
+	if size > rpmMaxHeaderSize {
+		return nil, errors.New("bdb: value is too big")
+	}
+	blob := make([]byte, 0, size)
+	page := make([]byte, pageSize)
+	for uint32(len(blob)) < size {
+		if n == 0 {
+			return nil, errors.New("bdb: overflow chain is too short")
+		}
+		if err := readPage(n, page); err != nil {
+			return nil, err
+		}
+		if page[25] != bdbPageOverflow {
+			return nil, errors.New("bdb: overflow page expected")
+		}
+		// Amount of data on overflow page is stored instead of offset of
+		// free space.
+		length := uint32(order.Uint16(page[22:24]))
+		if length == 0 || length > pageSize-bdbPageHeaderSize || length > size-uint32(len(blob)) {
+			return nil, errors.New("bdb: invalid overflow page")
+		}
+		blob = append(blob, page[bdbPageHeaderSize:bdbPageHeaderSize+length]...)
+		n = order.Uint32(page[16:20])
+	}
+	return blob, nil
+}
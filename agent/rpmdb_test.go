@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Fixtures are generated by testdata/rpmdb/gen.go.
+
+var rpmFixturePkgs = []Package{
+	{Name: "bash", Version: "5.1.8-6.el9"},
+	{Name: "glibc", Version: "2.34-60.el9"},
+	{Name: "gpg-pubkey", Version: "fd431d51-4ae0493b"},
+	{Name: "kernel-core", Version: "5.14.0-284.el9"},
+}
+
+func sortPkgs(pkgs []Package) {
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+}
+
+func TestReadRpmBDB(t *testing.T) {
+	for _, name := range []string{"Packages", "Packages-be"} {
+		pkgs, err := readRpmDB(filepath.Join("testdata", "rpmdb", name))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		sortPkgs(pkgs)
+		if !reflect.DeepEqual(pkgs, rpmFixturePkgs) {
+			t.Errorf("%s: wrong packages: %v", name, pkgs)
+		}
+	}
+}
+
+func TestReadRpmSqlite(t *testing.T) {
+	pkgs, err := readRpmDB(filepath.Join("testdata", "rpmdb", "rpmdb.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 304 {
+		t.Fatal("expected 304 packages, got", len(pkgs))
+	}
+	sortPkgs(pkgs)
+	expected := map[string]string{
+		"lib001": "1.0-1",
+		"lib100": "1.0-100",
+		"lib300": "1.0-300",
+	}
+	for _, pkg := range rpmFixturePkgs {
+		expected[pkg.Name] = pkg.Version
+	}
+	for _, pkg := range pkgs {
+		if v, ok := expected[pkg.Name]; ok {
+			if v != pkg.Version {
+				t.Errorf("wrong version of %s: %s", pkg.Name, pkg.Version)
+			}
+			delete(expected, pkg.Name)
+		}
+	}
+	if len(expected) != 0 {
+		t.Error("packages missing:", expected)
+	}
+}
+
+// Broken files should result in error, not panic or hang.
+func TestReadRpmDBCorrupted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"Packages", "rpmdb.sqlite"} {
+		orig, err := ioutil.ReadFile(filepath.Join("testdata", "rpmdb", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		for _, size := range []int{0, 50, 600, 4096, 4096 + 100, len(orig) / 2, len(orig) - 1000} {
+			if err := ioutil.WriteFile(path, orig[:size], 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readRpmDB(path); err == nil {
+				t.Errorf("%s truncated to %d bytes: no error", name, size)
+			}
+		}
+
+		// Garbage in every page except the first one.
+		for off := 4096; off < len(orig); off += 512 {
+			broken := append([]byte(nil), orig...)
+			for i := off; i < off+16 && i < len(broken); i++ {
+				broken[i] ^= 0xA5
+			}
+			if err := ioutil.WriteFile(path, broken, 0644); err != nil {
+				t.Fatal(err)
+			}
+			readRpmDB(path)
+		}
+	}
+}
+
+func TestParseRpmHeaderTruncated(t *testing.T) {
+	blobs, err := readRpmBDB(filepath.Join("testdata", "rpmdb", "Packages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		for size := 0; size < len(blob); size += 7 {
+			if _, err := parseRpmHeader(blob[:size]); err == nil {
+				t.Fatalf("header truncated to %d bytes: no error", size)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/encoding"
+)
+
+// Script describes script executed by RunScript.
+type Script struct {
+	// Options shared with execute_cmd, Cmd and Shell are not used.
+	Command
+
+	Body string
+	// Interpreter is "sh", "bash", "python", "powershell" or "cmd". Empty
+	// string means "cmd" on Windows and "sh" on other systems.
+	Interpreter string
+	// Args are passed to script.
+	Args []string
+
+	// If Encoding is not nil, cmd scripts are converted to it (cmd reads
+	// scripts using console code page).
+	Encoding encoding.Encoding
+}
+
+// Script files should have right extensions, otherwise cmd and powershell
+// refuse to run them.
+var scriptExts = map[string]string{
+	"sh":         ".sh",
+	"bash":       ".sh",
+	"python":     ".py",
+	"powershell": ".ps1",
+	"cmd":        ".cmd",
+}
+
+// ParseScript reads fields of run_script task. If task contains "sha256",
+// it's checked against script body.
+func ParseScript(body map[string]interface{}) (Script, error) {
+	s := Script{}
+	var ok bool
+	if s.Body, ok = body["script"].(string); !ok {
+		return s, errors.New("script should be string")
+	}
+	if s.Body == "" {
+		return s, errors.New("empty script is not allowed")
+	}
+	if val, prs := body["interpreter"]; prs {
+		if s.Interpreter, ok = val.(string); !ok {
+			return s, errors.New("interpreter should be string")
+		}
+		if _, ok := scriptExts[s.Interpreter]; !ok {
+			return s, fmt.Errorf("unknown interpreter: %s", s.Interpreter)
+		}
+	}
+	if val, prs := body["args"]; prs {
+		args, ok := val.([]interface{})
+		if !ok {
+			return s, errors.New("args should be array of strings")
+		}
+		s.Args = make([]string, len(args))
+		for i, arg := range args {
+			if s.Args[i], ok = arg.(string); !ok {
+				return s, errors.New("args should be array of strings")
+			}
+		}
+	}
+	if val, prs := body["sha256"]; prs {
+		sumStr, ok := val.(string)
+		if !ok {
+			return s, errors.New("sha256 should be string")
+		}
+		sum := sha256.Sum256([]byte(s.Body))
+		if !strings.EqualFold(sumStr, hex.EncodeToString(sum[:])) {
+			return s, errors.New("script checksum mismatch")
+		}
+	}
+	return s, parseCommandOptions(body, &s.Command)
+}
+
+func (s Script) interpreter() string {
+	if s.Interpreter == "" {
+		return defaultShell
+	}
+	return s.Interpreter
+}
+
+func (s Script) argv(path string) []string {
+	var argv []string
+	switch s.interpreter() {
+	case "sh":
+		argv = []string{"/bin/sh", path}
+	case "bash":
+		argv = []string{"bash", path}
+	case "python":
+		argv = []string{pythonCommand, path}
+	case "powershell":
+		argv = []string{"powershell", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", path}
+	case "cmd":
+		argv = []string{"cmd", "/C", path}
+	}
+	return append(argv, s.Args...)
+}
+
+// RunScript saves script to temporary file readable only by agent, runs it
+// using RunCommand and removes the file.
+func RunScript(ctx context.Context, s Script) (CommandResult, error) {
+	ext, ok := scriptExts[s.interpreter()]
+	if !ok {
+		return CommandResult{}, fmt.Errorf("unknown interpreter: %s", s.Interpreter)
+	}
+
+	body := []byte(s.Body)
+	switch s.interpreter() {
+	case "cmd":
+		if s.Encoding != nil {
+			var err error
+			body, err = s.Encoding.NewEncoder().Bytes(body)
+			if err != nil {
+				return CommandResult{}, errors.New("can't convert script to console encoding")
+			}
+		}
+	case "powershell":
+		// Without BOM Windows PowerShell reads script using ANSI code page.
+		body = append([]byte("\xEF\xBB\xBF"), body...)
+	}
+
+	// Directory is created with 0700 permissions, so other users can't
+	// read or replace script.
+	dir, err := ioutil.TempDir("", "sutrc-script-")
+	if err != nil {
+		return CommandResult{}, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "script"+ext)
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		return CommandResult{}, err
+	}
+
+	c := s.Command
+	c.argv = s.argv(path)
+	return RunCommand(ctx, c)
+}
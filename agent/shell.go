@@ -0,0 +1,346 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/text/encoding"
+)
+
+// ShellMessage is a control message sent as text frame over shell session
+// WebSockets (GET /shell and GET /shell_agent), binary frames carry terminal
+// input and output as is. Kind is one of:
+// - "resize" (admin -> agent), Cols and Rows are set.
+// - "exit" (agent -> admin), shell exited with StatusCode.
+// - "error" (server -> admin), session is closed because of Msg.
+type ShellMessage struct {
+	Kind       string `json:"kind"`
+	Cols       int    `json:"cols,omitempty"`
+	Rows       int    `json:"rows,omitempty"`
+	StatusCode *int   `json:"status_code,omitempty"`
+	Msg        string `json:"msg,omitempty"`
+}
+
+// ShellOptions describes interactive shell session started by RunShell.
+type ShellOptions struct {
+	// Session ID assigned by server.
+	Session string
+	// "cmd", "powershell", "sh" or "bash", empty string means "cmd" on
+	// Windows and "sh" on other systems.
+	Shell string
+	// Working directory, agent's one if empty.
+	Dir string
+	// Initial terminal size, ignored if shell is not started on PTY.
+	Cols, Rows int
+	// Encoding of console input and output, nil means UTF-8.
+	Encoding encoding.Encoding
+}
+
+// ShellResult is outcome of RunShell.
+type ShellResult struct {
+	StatusCode int
+	Duration   time.Duration
+	// Killed is true if shell was killed because session was closed or
+	// context was cancelled.
+	Killed bool
+}
+
+// terminal is a shell process with its console.
+type terminal interface {
+	io.ReadWriter
+	Resize(cols, rows int) error
+	// Kill kills shell and all processes it started.
+	Kill() error
+	Wait() (int, error)
+	// Close releases console, Read returns error after it.
+	Close() error
+}
+
+func interactiveShell(shell string) (*exec.Cmd, error) {
+	if shell == "" {
+		shell = defaultShell
+	}
+	switch shell {
+	case "cmd":
+		return exec.Command("cmd"), nil
+	case "powershell":
+		return exec.Command("powershell", "-NoLogo", "-NoProfile"), nil
+	case "sh":
+		return exec.Command("/bin/sh", "-i"), nil
+	case "bash":
+		return exec.Command("bash", "-i"), nil
+	}
+	return nil, fmt.Errorf("unknown shell: %s", shell)
+}
+
+// pipeTerminal runs shell with stdin and stdout connected to pipes, it's
+// used where PTY is not available. Resizing is not supported.
+type pipeTerminal struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *os.File
+}
+
+func startPipeTerminal(cmd *exec.Cmd) (terminal, error) {
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Single pipe for both stdout and stderr keeps them in order.
+	out, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = outW
+	cmd.Stderr = outW
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		outW.Close()
+		return nil, err
+	}
+	outW.Close()
+	return &pipeTerminal{cmd: cmd, in: in, out: out}, nil
+}
+
+func (t *pipeTerminal) Read(p []byte) (int, error)  { return t.out.Read(p) }
+func (t *pipeTerminal) Write(p []byte) (int, error) { return t.in.Write(p) }
+func (t *pipeTerminal) Resize(cols, rows int) error { return nil }
+func (t *pipeTerminal) Kill() error                 { return killProcessTree(t.cmd.Process) }
+
+func (t *pipeTerminal) Wait() (int, error) {
+	return exitStatus(t.cmd.Wait())
+}
+
+func (t *pipeTerminal) Close() error {
+	t.in.Close()
+	return t.out.Close()
+}
+
+// exitStatus converts error returned by exec.Cmd.Wait into exit code.
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return -1, err
+}
+
+// ParseShell reads fields of shell task.
+func ParseShell(body map[string]interface{}) (ShellOptions, error) {
+	opts := ShellOptions{Cols: 80, Rows: 24}
+	var ok bool
+	if opts.Session, ok = body["session"].(string); !ok || opts.Session == "" {
+		return opts, errors.New("session should be non-empty string")
+	}
+	if val, prs := body["shell"]; prs {
+		if opts.Shell, ok = val.(string); !ok {
+			return opts, errors.New("shell should be string")
+		}
+	}
+	if val, prs := body["cwd"]; prs {
+		if opts.Dir, ok = val.(string); !ok {
+			return opts, errors.New("cwd should be string")
+		}
+	}
+	for field, dst := range map[string]*int{"cols": &opts.Cols, "rows": &opts.Rows} {
+		val, prs := body[field]
+		if !prs {
+			continue
+		}
+		num, ok := val.(float64)
+		if !ok || num < 1 || num > 1000 {
+			return opts, errors.New(field + " should be number between 1 and 1000")
+		}
+		*dst = int(num)
+	}
+	return opts, nil
+}
+
+// shellConn serializes writes to session WebSocket.
+type shellConn struct {
+	c    *websocket.Conn
+	lock sync.Mutex
+}
+
+func (conn *shellConn) write(kind int, data []byte) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.c.WriteMessage(kind, data)
+}
+
+func (c *Client) dialShell(session string) (*websocket.Conn, error) {
+	req, err := http.NewRequest("GET", c.baseURL+"/shell_agent?session="+url.QueryEscape(session), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req)
+	// http -> ws, https -> wss
+	wsURL := strings.Replace(req.URL.String(), "http", "ws", 1)
+
+	dialer := websocket.Dialer{HandshakeTimeout: 30 * time.Second}
+	conn, resp, err := dialer.Dial(wsURL, req.Header)
+	if err != nil {
+		if err != websocket.ErrBadHandshake {
+			return nil, err
+		}
+		resp.Body.Close()
+		return nil, errors.New("shell session rejected by server: " + resp.Status)
+	}
+	return conn, nil
+}
+
+// RunShell joins shell session created by server and runs shell, relaying
+// its console to session until shell exits. Shell is killed along with all
+// processes it started if session is closed or ctx is cancelled.
+func (c *Client) RunShell(ctx context.Context, opts ShellOptions) (ShellResult, error) {
+	res := ShellResult{}
+	cmd, err := interactiveShell(opts.Shell)
+	if err != nil {
+		return res, err
+	}
+	cmd.Dir = opts.Dir
+
+	rawConn, err := c.dialShell(opts.Session)
+	if err != nil {
+		return res, err
+	}
+	conn := &shellConn{c: rawConn}
+	defer rawConn.Close()
+
+	start := time.Now()
+	term, err := startTerminal(cmd, opts.Cols, opts.Rows)
+	if err != nil {
+		msg, _ := json.Marshal(ShellMessage{Kind: "error", Msg: err.Error()})
+		conn.write(websocket.TextMessage, msg)
+		return res, err
+	}
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := term.Read(buf)
+			if n != 0 {
+				data := buf[:n]
+				if opts.Encoding != nil {
+					// Decoder is stateful, but console encodings we use
+					// are single-byte anyway.
+					if decoded, err := opts.Encoding.NewDecoder().Bytes(data); err == nil {
+						data = decoded
+					}
+				}
+				if err := conn.write(websocket.BinaryMessage, data); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Closed when session is closed by server or admin.
+	sessionDone := make(chan struct{})
+	go func() {
+		defer close(sessionDone)
+		for {
+			kind, data, err := rawConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if kind == websocket.BinaryMessage {
+				if opts.Encoding != nil {
+					encoded, err := opts.Encoding.NewEncoder().Bytes(data)
+					if err != nil {
+						continue
+					}
+					data = encoded
+				}
+				term.Write(data)
+				continue
+			}
+			msg := ShellMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			if msg.Kind == "resize" && msg.Cols > 0 && msg.Rows > 0 {
+				term.Resize(msg.Cols, msg.Rows)
+			}
+		}
+	}()
+
+	var waitErr error
+	waitDone := make(chan struct{})
+	go func() {
+		defer close(waitDone)
+		res.StatusCode, waitErr = term.Wait()
+	}()
+	select {
+	case <-waitDone:
+	case <-sessionDone:
+		res.Killed = true
+	case <-ctx.Done():
+		res.Killed = true
+	}
+	if res.Killed {
+		term.Kill()
+		<-waitDone
+	}
+
+	// Background processes may keep console open, don't wait for them
+	// for too long.
+	select {
+	case <-outputDone:
+	case <-time.After(time.Second):
+	}
+	term.Close()
+	res.Duration = time.Since(start)
+	if waitErr != nil {
+		return res, waitErr
+	}
+
+	status := res.StatusCode
+	msg, _ := json.Marshal(ShellMessage{Kind: "exit", StatusCode: &status})
+	conn.write(websocket.TextMessage, msg)
+	conn.lock.Lock()
+	rawConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.lock.Unlock()
+	return res, nil
+}
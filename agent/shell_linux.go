@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ptyTerminal runs shell on pseudo-terminal, so it behaves like in usual
+// terminal emulator.
+type ptyTerminal struct {
+	cmd  *exec.Cmd
+	ptmx *os.File
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	// Fd() would switch file to blocking mode and Close wouldn't interrupt
+	// pending Read.
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func openPTY() (ptmx, tty *os.File, err error) {
+	ptmx, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var num uint32
+	if err := ioctl(ptmx, syscall.TIOCGPTN, unsafe.Pointer(&num)); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(ptmx, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	tty, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(num)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
+
+// startTerminal starts shell on new PTY with specified size.
+func startTerminal(cmd *exec.Cmd, cols, rows int) (terminal, error) {
+	ptmx, tty, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	t := &ptyTerminal{cmd: cmd, ptmx: ptmx}
+	if err := t.Resize(cols, rows); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "TERM=xterm")
+	// New session makes shell leader of process group, so killProcessTree
+	// works as usual, and PTY becomes its controlling terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *ptyTerminal) Read(p []byte) (int, error) {
+	n, err := t.ptmx.Read(p)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+		// Returned when all processes closed PTY.
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (t *ptyTerminal) Write(p []byte) (int, error) { return t.ptmx.Write(p) }
+
+// Kill kills all processes in shell's session, interactive shells put
+// background jobs into separate process groups.
+func (t *ptyTerminal) Kill() error {
+	err := killProcessTree(t.cmd.Process)
+	procs, _ := ioutil.ReadDir("/proc")
+	for _, proc := range procs {
+		pid, convErr := strconv.Atoi(proc.Name())
+		if convErr != nil {
+			continue
+		}
+		stat, readErr := ioutil.ReadFile("/proc/" + proc.Name() + "/stat")
+		if readErr != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp session ..., comm can contain
+		// anything including spaces and parentheses.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 4 || fields[3] != strconv.Itoa(t.cmd.Process.Pid) {
+			continue
+		}
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	return err
+}
+func (t *ptyTerminal) Close() error { return t.ptmx.Close() }
+
+func (t *ptyTerminal) Resize(cols, rows int) error {
+	size := struct {
+		Rows, Cols, X, Y uint16
+	}{Rows: uint16(rows), Cols: uint16(cols)}
+	return ioctl(t.ptmx, syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+}
+
+func (t *ptyTerminal) Wait() (int, error) {
+	return exitStatus(t.cmd.Wait())
+}
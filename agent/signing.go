@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed tasks
+//
+// Admin signs task with personal ed25519 key and sends envelope through
+// server:
+//	{
+//	    "type": "execute_cmd",
+//	    "signed": {
+//	        "key": "KEY-ID",
+//	        "payload": "base64-encoded task JSON",
+//	        "signature": "base64-encoded signature of payload"
+//	    }
+//	}
+// Payload is a task object itself plus "nonce" (random string), "expires"
+// (UNIX timestamp) and "targets" (list of stable agent IDs, see StableID)
+// fields. Agents with pinned keys verify signature and execute payload,
+// server can't change anything.
+//
+// Targets are required: nonces are remembered by each agent separately, so
+// task without them could be replayed on all agents until it expires.
+
+// MaxSignedTaskTTL is maximum allowed time between now and expiration time of
+// signed task. Limits size of nonces store.
+const MaxSignedTaskTTL = 24 * time.Hour
+
+// LoadTrustedKeys reads file with lines in form "KEY-ID BASE64-PUBKEY".
+// Empty lines and lines starting with # are ignored.
+func LoadTrustedKeys(path string) (map[string]ed25519.PublicKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]ed25519.PublicKey)
+	scnr := bufio.NewScanner(f)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key ID and key", path, lineNum)
+		}
+		key, err := ParsePublicKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		keys[parts[0]] = key
+	}
+	return keys, scnr.Err()
+}
+
+// StableID returns agent ID used in "targets" of signed tasks. Unlike name,
+// it doesn't change when agent is renamed. It's derived from agent's
+// credentials (hardware ID), but doesn't reveal them.
+func StableID(hwid string) string {
+	sum := sha256.Sum256([]byte("sutrc-agent-id\n" + hwid))
+	return hex.EncodeToString(sum[:16])
+}
+
+// SignTask wraps task into signed envelope. Task should contain "type" and
+// "targets" fields, "nonce" and "expires" are added by this function.
+func SignTask(task map[string]interface{}, keyID string, key ed25519.PrivateKey, ttl time.Duration) (map[string]interface{}, error) {
+	taskType, ok := task["type"].(string)
+	if !ok {
+		return nil, errors.New("task type missing")
+	}
+	if _, err := signedTargets(task); err != nil {
+		return nil, err
+	}
+	if ttl > MaxSignedTaskTTL {
+		return nil, fmt.Errorf("TTL can't be longer than %v", MaxSignedTaskTTL)
+	}
+
+	rawNonce := make([]byte, 16)
+	if _, err := rand.Read(rawNonce); err != nil {
+		return nil, err
+	}
+	payload := make(map[string]interface{}, len(task)+2)
+	for k, v := range task {
+		payload[k] = v
+	}
+	payload["nonce"] = hex.EncodeToString(rawNonce)
+	payload["expires"] = time.Now().Add(ttl).Unix()
+
+	payloadBlob, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"type": taskType,
+		"signed": map[string]interface{}{
+			"key":       keyID,
+			"payload":   base64.StdEncoding.EncodeToString(payloadBlob),
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(key, payloadBlob)),
+		},
+	}, nil
+}
+
+// DecodeSignedTask extracts task payload from envelope without checking
+// signature. Used by server which can't check signatures anyway.
+func DecodeSignedTask(envelope map[string]interface{}) (map[string]interface{}, error) {
+	payload, _, _, err := splitEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	task := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return nil, fmt.Errorf("signed payload parse: %v", err)
+	}
+	return task, nil
+}
+
+func splitEnvelope(envelope map[string]interface{}) (payload, sig []byte, keyID string, err error) {
+	signed, ok := envelope["signed"].(map[string]interface{})
+	if !ok {
+		return nil, nil, "", errors.New("task is not signed")
+	}
+	keyID, _ = signed["key"].(string)
+	payloadStr, _ := signed["payload"].(string)
+	sigStr, _ := signed["signature"].(string)
+	if keyID == "" || payloadStr == "" || sigStr == "" {
+		return nil, nil, "", errors.New("malformed signed task")
+	}
+	payload, err = base64.StdEncoding.DecodeString(payloadStr)
+	if err != nil {
+		return nil, nil, "", errors.New("malformed signed task payload")
+	}
+	sig, err = base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		return nil, nil, "", errors.New("malformed task signature")
+	}
+	return payload, sig, keyID, nil
+}
+
+// signedTargets returns targets list of signed task payload.
+func signedTargets(payload map[string]interface{}) ([]string, error) {
+	targets, ok := payload["targets"].([]interface{})
+	if !ok || len(targets) == 0 {
+		return nil, errors.New("targets should be non-empty list of agent IDs")
+	}
+	res := make([]string, len(targets))
+	for i, t := range targets {
+		if res[i], ok = t.(string); !ok {
+			return nil, errors.New("targets should be non-empty list of agent IDs")
+		}
+	}
+	return res, nil
+}
+
+// nonceStore remembers nonces of executed signed tasks until they expire.
+// It's loaded from file on first use.
+type nonceStore struct {
+	path   string
+	nonces map[string]int64
+
+	lock sync.Mutex
+}
+
+func (s *nonceStore) load(path string) error {
+	s.path = path
+	s.nonces = make(map[string]int64)
+	if s.path == "" {
+		return nil
+	}
+	blob, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(blob, &s.nonces)
+}
+
+// use records nonce, returns false if it was used already. path is file
+// nonces are kept in.
+func (s *nonceStore) use(path, nonce string, expires int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.nonces == nil || s.path != path {
+		if err := s.load(path); err != nil {
+			return false, fmt.Errorf("nonces load: %v", err)
+		}
+	}
+	if _, prs := s.nonces[nonce]; prs {
+		return false, nil
+	}
+
+	now := time.Now().Unix()
+	for n, exp := range s.nonces {
+		if exp < now {
+			delete(s.nonces, n)
+		}
+	}
+	s.nonces[nonce] = expires
+
+	if s.path == "" {
+		return true, nil
+	}
+	blob, err := json.Marshal(s.nonces)
+	if err != nil {
+		return false, err
+	}
+	// Don't execute task if we can't remember it.
+	return true, ioutil.WriteFile(s.path, blob, 0600)
+}
+
+// verifyTask checks signature of task received from server and returns
+// payload with task ID set.
+func (c *Client) verifyTask(id int, type_ string, body map[string]interface{}) (map[string]interface{}, error) {
+	if _, prs := body["signed"]; !prs {
+		if contains(c.UnsignedTaskTypes, type_) {
+			return body, nil
+		}
+		return nil, errors.New("task is not signed")
+	}
+
+	payloadBlob, sig, keyID, err := splitEnvelope(body)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := c.TrustedKeys[keyID]
+	if !ok {
+		return nil, errors.New("task is signed by unknown key " + keyID)
+	}
+	if !ed25519.Verify(key, payloadBlob, sig) {
+		return nil, errors.New("invalid task signature")
+	}
+
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(payloadBlob, &payload); err != nil {
+		return nil, fmt.Errorf("signed payload parse: %v", err)
+	}
+	if payload["type"] != type_ {
+		return nil, errors.New("task type doesn't match signed one")
+	}
+
+	expiresF, ok := payload["expires"].(float64)
+	if !ok {
+		return nil, errors.New("missing expiration time in signed task")
+	}
+	expires := time.Unix(int64(expiresF), 0)
+	if time.Now().After(expires) {
+		return nil, errors.New("signed task expired")
+	}
+	if expires.Sub(time.Now()) > MaxSignedTaskTTL {
+		return nil, errors.New("signed task expiration time is too far in future")
+	}
+
+	targets, err := signedTargets(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(targets, StableID(c.authHeader)) {
+		return nil, errors.New("task is signed for different agents")
+	}
+
+	nonce, ok := payload["nonce"].(string)
+	if !ok || nonce == "" {
+		return nil, errors.New("missing nonce in signed task")
+	}
+	fresh, err := c.nonces.use(c.NonceFile, nonce, expires.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, errors.New("replayed signed task")
+	}
+
+	payload["id"] = float64(id)
+	return payload, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSigningClient(hwid string, pub ed25519.PublicKey) *Client {
+	c := NewClient("http://127.0.0.1:0")
+	c.authHeader = hwid
+	c.TrustedKeys = map[string]ed25519.PublicKey{"admin": pub}
+	return &c
+}
+
+// signTestTask signs task and round-trips it through JSON like server does.
+func signTestTask(t *testing.T, task map[string]interface{}, key ed25519.PrivateKey) map[string]interface{} {
+	t.Helper()
+	envelope, err := SignTask(task, "admin", key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]interface{})
+	if err := json.Unmarshal(blob, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestSignedTaskTargets(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newSigningClient("hwid-a", pub)
+	b := newSigningClient("hwid-b", pub)
+
+	if _, err := SignTask(map[string]interface{}{"type": "proclist"}, "admin", key, time.Hour); err == nil {
+		t.Error("task without targets signed")
+	}
+	if _, err := SignTask(map[string]interface{}{"type": "proclist", "targets": []interface{}{}}, "admin", key, time.Hour); err == nil {
+		t.Error("task with empty targets signed")
+	}
+
+	task := signTestTask(t, map[string]interface{}{
+		"type":    "proclist",
+		"targets": []interface{}{StableID("hwid-a")},
+	}, key)
+	if _, err := b.verifyTask(1, "proclist", task); err == nil {
+		t.Error("task targeted to a accepted by b")
+	}
+	// Name doesn't matter, agent may be renamed on server.
+	a.name = "renamed"
+	payload, err := a.verifyTask(1, "proclist", task)
+	if err != nil {
+		t.Fatal("task rejected by target:", err)
+	}
+	if payload["id"] != float64(1) {
+		t.Error("task ID not set:", payload["id"])
+	}
+	if _, err := a.verifyTask(2, "proclist", task); err == nil {
+		t.Error("replayed task accepted")
+	}
+}
+
+func TestSignedTaskNoTargets(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSigningClient("hwid-a", pub)
+
+	// Sign payload without targets bypassing SignTask checks.
+	task := signTestTask(t, map[string]interface{}{
+		"type":    "proclist",
+		"targets": []interface{}{StableID("hwid-a")},
+	}, key)
+	payloadBlob, _, _, err := splitEnvelope(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(payloadBlob, &payload); err != nil {
+		t.Fatal(err)
+	}
+	delete(payload, "targets")
+	payloadBlob, err = json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := task["signed"].(map[string]interface{})
+	signed["payload"] = base64.StdEncoding.EncodeToString(payloadBlob)
+	signed["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payloadBlob))
+
+	if _, err := c.verifyTask(1, "proclist", task); err == nil {
+		t.Error("untargeted task accepted")
+	}
+}
+
+func TestStableID(t *testing.T) {
+	if StableID("a") != StableID("a") {
+		t.Error("StableID is not deterministic")
+	}
+	if StableID("a") == StableID("b") {
+		t.Error("StableID collision")
+	}
+	if len(StableID("a")) != 32 {
+		t.Error("unexpected StableID length:", len(StableID("a")))
+	}
+}
+
+func TestAdvertisedTaskTypes(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("http://127.0.0.1:0")
+	c.SupportedTaskTypes = []string{"exec", "shell", "tunnel", "update"}
+	if got := strings.Join(c.advertisedTaskTypes(), ","); got != "exec,shell,tunnel,update" {
+		t.Error("unsigned agent:", got)
+	}
+
+	c = *newSigningClient("hwid", pub)
+	c.SupportedTaskTypes = []string{"exec", "shell", "tunnel", "update"}
+	if got := strings.Join(c.advertisedTaskTypes(), ","); got != "exec,update" {
+		t.Error("signing agent:", got)
+	}
+	c.UnsignedTaskTypes = []string{"update", "shell"}
+	if got := strings.Join(c.advertisedTaskTypes(), ","); got != "exec,shell,update" {
+		t.Error("signing agent with unsigned shell:", got)
+	}
+}
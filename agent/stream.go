@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Output is sent to server this often.
+const outputFlushInterval = 300 * time.Millisecond
+
+// If server is unreachable, at most maxPendingOutput bytes are kept, rest
+// is discarded.
+const maxPendingOutput = 4 << 20
+
+type outputChunk struct {
+	Seq    int    `json:"seq"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// OutputStream sends output of running task to server in small batches so
+// admins can watch it live (see GET /task_output).
+type OutputStream struct {
+	c      *Client
+	taskID int
+
+	lock        sync.Mutex
+	pending     []outputChunk
+	pendingSize int
+	lastSeq     int
+	// Chunks up to sentSeq may be already saved by server even if request
+	// failed, so data is never appended to them.
+	sentSeq int
+	dropped bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OutputStream starts streaming output of task, Close should be called
+// before sending task result.
+func (c *Client) OutputStream(taskID int) *OutputStream {
+	s := &OutputStream{
+		c:      c,
+		taskID: taskID,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s
+}
+
+// Write queues data written by task to stream ("stdout" or "stderr"). It
+// never blocks on network.
+func (s *OutputStream) Write(stream string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pendingSize+len(data) > maxPendingOutput {
+		if !s.dropped {
+			log.Println("Task", s.taskID, "output is not delivered fast enough, discarding it")
+			s.dropped = true
+		}
+		return
+	}
+	s.pendingSize += len(data)
+	if last := len(s.pending) - 1; last >= 0 && s.pending[last].Stream == stream && s.pending[last].Seq > s.sentSeq {
+		s.pending[last].Data += string(data)
+		return
+	}
+	s.lastSeq++
+	s.pending = append(s.pending, outputChunk{Seq: s.lastSeq, Stream: stream, Data: string(data)})
+}
+
+func (s *OutputStream) flushLoop() {
+	defer close(s.done)
+	t := time.NewTicker(outputFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.flush()
+		case <-s.stop:
+			// Give output last chance to get through.
+			for i := 0; i < 3; i++ {
+				if s.flush() {
+					return
+				}
+				time.Sleep(time.Second)
+			}
+			return
+		}
+	}
+}
+
+// flush sends pending chunks, they are kept for next attempt if request
+// fails. Returns true if nothing is left.
+func (s *OutputStream) flush() bool {
+	s.lock.Lock()
+	chunks := s.pending
+	s.pending = nil
+	s.pendingSize = 0
+	if len(chunks) != 0 {
+		s.sentSeq = chunks[len(chunks)-1].Seq
+	}
+	s.lock.Unlock()
+	if len(chunks) == 0 {
+		return true
+	}
+
+	if err := s.c.sendOutput(s.taskID, chunks); err != nil {
+		log.Println("Failed to send task", s.taskID, "output:", err)
+		s.lock.Lock()
+		s.pending = append(chunks, s.pending...)
+		s.pendingSize = 0
+		for _, chunk := range s.pending {
+			s.pendingSize += len(chunk.Data)
+		}
+		s.lock.Unlock()
+		return false
+	}
+	return true
+}
+
+// Close sends remaining output and stops streaming.
+func (s *OutputStream) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (c *Client) sendOutput(taskID int, chunks []outputChunk) error {
+	blob, err := json.Marshal(map[string]interface{}{"chunks": chunks})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.baseURL+"/task_output?id="+strconv.Itoa(taskID), bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+//go:build ignore
+// +build ignore
+
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+// gen.go generates RPM database fixtures used by rpmdb_test.go:
+//
+//	go run testdata/rpmdb/gen.go
+//
+// rpmdb.sqlite is created using SQLite itself. Packages files (Berkeley DB
+// hash, little- and big-endian) are written page by page, they contain
+// small values stored on hash page and big ones stored on overflow pages.
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type pkg struct {
+	name, version, release string
+	// Size of description, used to make big headers.
+	descLen int
+}
+
+// header builds RPM header blob as stored in database.
+func header(p pkg) []byte {
+	type entry struct {
+		tag, typ uint32
+		data     []byte
+		count    uint32
+	}
+	str := func(s string) []byte { return append([]byte(s), 0) }
+	entries := []entry{
+		// Region tag, contents don't matter here.
+		{63, 7, make([]byte, 16), 16},
+		{1000, 6, str(p.name), 1},
+		{1001, 6, str(p.version), 1},
+		{1002, 6, str(p.release), 1},
+		{1003, 4, []byte{0, 0, 0, 1}, 1},
+		{1005, 9, str(strings.Repeat("d", p.descLen)), 1},
+	}
+
+	var data []byte
+	index := make([]byte, 0, len(entries)*16)
+	for _, e := range entries {
+		if e.typ == 4 {
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		var raw [16]byte
+		binary.BigEndian.PutUint32(raw[0:], e.tag)
+		binary.BigEndian.PutUint32(raw[4:], e.typ)
+		binary.BigEndian.PutUint32(raw[8:], uint32(len(data)))
+		binary.BigEndian.PutUint32(raw[12:], e.count)
+		index = append(index, raw[:]...)
+		data = append(data, e.data...)
+	}
+
+	blob := make([]byte, 8, 8+len(index)+len(data))
+	binary.BigEndian.PutUint32(blob[0:], uint32(len(entries)))
+	binary.BigEndian.PutUint32(blob[4:], uint32(len(data)))
+	blob = append(blob, index...)
+	return append(blob, data...)
+}
+
+var basePkgs = []pkg{
+	{"bash", "5.1.8", "6.el9", 100},
+	{"glibc", "2.34", "60.el9", 3000},
+	{"kernel-core", "5.14.0", "284.el9", 20000},
+	{"gpg-pubkey", "fd431d51", "4ae0493b", 0},
+}
+
+func genSqlite(path string) {
+	os.Remove(path)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Same schema rpm uses, plus index to check that it's not confused with
+	// table.
+	for _, stmt := range []string{
+		`PRAGMA page_size = 4096`,
+		`CREATE TABLE Packages (hnum INTEGER PRIMARY KEY AUTOINCREMENT, blob BLOB NOT NULL)`,
+		`CREATE TABLE Name (key TEXT NOT NULL, hnum INTEGER NOT NULL, idx INTEGER NOT NULL, FOREIGN KEY (hnum) REFERENCES Packages(hnum))`,
+		`CREATE INDEX Name_key_idx ON Name(key ASC)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	pkgs := append([]pkg(nil), basePkgs...)
+	// Enough packages to get interior B-tree pages.
+	for i := 1; i <= 300; i++ {
+		descLen := 20
+		if i%100 == 0 {
+			descLen = 5000
+		}
+		pkgs = append(pkgs, pkg{fmt.Sprintf("lib%03d", i), "1.0", fmt.Sprint(i), descLen})
+	}
+	for _, p := range pkgs {
+		res, err := db.Exec(`INSERT INTO Packages (blob) VALUES (?)`, header(p))
+		if err != nil {
+			log.Fatal(err)
+		}
+		hnum, _ := res.LastInsertId()
+		if _, err := db.Exec(`INSERT INTO Name VALUES (?, ?, 0)`, p.name, hnum); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+const bdbPageSize = 4096
+
+// bdbPage builds page header, see dbinc/db_page.h.
+func bdbPage(order binary.ByteOrder, pgno, next uint32, entries, hfOffset uint16, typ byte) []byte {
+	page := make([]byte, bdbPageSize)
+	order.PutUint32(page[8:], pgno)
+	order.PutUint32(page[16:], next)
+	order.PutUint16(page[20:], entries)
+	order.PutUint16(page[22:], hfOffset)
+	page[24] = 1 // level
+	page[25] = typ
+	return page
+}
+
+func genBDB(path string, order binary.ByteOrder) {
+	var pages [][]byte
+	// Metadata page is filled at the end.
+	pages = append(pages, nil)
+
+	// Key 0 keeps next header number, it's not a package.
+	type item struct {
+		key   uint32
+		value []byte
+	}
+	items := []item{{0, []byte{5, 0, 0, 0}}}
+	for i, p := range basePkgs {
+		items = append(items, item{uint32(i + 1), header(p)})
+	}
+
+	// Two items per hash page, so there are several of them.
+	var hashPages []int
+	for i := 0; i < len(items); i += 2 {
+		hashPages = append(hashPages, len(pages))
+		pages = append(pages, nil)
+	}
+	for i, pageIdx := range hashPages {
+		chunk := items[i*2:]
+		if len(chunk) > 2 {
+			chunk = chunk[:2]
+		}
+
+		var raw [][]byte
+		for _, it := range chunk {
+			key := make([]byte, 5)
+			key[0] = 1 // H_KEYDATA
+			order.PutUint32(key[1:], it.key)
+			raw = append(raw, key)
+
+			if len(it.value) < 1000 {
+				raw = append(raw, append([]byte{1}, it.value...))
+				continue
+			}
+			// H_OFFPAGE, value is stored in chain of overflow pages.
+			first := uint32(len(pages))
+			rest := it.value
+			for len(rest) > 0 {
+				n := len(rest)
+				if n > bdbPageSize-26 {
+					n = bdbPageSize - 26
+				}
+				next := uint32(0)
+				if n < len(rest) {
+					next = uint32(len(pages) + 1)
+				}
+				page := bdbPage(order, uint32(len(pages)), next, 1, uint16(n), 7)
+				copy(page[26:], rest[:n])
+				pages = append(pages, page)
+				rest = rest[n:]
+			}
+			off := make([]byte, 12)
+			off[0] = 3
+			order.PutUint32(off[4:], first)
+			order.PutUint32(off[8:], uint32(len(it.value)))
+			raw = append(raw, off)
+		}
+
+		page := bdbPage(order, uint32(pageIdx), 0, uint16(len(raw)), 0, 13)
+		end := bdbPageSize
+		for j, r := range raw {
+			end -= len(r)
+			copy(page[end:], r)
+			order.PutUint16(page[26+j*2:], uint16(end))
+		}
+		order.PutUint16(page[22:], uint16(end))
+		pages[pageIdx] = page
+	}
+
+	// Free page, should be skipped.
+	pages = append(pages, bdbPage(order, uint32(len(pages)), 0, 0, 0, 0))
+
+	meta := make([]byte, bdbPageSize)
+	order.PutUint32(meta[12:], 0x061561) // magic
+	order.PutUint32(meta[16:], 9)        // version
+	order.PutUint32(meta[20:], bdbPageSize)
+	meta[25] = 8 // P_HASHMETA
+	order.PutUint32(meta[32:], uint32(len(pages)-1))
+	pages[0] = meta
+
+	var file []byte
+	for _, p := range pages {
+		file = append(file, p...)
+	}
+	if err := ioutil.WriteFile(path, file, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	genSqlite("testdata/rpmdb/rpmdb.sqlite")
+	genBDB("testdata/rpmdb/Packages", binary.LittleEndian)
+	genBDB("testdata/rpmdb/Packages-be", binary.BigEndian)
+}
@@ -0,0 +1,567 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TunnelMessage is a control message sent as text frame over tunnel
+// WebSocket (GET /tunnel_agent). Binary frames carry stream data: 4-byte
+// big-endian stream ID followed by payload. Kind is one of:
+//   - "open" (server -> agent), agent should connect to Host:Port.
+//   - "opened" (agent -> server), connection for stream is established.
+//   - "ack" (both directions), Bytes of stream data were written to its
+//     connection, sender can send that much more.
+//   - "close" (both directions), sender will not send more data for stream.
+//   - "reset" (both directions), stream is aborted because of Msg.
+type TunnelMessage struct {
+	Kind   string `json:"kind"`
+	Stream uint32 `json:"stream"`
+	Host   string `json:"host,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+	Msg    string `json:"msg,omitempty"`
+}
+
+// Each side can have at most tunnelWindow bytes of stream data not
+// acknowledged by the other side, so slow connection doesn't stall others.
+const tunnelWindow = 256 << 10
+
+const tunnelChunk = 32 << 10
+
+// How long to wait for agent to connect to the requested address.
+const tunnelDialTimeout = 15 * time.Second
+
+var ErrTunnelClosed = errors.New("tunnel connection closed")
+
+// TunnelMux multiplexes TCP streams over single WebSocket connection.
+// Server opens streams using Open, agent accepts them by dialing requested
+// address.
+type TunnelMux struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	dial      func(host string, port int) (net.Conn, error)
+
+	lock    sync.Mutex
+	streams map[uint32]*tunnelStream
+	nextID  uint32
+	idle    time.Time
+	// Count of streams ever opened.
+	total int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTunnelMux creates multiplexer for connection. dial is used to accept
+// streams, nil means that incoming "open" requests are rejected.
+func NewTunnelMux(conn *websocket.Conn, dial func(host string, port int) (net.Conn, error)) *TunnelMux {
+	return &TunnelMux{
+		conn:    conn,
+		dial:    dial,
+		streams: make(map[uint32]*tunnelStream),
+		idle:    time.Now(),
+		done:    make(chan struct{}),
+	}
+}
+
+// tunnelStream is one end of multiplexed stream, conn is local connection
+// data is relayed to and from.
+type tunnelStream struct {
+	m    *TunnelMux
+	id   uint32
+	conn io.ReadWriteCloser
+
+	opened chan error
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// Bytes we can send before other side acknowledges them.
+	credit int
+	// Data received from other side and not yet written to conn.
+	queue  [][]byte
+	queued int
+	// Other side will not send more data.
+	remoteClosed bool
+	// Other side knows that we will not send more data.
+	localClosed bool
+	reset       bool
+}
+
+func (m *TunnelMux) send(msg TunnelMessage) error {
+	blob, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return m.conn.WriteMessage(websocket.TextMessage, blob)
+}
+
+func (m *TunnelMux) sendData(id uint32, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, id)
+	copy(frame[4:], data)
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return m.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (m *TunnelMux) addStream(id uint32, conn io.ReadWriteCloser) *tunnelStream {
+	s := &tunnelStream{m: m, id: id, conn: conn, credit: tunnelWindow, opened: make(chan error, 1)}
+	s.cond = sync.NewCond(&s.lock)
+	m.lock.Lock()
+	m.streams[id] = s
+	m.total++
+	m.lock.Unlock()
+	return s
+}
+
+func (m *TunnelMux) stream(id uint32) *tunnelStream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.streams[id]
+}
+
+func (m *TunnelMux) removeStream(id uint32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.streams, id)
+	if len(m.streams) == 0 {
+		m.idle = time.Now()
+	}
+}
+
+// Streams returns count of active streams and time when last stream was
+// closed.
+func (m *TunnelMux) Streams() (int, time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.streams), m.idle
+}
+
+// Done returns channel that is closed when multiplexer is closed.
+func (m *TunnelMux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes connection and aborts all streams.
+func (m *TunnelMux) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.writeLock.Lock()
+		m.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		m.writeLock.Unlock()
+		m.conn.Close()
+
+		m.lock.Lock()
+		streams := make([]*tunnelStream, 0, len(m.streams))
+		for _, s := range m.streams {
+			streams = append(streams, s)
+		}
+		m.lock.Unlock()
+		for _, s := range streams {
+			s.abort(ErrTunnelClosed)
+		}
+	})
+	return nil
+}
+
+// Open asks other side to connect to host:port and relays conn to that
+// connection in background. Error is returned if other side failed to
+// connect. conn is closed when stream ends or Open fails.
+func (m *TunnelMux) Open(conn io.ReadWriteCloser, host string, port int) error {
+	m.lock.Lock()
+	m.nextID++
+	id := m.nextID
+	m.lock.Unlock()
+
+	s := m.addStream(id, conn)
+	if err := m.send(TunnelMessage{Kind: "open", Stream: id, Host: host, Port: port}); err != nil {
+		s.abort(err)
+		return err
+	}
+	select {
+	case err := <-s.opened:
+		if err != nil {
+			return err
+		}
+	case <-time.After(tunnelDialTimeout + 5*time.Second):
+		s.resetBoth("timed out waiting for connection")
+		return errors.New("timed out waiting for connection")
+	case <-m.done:
+		return ErrTunnelClosed
+	}
+	s.start()
+	return nil
+}
+
+func (m *TunnelMux) accept(id uint32, host string, port int) {
+	if m.dial == nil {
+		m.send(TunnelMessage{Kind: "reset", Stream: id, Msg: "streams can't be opened from this side"})
+		return
+	}
+	conn, err := m.dial(host, port)
+	if err != nil {
+		m.send(TunnelMessage{Kind: "reset", Stream: id, Msg: err.Error()})
+		return
+	}
+	select {
+	case <-m.done:
+		conn.Close()
+		return
+	default:
+	}
+	s := m.addStream(id, conn)
+	if err := m.send(TunnelMessage{Kind: "opened", Stream: id}); err != nil {
+		s.abort(err)
+		return
+	}
+	s.start()
+}
+
+// Serve reads messages from connection until it's closed. Multiplexer is
+// closed when Serve returns.
+func (m *TunnelMux) Serve() error {
+	defer m.Close()
+	for {
+		kind, data, err := m.conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-m.done:
+				return nil
+			default:
+			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+
+		if kind == websocket.BinaryMessage {
+			if len(data) < 4 {
+				continue
+			}
+			id := binary.BigEndian.Uint32(data)
+			if s := m.stream(id); s != nil {
+				s.push(data[4:])
+			}
+			continue
+		}
+
+		msg := TunnelMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Kind == "open" {
+			go m.accept(msg.Stream, msg.Host, msg.Port)
+			continue
+		}
+		s := m.stream(msg.Stream)
+		if s == nil {
+			continue
+		}
+		switch msg.Kind {
+		case "opened":
+			select {
+			case s.opened <- nil:
+			default:
+			}
+		case "ack":
+			s.lock.Lock()
+			s.credit += msg.Bytes
+			s.cond.Broadcast()
+			s.lock.Unlock()
+		case "close":
+			s.lock.Lock()
+			s.remoteClosed = true
+			s.cond.Broadcast()
+			s.lock.Unlock()
+		case "reset":
+			if msg.Msg == "" {
+				msg.Msg = "connection reset"
+			}
+			s.abort(errors.New(msg.Msg))
+		}
+	}
+}
+
+func (s *tunnelStream) start() {
+	go s.readLoop()
+	go s.writeLoop()
+}
+
+// push queues data received from other side.
+func (s *tunnelStream) push(data []byte) {
+	s.lock.Lock()
+	if s.queued+len(data) > tunnelWindow {
+		s.lock.Unlock()
+		// Other side ignores window, it's a bug.
+		s.resetBoth("flow control violation")
+		return
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	s.queue = append(s.queue, buf)
+	s.queued += len(buf)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// readLoop sends data read from local connection to other side.
+func (s *tunnelStream) readLoop() {
+	buf := make([]byte, tunnelChunk)
+	for {
+		s.lock.Lock()
+		for s.credit == 0 && !s.reset {
+			s.cond.Wait()
+		}
+		if s.reset {
+			s.lock.Unlock()
+			return
+		}
+		max := s.credit
+		s.lock.Unlock()
+		if max > len(buf) {
+			max = len(buf)
+		}
+
+		n, err := s.conn.Read(buf[:max])
+		if n != 0 {
+			s.lock.Lock()
+			s.credit -= n
+			s.lock.Unlock()
+			if err := s.m.sendData(s.id, buf[:n]); err != nil {
+				s.abort(err)
+				return
+			}
+		}
+		if err == io.EOF {
+			s.m.send(TunnelMessage{Kind: "close", Stream: s.id})
+			s.lock.Lock()
+			s.localClosed = true
+			s.cond.Broadcast()
+			s.lock.Unlock()
+			return
+		}
+		if err != nil {
+			s.resetBoth(err.Error())
+			return
+		}
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// errorCloser is implemented by connections that can tell their peer why
+// stream was aborted.
+type errorCloser interface {
+	CloseWithError(err error) error
+}
+
+// writeLoop writes data received from other side to local connection and
+// finishes stream when both directions are closed.
+func (s *tunnelStream) writeLoop() {
+	for {
+		s.lock.Lock()
+		for len(s.queue) == 0 && !s.remoteClosed && !s.reset {
+			s.cond.Wait()
+		}
+		if s.reset {
+			s.lock.Unlock()
+			return
+		}
+		if len(s.queue) == 0 {
+			// remoteClosed is set and everything is written.
+			s.lock.Unlock()
+			break
+		}
+		chunk := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queued -= len(chunk)
+		s.lock.Unlock()
+
+		if _, err := s.conn.Write(chunk); err != nil {
+			s.resetBoth(err.Error())
+			return
+		}
+		if err := s.m.send(TunnelMessage{Kind: "ack", Stream: s.id, Bytes: len(chunk)}); err != nil {
+			s.abort(err)
+			return
+		}
+	}
+
+	if cw, ok := s.conn.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		// Can't half-close, so peer will not be able to send anything
+		// anymore.
+		s.conn.Close()
+	}
+
+	s.lock.Lock()
+	for !s.localClosed && !s.reset {
+		s.cond.Wait()
+	}
+	s.lock.Unlock()
+	s.conn.Close()
+	s.m.removeStream(s.id)
+}
+
+// abort closes stream without notifying other side.
+func (s *tunnelStream) abort(err error) {
+	s.lock.Lock()
+	if s.reset {
+		s.lock.Unlock()
+		return
+	}
+	s.reset = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	select {
+	case s.opened <- err:
+	default:
+	}
+	if ec, ok := s.conn.(errorCloser); ok {
+		ec.CloseWithError(err)
+	} else {
+		s.conn.Close()
+	}
+	s.m.removeStream(s.id)
+}
+
+// resetBoth closes stream and tells other side to do the same.
+func (s *tunnelStream) resetBoth(msg string) {
+	s.lock.Lock()
+	reset := s.reset
+	s.lock.Unlock()
+	if reset {
+		// Already closed, probably that's why connection failed.
+		return
+	}
+	s.m.send(TunnelMessage{Kind: "reset", Stream: s.id, Msg: msg})
+	s.abort(errors.New(msg))
+}
+
+// dialTunnel resolves host once, so name that resolves to different
+// address after policy check can't be used to bypass it.
+func (c *Client) dialTunnel(host string, port int) (net.Conn, error) {
+	if port < 1 || port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelDialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses for " + host)
+	}
+	ip := addrs[0].IP
+	if c.Policy != nil {
+		if err := c.Policy.CheckTunnel(host, ip, port); err != nil {
+			return nil, errors.New("denied by local policy: " + err.Error())
+		}
+	}
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+// Tunnels connection is closed by agent after this time without streams.
+const tunnelIdleTimeout = 5 * time.Minute
+
+// TunnelStats is outcome of ServeTunnels.
+type TunnelStats struct {
+	Streams  int
+	Duration time.Duration
+}
+
+// ServeTunnels connects to server and accepts tunnel streams until
+// connection is lost, ctx is cancelled or there are no streams for 5
+// minutes. Addresses are checked against Policy.
+func (c *Client) ServeTunnels(ctx context.Context) (TunnelStats, error) {
+	stats := TunnelStats{}
+	req, err := http.NewRequest("GET", c.baseURL+"/tunnel_agent", nil)
+	if err != nil {
+		return stats, err
+	}
+	c.setHeaders(req)
+	// http -> ws, https -> wss
+	wsURL := strings.Replace(req.URL.String(), "http", "ws", 1)
+
+	dialer := websocket.Dialer{HandshakeTimeout: 30 * time.Second}
+	conn, resp, err := dialer.Dial(wsURL, req.Header)
+	if err != nil {
+		if err != websocket.ErrBadHandshake {
+			return stats, err
+		}
+		resp.Body.Close()
+		return stats, errors.New("tunnel connection rejected by server: " + resp.Status)
+	}
+
+	start := time.Now()
+	mux := NewTunnelMux(conn, c.dialTunnel)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- mux.Serve()
+	}()
+
+	check := time.NewTicker(10 * time.Second)
+	defer check.Stop()
+	ctxDone := ctx.Done()
+	for {
+		select {
+		case err := <-serveErr:
+			stats.Duration = time.Since(start)
+			mux.lock.Lock()
+			stats.Streams = mux.total
+			mux.lock.Unlock()
+			return stats, err
+		case <-ctxDone:
+			ctxDone = nil
+			mux.Close()
+		case <-check.C:
+			if count, idle := mux.Streams(); count == 0 && time.Since(idle) > tunnelIdleTimeout {
+				mux.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/inconshreveable/go-update"
+)
+
+// UpdateManifest describes agent binary released by admins.
+//
+// Signature is made using release key (not known to server) over message
+// returned by UpdateSignedMessage, so neither compromised server nor proxy
+// can push arbitrary binary or old vulnerable version to agents.
+type UpdateManifest struct {
+	Version int    `json:"version"`
+	URL     string `json:"url"`
+	// Hex-encoded SHA256 checksum of binary.
+	SHA256 string `json:"sha256"`
+	// Base64-encoded ed25519 signature.
+	Signature string `json:"signature"`
+}
+
+// UpdateSignedMessage returns message that should be signed by release key
+// for binary with specified version and SHA256 checksum.
+func UpdateSignedMessage(version int, checksum []byte) []byte {
+	return []byte(fmt.Sprintf("sutrc agent update %d %x", version, checksum))
+}
+
+// Verify checks manifest signature using release public key.
+func (m *UpdateManifest) Verify(key ed25519.PublicKey) error {
+	checksum, sig, err := m.decode()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, UpdateSignedMessage(m.Version, checksum), sig) {
+		return errors.New("invalid update signature")
+	}
+	return nil
+}
+
+func (m *UpdateManifest) decode() (checksum, sig []byte, err error) {
+	checksum, err = hex.DecodeString(m.SHA256)
+	if err != nil || len(checksum) != 32 {
+		return nil, nil, errors.New("malformed update checksum")
+	}
+	sig, err = base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, nil, errors.New("malformed update signature")
+	}
+	return checksum, sig, nil
+}
+
+// CheckUpdate asks server which agent version should be installed on this
+// machine. nil is returned if there is no newer version for us.
+func (c *Client) CheckUpdate() (*UpdateManifest, error) {
+	req, err := http.NewRequest("GET", c.baseURL+"/update_manifest", nil)
+	if err != nil {
+		return nil, fmt.Errorf("request create: %v", err)
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, httpError(resp)
+	}
+
+	m := UpdateManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("response body parse: %v", err)
+	}
+	if m.Version == 0 {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// updateState is saved on disk by ApplyUpdate and used by FinishUpdate to
+// check whether new version works.
+type updateState struct {
+	FromVersion int    `json:"from_version"`
+	ToVersion   int    `json:"to_version"`
+	Executable  string `json:"executable"`
+	OldPath     string `json:"old_path"`
+	// Number of times new version was started without passing health check.
+	Attempts   int    `json:"attempts"`
+	RolledBack bool   `json:"rolled_back"`
+	Msg        string `json:"msg"`
+}
+
+// Give up on new version if it didn't pass health check after this many
+// starts. Protects against versions that crash before they can roll back.
+const maxUpdateAttempts = 3
+
+// Delay between health checks rejected by server.
+var healthCheckRetry = 10 * time.Second
+
+// ApplyUpdate downloads agent binary described by manifest and replaces
+// current executable with it if checksum and signature are valid.
+//
+// Previous executable is kept and state is saved to statePath so
+// FinishUpdate called by new version can roll back if it doesn't work.
+// Caller is responsible for restarting agent after successful update.
+func (c *Client) ApplyUpdate(m *UpdateManifest, key ed25519.PublicKey, statePath string) error {
+	if m.Version <= AGENT_VERSION {
+		return fmt.Errorf("refusing to downgrade from %d to %d", AGENT_VERSION, m.Version)
+	}
+	if err := m.Verify(key); err != nil {
+		return err
+	}
+	checksum, sig, _ := m.decode()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	bin, err := c.Download(m.URL)
+	if err != nil {
+		return fmt.Errorf("download: %v", err)
+	}
+	defer bin.Close()
+
+	opts := update.Options{
+		Checksum:    checksum,
+		Signature:   sig,
+		PublicKey:   key,
+		Verifier:    ed25519Verifier(m.Version),
+		Hash:        crypto.SHA256,
+		OldSavePath: exe + ".old",
+	}
+	if err := update.Apply(bin, opts); err != nil {
+		if rerr := update.RollbackError(err); rerr != nil {
+			return fmt.Errorf("update failed: %v, rollback failed: %v", err, rerr)
+		}
+		return err
+	}
+
+	return saveUpdateState(statePath, updateState{
+		FromVersion: AGENT_VERSION,
+		ToVersion:   m.Version,
+		Executable:  exe,
+		OldPath:     opts.OldSavePath,
+	})
+}
+
+// ed25519Verifier implements update.Verifier for signatures made over
+// UpdateSignedMessage.
+type ed25519Verifier int
+
+func (v ed25519Verifier) VerifySignature(checksum, signature []byte, _ crypto.Hash, publicKey crypto.PublicKey) error {
+	key, ok := publicKey.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("not a valid ed25519 public key")
+	}
+	if !ed25519.Verify(key, UpdateSignedMessage(int(v), checksum), signature) {
+		return errors.New("invalid update signature")
+	}
+	return nil
+}
+
+// FinishUpdate should be called on each agent start before doing anything
+// else. If agent was just updated, it runs healthCheck and rolls back to
+// previous version if server keeps rejecting it (ErrAccessDenied,
+// ErrUpdateRequired or HTTPError is returned few times). Other errors (i.e.
+// server is not reachable) are retried with Client.Reconnect delays until
+// check passes. Result of update is reported to server.
+//
+// If restart is true, previous executable was restored and caller should
+// restart agent.
+func (c *Client) FinishUpdate(statePath string, healthCheck func() error) (restart bool, err error) {
+	state, err := loadUpdateState(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if state.ToVersion != AGENT_VERSION {
+		// We are previous version started after rollback (or update was
+		// replaced by something else).
+		status := "rolled_back"
+		if !state.RolledBack {
+			status = "failed"
+		}
+		if err := c.ReportUpdate(state.FromVersion, state.ToVersion, status, state.Msg); err != nil {
+			log.Println("Failed to report update result:", err)
+		}
+		return false, os.Remove(statePath)
+	}
+
+	state.Attempts++
+	if state.Attempts > maxUpdateAttempts {
+		return true, rollbackUpdate(statePath, state, "new version failed to start")
+	}
+	if err := saveUpdateState(statePath, state); err != nil {
+		return false, err
+	}
+
+	// Server may be unreachable for reasons that have nothing to do with
+	// update (e.g. network is not up yet at boot), so only errors returned
+	// by server itself count.
+	failures := 0
+	for {
+		err = healthCheck()
+		if err == nil {
+			break
+		}
+		if !isServerError(err) {
+			delay := c.Reconnect.Next()
+			log.Printf("Update health check failed: %v, retrying in %v", err, delay.Round(time.Millisecond))
+			time.Sleep(delay)
+			continue
+		}
+		log.Println("Update health check failed:", err)
+		failures++
+		if failures == 5 {
+			return true, rollbackUpdate(statePath, state, "health check failed: "+err.Error())
+		}
+		time.Sleep(healthCheckRetry)
+	}
+	c.Reconnect.Reset()
+
+	if err := os.Remove(state.OldPath); err != nil {
+		log.Println("Failed to remove previous executable:", err)
+	}
+	if err := c.ReportUpdate(state.FromVersion, state.ToVersion, "ok", ""); err != nil {
+		log.Println("Failed to report update result:", err)
+	}
+	return false, os.Remove(statePath)
+}
+
+// isServerError reports whether err is a response from server, as opposed to
+// network error.
+func isServerError(err error) bool {
+	if err == ErrAccessDenied || err == ErrUpdateRequired {
+		return true
+	}
+	_, ok := err.(*HTTPError)
+	return ok
+}
+
+func rollbackUpdate(statePath string, state updateState, reason string) error {
+	log.Printf("Rolling back to version %d: %s", state.FromVersion, reason)
+
+	// Running executable can't be overwritten on Windows but can be renamed.
+	failedPath := state.Executable + ".failed"
+	os.Remove(failedPath)
+	if err := os.Rename(state.Executable, failedPath); err != nil {
+		return err
+	}
+	if err := os.Rename(state.OldPath, state.Executable); err != nil {
+		// Try to put at least something back.
+		os.Rename(failedPath, state.Executable)
+		return err
+	}
+
+	state.RolledBack = true
+	state.Msg = reason
+	return saveUpdateState(statePath, state)
+}
+
+func loadUpdateState(path string) (updateState, error) {
+	state := updateState{}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(blob, &state)
+}
+
+func saveUpdateState(path string, state updateState) error {
+	blob, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, blob, 0600)
+}
+
+// ReportUpdate tells server about update result. status is one of "ok",
+// "rolled_back" or "failed".
+func (c *Client) ReportUpdate(fromVersion, toVersion int, status, msg string) error {
+	blob, err := json.Marshal(map[string]interface{}{
+		"from":   fromVersion,
+		"to":     toVersion,
+		"status": status,
+		"msg":    msg,
+	})
+	if err != nil {
+		return fmt.Errorf("json format: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/update_report", bytes.NewReader(blob))
+	if err != nil {
+		return fmt.Errorf("request create: %v", err)
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpError(resp)
+	}
+	return nil
+}
+
+// ParsePublicKey decodes base64-encoded ed25519 public key (release key or
+// admin's key used to sign tasks).
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid key length " + strconv.Itoa(len(key)))
+	}
+	return ed25519.PublicKey(key), nil
+}
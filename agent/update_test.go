@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startUpdate prepares state of update to current version as if agent was
+// just started after it and returns path of state file. Reports sent to
+// server are collected in reports.
+func startUpdate(t *testing.T, dir string) (*Client, string, *[]string) {
+	t.Helper()
+	var lock sync.Mutex
+	reports := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		reports = append(reports, string(blob))
+		lock.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	exe := filepath.Join(dir, "agent.exe")
+	old := filepath.Join(dir, "agent.exe.old")
+	if err := ioutil.WriteFile(exe, []byte("new"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(old, []byte("old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, "update.json")
+	state := updateState{FromVersion: AGENT_VERSION - 1, ToVersion: AGENT_VERSION, Executable: exe, OldPath: old}
+	if err := saveUpdateState(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(srv.URL)
+	c.Reconnect = Backoff{Min: time.Millisecond, Max: time.Millisecond}
+	return &c, statePath, &reports
+}
+
+// Network errors don't cause rollback, they are retried until server is
+// reachable.
+func TestFinishUpdateNetworkDown(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, statePath, reports := startUpdate(t, dir)
+
+	checks := 0
+	restart, err := c.FinishUpdate(statePath, func() error {
+		checks++
+		if checks <= 10 {
+			return errors.New("dial tcp: connect: network is unreachable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restart {
+		t.Fatal("update rolled back because of network errors")
+	}
+	if data := readTestFile(t, filepath.Join(dir, "agent.exe")); data != "new" {
+		t.Error("executable replaced:", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agent.exe.old")); !os.IsNotExist(err) {
+		t.Error("previous executable is not removed:", err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Error("update state is not removed:", err)
+	}
+	if len(*reports) != 1 {
+		t.Error("update result is not reported:", *reports)
+	}
+}
+
+func TestFinishUpdateRejected(t *testing.T) {
+	defer func(prev time.Duration) { healthCheckRetry = prev }(healthCheckRetry)
+	healthCheckRetry = time.Millisecond
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, statePath, _ := startUpdate(t, dir)
+
+	restart, err := c.FinishUpdate(statePath, func() error {
+		return &HTTPError{Status: http.StatusInternalServerError, Msg: "broken"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restart {
+		t.Fatal("update is not rolled back")
+	}
+	if data := readTestFile(t, filepath.Join(dir, "agent.exe")); data != "old" {
+		t.Error("previous executable is not restored:", data)
+	}
+	state, err := loadUpdateState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.RolledBack || state.Msg != "health check failed: broken" {
+		t.Error("unexpected state:", state)
+	}
+}
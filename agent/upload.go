@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Size of chunks used by UploadFile, server may request smaller chunks.
+const uploadChunkSize = 1 << 20
+
+// UploadFile gives up after that many failed attempts in a row.
+const maxUploadRetries = 10
+
+// UploadFile uploads data from src to server using chunked upload protocol
+// and returns URL of uploaded file.
+//
+// Size should be -1 if it's not known in advance. If taskID is not zero,
+// server reports upload progress to admins as progress of that task.
+//
+// Failed chunks are retried with exponential backoff. If src implements
+// io.Seeker, upload also can be resumed from any offset server reports,
+// otherwise only last chunk can be retried.
+func (c *Client) UploadFile(src io.Reader, size int64, taskID int) (string, error) {
+	id, maxChunk, err := c.createUpload(size, taskID)
+	if err != nil {
+		return "", err
+	}
+	u := upload{c: c, id: id, src: src, hash: sha256.New()}
+
+	chunkSize := uploadChunkSize
+	if maxChunk > 0 && maxChunk < chunkSize {
+		chunkSize = maxChunk
+	}
+	buf := make([]byte, chunkSize)
+
+	eof := false
+	for !eof {
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			c.abortUpload(id)
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+
+		resync, err := u.putChunk(buf[:n])
+		if err != nil {
+			c.abortUpload(id)
+			return "", err
+		}
+		if resync {
+			// Server has different amount of data, we seeked src to it and
+			// need to read next chunk again.
+			eof = false
+		}
+	}
+
+	var fileURL string
+	err = u.retry(func() error {
+		var err error
+		fileURL, err = c.finishUpload(id, hex.EncodeToString(u.hash.Sum(nil)))
+		return err
+	})
+	if err != nil {
+		c.abortUpload(id)
+		return "", err
+	}
+	return fileURL, nil
+}
+
+type upload struct {
+	c      *Client
+	id     string
+	src    io.Reader
+	offset int64
+	// hash of data from 0 to offset.
+	hash  hash.Hash
+	delay Backoff
+}
+
+// putChunk sends chunk and makes sure server saved it.
+//
+// If server has different amount of data and src is seekable, src is moved
+// to offset saved by server and resync=true is returned.
+func (u *upload) putChunk(chunk []byte) (resync bool, err error) {
+	failures := 0
+	for {
+		err := u.c.putUploadChunk(u.id, u.offset, chunk)
+		if err == nil {
+			break
+		}
+		failures++
+		if !retryableUploadError(err) || failures >= maxUploadRetries {
+			return false, err
+		}
+		delay := u.delay.Next()
+		log.Printf("Upload %s: chunk at offset %d failed (%v), retrying in %v\n", u.id, u.offset, err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+
+		// Find out what server actually has. Maybe chunk was saved but we
+		// didn't get response.
+		offset, err := u.c.uploadOffset(u.id)
+		if err != nil {
+			if !retryableUploadError(err) {
+				return false, err
+			}
+			continue
+		}
+		if offset == u.offset {
+			continue
+		}
+		if offset == u.offset+int64(len(chunk)) {
+			break
+		}
+		if err := u.seek(offset); err != nil {
+			return false, err
+		}
+		u.delay.Reset()
+		return true, nil
+	}
+
+	u.hash.Write(chunk)
+	u.offset += int64(len(chunk))
+	u.delay.Reset()
+	return false, nil
+}
+
+// seek moves src to specified offset and recomputes hash of data before it.
+func (u *upload) seek(offset int64) error {
+	seeker, ok := u.src.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("server has %d bytes instead of %d and source can't be rewound", offset, u.offset)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	u.hash.Reset()
+	if _, err := io.CopyN(u.hash, u.src, offset); err != nil {
+		return fmt.Errorf("rewind to %d: %v", offset, err)
+	}
+	log.Printf("Upload %s: resuming from offset %d\n", u.id, offset)
+	u.offset = offset
+	return nil
+}
+
+func (u *upload) retry(f func() error) error {
+	for failures := 1; ; failures++ {
+		err := f()
+		if err == nil || !retryableUploadError(err) || failures >= maxUploadRetries {
+			return err
+		}
+		delay := u.delay.Next()
+		log.Printf("Upload %s: %v, retrying in %v\n", u.id, err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// retryableUploadError reports whether request failed because of network or
+// server issues and may succeed if retried.
+func retryableUploadError(err error) bool {
+	if err == ErrAccessDenied || err == ErrUpdateRequired {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		// 409 is returned if offset doesn't match or session is busy
+		// with our previous request.
+		return httpErr.Temporary() || httpErr.Status == http.StatusConflict
+	}
+	return true
+}
+
+func (c *Client) uploadsRequest(method, path string, query url.Values, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req)
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("response decode: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) createUpload(size int64, taskID int) (id string, maxChunk int, err error) {
+	reqBody := map[string]interface{}{}
+	if size >= 0 {
+		reqBody["size"] = size
+	}
+	if taskID != 0 {
+		reqBody["task_id"] = taskID
+	}
+	blob, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", 0, err
+	}
+	resp := struct {
+		ID       string `json:"id"`
+		MaxChunk int    `json:"max_chunk"`
+	}{}
+	if err := c.uploadsRequest("POST", "/uploads", nil, blob, &resp); err != nil {
+		return "", 0, err
+	}
+	return resp.ID, resp.MaxChunk, nil
+}
+
+func (c *Client) putUploadChunk(id string, offset int64, chunk []byte) error {
+	sum := sha256.Sum256(chunk)
+	query := url.Values{}
+	query.Set("id", id)
+	query.Set("offset", strconv.FormatInt(offset, 10))
+	query.Set("sha256", hex.EncodeToString(sum[:]))
+	return c.uploadsRequest("PUT", "/uploads", query, chunk, nil)
+}
+
+func (c *Client) uploadOffset(id string) (int64, error) {
+	resp := struct {
+		Offset int64 `json:"offset"`
+	}{}
+	err := c.uploadsRequest("GET", "/uploads", url.Values{"id": {id}}, nil, &resp)
+	return resp.Offset, err
+}
+
+func (c *Client) finishUpload(id, checksum string) (string, error) {
+	resp := struct {
+		URL string `json:"url"`
+	}{}
+	query := url.Values{}
+	query.Set("id", id)
+	query.Set("sha256", checksum)
+	err := c.uploadsRequest("POST", "/uploads_finish", query, nil, &resp)
+	return resp.URL, err
+}
+
+// abortUpload removes upload session from server, errors are only logged.
+func (c *Client) abortUpload(id string) {
+	if err := c.uploadsRequest("DELETE", "/uploads", url.Values{"id": {id}}, nil, nil); err != nil {
+		log.Printf("Upload %s: failed to abort: %v\n", id, err)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSMessage is a message sent over tasks WebSocket (GET /tasks_ws) in both
+// directions. Kind is one of:
+// - "task" (server -> agent), Task is set.
+// - "result" (agent -> server), ID and Result are set.
+// - "ack" (server -> agent), result of task ID is saved by server.
+// - "cancel" (server -> agent), admin asked to abort task ID.
+// - "ping" (both directions), should be answered with "pong".
+type WSMessage struct {
+	Kind   string                 `json:"kind"`
+	ID     int                    `json:"id,omitempty"`
+	Task   map[string]interface{} `json:"task,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+}
+
+// How long to use long polling after server refused WebSocket connection.
+const wsFallbackTime = 10 * time.Minute
+
+// wsConn is a single WebSocket connection to server.
+type wsConn struct {
+	c *websocket.Conn
+
+	// Tasks received but not yet taken by wsNextTask. Queue is not limited so
+	// reader never blocks on it and keeps answering pings while agent is busy
+	// with previous tasks.
+	queueLock sync.Mutex
+	queue     []map[string]interface{}
+	// Receives value when task is added to queue.
+	queued chan struct{}
+	// Closed when connection is lost.
+	closed chan struct{}
+
+	writeLock sync.Mutex
+}
+
+func (conn *wsConn) push(task map[string]interface{}) {
+	conn.queueLock.Lock()
+	conn.queue = append(conn.queue, task)
+	conn.queueLock.Unlock()
+
+	select {
+	case conn.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (conn *wsConn) pop() map[string]interface{} {
+	conn.queueLock.Lock()
+	defer conn.queueLock.Unlock()
+	if len(conn.queue) == 0 {
+		return nil
+	}
+	task := conn.queue[0]
+	conn.queue[0] = nil
+	conn.queue = conn.queue[1:]
+	return task
+}
+
+func (conn *wsConn) send(msg WSMessage) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.c.WriteJSON(msg)
+}
+
+type wsState struct {
+	lock          sync.Mutex
+	conn          *wsConn
+	fallbackUntil time.Time
+}
+
+func (s *wsState) current() *wsConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn
+}
+
+// wsConnect returns current WebSocket connection or establishes new one.
+// nil is returned without error if server doesn't support WebSockets and
+// long polling should be used.
+func (c *Client) wsConnect() (*wsConn, error) {
+	c.ws.lock.Lock()
+	defer c.ws.lock.Unlock()
+
+	if c.ws.conn != nil {
+		return c.ws.conn, nil
+	}
+	if time.Now().Before(c.ws.fallbackUntil) {
+		return nil, nil
+	}
+
+	req, err := http.NewRequest("GET", c.baseURL+"/tasks_ws", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req)
+	// http -> ws, https -> wss
+	wsURL := strings.Replace(req.URL.String(), "http", "ws", 1)
+
+	dialer := websocket.Dialer{HandshakeTimeout: 30 * time.Second}
+	rawConn, resp, err := dialer.Dial(wsURL, req.Header)
+	if err != nil {
+		if err != websocket.ErrBadHandshake {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusForbidden:
+			return nil, ErrAccessDenied
+		case http.StatusUpgradeRequired:
+			return nil, ErrUpdateRequired
+		}
+		log.Println("WebSocket is not available (" + resp.Status + "), falling back to long polling")
+		c.ws.fallbackUntil = time.Now().Add(wsFallbackTime)
+		return nil, nil
+	}
+
+	conn := &wsConn{c: rawConn, queued: make(chan struct{}, 1), closed: make(chan struct{})}
+	c.ws.conn = conn
+	go c.wsReader(conn)
+	return conn, nil
+}
+
+func (c *Client) wsReader(conn *wsConn) {
+	defer func() {
+		c.ws.lock.Lock()
+		if c.ws.conn == conn {
+			c.ws.conn = nil
+		}
+		c.ws.lock.Unlock()
+		conn.c.Close()
+		close(conn.closed)
+	}()
+
+	for {
+		// Server sends pings every 20 seconds.
+		conn.c.SetReadDeadline(time.Now().Add(60 * time.Second))
+		msg := WSMessage{}
+		if err := conn.c.ReadJSON(&msg); err != nil {
+			log.Println("WebSocket connection lost:", err)
+			return
+		}
+
+		switch msg.Kind {
+		case "task":
+			conn.push(msg.Task)
+		case "cancel":
+			c.tasks.cancel(msg.ID)
+		case "ack":
+			if c.OutboxDir != "" {
+				c.outbox.remove(c.OutboxDir, msg.ID)
+			}
+		case "ping":
+			if err := conn.send(WSMessage{Kind: "pong"}); err != nil {
+				log.Println("WebSocket connection lost:", err)
+				return
+			}
+		}
+	}
+}
+
+// wsNextTask waits for task from server for up to 26 seconds (to match long
+// polling behaviour). Tasks received before connection was lost are still
+// returned.
+func (c *Client) wsNextTask(conn *wsConn) (map[string]interface{}, error) {
+	timeout := time.NewTimer(26 * time.Second)
+	defer timeout.Stop()
+
+	for {
+		if task := conn.pop(); task != nil {
+			return task, nil
+		}
+		select {
+		case <-conn.queued:
+		case <-conn.closed:
+			if task := conn.pop(); task != nil {
+				return task, nil
+			}
+			return nil, errors.New("connection lost")
+		case <-timeout.C:
+			return nil, nil
+		}
+	}
+}
+
+// taskTracker keeps contexts of tasks being executed so they can be
+// cancelled by server.
+type taskTracker struct {
+	lock    sync.Mutex
+	cancels map[int]context.CancelFunc
+	ctxs    map[int]context.Context
+}
+
+func (t *taskTracker) start(id int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ctxs == nil {
+		t.ctxs = make(map[int]context.Context)
+		t.cancels = make(map[int]context.CancelFunc)
+	}
+	t.ctxs[id], t.cancels[id] = context.WithCancel(context.Background())
+}
+
+func (t *taskTracker) cancel(id int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if cancel := t.cancels[id]; cancel != nil {
+		cancel()
+	}
+}
+
+func (t *taskTracker) finish(id int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if cancel := t.cancels[id]; cancel != nil {
+		cancel()
+	}
+	delete(t.ctxs, id)
+	delete(t.cancels, id)
+}
+
+// TaskContext returns context that is cancelled when admin cancels task
+// (POST /task_cancel) or result is sent. Cancellation is supported only
+// when WebSocket transport is used.
+func (c *Client) TaskContext(taskID int) context.Context {
+	c.tasks.lock.Lock()
+	defer c.tasks.lock.Unlock()
+	if ctx := c.tasks.ctxs[taskID]; ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2018  Vladyslav Yamkovyi (Hexawolf), Maks Mazurov (fox.cpp)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSPingWhileBusy(t *testing.T) {
+	const tasksCount = 100
+
+	pong := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for i := 1; i <= tasksCount; i++ {
+			task := map[string]interface{}{"id": float64(i), "type": "proclist"}
+			if err := conn.WriteJSON(WSMessage{Kind: "task", Task: task}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := conn.WriteJSON(WSMessage{Kind: "ping"}); err != nil {
+			t.Error(err)
+			return
+		}
+		msg := WSMessage{}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Error("no pong:", err)
+			return
+		}
+		if msg.Kind == "pong" {
+			close(pong)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+	conn, err := c.wsConnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Fatal("WebSocket not used")
+	}
+
+	// Nobody takes tasks until pong is received.
+	select {
+	case <-pong:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping is not answered while tasks are queued")
+	}
+
+	for i := 1; i <= tasksCount; i++ {
+		task, err := c.wsNextTask(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task == nil || task["id"] != float64(i) {
+			t.Fatalf("expected task %d, got %v", i, task)
+		}
+	}
+	// Server closed connection after pong.
+	if _, err := c.wsNextTask(conn); err == nil {
+		t.Error("expected error for lost connection")
+	}
+}
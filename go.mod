@@ -6,6 +6,7 @@ require (
 	github.com/foxcpp/filedrop v1.0.0
 	github.com/gen2brain/shm v0.0.0-20180314170312-6c18ff7f8b90 // indirect
 	github.com/go-sql-driver/mysql v1.4.0
+	github.com/gorilla/websocket v1.4.0
 	github.com/inconshreveable/go-update v0.0.0-20160112193335-8152e7eb6ccf
 	github.com/kbinani/screenshot v0.0.0-20181208081317-762b39512ae8
 	github.com/kr/pretty v0.1.0 // indirect
@@ -42,6 +42,38 @@ const description = "Implements remote control functionality and performs backgr
 var baseURL string
 var apiURL = baseURL + "/api"
 
+// updateKey is base64-encoded ed25519 public key used to verify agent
+// updates. Should be set using `go build -ldflags "-X main.updateKey=..."`,
+// agent refuses to update itself if it's empty.
+var updateKey string
+
+const updateStatePath = `C:\sutrc\update.json`
+
+// If trustedKeysPath exists, agent executes only tasks signed by admin keys
+// listed in it.
+const trustedKeysPath = `C:\sutrc\trusted_keys`
+const noncesPath = `C:\sutrc\nonces.json`
+
+// Local restrictions on tasks, see agent.Policy.
+const policyPath = `C:\sutrc\policy.yml`
+
+// Undelivered task results are kept here.
+const outboxDir = `C:\sutrc\outbox`
+
+// Downloaded files are cached here, up to cacheMaxSize bytes.
+const cacheDir = `C:\sutrc\cache`
+const cacheMaxSize = 2 << 30
+
+// Journals and output of detached jobs are kept here.
+const jobsDir = `C:\sutrc\jobs`
+
+var jobs = &agent.Jobs{Dir: jobsDir}
+
+// Cached files are served to other agents on this address, interface used
+// to connect to server is used if host is omitted. Can be set using
+// `go build -ldflags "-X main.peerAddr=..."`.
+var peerAddr = ":18091"
+
 func initLog() {
 	logDir := `C:\sutrc\logs`
 	if err := os.MkdirAll(logDir, os.ModePerm); err != nil {
@@ -58,9 +90,66 @@ func initLog() {
 }
 
 func main() {
+	// Detached jobs are supervised by separate agent process.
+	agent.RunJobSupervisor()
+
 	initLog()
 
 	client := agent.NewClient(apiURL)
+	// Server learns about supported task types during registration, so
+	// this should be set before RegisterAgent.
+	client.SupportedTaskTypes = []string{
+		"execute_cmd",
+		"run_script",
+		"proclist",
+		"killproc",
+		"downloadfile",
+		"uploadfile",
+		"uploaddir",
+		"downloadarchive",
+		"readfile",
+		"writefile",
+		"dircontents",
+		"findfiles",
+		"deletefile",
+		"movefile",
+		"screenshot",
+		"update",
+		"inventory",
+		"cache_query",
+		"shell",
+		"tunnel",
+		"spawn_job",
+		"job_status",
+		"job_output",
+		"job_kill",
+	}
+	client.OutboxDir = outboxDir
+	client.Cache = &agent.Cache{Dir: cacheDir, MaxSize: cacheMaxSize}
+	client.UsePeers = true
+
+	keys, err := agent.LoadTrustedKeys(trustedKeysPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("Failed to load trusted keys:", err)
+	}
+	if keys != nil {
+		log.Println("Loaded", len(keys), "trusted keys, unsigned tasks will be rejected")
+		client.TrustedKeys = keys
+		client.NonceFile = noncesPath
+		// Update manifests are signed separately. Shell sessions and
+		// tunnels are created by server and can't be signed, so they are
+		// not available unless listed here.
+		client.UnsignedTaskTypes = []string{"update"}
+	}
+
+	policy, err := agent.LoadPolicy(policyPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("Failed to load policy:", err)
+	}
+	if policy != nil {
+		log.Println("Loaded local policy from", policyPath)
+		client.Policy = policy
+	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -77,6 +166,19 @@ func main() {
 	// first launch. This function uses hostname and HWID to get something unique from both
 	// sides and uses it as a machine fingerprint.
 	hwid, err := machineid.ProtectedID(hostname)
+	client.UseAccount(string(hwid))
+
+	// If we were just updated - check that we can talk to server, otherwise
+	// previous version is restored.
+	restart, err := client.FinishUpdate(updateStatePath, func() error {
+		return client.RegisterAgent(hostname, hwid)
+	})
+	if err != nil {
+		log.Println("Failed to finish update:", err)
+	}
+	if restart {
+		restartAgent()
+	}
 
 	// The sutrc protocol enforces agent registration. This creates some obvious stage of
 	// "agent installation", which will probably never be executed in some cases (ops error).
@@ -91,82 +193,138 @@ func main() {
 	// considered a bug. Immediately after installation, the hostname will be changed and after
 	// reboot agent will be functioning properly, with new, unique HWID passed to this function.
 	// HWID must not be duplicated in real life. This is bad, very bad and not even sutrc's problem.
-	if err := client.RegisterAgent(hostname, hwid); err != nil {
-		log.Fatalf("failed to register on central server: %s", err)
+	//
+	// Server may be unavailable at boot time though, so keep trying unless
+	// we are explicitly rejected.
+	for {
+		err := client.RegisterAgent(hostname, hwid)
+		if err == nil {
+			break
+		}
+		if err == agent.ErrAccessDenied {
+			log.Fatalf("failed to register on central server: %s", err)
+		}
+		delay := client.Reconnect.Next()
+		log.Printf("Failed to register on central server: %v, retrying in %v", err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
 	}
+	client.Reconnect.Reset()
 
-	log.Println("Starting longpolling")
+	client.OnCredentialsRevoked = func() {
+		log.Println("Server rejected our credentials, agent was probably removed")
+	}
 
-	client.SupportedTaskTypes = []string{
-		"execute_cmd",
-		"proclist",
-		"downloadfile",
-		"uploadfile",
-		"dircontents",
-		"deletefile",
-		"movefile",
-		"screenshot",
-		"update",
+	client.StartHeartbeats(time.Minute)
+	client.StartInventory(6 * time.Hour)
+	if err := client.ServePeers(peerAddr); err != nil {
+		log.Println("Failed to start serving files to peers:", err)
 	}
-	client.UseAccount(string(hwid))
+
+	log.Println("Starting longpolling")
+
+	// Server keeps refusing us until we are updated, but there may be no
+	// newer release to update to yet, so don't retry update immediately.
+	updateRetry := agent.Backoff{Min: time.Minute, Max: time.Hour}
 	for {
-		id, ttype, body, err := client.PollTasks()
-		if err != nil {
-			log.Println("Error during task polling:", err)
-			if err.Error() == "access denied" {
-				log.Println("Exiting!")
-				os.Exit(1)
-				return
-			}
-			if id != -1 {
-				go client.SendTaskResult(id, map[string]interface{}{"error": true, "msg": err.Error()})
+		id, ttype, body, err := client.NextTask()
+		if err == agent.ErrUpdateRequired {
+			log.Println("Server requires agent update")
+			if err := selfUpdate(&client); err != nil {
+				log.Println("Update failed:", err)
+			} else {
+				// Returns only if new process can't be started.
+				restartAgent()
 			}
-			time.Sleep(30 * time.Second)
+			delay := updateRetry.Next()
+			log.Println("Retrying update in", delay.Round(time.Second))
+			time.Sleep(delay)
 			continue
 		}
-		if id == -1 {
-			continue
+		if err != nil {
+			log.Println("Error during task polling:", err)
+			log.Println("Exiting!")
+			os.Exit(1)
+			return
 		}
+		updateRetry.Reset()
 		log.Println("Received task", body)
 		switch ttype {
 		case "execute_cmd":
 			executeCmdTask(&client, id, body)
+		case "run_script":
+			runScriptTask(&client, id, body)
 		case "proclist":
 			proclistTask(&client, id, body)
+		case "killproc":
+			killprocTask(&client, id, body)
 		case "downloadfile":
 			downloadFileTask(&client, id, body)
 		case "uploadfile":
 			uploadFileTask(&client, id, body)
+		case "uploaddir":
+			go uploadDirTask(&client, id, body)
+		case "downloadarchive":
+			go downloadArchiveTask(&client, id, body)
+		case "readfile":
+			readFileTask(&client, id, body)
+		case "writefile":
+			writeFileTask(&client, id, body)
 		case "dircontents":
 			dirContentsTask(&client, id, body)
+		case "findfiles":
+			// Walking whole disk can take a while.
+			go findFilesTask(&client, id, body)
 		case "deletefile":
 			deleteFileTask(&client, id, body)
 		case "movefile":
 			moveFileTask(&client, id, body)
 		case "screenshot":
 			screenshotTask(&client, id, body)
+		case "inventory":
+			inventoryTask(&client, id, body)
+		case "cache_query":
+			cacheQueryTask(&client, id, body)
+		case "shell":
+			// Session can last for hours, don't block other tasks.
+			go shellTask(&client, id, body)
+		case "tunnel":
+			go tunnelTask(&client, id, body)
+		case "spawn_job":
+			spawnJobTask(&client, id, body)
+		case "job_status":
+			jobStatusTask(&client, id, body)
+		case "job_output":
+			jobOutputTask(&client, id, body)
+		case "job_kill":
+			jobKillTask(&client, id, body)
 		case "update":
-			selfUpdateTask(&client, id, body)
-
-			// Golang have a very weird logic somewhere that prevents us from
-			// leaving a running children process and terminate.
-			// So basicallly we have to "hide" children from golang code by
-			// calling CreateProcess directly.
-
-			cmd, err := windows.UTF16PtrFromString(`C:\sutrc\sutagent.exe`)
-			if err != nil {
-				panic(err)
-			}
-			si := windows.StartupInfo{}        // It's important to pass these structures
-			pi := windows.ProcessInformation{} // otherwise it will fail.
-			err = windows.CreateProcess(cmd, cmd, nil, nil, false, 0, nil, nil, &si, &pi)
-			if err != nil {
-				log.Println(err)
-			} else {
-				log.Println("Exiting")
-				os.Exit(0)
+			if selfUpdateTask(&client, id, body) {
+				restartAgent()
 			}
 		}
 	}
 
 }
+
+// restartAgent starts new agent process and exits. Returns only if new
+// process creation failed.
+func restartAgent() {
+	// Golang have a very weird logic somewhere that prevents us from
+	// leaving a running children process and terminate.
+	// So basicallly we have to "hide" children from golang code by
+	// calling CreateProcess directly.
+
+	cmd, err := windows.UTF16PtrFromString(`C:\sutrc\sutagent.exe`)
+	if err != nil {
+		panic(err)
+	}
+	si := windows.StartupInfo{}        // It's important to pass these structures
+	pi := windows.ProcessInformation{} // otherwise it will fail.
+	err = windows.CreateProcess(cmd, cmd, nil, nil, false, 0, nil, nil, &si, &pi)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("Exiting")
+		os.Exit(0)
+	}
+}
@@ -23,20 +23,67 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"image/jpeg"
 	"image/png"
 	"io"
-	"io/ioutil"
+	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"syscall"
 
 	"github.com/foxcpp/sutrc/agent"
-	"github.com/inconshreveable/go-update"
 	"github.com/kbinani/screenshot"
 )
 
+func readFileTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	path, ok := body["path"].(string)
+	if !ok {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "path should be string"})
+		return
+	}
+
+	file, err := agent.ReadInlineFile(path)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{
+		"error":    false,
+		"data":     base64.StdEncoding.EncodeToString(file.Data),
+		"sha256":   file.SHA256,
+		"size":     len(file.Data),
+		"modified": file.Modified.Unix(),
+	})
+}
+
+func writeFileTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	opts, err := agent.ParseWriteFile(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+
+	res, err := agent.WriteInlineFile(opts)
+	if err != nil {
+		if changed, ok := err.(agent.FileChangedError); ok {
+			client.SendTaskResult(taskID, map[string]interface{}{
+				"error":    true,
+				"conflict": true,
+				"sha256":   changed.SHA256,
+				"msg":      err.Error(),
+			})
+			return
+		}
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	result := map[string]interface{}{"error": false, "sha256": res.SHA256, "size": res.Size}
+	if res.BackupPath != "" {
+		result["backup"] = res.BackupPath
+	}
+	client.SendTaskResult(taskID, result)
+}
+
 func deleteFileTask(client *agent.Client, taskID int, body map[string]interface{}) {
 	path, ok := body["path"].(string)
 	if !ok {
@@ -82,8 +129,14 @@ func uploadFileTask(client *agent.Client, taskID int, body map[string]interface{
 		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
 
-	url, err := client.UploadFile(file)
+	url, err := client.UploadFile(file, stat.Size(), taskID)
 	if err != nil {
 		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Upload fail: " + err.Error()})
 		return
@@ -92,6 +145,27 @@ func uploadFileTask(client *agent.Client, taskID int, body map[string]interface{
 	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "url": url})
 }
 
+func uploadDirTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	opts, err := agent.ParseUploadDir(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+
+	res, err := client.UploadDir(client.TaskContext(taskID), opts, taskID)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Upload fail: " + err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{
+		"error":  false,
+		"url":    res.URL,
+		"format": opts.Format,
+		"files":  res.Files,
+		"size":   res.Size,
+	})
+}
+
 func dirContentsTask(client *agent.Client, taskID int, body map[string]interface{}) {
 	path, ok := body["dir"].(string)
 	if !ok {
@@ -99,26 +173,46 @@ func dirContentsTask(client *agent.Client, taskID int, body map[string]interface
 		return
 	}
 
-	dirInfo, err := ioutil.ReadDir(path)
+	contents, err := agent.ListDir(path)
 	if err != nil {
 		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
+	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "contents": contents})
+}
 
-	res := []map[string]interface{}{}
-	for _, entry := range dirInfo {
-		res = append(res, map[string]interface{}{
-			"name":     entry.Name(),
-			"dir":      entry.IsDir(),
-			"fullpath": filepath.Join(path, entry.Name()),
-		})
+func findFilesTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	opts, err := agent.ParseFindFiles(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	if client.Policy != nil {
+		// Only root is checked before task is accepted.
+		opts.Skip = func(path string) bool {
+			return client.Policy.CheckPath(path) != nil
+		}
 	}
-	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "contents": res})
+
+	res, err := agent.FindFiles(client.TaskContext(taskID), opts)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{
+		"error":      false,
+		"files":      res.Files,
+		"total_size": res.TotalSize,
+		"truncated":  res.Truncated,
+		"scanned":    res.Scanned,
+		"errors":     res.Errors,
+	})
 }
 
 func downloadFileTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	// url can be omitted if file with specified sha256 is cached.
 	url, ok := body["url"].(string)
-	if !ok {
+	if _, prs := body["url"]; prs && !ok {
 		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "url should be string"})
 		return
 	}
@@ -128,25 +222,121 @@ func downloadFileTask(client *agent.Client, taskID int, body map[string]interfac
 		return
 	}
 
-	remoteFile, err := client.Download(url)
+	opts := agent.DownloadOptions{}
+	if sum, ok := body["sha256"]; ok {
+		if opts.SHA256, ok = sum.(string); !ok {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "sha256 should be string"})
+			return
+		}
+	}
+	if size, ok := body["size"]; ok {
+		sizeF, ok := size.(float64)
+		if !ok || sizeF < 0 {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "size should be non-negative number"})
+			return
+		}
+		opts.Size = int64(sizeF)
+	}
+	if backup, ok := body["backup"]; ok {
+		if opts.Backup, ok = backup.(bool); !ok {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "backup should be boolean"})
+			return
+		}
+	}
+
+	res, err := client.DownloadFile(url, outPath, opts)
 	if err != nil {
 		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Download fail: " + err.Error()})
 		return
 	}
+	result := map[string]interface{}{"error": false, "sha256": res.SHA256, "size": res.Size, "cached": res.Cached}
+	if res.BackupPath != "" {
+		result["backup"] = res.BackupPath
+	}
+	if res.FromPeers != 0 {
+		result["from_peers"] = res.FromPeers
+	}
+	client.SendTaskResult(taskID, result)
+}
 
-	file, err := os.Create(outPath)
+func downloadArchiveTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	opts, err := agent.ParseDownloadArchive(body)
 	if err != nil {
 		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, remoteFile)
+	res, err := client.DownloadArchive(opts)
 	if err != nil {
-		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Extraction fail: " + err.Error()})
 		return
 	}
-	client.SendTaskResult(taskID, map[string]interface{}{"error": false})
+	result := map[string]interface{}{
+		"error":   false,
+		"sha256":  res.SHA256,
+		"cached":  res.Cached,
+		"files":   res.Files,
+		"dirs":    res.Dirs,
+		"links":   res.Links,
+		"size":    res.Size,
+		"skipped": res.Skipped,
+	}
+	if res.FromPeers != 0 {
+		result["from_peers"] = res.FromPeers
+	}
+	client.SendTaskResult(taskID, result)
+}
+
+func cacheQueryTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	if client.Cache == nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "cache is disabled"})
+		return
+	}
+
+	sums, prs := body["sha256"]
+	if !prs {
+		entries, total, err := client.Cache.Entries()
+		if err != nil {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+			return
+		}
+		files := make(map[string]interface{}, len(entries))
+		for _, entry := range entries {
+			files[entry.SHA256] = entry
+		}
+		client.SendTaskResult(taskID, map[string]interface{}{
+			"error":      false,
+			"files":      files,
+			"total_size": total,
+			"max_size":   client.Cache.MaxSize,
+		})
+		return
+	}
+
+	sumsList, ok := sums.([]interface{})
+	if !ok {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "sha256 should be list of strings"})
+		return
+	}
+	files := make(map[string]interface{}, len(sumsList))
+	for _, sum := range sumsList {
+		sumStr, ok := sum.(string)
+		if !ok {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "sha256 should be list of strings"})
+			return
+		}
+		entry, err := client.Cache.Stat(sumStr)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+				return
+			}
+			files[sumStr] = nil
+			continue
+		}
+		files[sumStr] = entry
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "files": files})
 }
 
 func screenshotTask(client *agent.Client, taskID int, _ map[string]interface{}) {
@@ -168,7 +358,9 @@ func screenshotTask(client *agent.Client, taskID int, _ map[string]interface{})
 		png.Encode(wtr, img)
 		wtr.Close()
 	}()
-	url, err := client.UploadFile(rdr)
+	url, err := client.UploadFile(rdr, -1, taskID)
+	// Unblock encoder if upload failed before reading everything.
+	rdr.Close()
 	if err != nil {
 		client.SendTaskResult(taskID, map[string]interface{}{
 			"error": true,
@@ -182,84 +374,313 @@ func screenshotTask(client *agent.Client, taskID int, _ map[string]interface{})
 	})
 }
 
-/*
+func inventoryTask(client *agent.Client, taskID int, _ map[string]interface{}) {
+	inv, err := agent.CollectInventory()
+	res := map[string]interface{}{"error": false, "inventory": inv}
+	if err != nil {
+		res["warning"] = err.Error()
+	}
+	// Also save snapshot on server so it will be visible in inventory
+	// search without waiting for periodic collection.
+	if err := client.SendInventory(inv); err != nil {
+		log.Println("Failed to send inventory:", err)
+	}
+	client.SendTaskResult(taskID, res)
+}
+
 func proclistTask(client *agent.Client, taskID int, _ map[string]interface{}) {
-	procs, err := Processes()
+	procs, err := agent.ListProcesses()
 	if err != nil {
-		client.SendTaskResult(taskID, map[string]interface{}{
-			"error": true,
-			"msg":   err.Error(),
-		})
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
-	var windowsArray []Window
-	for _, v := range procs {
-		windowsArray = append(windowsArray, Window{
-			PID:  v.Pid(),
-			Name: v.Executable(),
-		})
+	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "procs": procs})
+}
+
+func killprocTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	opts, err := agent.ParseKillProc(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	res, err := agent.KillProcesses(opts)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{
+		"error":  false,
+		"killed": res.Killed,
+		"failed": res.Errors,
+	})
+}
+
+func executeCmdTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	cmd, err := agent.ParseCommand(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	cmd.Stdin, err = cmdEncoding.NewEncoder().String(cmd.Stdin)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Can't convert stdin to console encoding"})
+		return
 	}
-	responseMap := map[string]interface{}{
-		"procs": windowsArray,
+
+	stream := streamCommandOutput(client, taskID, &cmd)
+	// Task context is cancelled only if admin cancels task explicitly,
+	// otherwise command runs until it exits or its timeout passes.
+	res, err := agent.RunCommand(client.TaskContext(taskID), cmd)
+	if stream != nil {
+		// Output should reach server before result.
+		stream.Close()
 	}
-	client.SendTaskResult(taskID, responseMap)
+	sendCommandResult(client, taskID, res, err)
 }
-*/
 
-func proclistTask(client *agent.Client, taskID int, _ map[string]interface{}) {
-	windows := ListWindows()
-	responseMap := map[string]interface{}{
-		"procs": windows,
+func runScriptTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	script, err := agent.ParseScript(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	script.Encoding = cmdEncoding
+	script.Stdin, err = cmdEncoding.NewEncoder().String(script.Stdin)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Can't convert stdin to console encoding"})
+		return
 	}
-	client.SendTaskResult(taskID, responseMap)
+
+	stream := streamCommandOutput(client, taskID, &script.Command)
+	res, err := agent.RunScript(client.TaskContext(taskID), script)
+	if stream != nil {
+		stream.Close()
+	}
+	sendCommandResult(client, taskID, res, err)
 }
 
-func executeCmdTask(client *agent.Client, taskID int, body map[string]interface{}) {
+// streamCommandOutput sets up output streaming if command asks for it.
+// Returned stream (if not nil) should be closed after command finishes.
+func streamCommandOutput(client *agent.Client, taskID int, cmd *agent.Command) *agent.OutputStream {
+	if !cmd.Stream {
+		return nil
+	}
+	stream := client.OutputStream(taskID)
+	cmd.Output = func(name string, data []byte) {
+		// Called concurrently for stdout and stderr, so decoder can't
+		// be shared.
+		decoded, err := cmdEncoding.NewDecoder().Bytes(data)
+		if err != nil {
+			decoded = data
+		}
+		stream.Write(name, decoded)
+	}
+	return stream
+}
+
+func sendCommandResult(client *agent.Client, taskID int, res agent.CommandResult, err error) {
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+
 	dec := cmdEncoding.NewDecoder()
+	result := map[string]interface{}{
+		"error":            false,
+		"status_code":      res.StatusCode,
+		"duration":         res.Duration.Seconds(),
+		"killed":           res.Killed,
+		"stdout_truncated": res.StdoutTruncated,
+		"stderr_truncated": res.StderrTruncated,
+		"output_truncated": res.OutputTruncated,
+	}
+	for key, out := range map[string][]byte{"stdout": res.Stdout, "stderr": res.Stderr, "output": res.Output} {
+		decoded, err := dec.Bytes(out)
+		if err != nil {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Can't convert output to Unicode"})
+			return
+		}
+		result[key] = string(decoded)
+	}
+	client.SendTaskResult(taskID, result)
+}
 
-	command, ok := body["cmd"].(string)
-	if !ok {
-		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "cmd should be string"})
+func spawnJobTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	cmd, err := agent.ParseCommand(body)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
-	if command == "" {
-		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Empty command is not allowed"})
+	cmd.Stdin, err = cmdEncoding.NewEncoder().String(cmd.Stdin)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Can't convert stdin to console encoding"})
 		return
 	}
 
-	out := exec.Command("cmd", "/C", command)
-	returnResult, err := out.CombinedOutput()
+	jobID, err := jobs.Spawn(cmd)
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); !ok {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "job_id": jobID})
+}
+
+func jobStatusTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	if _, prs := body["job_id"]; !prs {
+		list, err := jobs.List()
+		if err != nil {
 			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 			return
 		}
+		client.SendTaskResult(taskID, map[string]interface{}{"error": false, "jobs": list})
+		return
 	}
 
-	decodedOut, err := dec.String(string(returnResult))
+	jobID, ok := body["job_id"].(string)
+	if !ok {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "job_id should be string"})
+		return
+	}
+	info, err := jobs.Status(jobID)
 	if err != nil {
-		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Can't convert output to Unicode"})
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
+	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "job": info})
+}
 
+func jobOutputTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	jobID, ok := body["job_id"].(string)
+	if !ok {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "job_id should be string"})
+		return
+	}
+	stream := "stdout"
+	if val, prs := body["stream"]; prs {
+		if stream, ok = val.(string); !ok {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "stream should be string"})
+			return
+		}
+	}
+	offset := float64(0)
+	if val, prs := body["offset"]; prs {
+		if offset, ok = val.(float64); !ok {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "offset should be number"})
+			return
+		}
+	}
+	limit := float64(agent.MaxJobOutputChunk)
+	if val, prs := body["limit"]; prs {
+		if limit, ok = val.(float64); !ok || limit <= 0 || limit > agent.MaxJobOutputChunk {
+			client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "limit should be number between 1 and 1048576"})
+			return
+		}
+	}
+
+	data, start, err := jobs.Output(jobID, stream, int64(offset), int64(limit))
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	info, err := jobs.Status(jobID)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	decoded, err := cmdEncoding.NewDecoder().Bytes(data)
+	if err != nil {
+		decoded = data
+	}
+	size := info.StdoutSize
+	if stream == "stderr" {
+		size = info.StderrSize
+	}
 	client.SendTaskResult(taskID, map[string]interface{}{
-		"status_code": out.ProcessState.Sys().(syscall.WaitStatus).ExitCode,
-		"output":      decodedOut,
+		"error":       false,
+		"data":        string(decoded),
+		"offset":      start,
+		"next_offset": start + int64(len(data)),
+		"size":        size,
+		"running":     info.Running,
 	})
 }
 
-func selfUpdateTask(client *agent.Client, taskID int, _ map[string]interface{}) {
-	inp, err := client.Download(baseURL + "/sutagent.exe")
+func jobKillTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	jobID, ok := body["job_id"].(string)
+	if !ok {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "job_id should be string"})
+		return
+	}
+	killed, err := jobs.Kill(jobID)
 	if err != nil {
-		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Unable to fetch latest agent version: " + err.Error()})
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
-	err = update.Apply(inp, update.Options{})
+	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "killed": killed})
+}
+
+func shellTask(client *agent.Client, taskID int, body map[string]interface{}) {
+	opts, err := agent.ParseShell(body)
 	if err != nil {
-		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Unable to fetch latest agent version: " + err.Error()})
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
 		return
 	}
-	inp.Close()
+	opts.Encoding = cmdEncoding
+
+	res, err := client.RunShell(client.TaskContext(taskID), opts)
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{
+		"error":       false,
+		"status_code": res.StatusCode,
+		"duration":    res.Duration.Seconds(),
+		"killed":      res.Killed,
+	})
+}
+
+func tunnelTask(client *agent.Client, taskID int, _ map[string]interface{}) {
+	stats, err := client.ServeTunnels(client.TaskContext(taskID))
+	if err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": err.Error()})
+		return
+	}
+	client.SendTaskResult(taskID, map[string]interface{}{
+		"error":    false,
+		"streams":  stats.Streams,
+		"duration": stats.Duration.Seconds(),
+	})
+}
+
+// selfUpdateTask returns true if agent binary was replaced and agent should
+// be restarted.
+func selfUpdateTask(client *agent.Client, taskID int, _ map[string]interface{}) bool {
+	if err := selfUpdate(client); err != nil {
+		client.SendTaskResult(taskID, map[string]interface{}{"error": true, "msg": "Unable to fetch latest agent version: " + err.Error()})
+		return false
+	}
 
 	client.SendTaskResult(taskID, map[string]interface{}{"error": false, "msg": "Update process was initiated"})
+	return true
+}
+
+func selfUpdate(client *agent.Client) error {
+	if updateKey == "" {
+		return errors.New("agent is built without update key")
+	}
+	key, err := agent.ParsePublicKey(updateKey)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := client.CheckUpdate()
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return errors.New("no update available")
+	}
+	log.Println("Updating to version", manifest.Version)
+	return client.ApplyUpdate(manifest, key, updateStatePath)
 }
@@ -0,0 +1,172 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// agentInfo is what agent tells about itself in Version and Task-Types
+// headers.
+type agentInfo struct {
+	Version int
+	// nil if agent didn't report supported task types, any task is allowed
+	// in this case.
+	TaskTypes []string
+}
+
+// agentsInfo mirrors agent_info table so we don't have to hit DB on each
+// longpolling request.
+var agentsInfo = make(map[string]agentInfo)
+var agentsInfoLock sync.Mutex
+
+func loadAgentsInfo() error {
+	info, err := db.ListAgentsInfo()
+	if err != nil {
+		return err
+	}
+
+	agentsInfoLock.Lock()
+	agentsInfo = info
+	agentsInfoLock.Unlock()
+	return nil
+}
+
+// recordAgentInfo updates stored capabilities of agent using headers from
+// request if they changed since last time.
+func recordAgentInfo(agentID string, h http.Header) {
+	info := agentInfo{}
+	if verStr := h.Get("Version"); verStr != "" {
+		ver, err := strconv.Atoi(verStr)
+		if err != nil {
+			debugLog("Invalid Version header from", agentID+":", verStr)
+			return
+		}
+		info.Version = ver
+	}
+	if typesStr := h.Get("Task-Types"); typesStr != "" {
+		info.TaskTypes = strings.Split(typesStr, ",")
+	}
+
+	agentsInfoLock.Lock()
+	defer agentsInfoLock.Unlock()
+	if prev, prs := agentsInfo[agentID]; prs && sameAgentInfo(prev, info) {
+		return
+	}
+	if err := db.SetAgentInfo(agentID, info); err != nil {
+		log.Println("Failed to save agent info:", err)
+		return
+	}
+	agentsInfo[agentID] = info
+	debugLog(agentID, "reported version", info.Version, "and task types", info.TaskTypes)
+}
+
+func sameAgentInfo(a, b agentInfo) bool {
+	if a.Version != b.Version || len(a.TaskTypes) != len(b.TaskTypes) {
+		return false
+	}
+	for i := range a.TaskTypes {
+		if a.TaskTypes[i] != b.TaskTypes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// agentSupportsTask checks whether agent reported support for task type.
+// Agents that didn't report anything are assumed to support everything.
+func agentSupportsTask(agentID, taskType string) bool {
+	agentsInfoLock.Lock()
+	defer agentsInfoLock.Unlock()
+
+	info, prs := agentsInfo[agentID]
+	if !prs || info.TaskTypes == nil {
+		return true
+	}
+	for _, t := range info.TaskTypes {
+		if t == taskType {
+			return true
+		}
+	}
+	return false
+}
+
+// agentOutdated checks whether agent version is lower than configured
+// minimum. Agents that didn't report version are considered outdated too.
+func agentOutdated(agentID string) bool {
+	if serverConf.MinAgentVersion == 0 {
+		return false
+	}
+
+	agentsInfoLock.Lock()
+	defer agentsInfoLock.Unlock()
+	return agentsInfo[agentID].Version < serverConf.MinAgentVersion
+}
+
+func agentsVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/agents_versions only supports GET")
+		return
+	}
+
+	agents, err := db.ListAgents()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(StringSlice(agents))
+
+	// JSON doesn't allow numeric keys so versions are stringified, agents
+	// that never reported version are counted under "unknown".
+	versions := make(map[string]int)
+	outdated := []string{}
+	agentsInfoLock.Lock()
+	for _, agent := range agents {
+		info, prs := agentsInfo[agent]
+		if !prs || info.Version == 0 {
+			versions["unknown"]++
+		} else {
+			versions[strconv.Itoa(info.Version)]++
+		}
+		if serverConf.MinAgentVersion != 0 && info.Version < serverConf.MinAgentVersion {
+			outdated = append(outdated, agent)
+		}
+	}
+	agentsInfoLock.Unlock()
+
+	writeJson(w, map[string]interface{}{
+		"error":       false,
+		"min_version": serverConf.MinAgentVersion,
+		"versions":    versions,
+		"outdated":    outdated,
+	})
+}
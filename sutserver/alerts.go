@@ -0,0 +1,325 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertRule is configured in "alerts" section of config file, it is checked
+// for each agent every minute.
+type alertRule struct {
+	Name string `yaml:"name"`
+	// One of:
+	// - "disk_usage" - any disk is used more than Threshold percents.
+	// - "mem_usage" - memory is used more than Threshold percents.
+	// - "cpu_load" - CPU load is above Threshold percents.
+	// - "offline" - agent is offline for more than Threshold minutes.
+	// - "version" - agent version is lower than Threshold.
+	Type      string  `yaml:"type"`
+	Threshold float64 `yaml:"threshold"`
+	// Hours like "8-20" (server local time), new alerts are fired only
+	// during them. Empty means always. Active alerts are resolved only when
+	// condition is not true anymore, even outside of these hours.
+	Hours string `yaml:"hours"`
+	// Weekdays new alerts are fired on, 0 is Sunday. Empty means every day.
+	Weekdays []int `yaml:"weekdays"`
+
+	fromHour, toHour int
+}
+
+var alertTypes = []string{"disk_usage", "mem_usage", "cpu_load", "offline", "version"}
+
+func (rule *alertRule) validate() error {
+	if rule.Name == "" {
+		return errors.New("alert rule name is missing")
+	}
+	known := false
+	for _, t := range alertTypes {
+		if rule.Type == t {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("alert rule %s: unknown type %s", rule.Name, rule.Type)
+	}
+
+	rule.fromHour, rule.toHour = 0, 24
+	if rule.Hours != "" {
+		parts := strings.Split(rule.Hours, "-")
+		if len(parts) != 2 {
+			return fmt.Errorf("alert rule %s: hours should be in FROM-TO format", rule.Name)
+		}
+		var err1, err2 error
+		rule.fromHour, err1 = strconv.Atoi(parts[0])
+		rule.toHour, err2 = strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil || rule.fromHour < 0 || rule.toHour > 24 || rule.fromHour >= rule.toHour {
+			return fmt.Errorf("alert rule %s: invalid hours", rule.Name)
+		}
+	}
+	for _, d := range rule.Weekdays {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("alert rule %s: invalid weekday %d", rule.Name, d)
+		}
+	}
+	return nil
+}
+
+// applies checks whether rule can fire alerts at specified time.
+func (rule *alertRule) applies(now time.Time) bool {
+	if now.Hour() < rule.fromHour || now.Hour() >= rule.toHour {
+		return false
+	}
+	if len(rule.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range rule.Weekdays {
+		if time.Weekday(d) == now.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// alertKey identifies alert. Subject is set for rules that can fire more
+// than once per agent (mount point for disk_usage).
+type alertKey struct {
+	Rule    string
+	Agent   string
+	Subject string
+}
+
+type alert struct {
+	alertKey
+	Msg      string
+	Fired    time.Time
+	Resolved time.Time
+}
+
+func (a alert) toJSON() map[string]interface{} {
+	res := map[string]interface{}{
+		"rule":     a.Rule,
+		"agent":    a.Agent,
+		"subject":  a.Subject,
+		"msg":      a.Msg,
+		"fired":    a.Fired.Unix(),
+		"resolved": nil,
+	}
+	if !a.Resolved.IsZero() {
+		res["resolved"] = a.Resolved.Unix()
+	}
+	return res
+}
+
+var activeAlerts = make(map[alertKey]alert)
+var activeAlertsLock sync.Mutex
+
+// Agents not seen since server start are considered offline since that
+// moment.
+var serverStarted = time.Now()
+
+func initAlerts() error {
+	for i := range serverConf.Alerts {
+		if err := serverConf.Alerts[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	active, err := db.ActiveAlerts()
+	if err != nil {
+		return err
+	}
+	activeAlertsLock.Lock()
+	for _, a := range active {
+		activeAlerts[a.alertKey] = a
+	}
+	activeAlertsLock.Unlock()
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			evaluateAlerts(time.Now())
+		}
+	}()
+	return nil
+}
+
+// evaluateAlerts checks all rules against all agents, fires new alerts and
+// resolves ones whose condition is not true anymore.
+//
+// Rules are checked even outside of their time window, so alerts fired
+// during it are resolved only when condition clears, not when window ends.
+func evaluateAlerts(now time.Time) {
+	agents, err := db.ListAgents()
+	if err != nil {
+		log.Println("Failed to evaluate alerts:", err)
+		return
+	}
+
+	found := make(map[alertKey]string)
+	canFire := make(map[string]bool)
+	for _, rule := range serverConf.Alerts {
+		canFire[rule.Name] = rule.applies(now)
+		for _, agent := range agents {
+			checkAlertRule(rule, agent, now, found)
+		}
+	}
+
+	activeAlertsLock.Lock()
+	defer activeAlertsLock.Unlock()
+	for key, msg := range found {
+		if _, prs := activeAlerts[key]; prs || !canFire[key.Rule] {
+			continue
+		}
+		a := alert{alertKey: key, Msg: msg, Fired: now}
+		if err := db.AddAlert(a); err != nil {
+			log.Println("Failed to save alert:", err)
+			continue
+		}
+		activeAlerts[key] = a
+		log.Printf("Alert %s fired for %s: %s", key.Rule, key.Agent, msg)
+		publishEvent("alert_fired", a.toJSON())
+	}
+	for key, a := range activeAlerts {
+		if _, prs := found[key]; prs {
+			continue
+		}
+		a.Resolved = now
+		if err := db.ResolveAlert(key, now); err != nil {
+			log.Println("Failed to resolve alert:", err)
+			continue
+		}
+		delete(activeAlerts, key)
+		log.Printf("Alert %s resolved for %s", key.Rule, key.Agent)
+		publishEvent("alert_resolved", a.toJSON())
+	}
+}
+
+// checkAlertRule adds alerts for agent to found if rule condition is true.
+func checkAlertRule(rule alertRule, agent string, now time.Time, found map[alertKey]string) {
+	key := alertKey{Rule: rule.Name, Agent: agent}
+
+	agentsMetricsLock.Lock()
+	m, hasMetrics := agentsMetrics[agent]
+	agentsMetricsLock.Unlock()
+
+	switch rule.Type {
+	case "disk_usage":
+		for _, disk := range m.Disks {
+			if disk.Total == 0 {
+				continue
+			}
+			usage := 100 * float64(disk.Used) / float64(disk.Total)
+			if usage > rule.Threshold {
+				key.Subject = disk.Mount
+				found[key] = fmt.Sprintf("Disk %s is %.0f%% full", disk.Mount, usage)
+			}
+		}
+	case "mem_usage":
+		if m.MemTotal == 0 {
+			return
+		}
+		usage := 100 * float64(m.MemUsed) / float64(m.MemTotal)
+		if usage > rule.Threshold {
+			found[key] = fmt.Sprintf("Memory is %.0f%% used", usage)
+		}
+	case "cpu_load":
+		if hasMetrics && m.CPULoad > rule.Threshold {
+			found[key] = fmt.Sprintf("CPU load is %.0f%%", m.CPULoad)
+		}
+	case "offline":
+		onlineAgentsLock.Lock()
+		online := onlineAgents[agent]
+		onlineAgentsLock.Unlock()
+		if online {
+			return
+		}
+
+		lastSeen := serverStarted
+		lastRequestStampLock.Lock()
+		if lastRequestStamp[agent].After(lastSeen) {
+			lastSeen = lastRequestStamp[agent]
+		}
+		lastRequestStampLock.Unlock()
+		if hasMetrics && time.Unix(m.Stamp, 0).After(lastSeen) {
+			lastSeen = time.Unix(m.Stamp, 0)
+		}
+
+		offline := now.Sub(lastSeen)
+		if offline > time.Duration(rule.Threshold*float64(time.Minute)) {
+			found[key] = "Agent is offline for " + offline.Round(time.Minute).String()
+		}
+	case "version":
+		agentsInfoLock.Lock()
+		version := agentsInfo[agent].Version
+		agentsInfoLock.Unlock()
+		if float64(version) < rule.Threshold {
+			found[key] = fmt.Sprintf("Agent version %d is lower than %.0f", version, rule.Threshold)
+		}
+	}
+}
+
+// alertsHandler returns active alerts or alerts history if since is
+// specified.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/alerts only supports GET")
+		return
+	}
+
+	res := []map[string]interface{}{}
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid since value")
+			return
+		}
+		history, err := db.AlertsHistory(time.Unix(since, 0))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, a := range history {
+			res = append(res, a.toJSON())
+		}
+	} else {
+		activeAlertsLock.Lock()
+		for _, a := range activeAlerts {
+			res = append(res, a.toJSON())
+		}
+		activeAlertsLock.Unlock()
+	}
+
+	writeJson(w, map[string]interface{}{"error": false, "alerts": res})
+}
@@ -0,0 +1,157 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+)
+
+// setupAlertsTest configures rules and metrics of pc1 and resets alerts
+// state.
+func setupAlertsTest(t *testing.T, rules []alertRule) {
+	t.Helper()
+	openTestDB(t)
+	if err := db.AddAgent("pc1", "hwid1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevRules := serverConf.Alerts
+	serverConf.Alerts = rules
+	activeAlertsLock.Lock()
+	activeAlerts = make(map[alertKey]alert)
+	activeAlertsLock.Unlock()
+	t.Cleanup(func() {
+		serverConf.Alerts = prevRules
+		activeAlertsLock.Lock()
+		activeAlerts = make(map[alertKey]alert)
+		activeAlertsLock.Unlock()
+		agentsMetricsLock.Lock()
+		delete(agentsMetrics, "pc1")
+		agentsMetricsLock.Unlock()
+	})
+}
+
+func setCPULoad(load float64) {
+	agentsMetricsLock.Lock()
+	agentsMetrics["pc1"] = metricsEntry{Stamp: time.Now().Unix(), Metrics: agent.Metrics{CPULoad: load}}
+	agentsMetricsLock.Unlock()
+}
+
+// checkActiveAlert checks whether alert of rule for pc1 is active both in
+// memory and DB.
+func checkActiveAlert(t *testing.T, rule string, expected bool) {
+	t.Helper()
+	activeAlertsLock.Lock()
+	_, active := activeAlerts[alertKey{Rule: rule, Agent: "pc1"}]
+	activeAlertsLock.Unlock()
+	if active != expected {
+		t.Fatalf("alert %s active: %v, expected %v", rule, active, expected)
+	}
+
+	saved, err := db.ActiveAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeInDB := false
+	for _, a := range saved {
+		if a.Rule == rule && a.Agent == "pc1" {
+			activeInDB = true
+		}
+	}
+	if activeInDB != expected {
+		t.Fatalf("alert %s active in DB: %v, expected %v", rule, activeInDB, expected)
+	}
+}
+
+func at(hour int) time.Time {
+	// 2019-01-07 is Monday.
+	return time.Date(2019, 1, 7, hour, 0, 0, 0, time.Local)
+}
+
+func TestAlertOutsideHours(t *testing.T) {
+	setupAlertsTest(t, []alertRule{{Name: "cpu", Type: "cpu_load", Threshold: 90, Hours: "8-20"}})
+
+	setCPULoad(95)
+	evaluateAlerts(at(7))
+	checkActiveAlert(t, "cpu", false)
+
+	evaluateAlerts(at(10))
+	checkActiveAlert(t, "cpu", true)
+
+	// Window ended but condition is still true.
+	evaluateAlerts(at(20))
+	checkActiveAlert(t, "cpu", true)
+	evaluateAlerts(at(23))
+	checkActiveAlert(t, "cpu", true)
+
+	// Condition cleared outside of window.
+	setCPULoad(10)
+	evaluateAlerts(at(23))
+	checkActiveAlert(t, "cpu", false)
+
+	history, err := db.AlertsHistory(at(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatal("expected one alert in history, got", len(history))
+	}
+	if !history[0].Resolved.Equal(at(23)) {
+		t.Error("wrong resolution time:", history[0].Resolved)
+	}
+}
+
+func TestAlertWeekdays(t *testing.T) {
+	setupAlertsTest(t, []alertRule{{Name: "cpu", Type: "cpu_load", Threshold: 90, Weekdays: []int{2}}})
+
+	setCPULoad(95)
+	// Monday.
+	evaluateAlerts(at(10))
+	checkActiveAlert(t, "cpu", false)
+	// Tuesday.
+	evaluateAlerts(at(10).AddDate(0, 0, 1))
+	checkActiveAlert(t, "cpu", true)
+	// Wednesday, still active.
+	evaluateAlerts(at(10).AddDate(0, 0, 2))
+	checkActiveAlert(t, "cpu", true)
+}
+
+func TestAlertRuleRemoved(t *testing.T) {
+	setupAlertsTest(t, []alertRule{{Name: "cpu", Type: "cpu_load", Threshold: 90}})
+
+	setCPULoad(95)
+	evaluateAlerts(at(10))
+	checkActiveAlert(t, "cpu", true)
+
+	serverConf.Alerts = nil
+	evaluateAlerts(at(11))
+	checkActiveAlert(t, "cpu", false)
+}
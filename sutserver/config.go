@@ -32,4 +32,53 @@ type Config struct {
 		DSN string `yaml:"dsn"`
 	} `yaml:"db"`
 	Filedrop filedrop.Config `yaml:"filedrop"`
-}
\ No newline at end of file
+
+	// Agents with version lower than MinAgentVersion are not allowed to
+	// poll tasks. Zero disables the check.
+	MinAgentVersion int `yaml:"min_agent_version"`
+	// If AutoUpdateAgents is true, outdated agents get "update" task queued
+	// instead of an error (if they support it).
+	AutoUpdateAgents bool `yaml:"auto_update_agents"`
+	// UpdateKey is base64-encoded ed25519 public key used to sign agent
+	// releases. If set, server refuses to publish releases with invalid
+	// signature. Agents check signatures anyway.
+	UpdateKey string `yaml:"update_key"`
+
+	// Tasks and their results are kept in DB for TaskLogDays days
+	// (7 by default).
+	TaskLogDays int `yaml:"task_log_days"`
+	// Agents metrics history is kept for MetricsDays days (7 by default).
+	MetricsDays int `yaml:"metrics_days"`
+
+	// Inventory snapshots are kept for InventoryDays days (90 by default),
+	// latest snapshot of each agent is never removed.
+	InventoryDays int `yaml:"inventory_days"`
+
+	// Alert rules checked every minute, see alertRule.
+	Alerts []alertRule `yaml:"alerts"`
+
+	// Roles (see "setrole" subcommand) allowed to open interactive shell
+	// sessions and read their recordings. Shell sessions are disabled if it's
+	// empty.
+	ShellRoles []string `yaml:"shell_roles"`
+	// Shell sessions are closed after ShellIdleTimeout minutes without
+	// input from admin (15 by default).
+	ShellIdleTimeout int `yaml:"shell_idle_timeout"`
+	// Shell sessions recordings are stored in ShellRecordingsDir
+	// ("recordings" in filedrop storage directory by default) and kept
+	// along with audit log for ShellLogDays days (90 by default).
+	ShellRecordingsDir string `yaml:"shell_recordings_dir"`
+	ShellLogDays       int    `yaml:"shell_log_days"`
+
+	// Roles allowed to open TCP tunnels through agents. Empty list allows
+	// it to everybody.
+	TunnelRoles []string `yaml:"tunnel_roles"`
+	// IP address tunnel listeners are bound to (127.0.0.1 by default).
+	TunnelListenIP string `yaml:"tunnel_listen_ip"`
+	// Tunnel listeners are closed after TunnelIdleTimeout minutes without
+	// connections (30 by default).
+	TunnelIdleTimeout int `yaml:"tunnel_idle_timeout"`
+}
+
+// serverConf is set once at startup by "server" subcommand.
+var serverConf Config
@@ -26,7 +26,9 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"strings"
+	"time"
 )
 
 type DB struct {
@@ -37,9 +39,12 @@ type DB struct {
 	checkUsrExistance *sql.Stmt
 	addAccount        *sql.Stmt
 	remAccount        *sql.Stmt
+	setAdminRole      *sql.Stmt
+	remAdminRole      *sql.Stmt
 
 	// Agents management
 	listAgents       *sql.Stmt
+	listAgentHWIDs   *sql.Stmt
 	addAgent         *sql.Stmt
 	remAgent         *sql.Stmt
 	renameAgent      *sql.Stmt
@@ -47,10 +52,81 @@ type DB struct {
 	checkAgentByName *sql.Stmt
 	getAgentName     *sql.Stmt
 
+	// Agent capabilities
+	listAgentsInfo  *sql.Stmt
+	setAgentInfo    *sql.Stmt
+	remAgentInfo    *sql.Stmt
+	renameAgentInfo *sql.Stmt
+
+	// Agent updates
+	listReleases       *sql.Stmt
+	addRelease         *sql.Stmt
+	updateRelease      *sql.Stmt
+	remRelease         *sql.Stmt
+	listAgentChannels  *sql.Stmt
+	setAgentChannel    *sql.Stmt
+	remAgentChannel    *sql.Stmt
+	renameAgentChannel *sql.Stmt
+	addUpdateReport    *sql.Stmt
+	updateReportsStats *sql.Stmt
+
+	failedUpdates       *sql.Stmt
+	renameUpdateReports *sql.Stmt
+
+	// Tasks log
+	addTaskLog    *sql.Stmt
+	setTaskResult *sql.Stmt
+	getTaskLog    *sql.Stmt
+	maxTaskID     *sql.Stmt
+	pruneTaskLog  *sql.Stmt
+	renameTaskLog *sql.Stmt
+
+	// Agents metrics
+	addAgentMetrics     *sql.Stmt
+	latestAgentsMetrics *sql.Stmt
+	agentMetricsHistory *sql.Stmt
+	pruneAgentsMetrics  *sql.Stmt
+	remAgentMetrics     *sql.Stmt
+	renameAgentMetrics  *sql.Stmt
+
+	// Inventory
+	addInventory         *sql.Stmt
+	latestInventory      *sql.Stmt
+	latestInventories    *sql.Stmt
+	inventoryStamps      *sql.Stmt
+	getInventory         *sql.Stmt
+	pruneInventory       *sql.Stmt
+	remAgentInventory    *sql.Stmt
+	renameAgentInventory *sql.Stmt
+
+	// Alerts
+	addAlert      *sql.Stmt
+	resolveAlert  *sql.Stmt
+	activeAlerts  *sql.Stmt
+	alertsHistory *sql.Stmt
+
+	// Shell sessions audit
+	addShellSession    *sql.Stmt
+	endShellSession    *sql.Stmt
+	getShellSession    *sql.Stmt
+	listShellSessions  *sql.Stmt
+	agentShellSessions *sql.Stmt
+	staleShellSessions *sql.Stmt
+	remShellSession    *sql.Stmt
+
+	// Scripts library
+	listScripts *sql.Stmt
+	getScript   *sql.Stmt
+	addScript   *sql.Stmt
+	remScript   *sql.Stmt
+
 	// Session management
-	initSession  *sql.Stmt
-	killSession  *sql.Stmt
-	checkSession *sql.Stmt
+	initSession     *sql.Stmt
+	killSession     *sql.Stmt
+	checkSession    *sql.Stmt
+	addSessionAdmin *sql.Stmt
+	remSessionAdmin *sql.Stmt
+	getSessionAdmin *sql.Stmt
 }
 
 func OpenDB(driver, dsn string) (*DB, error) {
@@ -122,6 +198,25 @@ func (db *DB) ListAgents() ([]string, error) {
 	return res, nil
 }
 
+// ListAgentHWIDs returns map of agent names to their hardware IDs.
+func (db *DB) ListAgentHWIDs() (map[string]string, error) {
+	rows, err := db.listAgentHWIDs.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]string)
+	for rows.Next() {
+		name, hwid := "", ""
+		if err := rows.Scan(&name, &hwid); err != nil {
+			return nil, err
+		}
+		res[name] = hwid
+	}
+	return res, rows.Err()
+}
+
 func (db *DB) CheckAuth(token string) bool {
 	row := db.checkUsrExistance.QueryRow(token)
 	res := 0
@@ -137,11 +232,38 @@ func (db *DB) AddAccount(token string) error {
 }
 
 func (db *DB) RemAccount(token string) error {
+	if _, err := db.remAdminRole.Exec(token); err != nil {
+		return err
+	}
 	_, err := db.remAccount.Exec(token)
 	return err
 }
 
+// SetAdminRole assigns role to admin account, empty role removes it.
+func (db *DB) SetAdminRole(token, role string) error {
+	if _, err := db.remAdminRole.Exec(token); err != nil {
+		return err
+	}
+	if role == "" {
+		return nil
+	}
+	_, err := db.setAdminRole.Exec(token, role)
+	return err
+}
+
 func (db *DB) RemAgent(name string) error {
+	if _, err := db.remAgentInfo.Exec(name); err != nil {
+		return err
+	}
+	if _, err := db.remAgentChannel.Exec(name); err != nil {
+		return err
+	}
+	if _, err := db.remAgentMetrics.Exec(name); err != nil {
+		return err
+	}
+	if _, err := db.remAgentInventory.Exec(name); err != nil {
+		return err
+	}
 	_, err := db.remAgent.Exec(name)
 	return err
 }
@@ -152,6 +274,24 @@ func (db *DB) AddAgent(name, hwid string) error {
 }
 
 func (db *DB) RenameAgent(fromName, toName string) error {
+	if _, err := db.renameAgentInfo.Exec(toName, fromName); err != nil {
+		return err
+	}
+	if _, err := db.renameAgentChannel.Exec(toName, fromName); err != nil {
+		return err
+	}
+	if _, err := db.renameTaskLog.Exec(toName, fromName); err != nil {
+		return err
+	}
+	if _, err := db.renameUpdateReports.Exec(toName, fromName); err != nil {
+		return err
+	}
+	if _, err := db.renameAgentMetrics.Exec(toName, fromName); err != nil {
+		return err
+	}
+	if _, err := db.renameAgentInventory.Exec(toName, fromName); err != nil {
+		return err
+	}
 	_, err := db.renameAgent.Exec(toName, fromName)
 	return err
 }
@@ -180,119 +320,1106 @@ func (db *DB) GetAgentName(hwid string) (string, error) {
 	return name, row.Scan(&name)
 }
 
-func (db *DB) InitSession() (string, error) {
-	rawSID := make([]byte, 32)
-	if _, err := rand.Read(rawSID); err != nil {
-		return "", err
+// ListAgentsInfo returns capabilities last reported by each agent.
+func (db *DB) ListAgentsInfo() (map[string]agentInfo, error) {
+	rows, err := db.listAgentsInfo.Query()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return map[string]agentInfo{}, nil
+		}
+		return nil, err
 	}
-	sid := hex.EncodeToString(rawSID)
+	defer rows.Close()
 
-	_, err := db.initSession.Exec(sid)
-	return sid, err
+	res := make(map[string]agentInfo)
+	for rows.Next() {
+		name, taskTypes := "", ""
+		info := agentInfo{}
+		if err := rows.Scan(&name, &info.Version, &taskTypes); err != nil {
+			return nil, err
+		}
+		if taskTypes != "" {
+			info.TaskTypes = strings.Split(taskTypes, ",")
+		}
+		res[name] = info
+	}
+	return res, rows.Err()
 }
 
-func (db *DB) KillSession(sid string) error {
-	_, err := db.killSession.Exec(sid)
+func (db *DB) SetAgentInfo(name string, info agentInfo) error {
+	_, err := db.setAgentInfo.Exec(name, info.Version, strings.Join(info.TaskTypes, ","))
 	return err
 }
 
-func (db *DB) CheckSession(sid string) bool {
-	row := db.checkSession.QueryRow(sid)
-	res := 0
-	if err := row.Scan(&res); err != nil {
-		return false
+func (db *DB) ListReleases() ([]release, error) {
+	rows, err := db.listReleases.Query()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []release{}, nil
+		}
+		return nil, err
 	}
-	return res == 1
+	defer rows.Close()
+
+	res := []release{}
+	for rows.Next() {
+		r := release{}
+		if err := rows.Scan(&r.Version, &r.Channel, &r.Rollout, &r.Manifest); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
 }
 
-func (db *DB) initSchema() error {
-	_, err := db.d.Exec(`CREATE TABLE IF NOT EXISTS admins (
-		token VARCHAR(256) PRIMARY KEY NOT NULL
-	)`)
+func (db *DB) AddRelease(r release) error {
+	_, err := db.addRelease.Exec(r.Version, r.Channel, r.Rollout, r.Manifest)
+	return err
+}
+
+// UpdateRelease changes channel and rollout percentage of release.
+func (db *DB) UpdateRelease(version int, channel string, rollout int) error {
+	_, err := db.updateRelease.Exec(channel, rollout, version)
+	return err
+}
+
+func (db *DB) RemRelease(version int) error {
+	_, err := db.remRelease.Exec(version)
+	return err
+}
+
+// ListAgentChannels returns update channels of agents. Agents not listed
+// use "stable" channel.
+func (db *DB) ListAgentChannels() (map[string]string, error) {
+	rows, err := db.listAgentChannels.Query()
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return map[string]string{}, nil
+		}
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS agents (
-		name VARCHAR(256) PRIMARY KEY NOT NULL,
-		hwid VARCHAR(256) UNIQUE NOT NULL
-	)`)
-	if err != nil {
-		return err
+	res := make(map[string]string)
+	for rows.Next() {
+		name, channel := "", ""
+		if err := rows.Scan(&name, &channel); err != nil {
+			return nil, err
+		}
+		res[name] = channel
 	}
+	return res, rows.Err()
+}
 
-	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS sessions (
-		sessionId CHAR(64) PRIMARY KEY NOT NULL
-	)`)
+func (db *DB) SetAgentChannel(name, channel string) error {
+	_, err := db.setAgentChannel.Exec(name, channel)
 	return err
 }
 
-func (db *DB) initStmts() error {
-	var err error
+func (db *DB) AddUpdateReport(agent string, fromVersion, toVersion int, status, msg string) error {
+	_, err := db.addUpdateReport.Exec(agent, fromVersion, toVersion, status, msg, time.Now().Unix())
+	return err
+}
 
-	db.listAgents, err = db.d.Prepare(`SELECT name FROM agents`)
+// FailedUpdates returns set of versions agent failed to update to or rolled
+// back from.
+func (db *DB) FailedUpdates(agent string) (map[int]bool, error) {
+	rows, err := db.failedUpdates.Query(agent)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	db.checkUsrExistance, err = db.d.Prepare(`SELECT COUNT(token) FROM admins WHERE token = ?`)
+	res := make(map[int]bool)
+	for rows.Next() {
+		version := 0
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		res[version] = true
+	}
+	return res, rows.Err()
+}
+
+// UpdateReportsStats returns count of update reports per target version and
+// status.
+func (db *DB) UpdateReportsStats() (map[int]map[string]int, error) {
+	rows, err := db.updateReportsStats.Query()
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return map[int]map[string]int{}, nil
+		}
+		return nil, err
 	}
-	if db.driver != "mysql" {
-		// Everybody except MySQL support this syntax.
-		db.addAccount, err = db.d.Prepare(`INSERT INTO admins VALUES (?) ON CONFLICT DO NOTHING`)
-	} else {
-		// But MySQL is special boi.
-		db.addAccount, err = db.d.Prepare(`INSERT IGNORE INTO admins VALUES (?)`)
+	defer rows.Close()
+
+	res := make(map[int]map[string]int)
+	for rows.Next() {
+		version, status, count := 0, "", 0
+		if err := rows.Scan(&version, &status, &count); err != nil {
+			return nil, err
+		}
+		if res[version] == nil {
+			res[version] = make(map[string]int)
+		}
+		res[version][status] = count
 	}
+	return res, rows.Err()
+}
+
+// taskLogEntry is a task sent to agent, Result is nil until agent reports
+// it.
+type taskLogEntry struct {
+	ID       int
+	Agent    string
+	Type     string
+	Created  time.Time
+	Result   []byte
+	Finished time.Time
+}
+
+func (db *DB) AddTaskLog(id int, agent, type_ string) error {
+	_, err := db.addTaskLog.Exec(id, agent, type_, time.Now().Unix())
+	return err
+}
+
+// SetTaskResult saves task result unless task doesn't belong to agent or
+// already has result. Returns false in the latter case.
+func (db *DB) SetTaskResult(id int, agent string, result []byte) (bool, error) {
+	res, err := db.setTaskResult.Exec(string(result), time.Now().Unix(), id, agent)
 	if err != nil {
-		return err
+		return false, err
 	}
-	db.remAccount, err = db.d.Prepare(`DELETE FROM admins WHERE token = ?`)
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+func (db *DB) GetTaskLog(id int) (taskLogEntry, error) {
+	e := taskLogEntry{ID: id}
+	created := int64(0)
+	var result sql.NullString
+	var finished sql.NullInt64
+	if err := db.getTaskLog.QueryRow(id).Scan(&e.Agent, &e.Type, &created, &result, &finished); err != nil {
+		return e, err
+	}
+	e.Created = time.Unix(created, 0)
+	if result.Valid {
+		e.Result = []byte(result.String)
+		e.Finished = time.Unix(finished.Int64, 0)
+	}
+	return e, nil
+}
+
+// MaxTaskID returns biggest ID of logged task or 0 if there are none.
+func (db *DB) MaxTaskID() (int, error) {
+	id := 0
+	return id, db.maxTaskID.QueryRow().Scan(&id)
+}
+
+// PruneTaskLog removes tasks created before specified time.
+func (db *DB) PruneTaskLog(before time.Time) error {
+	_, err := db.pruneTaskLog.Exec(before.Unix())
+	return err
+}
+
+func (db *DB) AddAgentMetrics(agent string, entry metricsEntry) error {
+	blob, err := json.Marshal(entry.Metrics)
 	if err != nil {
 		return err
 	}
+	_, err = db.addAgentMetrics.Exec(agent, entry.Stamp, string(blob))
+	return err
+}
 
-	if db.driver != "mysql" {
-		// Same here.
-		db.addAgent, err = db.d.Prepare(`INSERT INTO agents VALUES (?, ?) ON CONFLICT DO NOTHING`)
-	} else {
-		db.addAgent, err = db.d.Prepare(`INSERT IGNORE INTO agents VALUES (?, ?)`)
+func scanMetricsEntry(rows *sql.Rows, dest ...interface{}) (metricsEntry, error) {
+	entry := metricsEntry{}
+	blob := ""
+	if err := rows.Scan(append(dest, &entry.Stamp, &blob)...); err != nil {
+		return entry, err
 	}
+	return entry, json.Unmarshal([]byte(blob), &entry.Metrics)
+}
+
+// LatestAgentsMetrics returns most recent metrics of each agent.
+func (db *DB) LatestAgentsMetrics() (map[string]metricsEntry, error) {
+	rows, err := db.latestAgentsMetrics.Query()
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return map[string]metricsEntry{}, nil
+		}
+		return nil, err
 	}
-	db.remAgent, err = db.d.Prepare(`DELETE FROM agents WHERE name = ?`)
-	if err != nil {
-		return err
+	defer rows.Close()
+
+	res := make(map[string]metricsEntry)
+	for rows.Next() {
+		name := ""
+		entry, err := scanMetricsEntry(rows, &name)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = entry
 	}
-	db.renameAgent, err = db.d.Prepare(`UPDATE agents SET name = ? WHERE name = ?`)
+	return res, rows.Err()
+}
+
+// AgentMetricsHistory returns metrics of agent reported between since and
+// until (UNIX timestamps, inclusive), oldest first.
+func (db *DB) AgentMetricsHistory(agent string, since, until int64) ([]metricsEntry, error) {
+	rows, err := db.agentMetricsHistory.Query(agent, since, until)
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return []metricsEntry{}, nil
+		}
+		return nil, err
 	}
-	db.checkAgentByName, err = db.d.Prepare(`SELECT COUNT(name) FROM agents WHERE name = ?`)
-	if err != nil {
-		return err
+	defer rows.Close()
+
+	res := []metricsEntry{}
+	for rows.Next() {
+		entry, err := scanMetricsEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
 	}
-	db.checkAgentByHWID, err = db.d.Prepare(`SELECT COUNT(hwid) FROM agents WHERE hwid = ?`)
+	return res, rows.Err()
+}
+
+// PruneAgentsMetrics removes metrics reported before specified time.
+func (db *DB) PruneAgentsMetrics(before time.Time) error {
+	_, err := db.pruneAgentsMetrics.Exec(before.Unix())
+	return err
+}
+
+// AddInventory saves inventory snapshot unless it is same as the latest one.
+// Returns false in the latter case.
+func (db *DB) AddInventory(agent string, snapshot inventorySnapshot) (bool, error) {
+	blob, err := json.Marshal(snapshot.Inventory)
 	if err != nil {
-		return err
+		return false, err
 	}
-	db.getAgentName, err = db.d.Prepare(`SELECT name FROM agents WHERE hwid = ?`)
+
+	latestStamp := int64(0)
+	latest := ""
+	err = db.latestInventory.QueryRow(agent).Scan(&latestStamp, &latest)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil && latest == string(blob) {
+		return false, nil
+	}
+	// Keep stamps unique even if inventory changes more than once per second.
+	if snapshot.Stamp <= latestStamp {
+		snapshot.Stamp = latestStamp + 1
+	}
+
+	_, err = db.addInventory.Exec(agent, snapshot.Stamp, string(blob))
+	return err == nil, err
+}
+
+// LatestInventories returns latest inventory snapshot of each agent.
+func (db *DB) LatestInventories() (map[string]inventorySnapshot, error) {
+	rows, err := db.latestInventories.Query()
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return map[string]inventorySnapshot{}, nil
+		}
+		return nil, err
 	}
+	defer rows.Close()
 
-	db.initSession, err = db.d.Prepare(`INSERT INTO sessions VALUES (?)`)
+	res := make(map[string]inventorySnapshot)
+	for rows.Next() {
+		name, blob := "", ""
+		snapshot := inventorySnapshot{}
+		if err := rows.Scan(&name, &snapshot.Stamp, &blob); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(blob), &snapshot.Inventory); err != nil {
+			return nil, err
+		}
+		res[name] = snapshot
+	}
+	return res, rows.Err()
+}
+
+// InventoryStamps returns timestamps of agent's inventory snapshots, oldest
+// first.
+func (db *DB) InventoryStamps(agent string) ([]int64, error) {
+	rows, err := db.inventoryStamps.Query(agent)
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return []int64{}, nil
+		}
+		return nil, err
 	}
-	db.killSession, err = db.d.Prepare(`DELETE FROM sessions WHERE sessionId = ?`)
+	defer rows.Close()
+
+	res := []int64{}
+	for rows.Next() {
+		stamp := int64(0)
+		if err := rows.Scan(&stamp); err != nil {
+			return nil, err
+		}
+		res = append(res, stamp)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) GetInventory(agent string, stamp int64) (inventorySnapshot, error) {
+	snapshot := inventorySnapshot{Stamp: stamp}
+	blob := ""
+	if err := db.getInventory.QueryRow(agent, stamp).Scan(&blob); err != nil {
+		return snapshot, err
+	}
+	return snapshot, json.Unmarshal([]byte(blob), &snapshot.Inventory)
+}
+
+// PruneInventory removes agent's snapshots taken before specified UNIX
+// timestamp.
+func (db *DB) PruneInventory(agent string, before int64) error {
+	_, err := db.pruneInventory.Exec(agent, before)
+	return err
+}
+
+func (db *DB) AddAlert(a alert) error {
+	_, err := db.addAlert.Exec(a.Rule, a.Agent, a.Subject, a.Msg, a.Fired.Unix())
+	return err
+}
+
+func (db *DB) ResolveAlert(key alertKey, stamp time.Time) error {
+	_, err := db.resolveAlert.Exec(stamp.Unix(), key.Rule, key.Agent, key.Subject)
+	return err
+}
+
+func scanAlerts(rows *sql.Rows) ([]alert, error) {
+	defer rows.Close()
+
+	res := []alert{}
+	for rows.Next() {
+		a := alert{}
+		fired := int64(0)
+		var resolved sql.NullInt64
+		if err := rows.Scan(&a.Rule, &a.Agent, &a.Subject, &a.Msg, &fired, &resolved); err != nil {
+			return nil, err
+		}
+		a.Fired = time.Unix(fired, 0)
+		if resolved.Valid {
+			a.Resolved = time.Unix(resolved.Int64, 0)
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) ActiveAlerts() ([]alert, error) {
+	rows, err := db.activeAlerts.Query()
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return []alert{}, nil
+		}
+		return nil, err
 	}
-	db.checkSession, err = db.d.Prepare(`SELECT COUNT(sessionId) FROM sessions WHERE sessionId = ?`)
+	return scanAlerts(rows)
+}
+
+// AlertsHistory returns alerts fired after since, newest first.
+func (db *DB) AlertsHistory(since time.Time) ([]alert, error) {
+	rows, err := db.alertsHistory.Query(since.Unix())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []alert{}, nil
+		}
+		return nil, err
+	}
+	return scanAlerts(rows)
+}
+
+// InitSession creates session for admin with specified token.
+func (db *DB) InitSession(token string) (string, error) {
+	rawSID := make([]byte, 32)
+	if _, err := rand.Read(rawSID); err != nil {
+		return "", err
+	}
+	sid := hex.EncodeToString(rawSID)
+
+	if _, err := db.initSession.Exec(sid); err != nil {
+		return "", err
+	}
+	_, err := db.addSessionAdmin.Exec(sid, token)
+	return sid, err
+}
+
+// SessionAdmin returns token and role of admin owning session. Both are
+// empty for sessions created before roles were introduced.
+func (db *DB) SessionAdmin(sid string) (token, role string, err error) {
+	err = db.getSessionAdmin.QueryRow(sid).Scan(&token, &role)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return token, role, err
+}
+
+func (db *DB) KillSession(sid string) error {
+	if _, err := db.remSessionAdmin.Exec(sid); err != nil {
+		return err
+	}
+	_, err := db.killSession.Exec(sid)
+	return err
+}
+
+func (db *DB) CheckSession(sid string) bool {
+	row := db.checkSession.QueryRow(sid)
+	res := 0
+	if err := row.Scan(&res); err != nil {
+		return false
+	}
+	return res == 1
+}
+
+func (db *DB) AddShellSession(s shellSessionInfo) error {
+	_, err := db.addShellSession.Exec(s.ID, s.Agent, s.Admin, s.Role, s.TaskID, s.Started)
+	return err
+}
+
+func (db *DB) EndShellSession(id string, ended int64, reason string) error {
+	_, err := db.endShellSession.Exec(ended, reason, id)
+	return err
+}
+
+func scanShellSessions(rows *sql.Rows) ([]shellSessionInfo, error) {
+	defer rows.Close()
+
+	res := []shellSessionInfo{}
+	for rows.Next() {
+		s := shellSessionInfo{}
+		var ended sql.NullInt64
+		var reason sql.NullString
+		if err := rows.Scan(&s.ID, &s.Agent, &s.Admin, &s.Role, &s.TaskID, &s.Started, &ended, &reason); err != nil {
+			return nil, err
+		}
+		if ended.Valid {
+			s.Ended = &ended.Int64
+			s.Reason = reason.String
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) GetShellSession(id string) (shellSessionInfo, error) {
+	rows, err := db.getShellSession.Query(id)
+	if err != nil {
+		return shellSessionInfo{}, err
+	}
+	sessions, err := scanShellSessions(rows)
+	if err != nil {
+		return shellSessionInfo{}, err
+	}
+	if len(sessions) == 0 {
+		return shellSessionInfo{}, sql.ErrNoRows
+	}
+	return sessions[0], nil
+}
+
+// ShellSessions returns last limit sessions, newest first. Empty agent
+// means sessions of all agents.
+func (db *DB) ShellSessions(agent string, limit int) ([]shellSessionInfo, error) {
+	var rows *sql.Rows
+	var err error
+	if agent == "" {
+		rows, err = db.listShellSessions.Query(limit)
+	} else {
+		rows, err = db.agentShellSessions.Query(agent, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanShellSessions(rows)
+}
+
+// StaleShellSessions returns IDs of sessions started before specified UNIX
+// timestamp.
+func (db *DB) StaleShellSessions(before int64) ([]string, error) {
+	rows, err := db.staleShellSessions.Query(before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) RemShellSession(id string) error {
+	_, err := db.remShellSession.Exec(id)
+	return err
+}
+
+func scanScripts(rows *sql.Rows) ([]script, error) {
+	defer rows.Close()
+	res := []script{}
+	for rows.Next() {
+		s := script{}
+		if err := rows.Scan(&s.Name, &s.Interpreter, &s.Description, &s.Body, &s.Author, &s.Updated); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// ListScripts returns all scripts from library sorted by name.
+func (db *DB) ListScripts() ([]script, error) {
+	rows, err := db.listScripts.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanScripts(rows)
+}
+
+// GetScript returns sql.ErrNoRows if there is no such script.
+func (db *DB) GetScript(name string) (script, error) {
+	rows, err := db.getScript.Query(name)
+	if err != nil {
+		return script{}, err
+	}
+	res, err := scanScripts(rows)
+	if err != nil {
+		return script{}, err
+	}
+	if len(res) == 0 {
+		return script{}, sql.ErrNoRows
+	}
+	return res[0], nil
+}
+
+// SaveScript adds script to library or replaces one with the same name.
+func (db *DB) SaveScript(s script) error {
+	tx, err := db.d.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.remScript).Exec(s.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Stmt(db.addScript).Exec(s.Name, s.Interpreter, s.Description, s.Body, s.Author, s.Updated); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemScript removes script from library. Returns false if there was no such
+// script.
+func (db *DB) RemScript(name string) (bool, error) {
+	res, err := db.remScript.Exec(name)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected != 0, err
+}
+
+func (db *DB) initSchema() error {
+	_, err := db.d.Exec(`CREATE TABLE IF NOT EXISTS admins (
+		token VARCHAR(256) PRIMARY KEY NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS agents (
+		name VARCHAR(256) PRIMARY KEY NOT NULL,
+		hwid VARCHAR(256) UNIQUE NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Empty task_types means that agent didn't report them.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS agent_info (
+		name VARCHAR(256) PRIMARY KEY NOT NULL,
+		version INTEGER NOT NULL,
+		task_types TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS agent_releases (
+		version INTEGER PRIMARY KEY NOT NULL,
+		channel VARCHAR(64) NOT NULL,
+		rollout INTEGER NOT NULL,
+		manifest TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS agent_channels (
+		name VARCHAR(256) PRIMARY KEY NOT NULL,
+		channel VARCHAR(64) NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS update_reports (
+		agent VARCHAR(256) NOT NULL,
+		from_version INTEGER NOT NULL,
+		to_version INTEGER NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		msg TEXT NOT NULL,
+		stamp BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// result and finished are NULL until agent reports result.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS task_log (
+		id INTEGER PRIMARY KEY NOT NULL,
+		agent VARCHAR(256) NOT NULL,
+		type VARCHAR(64) NOT NULL,
+		created BIGINT NOT NULL,
+		result TEXT,
+		finished BIGINT
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// metrics is JSON-encoded agent.Metrics.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS agent_metrics (
+		agent VARCHAR(256) NOT NULL,
+		stamp BIGINT NOT NULL,
+		metrics TEXT NOT NULL,
+		PRIMARY KEY (agent, stamp)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// data is JSON-encoded agent.Inventory.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS inventory (
+		agent VARCHAR(256) NOT NULL,
+		stamp BIGINT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (agent, stamp)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// resolved is NULL for active alerts.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS alerts (
+		rule VARCHAR(64) NOT NULL,
+		agent VARCHAR(256) NOT NULL,
+		subject VARCHAR(256) NOT NULL,
+		msg TEXT NOT NULL,
+		fired BIGINT NOT NULL,
+		resolved BIGINT,
+		PRIMARY KEY (rule, agent, subject, fired)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Admins without row here have empty role.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS admin_roles (
+		token VARCHAR(256) PRIMARY KEY NOT NULL,
+		role VARCHAR(64) NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// ended and reason are NULL while session is active. admin is prefix of
+	// admin's token, just like in logs.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS shell_sessions (
+		id CHAR(32) PRIMARY KEY NOT NULL,
+		agent VARCHAR(256) NOT NULL,
+		admin VARCHAR(16) NOT NULL,
+		role VARCHAR(64) NOT NULL,
+		task_id INTEGER NOT NULL,
+		started BIGINT NOT NULL,
+		ended BIGINT,
+		reason VARCHAR(64)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// author is prefix of token of admin who saved script.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS scripts (
+		name VARCHAR(256) PRIMARY KEY NOT NULL,
+		interpreter VARCHAR(16) NOT NULL,
+		description TEXT NOT NULL,
+		body TEXT NOT NULL,
+		author VARCHAR(16) NOT NULL,
+		updated BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		sessionId CHAR(64) PRIMARY KEY NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Sessions created before roles were introduced have no row here.
+	_, err = db.d.Exec(`CREATE TABLE IF NOT EXISTS session_admins (
+		sessionId CHAR(64) PRIMARY KEY NOT NULL,
+		token VARCHAR(256) NOT NULL
+	)`)
+	return err
+}
+
+func (db *DB) initStmts() error {
+	var err error
+
+	db.listAgents, err = db.d.Prepare(`SELECT name FROM agents`)
+	if err != nil {
+		return err
+	}
+	db.listAgentHWIDs, err = db.d.Prepare(`SELECT name, hwid FROM agents`)
+	if err != nil {
+		return err
+	}
+
+	db.checkUsrExistance, err = db.d.Prepare(`SELECT COUNT(token) FROM admins WHERE token = ?`)
+	if err != nil {
+		return err
+	}
+	if db.driver != "mysql" {
+		// Everybody except MySQL support this syntax.
+		db.addAccount, err = db.d.Prepare(`INSERT INTO admins VALUES (?) ON CONFLICT DO NOTHING`)
+	} else {
+		// But MySQL is special boi.
+		db.addAccount, err = db.d.Prepare(`INSERT IGNORE INTO admins VALUES (?)`)
+	}
+	if err != nil {
+		return err
+	}
+	db.remAccount, err = db.d.Prepare(`DELETE FROM admins WHERE token = ?`)
+	if err != nil {
+		return err
+	}
+	db.setAdminRole, err = db.d.Prepare(`INSERT INTO admin_roles VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	db.remAdminRole, err = db.d.Prepare(`DELETE FROM admin_roles WHERE token = ?`)
+	if err != nil {
+		return err
+	}
+
+	if db.driver != "mysql" {
+		// Same here.
+		db.addAgent, err = db.d.Prepare(`INSERT INTO agents VALUES (?, ?) ON CONFLICT DO NOTHING`)
+	} else {
+		db.addAgent, err = db.d.Prepare(`INSERT IGNORE INTO agents VALUES (?, ?)`)
+	}
+	if err != nil {
+		return err
+	}
+	db.remAgent, err = db.d.Prepare(`DELETE FROM agents WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.renameAgent, err = db.d.Prepare(`UPDATE agents SET name = ? WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.checkAgentByName, err = db.d.Prepare(`SELECT COUNT(name) FROM agents WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.checkAgentByHWID, err = db.d.Prepare(`SELECT COUNT(hwid) FROM agents WHERE hwid = ?`)
+	if err != nil {
+		return err
+	}
+	db.getAgentName, err = db.d.Prepare(`SELECT name FROM agents WHERE hwid = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.listAgentsInfo, err = db.d.Prepare(`SELECT name, version, task_types FROM agent_info`)
+	if err != nil {
+		return err
+	}
+	if db.driver != "mysql" {
+		db.setAgentInfo, err = db.d.Prepare(`INSERT INTO agent_info VALUES (?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET version = excluded.version, task_types = excluded.task_types`)
+	} else {
+		db.setAgentInfo, err = db.d.Prepare(`INSERT INTO agent_info VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE version = VALUES(version), task_types = VALUES(task_types)`)
+	}
+	if err != nil {
+		return err
+	}
+	db.remAgentInfo, err = db.d.Prepare(`DELETE FROM agent_info WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.renameAgentInfo, err = db.d.Prepare(`UPDATE agent_info SET name = ? WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.listReleases, err = db.d.Prepare(`SELECT version, channel, rollout, manifest FROM agent_releases ORDER BY version`)
+	if err != nil {
+		return err
+	}
+	db.addRelease, err = db.d.Prepare(`INSERT INTO agent_releases VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	db.updateRelease, err = db.d.Prepare(`UPDATE agent_releases SET channel = ?, rollout = ? WHERE version = ?`)
+	if err != nil {
+		return err
+	}
+	db.remRelease, err = db.d.Prepare(`DELETE FROM agent_releases WHERE version = ?`)
+	if err != nil {
+		return err
+	}
+	db.listAgentChannels, err = db.d.Prepare(`SELECT name, channel FROM agent_channels`)
+	if err != nil {
+		return err
+	}
+	if db.driver != "mysql" {
+		db.setAgentChannel, err = db.d.Prepare(`INSERT INTO agent_channels VALUES (?, ?)
+			ON CONFLICT (name) DO UPDATE SET channel = excluded.channel`)
+	} else {
+		db.setAgentChannel, err = db.d.Prepare(`INSERT INTO agent_channels VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE channel = VALUES(channel)`)
+	}
+	if err != nil {
+		return err
+	}
+	db.remAgentChannel, err = db.d.Prepare(`DELETE FROM agent_channels WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.renameAgentChannel, err = db.d.Prepare(`UPDATE agent_channels SET name = ? WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.addUpdateReport, err = db.d.Prepare(`INSERT INTO update_reports VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	db.updateReportsStats, err = db.d.Prepare(`SELECT to_version, status, COUNT(*) FROM update_reports GROUP BY to_version, status`)
+	if err != nil {
+		return err
+	}
+	db.failedUpdates, err = db.d.Prepare(`SELECT DISTINCT to_version FROM update_reports WHERE agent = ? AND status != 'ok'`)
+	if err != nil {
+		return err
+	}
+	db.renameUpdateReports, err = db.d.Prepare(`UPDATE update_reports SET agent = ? WHERE agent = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.addTaskLog, err = db.d.Prepare(`INSERT INTO task_log VALUES (?, ?, ?, ?, NULL, NULL)`)
+	if err != nil {
+		return err
+	}
+	db.setTaskResult, err = db.d.Prepare(`UPDATE task_log SET result = ?, finished = ? WHERE id = ? AND agent = ? AND result IS NULL`)
+	if err != nil {
+		return err
+	}
+	db.getTaskLog, err = db.d.Prepare(`SELECT agent, type, created, result, finished FROM task_log WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	db.maxTaskID, err = db.d.Prepare(`SELECT COALESCE(MAX(id), 0) FROM task_log`)
+	if err != nil {
+		return err
+	}
+	db.pruneTaskLog, err = db.d.Prepare(`DELETE FROM task_log WHERE created < ?`)
+	if err != nil {
+		return err
+	}
+	db.renameTaskLog, err = db.d.Prepare(`UPDATE task_log SET agent = ? WHERE agent = ?`)
+	if err != nil {
+		return err
+	}
+
+	if db.driver != "mysql" {
+		// Agent can send more than one heartbeat per second only if it's
+		// broken, just ignore extra ones.
+		db.addAgentMetrics, err = db.d.Prepare(`INSERT INTO agent_metrics VALUES (?, ?, ?) ON CONFLICT DO NOTHING`)
+	} else {
+		db.addAgentMetrics, err = db.d.Prepare(`INSERT IGNORE INTO agent_metrics VALUES (?, ?, ?)`)
+	}
+	if err != nil {
+		return err
+	}
+	db.latestAgentsMetrics, err = db.d.Prepare(`SELECT agent, stamp, metrics FROM agent_metrics m
+		WHERE stamp = (SELECT MAX(stamp) FROM agent_metrics WHERE agent = m.agent)`)
+	if err != nil {
+		return err
+	}
+	db.agentMetricsHistory, err = db.d.Prepare(`SELECT stamp, metrics FROM agent_metrics
+		WHERE agent = ? AND stamp >= ? AND stamp <= ? ORDER BY stamp`)
+	if err != nil {
+		return err
+	}
+	db.pruneAgentsMetrics, err = db.d.Prepare(`DELETE FROM agent_metrics WHERE stamp < ?`)
+	if err != nil {
+		return err
+	}
+	db.remAgentMetrics, err = db.d.Prepare(`DELETE FROM agent_metrics WHERE agent = ?`)
+	if err != nil {
+		return err
+	}
+	db.renameAgentMetrics, err = db.d.Prepare(`UPDATE agent_metrics SET agent = ? WHERE agent = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.addInventory, err = db.d.Prepare(`INSERT INTO inventory VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	db.latestInventory, err = db.d.Prepare(`SELECT stamp, data FROM inventory WHERE agent = ? ORDER BY stamp DESC LIMIT 1`)
+	if err != nil {
+		return err
+	}
+	db.latestInventories, err = db.d.Prepare(`SELECT agent, stamp, data FROM inventory i
+		WHERE stamp = (SELECT MAX(stamp) FROM inventory WHERE agent = i.agent)`)
+	if err != nil {
+		return err
+	}
+	db.inventoryStamps, err = db.d.Prepare(`SELECT stamp FROM inventory WHERE agent = ? ORDER BY stamp`)
+	if err != nil {
+		return err
+	}
+	db.getInventory, err = db.d.Prepare(`SELECT data FROM inventory WHERE agent = ? AND stamp = ?`)
+	if err != nil {
+		return err
+	}
+	db.pruneInventory, err = db.d.Prepare(`DELETE FROM inventory WHERE agent = ? AND stamp < ?`)
+	if err != nil {
+		return err
+	}
+	db.remAgentInventory, err = db.d.Prepare(`DELETE FROM inventory WHERE agent = ?`)
+	if err != nil {
+		return err
+	}
+	db.renameAgentInventory, err = db.d.Prepare(`UPDATE inventory SET agent = ? WHERE agent = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.addAlert, err = db.d.Prepare(`INSERT INTO alerts VALUES (?, ?, ?, ?, ?, NULL)`)
+	if err != nil {
+		return err
+	}
+	db.resolveAlert, err = db.d.Prepare(`UPDATE alerts SET resolved = ?
+		WHERE rule = ? AND agent = ? AND subject = ? AND resolved IS NULL`)
+	if err != nil {
+		return err
+	}
+	db.activeAlerts, err = db.d.Prepare(`SELECT rule, agent, subject, msg, fired, resolved FROM alerts WHERE resolved IS NULL`)
+	if err != nil {
+		return err
+	}
+	db.alertsHistory, err = db.d.Prepare(`SELECT rule, agent, subject, msg, fired, resolved FROM alerts
+		WHERE fired >= ? ORDER BY fired DESC`)
+	if err != nil {
+		return err
+	}
+
+	db.initSession, err = db.d.Prepare(`INSERT INTO sessions VALUES (?)`)
+	if err != nil {
+		return err
+	}
+	db.killSession, err = db.d.Prepare(`DELETE FROM sessions WHERE sessionId = ?`)
+	if err != nil {
+		return err
+	}
+	db.checkSession, err = db.d.Prepare(`SELECT COUNT(sessionId) FROM sessions WHERE sessionId = ?`)
+	if err != nil {
+		return err
+	}
+	db.addSessionAdmin, err = db.d.Prepare(`INSERT INTO session_admins VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	db.remSessionAdmin, err = db.d.Prepare(`DELETE FROM session_admins WHERE sessionId = ?`)
+	if err != nil {
+		return err
+	}
+	db.getSessionAdmin, err = db.d.Prepare(`SELECT session_admins.token, COALESCE(admin_roles.role, '')
+		FROM session_admins LEFT JOIN admin_roles ON admin_roles.token = session_admins.token
+		WHERE session_admins.sessionId = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.addShellSession, err = db.d.Prepare(`INSERT INTO shell_sessions VALUES (?, ?, ?, ?, ?, ?, NULL, NULL)`)
+	if err != nil {
+		return err
+	}
+	db.endShellSession, err = db.d.Prepare(`UPDATE shell_sessions SET ended = ?, reason = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	db.getShellSession, err = db.d.Prepare(`SELECT id, agent, admin, role, task_id, started, ended, reason
+		FROM shell_sessions WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	db.listShellSessions, err = db.d.Prepare(`SELECT id, agent, admin, role, task_id, started, ended, reason
+		FROM shell_sessions ORDER BY started DESC LIMIT ?`)
+	if err != nil {
+		return err
+	}
+	db.agentShellSessions, err = db.d.Prepare(`SELECT id, agent, admin, role, task_id, started, ended, reason
+		FROM shell_sessions WHERE agent = ? ORDER BY started DESC LIMIT ?`)
+	if err != nil {
+		return err
+	}
+	db.staleShellSessions, err = db.d.Prepare(`SELECT id FROM shell_sessions WHERE started < ?`)
+	if err != nil {
+		return err
+	}
+	db.remShellSession, err = db.d.Prepare(`DELETE FROM shell_sessions WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	db.listScripts, err = db.d.Prepare(`SELECT name, interpreter, description, body, author, updated
+		FROM scripts ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	db.getScript, err = db.d.Prepare(`SELECT name, interpreter, description, body, author, updated
+		FROM scripts WHERE name = ?`)
+	if err != nil {
+		return err
+	}
+	db.addScript, err = db.d.Prepare(`INSERT INTO scripts VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	db.remScript, err = db.d.Prepare(`DELETE FROM scripts WHERE name = ?`)
 	if err != nil {
 		return err
 	}
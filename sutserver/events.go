@@ -0,0 +1,127 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// event is a notification for admins (dashboard), like fired alert.
+type event struct {
+	Seq   int64                  `json:"seq"`
+	Kind  string                 `json:"kind"`
+	Stamp int64                  `json:"stamp"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// Only last maxEvents events are kept in memory, clients that didn't poll
+// for longer may miss some.
+const maxEvents = 1000
+
+var events []event
+var lastEventSeq int64
+
+// eventsNotify is closed and replaced when new event is published.
+var eventsNotify = make(chan struct{})
+var eventsLock sync.Mutex
+
+func publishEvent(kind string, data map[string]interface{}) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	lastEventSeq++
+	events = append(events, event{
+		Seq:   lastEventSeq,
+		Kind:  kind,
+		Stamp: time.Now().Unix(),
+		Data:  data,
+	})
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+
+	close(eventsNotify)
+	eventsNotify = make(chan struct{})
+	debugLog("Event", lastEventSeq, kind, data)
+}
+
+// eventsAfter returns events with sequence number bigger than seq and channel
+// that will be closed when new event is published.
+func eventsAfter(seq int64) ([]event, chan struct{}) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	if seq > lastEventSeq {
+		// Server was restarted and sequence numbers started from zero.
+		seq = 0
+	}
+
+	res := []event{}
+	for _, e := range events {
+		if e.Seq > seq {
+			res = append(res, e)
+		}
+	}
+	return res, eventsNotify
+}
+
+// eventsHandler is longpolling endpoint for events, it waits up to 26 seconds
+// if there are no events after specified sequence number.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/events only supports GET")
+		return
+	}
+
+	after := int64(0)
+	if s := r.URL.Query().Get("after"); s != "" {
+		var err error
+		if after, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid after value")
+			return
+		}
+	}
+
+	res, notify := eventsAfter(after)
+	if len(res) == 0 {
+		select {
+		case <-notify:
+			res, _ = eventsAfter(after)
+		case <-time.After(26 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	eventsLock.Lock()
+	last := lastEventSeq
+	eventsLock.Unlock()
+	writeJson(w, map[string]interface{}{"error": false, "events": res, "last": last})
+}
@@ -0,0 +1,475 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+)
+
+// inventorySnapshot is agent's inventory saved at Stamp. New snapshot is
+// saved only if inventory changed.
+type inventorySnapshot struct {
+	Stamp int64
+	agent.Inventory
+}
+
+func initInventory() {
+	days := serverConf.InventoryDays
+	if days == 0 {
+		days = 90
+	}
+	go func() {
+		for {
+			pruneInventory(time.Now().AddDate(0, 0, -days))
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// pruneInventory removes snapshots taken before specified time, but always
+// keeps latest snapshot of each agent.
+func pruneInventory(before time.Time) {
+	latest, err := db.LatestInventories()
+	if err != nil {
+		log.Println("Failed to prune inventory:", err)
+		return
+	}
+	for agentID, snapshot := range latest {
+		cutoff := before.Unix()
+		if snapshot.Stamp < cutoff {
+			cutoff = snapshot.Stamp
+		}
+		if err := db.PruneInventory(agentID, cutoff); err != nil {
+			log.Println("Failed to prune inventory:", err)
+			return
+		}
+	}
+}
+
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !checkAgentAuth(r.Header) {
+			writeError(w, http.StatusForbidden, "Authorization failure")
+			return
+		}
+		saveInventory(w, r)
+	} else if r.Method == http.MethodGet {
+		if !checkAdminAuth(r.Header) {
+			writeError(w, http.StatusForbidden, "Authorization failure")
+			return
+		}
+		getInventory(w, r)
+	} else {
+		writeError(w, http.StatusMethodNotAllowed, "/inventory only supports GET and POST")
+	}
+}
+
+func saveInventory(w http.ResponseWriter, r *http.Request) {
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	snapshot := inventorySnapshot{Stamp: time.Now().Unix()}
+	if err := json.NewDecoder(r.Body).Decode(&snapshot.Inventory); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	saved, err := db.AddInventory(agentID, snapshot)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if saved {
+		debugLog("Saved new inventory snapshot of", agentID)
+	}
+	writeJson(w, map[string]interface{}{"error": false})
+}
+
+func getInventory(w http.ResponseWriter, r *http.Request) {
+	agentID := r.URL.Query().Get("id")
+	if agentID == "" {
+		writeError(w, http.StatusBadRequest, "Missing id parameter")
+		return
+	}
+
+	stamps, err := db.InventoryStamps(agentID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(stamps) == 0 {
+		writeError(w, http.StatusNotFound, "Agent didn't report inventory")
+		return
+	}
+
+	stamp := stamps[len(stamps)-1]
+	if stampStr := r.URL.Query().Get("stamp"); stampStr != "" {
+		if stamp, err = strconv.ParseInt(stampStr, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid stamp value")
+			return
+		}
+	}
+
+	snapshot, err := db.GetInventory(agentID, stamp)
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+
+	writeJson(w, map[string]interface{}{
+		"error":     false,
+		"stamp":     snapshot.Stamp,
+		"inventory": snapshot.Inventory,
+		"snapshots": stamps,
+	})
+}
+
+// inventoryMatches checks latest inventory against search parameters. All
+// specified parameters should match.
+func inventoryMatches(inv agent.Inventory, q map[string]string) bool {
+	containsFold := func(s, substr string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+	}
+
+	if v := q["hostname"]; v != "" && !containsFold(inv.Hostname, v) {
+		return false
+	}
+	if v := q["os"]; v != "" && !containsFold(inv.OS, v) {
+		return false
+	}
+	if v := q["kernel"]; v != "" && !containsFold(inv.Kernel, v) {
+		return false
+	}
+	if v := q["cpu"]; v != "" && !containsFold(inv.CPUModel, v) {
+		return false
+	}
+	if v := q["mem_min"]; v != "" {
+		min, _ := strconv.ParseUint(v, 10, 64)
+		if inv.MemTotal < min {
+			return false
+		}
+	}
+	if v := q["mem_max"]; v != "" {
+		max, _ := strconv.ParseUint(v, 10, 64)
+		if inv.MemTotal > max {
+			return false
+		}
+	}
+	if v := q["package"]; v != "" {
+		found := false
+		for _, pkg := range inv.Packages {
+			if strings.EqualFold(pkg.Name, v) && (q["package_version"] == "" || pkg.Version == q["package_version"]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if v := q["mac"]; v != "" {
+		found := false
+		for _, iface := range inv.Interfaces {
+			if strings.EqualFold(iface.MAC, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if v := q["ip"]; v != "" {
+		found := false
+		for _, iface := range inv.Interfaces {
+			for _, addr := range iface.Addrs {
+				if strings.HasPrefix(addr, v) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+var inventorySearchParams = []string{"hostname", "os", "kernel", "cpu", "mem_min", "mem_max", "package", "package_version", "mac", "ip"}
+
+func inventorySearchHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/inventory_search only supports GET")
+		return
+	}
+
+	q := make(map[string]string)
+	for _, param := range inventorySearchParams {
+		q[param] = r.URL.Query().Get(param)
+	}
+	for _, param := range []string{"mem_min", "mem_max"} {
+		if _, err := strconv.ParseUint(q[param], 10, 64); q[param] != "" && err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid "+param+" value")
+			return
+		}
+	}
+	if q["package_version"] != "" && q["package"] == "" {
+		writeError(w, http.StatusBadRequest, "package_version requires package")
+		return
+	}
+
+	latest, err := db.LatestInventories()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	agents := []string{}
+	for agentID, snapshot := range latest {
+		if inventoryMatches(snapshot.Inventory, q) {
+			agents = append(agents, agentID)
+		}
+	}
+	sort.Sort(StringSlice(agents))
+
+	res := []map[string]interface{}{}
+	for _, agentID := range agents {
+		snapshot := latest[agentID]
+		res = append(res, map[string]interface{}{
+			"agent":     agentID,
+			"stamp":     snapshot.Stamp,
+			"hostname":  snapshot.Hostname,
+			"os":        snapshot.OS,
+			"cpu_model": snapshot.CPUModel,
+			"mem_total": snapshot.MemTotal,
+		})
+	}
+	writeJson(w, map[string]interface{}{"error": false, "agents": res})
+}
+
+// diffInventory lists differences between two inventories.
+func diffInventory(a, b agent.Inventory) map[string]interface{} {
+	changed := make(map[string][]interface{})
+	addChange := func(field string, from, to interface{}) {
+		if from != to {
+			changed[field] = []interface{}{from, to}
+		}
+	}
+	addChange("hostname", a.Hostname, b.Hostname)
+	addChange("os", a.OS, b.OS)
+	addChange("kernel", a.Kernel, b.Kernel)
+	addChange("arch", a.Arch, b.Arch)
+	addChange("cpu_model", a.CPUModel, b.CPUModel)
+	addChange("cpu_cores", a.CPUCores, b.CPUCores)
+	addChange("mem_total", a.MemTotal, b.MemTotal)
+
+	// Packages are compared by name, there may be several versions of one
+	// package installed so versions are joined.
+	pkgVersions := func(pkgs []agent.Package) map[string]string {
+		res := make(map[string]string)
+		for _, pkg := range pkgs {
+			if res[pkg.Name] != "" {
+				res[pkg.Name] += ", "
+			}
+			res[pkg.Name] += pkg.Version
+		}
+		return res
+	}
+	aPkgs, bPkgs := pkgVersions(a.Packages), pkgVersions(b.Packages)
+	pkgsAdded, pkgsRemoved := []agent.Package{}, []agent.Package{}
+	pkgsChanged := []map[string]string{}
+	for name, ver := range bPkgs {
+		aVer, prs := aPkgs[name]
+		if !prs {
+			pkgsAdded = append(pkgsAdded, agent.Package{Name: name, Version: ver})
+		} else if aVer != ver {
+			pkgsChanged = append(pkgsChanged, map[string]string{"name": name, "from": aVer, "to": ver})
+		}
+	}
+	for name, ver := range aPkgs {
+		if _, prs := bPkgs[name]; !prs {
+			pkgsRemoved = append(pkgsRemoved, agent.Package{Name: name, Version: ver})
+		}
+	}
+	sort.Slice(pkgsAdded, func(i, j int) bool { return pkgsAdded[i].Name < pkgsAdded[j].Name })
+	sort.Slice(pkgsRemoved, func(i, j int) bool { return pkgsRemoved[i].Name < pkgsRemoved[j].Name })
+	sort.Slice(pkgsChanged, func(i, j int) bool { return pkgsChanged[i]["name"] < pkgsChanged[j]["name"] })
+
+	disks := func(inv agent.Inventory) map[string]interface{} {
+		res := make(map[string]interface{})
+		for _, d := range inv.Disks {
+			res[d.Mount] = d
+		}
+		return res
+	}
+	ifaces := func(inv agent.Inventory) map[string]interface{} {
+		res := make(map[string]interface{})
+		for _, iface := range inv.Interfaces {
+			res[iface.Name] = iface
+		}
+		return res
+	}
+
+	return map[string]interface{}{
+		"changed": changed,
+		"packages": map[string]interface{}{
+			"added":   pkgsAdded,
+			"removed": pkgsRemoved,
+			"changed": pkgsChanged,
+		},
+		"disks":      diffByKey(disks(a), disks(b)),
+		"interfaces": diffByKey(ifaces(a), ifaces(b)),
+	}
+}
+
+// diffByKey compares two sets of objects identified by key.
+func diffByKey(a, b map[string]interface{}) map[string]interface{} {
+	added, removed, changed := []interface{}{}, []interface{}{}, []interface{}{}
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, prs := a[k]; !prs {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		aVal, aPrs := a[k]
+		bVal, bPrs := b[k]
+		switch {
+		case !aPrs:
+			added = append(added, bVal)
+		case !bPrs:
+			removed = append(removed, aVal)
+		default:
+			aBlob, _ := json.Marshal(aVal)
+			bBlob, _ := json.Marshal(bVal)
+			if string(aBlob) != string(bBlob) {
+				changed = append(changed, map[string]interface{}{"from": aVal, "to": bVal})
+			}
+		}
+	}
+	return map[string]interface{}{"added": added, "removed": removed, "changed": changed}
+}
+
+// inventoryDiffHandler compares two snapshots of one agent (last two by
+// default) or latest snapshots of two agents.
+func inventoryDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/inventory_diff only supports GET")
+		return
+	}
+
+	agentID := r.URL.Query().Get("id")
+	if agentID == "" {
+		writeError(w, http.StatusBadRequest, "Missing id parameter")
+		return
+	}
+	stamps, err := db.InventoryStamps(agentID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(stamps) == 0 {
+		writeError(w, http.StatusNotFound, "Agent didn't report inventory")
+		return
+	}
+
+	fromAgent, toAgent := agentID, agentID
+	fromStamp, toStamp := stamps[len(stamps)-1], stamps[len(stamps)-1]
+	if len(stamps) > 1 {
+		fromStamp = stamps[len(stamps)-2]
+	}
+
+	if other := r.URL.Query().Get("other"); other != "" {
+		otherStamps, err := db.InventoryStamps(other)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(otherStamps) == 0 {
+			writeError(w, http.StatusNotFound, "Other agent didn't report inventory")
+			return
+		}
+		fromStamp = toStamp
+		toAgent, toStamp = other, otherStamps[len(otherStamps)-1]
+	} else {
+		for param, dest := range map[string]*int64{"from": &fromStamp, "to": &toStamp} {
+			if s := r.URL.Query().Get(param); s != "" {
+				if *dest, err = strconv.ParseInt(s, 10, 64); err != nil {
+					writeError(w, http.StatusBadRequest, "Invalid "+param+" value")
+					return
+				}
+			}
+		}
+	}
+
+	from, err := db.GetInventory(fromAgent, fromStamp)
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+	to, err := db.GetInventory(toAgent, toStamp)
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+
+	writeJson(w, map[string]interface{}{
+		"error": false,
+		"from":  map[string]interface{}{"agent": fromAgent, "stamp": fromStamp},
+		"to":    map[string]interface{}{"agent": toAgent, "stamp": toStamp},
+		"diff":  diffInventory(from.Inventory, to.Inventory),
+	})
+}
+
+func writeSnapshotError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "No such snapshot")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
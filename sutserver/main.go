@@ -37,6 +37,7 @@ import (
 	"time"
 
 	"github.com/foxcpp/filedrop"
+	"github.com/foxcpp/sutrc/agent"
 	"gopkg.in/yaml.v2"
 )
 
@@ -57,10 +58,20 @@ func main() {
 		fmt.Println("\tAdd account token TOKEN to server DB from CONFIGFILE.")
 		fmt.Println(os.Args[0], "remaccount CONFIGFILE TOKEN")
 		fmt.Println("\tRemove account token TOKEN from server DB from CONFIGFILE.")
+		fmt.Println(os.Args[0], "setrole CONFIGFILE TOKEN ROLE")
+		fmt.Println("\tAssign ROLE to account TOKEN, empty ROLE removes it.")
 		fmt.Println(os.Args[0], "addagent CONFIGFILE NAME HWID")
 		fmt.Println("\tAdd agent NAME with HWID to server DB from CONFIGFILE.")
 		fmt.Println(os.Args[0], "remagent CONFIGFILE NAME")
 		fmt.Println("\tRemove agent NAME from server DB from CONFIGFILE.")
+		fmt.Println(os.Args[0], "genkey KEYFILE")
+		fmt.Println("\tGenerate ed25519 key pair, save private key to KEYFILE and print public key.")
+		fmt.Println(os.Args[0], "signupdate KEYFILE BINARY VERSION URL")
+		fmt.Println("\tPrint signed manifest for agent BINARY with VERSION served at URL.")
+		fmt.Println(os.Args[0], "signtask KEYFILE KEYID [TTL]")
+		fmt.Println("\tSign task read from stdin, it will be valid for TTL (default 1h).")
+		fmt.Println(os.Args[0], "tunnel LOCALADDR TUNNELADDR SECRET")
+		fmt.Println("\tForward connections to LOCALADDR to tunnel listener at TUNNELADDR.")
 		return
 	}
 
@@ -72,10 +83,20 @@ func main() {
 		addAccountSubcmd()
 	case "remaccount":
 		remAccountSubcmd()
+	case "setrole":
+		setRoleSubcmd()
 	case "addagent":
 		addAgentSubcmd()
 	case "remagent":
 		remAgentSubcmd()
+	case "genkey":
+		genKeySubcmd()
+	case "signupdate":
+		signUpdateSubcmd()
+	case "signtask":
+		signTaskSubcmd()
+	case "tunnel":
+		tunnelSubcmd()
 	default:
 		fmt.Fprintln(os.Stderr, "Unknown subcommand.")
 		os.Exit(1)
@@ -110,6 +131,7 @@ func serverSubcommand() {
 	if err := yaml.Unmarshal(confBlob, &conf); err != nil {
 		log.Fatalln("Failed to parse config file:", err)
 	}
+	serverConf = conf
 
 	db, err = OpenDB(conf.DB.Driver, conf.DB.DSN)
 	if err != nil {
@@ -117,17 +139,68 @@ func serverSubcommand() {
 	}
 	defer db.Close()
 
+	if err := loadAgentsInfo(); err != nil {
+		log.Fatalln("Failed to load agents info:", err)
+	}
+	if err := initTaskLog(); err != nil {
+		log.Fatalln("Failed to initialize tasks log:", err)
+	}
+	if err := initMetrics(); err != nil {
+		log.Fatalln("Failed to load agents metrics:", err)
+	}
+	initInventory()
+	initTaskOutput()
+	if err := initAlerts(); err != nil {
+		log.Fatalln("Failed to initialize alerts:", err)
+	}
+
 	conf.Filedrop.DB.Driver = conf.DB.Driver
 	conf.Filedrop.DB.DSN = conf.DB.DSN
 	filedropSrv := startFiledrop(conf.Filedrop)
 	defer filedropSrv.Close()
+	if err := initUploads(filedropSrv, conf.Filedrop); err != nil {
+		log.Fatalln("Failed to initialize uploads:", err)
+	}
+	initP2P(filedropSrv)
+	if err := initShell(conf.Filedrop.StorageDir); err != nil {
+		log.Fatalln("Failed to initialize shell sessions:", err)
+	}
+	initTunnels()
 
 	http.HandleFunc(PathPrefix+"/tasks", tasksHandler)
 	http.HandleFunc(PathPrefix+"/task_result", tasksResultHandler)
+	http.HandleFunc(PathPrefix+"/task_output", taskOutputHandler)
+	http.HandleFunc(PathPrefix+"/task_cancel", taskCancelHandler)
+	http.HandleFunc(PathPrefix+"/tasks_ws", tasksWSHandler)
+	http.HandleFunc(PathPrefix+"/scripts", scriptsHandler)
+	http.HandleFunc(PathPrefix+"/run_script", runScriptHandler)
 	http.HandleFunc(PathPrefix+"/login", loginHandler)
 	http.HandleFunc(PathPrefix+"/logout", logoutHandler)
 	http.HandleFunc(PathPrefix+"/agents", agentsHandler)
 	http.HandleFunc(PathPrefix+"/agents_selfreg", agentsSelfregHandler)
+	http.HandleFunc(PathPrefix+"/agents_versions", agentsVersionsHandler)
+	http.HandleFunc(PathPrefix+"/agents_channels", agentsChannelsHandler)
+	http.HandleFunc(PathPrefix+"/agents_metrics", agentsMetricsHandler)
+	http.HandleFunc(PathPrefix+"/heartbeat", heartbeatHandler)
+	http.HandleFunc(PathPrefix+"/inventory", inventoryHandler)
+	http.HandleFunc(PathPrefix+"/inventory_search", inventorySearchHandler)
+	http.HandleFunc(PathPrefix+"/inventory_diff", inventoryDiffHandler)
+	http.HandleFunc(PathPrefix+"/alerts", alertsHandler)
+	http.HandleFunc(PathPrefix+"/events", eventsHandler)
+	http.HandleFunc(PathPrefix+"/updates", updatesHandler)
+	http.HandleFunc(PathPrefix+"/update_manifest", updateManifestHandler)
+	http.HandleFunc(PathPrefix+"/update_report", updateReportHandler)
+	http.HandleFunc(PathPrefix+"/uploads", uploadsHandler)
+	http.HandleFunc(PathPrefix+"/uploads_finish", uploadsFinishHandler)
+	http.HandleFunc(PathPrefix+"/p2p", p2pHandler)
+	http.HandleFunc(PathPrefix+"/p2p_chunk", p2pChunkHandler)
+	http.HandleFunc(PathPrefix+"/ws_ticket", wsTicketHandler)
+	http.HandleFunc(PathPrefix+"/shell", shellHandler)
+	http.HandleFunc(PathPrefix+"/shell_agent", shellAgentHandler)
+	http.HandleFunc(PathPrefix+"/shell_sessions", shellSessionsHandler)
+	http.HandleFunc(PathPrefix+"/tunnel", tunnelHandler)
+	http.HandleFunc(PathPrefix+"/tunnels", tunnelsHandler)
+	http.HandleFunc(PathPrefix+"/tunnel_agent", tunnelAgentHandler)
 	http.Handle(PathPrefix+"/filedrop/", filedropSrv)
 
 	go func() {
@@ -245,6 +318,7 @@ func removeAgentQueues(id string) {
 		close(tasks[id])
 	}
 	delete(tasks, id)
+	delete(autoUpdateQueued, id)
 	taskMetaLock.Unlock()
 
 	lastRequestStampLock.Lock()
@@ -254,6 +328,19 @@ func removeAgentQueues(id string) {
 	onlineAgentsLock.Lock()
 	delete(onlineAgents, id)
 	onlineAgentsLock.Unlock()
+
+	agentsInfoLock.Lock()
+	delete(agentsInfo, id)
+	agentsInfoLock.Unlock()
+
+	agentsMetricsLock.Lock()
+	delete(agentsMetrics, id)
+	agentsMetricsLock.Unlock()
+
+	peersLock.Lock()
+	delete(peers, id)
+	delete(peerHandouts, id)
+	peersLock.Unlock()
 }
 
 func agentSelfreg(w http.ResponseWriter, r *http.Request) {
@@ -265,6 +352,11 @@ func agentSelfreg(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if db.CheckAgentAuth(hwid) {
+		// Agent name in DB may differ from requested one if agent was
+		// renamed by admin.
+		if agentID, err := db.GetAgentName(hwid); err == nil {
+			recordAgentInfo(agentID, r.Header)
+		}
 		return
 	}
 
@@ -277,6 +369,7 @@ func agentSelfreg(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	recordAgentInfo(name, r.Header)
 }
 
 // StringSlice is a sort.Interface implementation that considers longer strings
@@ -312,6 +405,16 @@ func agentListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	sort.Sort(StringSlice(agents))
 
+	hwids, err := db.ListAgentHWIDs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stableIDs := make(map[string]string, len(hwids))
+	for name, hwid := range hwids {
+		stableIDs[name] = agent.StableID(hwid)
+	}
+
 	lastRequestStampLock.Lock()
 	onlineAgentsLock.Lock()
 	defer lastRequestStampLock.Unlock()
@@ -328,7 +431,29 @@ func agentListHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	writeJson(w, map[string]interface{}{"error": false, "agents": agents, "online": onlineAgentsL})
+	versions := make(map[string]int)
+	taskTypes := make(map[string][]string)
+	agentsInfoLock.Lock()
+	for _, agent := range agents {
+		info, prs := agentsInfo[agent]
+		if !prs {
+			continue
+		}
+		versions[agent] = info.Version
+		if info.TaskTypes != nil {
+			taskTypes[agent] = info.TaskTypes
+		}
+	}
+	agentsInfoLock.Unlock()
+
+	writeJson(w, map[string]interface{}{
+		"error":      false,
+		"agents":     agents,
+		"online":     onlineAgentsL,
+		"versions":   versions,
+		"task_types": taskTypes,
+		"stable_ids": stableIDs,
+	})
 }
 
 func renameAgentHandler(w http.ResponseWriter, r *http.Request) {
@@ -369,6 +494,28 @@ func renameAgentHandler(w http.ResponseWriter, r *http.Request) {
 	onlineAgents[newId] = onlineAgents[oldId]
 	delete(onlineAgents, oldId)
 	onlineAgentsLock.Unlock()
+
+	agentsInfoLock.Lock()
+	if info, prs := agentsInfo[oldId]; prs {
+		agentsInfo[newId] = info
+		delete(agentsInfo, oldId)
+	}
+	agentsInfoLock.Unlock()
+
+	agentsMetricsLock.Lock()
+	if m, prs := agentsMetrics[oldId]; prs {
+		agentsMetrics[newId] = m
+		delete(agentsMetrics, oldId)
+	}
+	agentsMetricsLock.Unlock()
+
+	peersLock.Lock()
+	if info, prs := peers[oldId]; prs {
+		peers[newId] = info
+		delete(peers, oldId)
+	}
+	delete(peerHandouts, oldId)
+	peersLock.Unlock()
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -378,7 +525,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := db.InitSession()
+	token, err := db.InitSession(r.URL.Query().Get("token"))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -425,3 +572,12 @@ func checkAgentAuth(h http.Header) bool {
 func checkAdminAuth(h http.Header) bool {
 	return db.CheckSession(h.Get("Authorization"))
 }
+
+func contains(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
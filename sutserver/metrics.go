@@ -0,0 +1,159 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+)
+
+// metricsEntry is agent's heartbeat stored by server.
+type metricsEntry struct {
+	Stamp int64 `json:"stamp"`
+	agent.Metrics
+}
+
+// agentsMetrics stores latest heartbeat of each agent.
+var agentsMetrics = make(map[string]metricsEntry)
+var agentsMetricsLock sync.Mutex
+
+// initMetrics loads latest heartbeats from DB and starts periodic cleanup of
+// metrics history.
+func initMetrics() error {
+	latest, err := db.LatestAgentsMetrics()
+	if err != nil {
+		return err
+	}
+	agentsMetricsLock.Lock()
+	agentsMetrics = latest
+	agentsMetricsLock.Unlock()
+
+	days := serverConf.MetricsDays
+	if days == 0 {
+		days = 7
+	}
+	go func() {
+		for {
+			if err := db.PruneAgentsMetrics(time.Now().AddDate(0, 0, -days)); err != nil {
+				log.Println("Failed to prune metrics history:", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+	return nil
+}
+
+func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "/heartbeat only supports POST")
+		return
+	}
+
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	entry := metricsEntry{Stamp: time.Now().Unix()}
+	if err := json.NewDecoder(r.Body).Decode(&entry.Metrics); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	lastRequestStampLock.Lock()
+	lastRequestStamp[agentID] = time.Now()
+	lastRequestStampLock.Unlock()
+
+	if err := db.AddAgentMetrics(agentID, entry); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	agentsMetricsLock.Lock()
+	agentsMetrics[agentID] = entry
+	agentsMetricsLock.Unlock()
+
+	writeJson(w, map[string]interface{}{"error": false})
+}
+
+// agentsMetricsHandler returns latest heartbeat of each agent or metrics
+// history of single agent if id is specified.
+func agentsMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/agents_metrics only supports GET")
+		return
+	}
+
+	agentID := r.URL.Query().Get("id")
+	if agentID == "" {
+		agentsMetricsLock.Lock()
+		latest := make(map[string]metricsEntry, len(agentsMetrics))
+		for k, v := range agentsMetrics {
+			latest[k] = v
+		}
+		agentsMetricsLock.Unlock()
+
+		writeJson(w, map[string]interface{}{"error": false, "metrics": latest})
+		return
+	}
+
+	// Last day by default.
+	until := time.Now().Unix()
+	since := until - 24*60*60
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid since value")
+			return
+		}
+	}
+	if s := r.URL.Query().Get("until"); s != "" {
+		var err error
+		if until, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid until value")
+			return
+		}
+	}
+
+	history, err := db.AgentMetricsHistory(agentID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, map[string]interface{}{"error": false, "metrics": history})
+}
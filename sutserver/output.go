@@ -0,0 +1,266 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Output of running tasks streamed by agents is kept in memory until
+// maxOutputAge passes after task finished, final result is saved to tasks
+// log as usual.
+
+// Only first maxTaskOutput bytes of output are kept.
+const maxTaskOutput = 8 << 20
+
+const maxOutputAge = 10 * time.Minute
+
+type outputChunk struct {
+	Seq    int    `json:"seq"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+	Stamp  int64  `json:"stamp"`
+}
+
+type taskOutput struct {
+	agent     string
+	chunks    []outputChunk
+	size      int
+	truncated bool
+	finished  bool
+	updated   time.Time
+	// notify is closed and replaced when output is updated.
+	notify chan struct{}
+}
+
+var taskOutputs = make(map[int]*taskOutput)
+var taskOutputsLock sync.Mutex
+
+func initTaskOutput() {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			pruneTaskOutputs()
+		}
+	}()
+}
+
+func pruneTaskOutputs() {
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	for id, out := range taskOutputs {
+		// Unfinished tasks are kept longer in case agent is just slow.
+		if (out.finished && time.Since(out.updated) > maxOutputAge) || time.Since(out.updated) > 24*time.Hour {
+			delete(taskOutputs, id)
+		}
+	}
+}
+
+// finishTaskOutput wakes up admins waiting for output of task, called when
+// task result is received.
+func finishTaskOutput(id int) {
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	if out := taskOutputs[id]; out != nil {
+		out.finished = true
+		out.updated = time.Now()
+		close(out.notify)
+		out.notify = make(chan struct{})
+	}
+}
+
+func taskOutputHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !checkAgentAuth(r.Header) {
+			writeError(w, http.StatusForbidden, "Authorization failure")
+			return
+		}
+		saveTaskOutput(w, r)
+	} else if r.Method == http.MethodGet {
+		if !checkAdminAuth(r.Header) {
+			writeError(w, http.StatusForbidden, "Authorization failure")
+			return
+		}
+		getTaskOutput(w, r)
+	} else {
+		writeError(w, http.StatusMethodNotAllowed, "/task_output only supports GET and POST")
+	}
+}
+
+// saveTaskOutput handles POST /task_output?id=TASKID. Chunks with sequence
+// numbers that were already received are ignored so agent can safely retry.
+func saveTaskOutput(w http.ResponseWriter, r *http.Request) {
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid id value")
+		return
+	}
+	req := struct {
+		Chunks []outputChunk `json:"chunks"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	taskOutputsLock.Lock()
+	out := taskOutputs[id]
+	taskOutputsLock.Unlock()
+	if out == nil {
+		entry, err := db.GetTaskLog(id)
+		if err != nil && err != sql.ErrNoRows {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err == sql.ErrNoRows || entry.Agent != agentID || entry.Result != nil {
+			writeError(w, http.StatusBadRequest, "Invalid id value")
+			return
+		}
+	}
+
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	out = getOutput(id, agentID)
+	if out.agent != agentID || out.finished {
+		writeError(w, http.StatusBadRequest, "Invalid id value")
+		return
+	}
+
+	lastSeq := 0
+	if len(out.chunks) != 0 {
+		lastSeq = out.chunks[len(out.chunks)-1].Seq
+	}
+	now := time.Now()
+	for _, chunk := range req.Chunks {
+		if chunk.Seq <= lastSeq {
+			continue
+		}
+		lastSeq = chunk.Seq
+		if out.size+len(chunk.Data) > maxTaskOutput {
+			out.truncated = true
+			continue
+		}
+		chunk.Stamp = now.Unix()
+		out.chunks = append(out.chunks, chunk)
+		out.size += len(chunk.Data)
+	}
+	out.updated = now
+	close(out.notify)
+	out.notify = make(chan struct{})
+
+	writeJson(w, map[string]interface{}{"error": false})
+}
+
+// getOutput returns output of task, creating it if necessary.
+// taskOutputsLock should be held.
+func getOutput(id int, agentID string) *taskOutput {
+	out := taskOutputs[id]
+	if out == nil {
+		out = &taskOutput{agent: agentID, updated: time.Now(), notify: make(chan struct{})}
+		taskOutputs[id] = out
+	}
+	return out
+}
+
+// outputAfter returns chunks with sequence number bigger than seq and
+// channel closed on next update. Output is created only if task is not
+// finished yet.
+func outputAfter(entry taskLogEntry, seq int) (res []outputChunk, finished, truncated bool, notify chan struct{}) {
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	res = []outputChunk{}
+	out := taskOutputs[entry.ID]
+	if out == nil {
+		if entry.Result != nil {
+			return res, true, false, nil
+		}
+		out = getOutput(entry.ID, entry.Agent)
+	}
+	for _, chunk := range out.chunks {
+		if chunk.Seq > seq {
+			res = append(res, chunk)
+		}
+	}
+	return res, out.finished, out.truncated, out.notify
+}
+
+// getTaskOutput handles GET /task_output?id=TASKID&after=SEQ, it waits up
+// to 26 seconds for new output.
+func getTaskOutput(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid id value")
+		return
+	}
+	after := 0
+	if s := r.URL.Query().Get("after"); s != "" {
+		if after, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid after value")
+			return
+		}
+	}
+
+	entry, err := db.GetTaskLog(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "No such task")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	chunks, finished, truncated, notify := outputAfter(entry, after)
+	finished = finished || entry.Result != nil
+	if len(chunks) == 0 && !finished {
+		select {
+		case <-notify:
+		case <-time.After(26 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		chunks, finished, truncated, _ = outputAfter(entry, after)
+	}
+
+	last := after
+	if len(chunks) != 0 {
+		last = chunks[len(chunks)-1].Seq
+	}
+	writeJson(w, map[string]interface{}{
+		"error":     false,
+		"chunks":    chunks,
+		"last":      last,
+		"finished":  finished,
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,96 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestStreamOutlivesWaiter checks that output of WebSocket agent task can
+// be followed after admin's request for result timed out.
+func TestStreamOutlivesWaiter(t *testing.T) {
+	srv, sid, client := startTestWSAgent(t)
+
+	waiterDone := make(chan struct{})
+	proceed := make(chan struct{})
+	agentErr := make(chan string, 1)
+	go func() {
+		id, _, _, err := client.NextTask()
+		if err != nil {
+			agentErr <- err.Error()
+			return
+		}
+		stream := client.OutputStream(id)
+		<-waiterDone
+		stream.Write("stdout", []byte("Unpacking foo...\n"))
+		<-proceed
+		if err := client.TaskContext(id).Err(); err != nil {
+			agentErr <- "task cancelled after waiter timeout"
+			return
+		}
+		stream.Write("stdout", []byte("Setting up foo...\n"))
+		stream.Close()
+		agentErr <- ""
+		client.SendTaskResult(id, map[string]interface{}{"stdout": "Unpacking foo...\nSetting up foo...\n", "status_code": 0})
+	}()
+	waitWSAgent(t)
+
+	taskID := queueTimedOutTask(t, srv, sid, `{"type":"execute_cmd","cmd":"apt-get install -y foo","stream":true}`)
+	close(waiterDone)
+
+	type outputResp struct {
+		Chunks   []outputChunk `json:"chunks"`
+		Last     int           `json:"last"`
+		Finished bool          `json:"finished"`
+	}
+	output := ""
+	last := 0
+	proceeded := false
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp := outputResp{}
+		adminRequest(t, srv, sid, "GET", "/task_output?id="+strconv.Itoa(taskID)+"&after="+strconv.Itoa(last), "", &resp)
+		for _, chunk := range resp.Chunks {
+			output += chunk.Data
+		}
+		last = resp.Last
+		if output == "Unpacking foo...\n" && !proceeded {
+			close(proceed)
+			proceeded = true
+		}
+		if resp.Finished {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("task not finished, output so far:", output)
+		}
+	}
+	if msg := <-agentErr; msg != "" {
+		t.Fatal(msg)
+	}
+	if output != "Unpacking foo...\nSetting up foo...\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
@@ -0,0 +1,480 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+	"github.com/foxcpp/sutrc/agent"
+)
+
+// Agents can serve files from their download cache to other agents in the
+// same subnet (peers), so mass deployments don't saturate server's uplink.
+//
+// Server knows which agent has which files (agents announce contents of
+// their cache) and gives out list of peers along with SHA-256 of each
+// chunk of file, so peers can't inject data. Chunks that can't be fetched
+// from peers are served by server itself.
+//
+// Peers serve files only to agents with ticket signed using peer's key (see
+// agent.PeerTicket), so access to file through peers is controlled by
+// server same as access to filedrop.
+
+// Size of chunks file is split into for transfer between peers.
+const p2pChunkSize = 1 << 20
+
+// Maximum amount of peers returned in single response.
+const maxPeersPerRequest = 4
+
+// Agents announce cache contents periodically, announcements older than
+// peerAnnounceTTL are ignored.
+const peerAnnounceTTL = 30 * time.Minute
+
+// Tickets for peers and access to chunks served by server are valid for
+// p2pTicketTTL after agent requested manifest.
+const p2pTicketTTL = time.Hour
+
+type peerInfo struct {
+	// Addr is IP:PORT where agent serves chunks.
+	Addr  string
+	Files map[string]bool
+	Stamp time.Time
+	// Key is used to sign tickets for this peer.
+	Key []byte
+}
+
+var peers = make(map[string]peerInfo)
+
+// peerHandouts contains times when each agent was given out as peer,
+// least loaded peers are preferred.
+var peerHandouts = make(map[string][]time.Time)
+var peersLock sync.Mutex
+
+// chunkManifest describes filedrop file split into chunks.
+type chunkManifest struct {
+	SHA256    string   `json:"sha256"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+
+	used time.Time
+}
+
+// Files in filedrop are immutable, so manifests are computed once (per
+// p2pManifestTTL).
+const p2pManifestTTL = time.Hour
+
+var p2pManifests = make(map[string]*chunkManifest)
+var p2pManifestsLock sync.Mutex
+
+// p2pGrants contains expiration times of access to chunks served by
+// server, keyed by agent ID and file UUID. Access is granted when agent
+// requests manifest, which counts as file use.
+var p2pGrants = make(map[[2]string]time.Time)
+var p2pGrantsLock sync.Mutex
+
+var p2pFiledrop *filedrop.Server
+
+func initP2P(srv *filedrop.Server) {
+	p2pFiledrop = srv
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			prunePeers()
+		}
+	}()
+}
+
+func prunePeers() {
+	peersLock.Lock()
+	for agentID, info := range peers {
+		if time.Since(info.Stamp) > peerAnnounceTTL {
+			delete(peers, agentID)
+			delete(peerHandouts, agentID)
+		}
+	}
+	peersLock.Unlock()
+
+	p2pManifestsLock.Lock()
+	for fileUUID, m := range p2pManifests {
+		if time.Since(m.used) > p2pManifestTTL {
+			delete(p2pManifests, fileUUID)
+		}
+	}
+	p2pManifestsLock.Unlock()
+
+	p2pGrantsLock.Lock()
+	for key, expires := range p2pGrants {
+		if time.Now().After(expires) {
+			delete(p2pGrants, key)
+		}
+	}
+	p2pGrantsLock.Unlock()
+}
+
+// agentIP returns IP address of agent that sent request. X-Real-IP is used
+// if server is behind reverse proxy.
+func agentIP(r *http.Request) net.IP {
+	if ip := net.ParseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// sameSubnet reports whether a and b are in the same /24 IPv4 or /64 IPv6
+// network.
+func sameSubnet(a, b net.IP) bool {
+	mask := net.CIDRMask(64, 128)
+	if a.To4() != nil {
+		a, b = a.To4(), b.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Mask(mask).Equal(b.Mask(mask))
+}
+
+func isAgentOnline(agentID string) bool {
+	onlineAgentsLock.Lock()
+	online := onlineAgents[agentID]
+	onlineAgentsLock.Unlock()
+	if online {
+		return true
+	}
+	lastRequestStampLock.Lock()
+	defer lastRequestStampLock.Unlock()
+	return time.Since(lastRequestStamp[agentID]) < 28*time.Second
+}
+
+// filedropUUID extracts filedrop file UUID from URL of file.
+func filedropUUID(fileURL string) (string, bool) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(u.Path, "/")
+	for i, part := range parts {
+		if part == "filedrop" && i+1 < len(parts) {
+			return parts[i+1], true
+		}
+	}
+	return "", false
+}
+
+func p2pHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		announcePeer(w, r, agentID)
+	} else if r.Method == http.MethodGet {
+		findPeers(w, r, agentID)
+	} else {
+		writeError(w, http.StatusMethodNotAllowed, "/p2p only supports GET and POST")
+	}
+}
+
+// announcePeer handles POST /p2p, agent reports port it serves chunks on
+// and full list of cached files. Response contains key for checking
+// tickets.
+func announcePeer(w http.ResponseWriter, r *http.Request, agentID string) {
+	req := struct {
+		Port  int      `json:"port"`
+		Files []string `json:"files"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.Port <= 0 || req.Port > 65535 {
+		writeError(w, http.StatusBadRequest, "Invalid port value")
+		return
+	}
+	ip := agentIP(r)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "Can't determine agent address")
+		return
+	}
+
+	info := peerInfo{
+		Addr:  net.JoinHostPort(ip.String(), strconv.Itoa(req.Port)),
+		Files: make(map[string]bool, len(req.Files)),
+		Stamp: time.Now(),
+	}
+	for _, sum := range req.Files {
+		info.Files[strings.ToLower(sum)] = true
+	}
+
+	peersLock.Lock()
+	// Key is kept while agent announces itself, so tickets already given
+	// out remain valid.
+	if old, ok := peers[agentID]; ok {
+		info.Key = old.Key
+	} else {
+		info.Key = make([]byte, 32)
+		if _, err := rand.Read(info.Key); err != nil {
+			peersLock.Unlock()
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	peers[agentID] = info
+	peersLock.Unlock()
+
+	debugLog("Agent", agentID, "serves", len(info.Files), "files on", info.Addr)
+	writeJson(w, map[string]interface{}{"error": false, "key": hex.EncodeToString(info.Key)})
+}
+
+// findPeers handles GET /p2p?url=URL. It returns chunk manifest of filedrop
+// file and peers in the same subnet that have it along with tickets for
+// them.
+//
+// Request counts as file use, same as normal download, and allows agent to
+// get chunks of file using GET /p2p_chunk.
+func findPeers(w http.ResponseWriter, r *http.Request, agentID string) {
+	fileUUID, ok := filedropUUID(r.URL.Query().Get("url"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Only files from server's filedrop can be shared between peers")
+		return
+	}
+
+	file, _, err := p2pFiledrop.GetFile(fileUUID)
+	if err != nil {
+		if err == filedrop.ErrFileDoesntExists {
+			writeError(w, http.StatusNotFound, "No such file")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m, err := fileManifest(fileUUID, file)
+	file.(io.Closer).Close()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	expires := time.Now().Add(p2pTicketTTL)
+	p2pGrantsLock.Lock()
+	p2pGrants[[2]string{agentID, fileUUID}] = expires
+	p2pGrantsLock.Unlock()
+
+	writeJson(w, map[string]interface{}{
+		"error":      false,
+		"sha256":     m.SHA256,
+		"size":       m.Size,
+		"chunk_size": m.ChunkSize,
+		"chunks":     m.Chunks,
+		"peers":      pickPeers(agentID, agentIP(r), m.SHA256, expires.Unix()),
+		"expires":    expires.Unix(),
+	})
+}
+
+func fileManifest(fileUUID string, file io.Reader) (*chunkManifest, error) {
+	p2pManifestsLock.Lock()
+	if m := p2pManifests[fileUUID]; m != nil {
+		m.used = time.Now()
+		p2pManifestsLock.Unlock()
+		return m, nil
+	}
+	p2pManifestsLock.Unlock()
+
+	// Hashing big file takes a while, so it's done without lock. Manifest
+	// may be computed twice if file is requested concurrently, that's fine.
+	m := &chunkManifest{ChunkSize: p2pChunkSize, Chunks: []string{}, used: time.Now()}
+	fileHash := sha256.New()
+	buf := make([]byte, p2pChunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n != 0 {
+			sum := sha256.Sum256(buf[:n])
+			m.Chunks = append(m.Chunks, hex.EncodeToString(sum[:]))
+			fileHash.Write(buf[:n])
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.SHA256 = hex.EncodeToString(fileHash.Sum(nil))
+
+	p2pManifestsLock.Lock()
+	defer p2pManifestsLock.Unlock()
+	if existing := p2pManifests[fileUUID]; existing != nil {
+		existing.used = time.Now()
+		return existing, nil
+	}
+	p2pManifests[fileUUID] = m
+	return m, nil
+}
+
+// peerTicket is address of peer and ticket for downloading file from it.
+type peerTicket struct {
+	Addr   string `json:"addr"`
+	Ticket string `json:"ticket"`
+}
+
+// pickPeers returns addresses of online agents in the same subnet as
+// requesting agent that have file, least loaded first, and tickets valid
+// until expires.
+func pickPeers(agentID string, ip net.IP, sum string, expires int64) []peerTicket {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	candidates := []string{}
+	for peerID, info := range peers {
+		if peerID == agentID || !info.Files[sum] || time.Since(info.Stamp) > peerAnnounceTTL {
+			continue
+		}
+		host, _, err := net.SplitHostPort(info.Addr)
+		if err != nil || ip == nil || !sameSubnet(ip, net.ParseIP(host)) {
+			continue
+		}
+		if !isAgentOnline(peerID) {
+			continue
+		}
+		candidates = append(candidates, peerID)
+	}
+
+	// Only handouts during last minute are counted.
+	now := time.Now()
+	load := make(map[string]int, len(candidates))
+	for _, peerID := range candidates {
+		recent := peerHandouts[peerID][:0]
+		for _, stamp := range peerHandouts[peerID] {
+			if now.Sub(stamp) < time.Minute {
+				recent = append(recent, stamp)
+			}
+		}
+		peerHandouts[peerID] = recent
+		load[peerID] = len(recent)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if load[candidates[i]] != load[candidates[j]] {
+			return load[candidates[i]] < load[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	if len(candidates) > maxPeersPerRequest {
+		candidates = candidates[:maxPeersPerRequest]
+	}
+
+	res := make([]peerTicket, 0, len(candidates))
+	for _, peerID := range candidates {
+		peerHandouts[peerID] = append(peerHandouts[peerID], now)
+		res = append(res, peerTicket{
+			Addr:   peers[peerID].Addr,
+			Ticket: agent.PeerTicket(peers[peerID].Key, sum, expires),
+		})
+	}
+	return res
+}
+
+// p2pChunkHandler handles GET /p2p_chunk?url=URL&offset=N&length=N, it
+// serves chunks that agent failed to get from peers.
+//
+// Unlike normal filedrop downloads, it doesn't count as file use, agent
+// already did that when requested manifest, so only files agent requested
+// manifest for during last p2pTicketTTL are served.
+func p2pChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/p2p_chunk only supports GET")
+		return
+	}
+	fileUUID, ok := filedropUUID(r.URL.Query().Get("url"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid url value")
+		return
+	}
+	p2pGrantsLock.Lock()
+	expires, granted := p2pGrants[[2]string{agentID, fileUUID}]
+	p2pGrantsLock.Unlock()
+	if !granted || time.Now().After(expires) {
+		writeError(w, http.StatusForbidden, "Manifest for file was not requested")
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid offset value")
+		return
+	}
+	length, err := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+	if err != nil || length <= 0 || length > p2pChunkSize {
+		writeError(w, http.StatusBadRequest, "Invalid length value")
+		return
+	}
+
+	file, err := p2pFiledrop.OpenFile(fileUUID)
+	if err != nil {
+		if err == filedrop.ErrFileDoesntExists {
+			writeError(w, http.StatusNotFound, "No such file")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.(io.Closer).Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, io.LimitReader(file, length))
+}
@@ -0,0 +1,243 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// script is entry of scripts library, admins can run them on agents by name
+// using POST /run_script.
+type script struct {
+	Name string
+	// Empty interpreter means agent's default one ("cmd" on Windows, "sh"
+	// elsewhere).
+	Interpreter string
+	Description string
+	Body        string
+	Author      string
+	Updated     int64
+}
+
+var scriptInterpreters = []string{"", "sh", "bash", "python", "powershell", "cmd"}
+
+// scriptParams lists fields of run_script task that can be passed when
+// running script from library.
+var scriptParams = []string{"args", "env", "stdin", "cwd", "timeout", "stream"}
+
+func (s script) sha256() string {
+	sum := sha256.Sum256([]byte(s.Body))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s script) toJSON(withBody bool) map[string]interface{} {
+	res := map[string]interface{}{
+		"name":        s.Name,
+		"interpreter": s.Interpreter,
+		"description": s.Description,
+		"author":      s.Author,
+		"updated":     s.Updated,
+		"sha256":      s.sha256(),
+	}
+	if withBody {
+		res["script"] = s.Body
+	}
+	return res
+}
+
+func scriptsHandler(w http.ResponseWriter, r *http.Request) {
+	token, _, ok := checkAdminRole(w, r, nil)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		if name != "" {
+			s, err := db.GetScript(name)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					writeError(w, http.StatusNotFound, "No such script")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJson(w, map[string]interface{}{"error": false, "script": s.toJSON(true)})
+			return
+		}
+
+		scripts, err := db.ListScripts()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res := make([]map[string]interface{}, 0, len(scripts))
+		for _, s := range scripts {
+			res = append(res, s.toJSON(false))
+		}
+		writeJson(w, map[string]interface{}{"error": false, "scripts": res})
+	case http.MethodPost:
+		saveScript(w, r, name, token)
+	case http.MethodDelete:
+		if name == "" {
+			writeError(w, http.StatusBadRequest, "Missing name parameter")
+			return
+		}
+		removed, err := db.RemScript(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "No such script")
+			return
+		}
+		log.Printf("%s removed script %s", tokenPrefix(token), name)
+		writeJson(w, map[string]interface{}{"error": false})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "/scripts only supports GET, POST and DELETE")
+	}
+}
+
+func saveScript(w http.ResponseWriter, r *http.Request, name, token string) {
+	if name == "" || len(name) > 256 {
+		writeError(w, http.StatusBadRequest, "Name should be non-empty and at most 256 bytes long")
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req := struct {
+		Interpreter string `json:"interpreter"`
+		Description string `json:"description"`
+		Script      string `json:"script"`
+	}{}
+	if err := json.Unmarshal(buf, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.Script == "" {
+		writeError(w, http.StatusBadRequest, "Empty script is not allowed")
+		return
+	}
+	if !contains(scriptInterpreters, req.Interpreter) {
+		writeError(w, http.StatusBadRequest, "Unknown interpreter: "+req.Interpreter)
+		return
+	}
+
+	s := script{
+		Name:        name,
+		Interpreter: req.Interpreter,
+		Description: req.Description,
+		Body:        req.Script,
+		Author:      tokenPrefix(token),
+		Updated:     time.Now().Unix(),
+	}
+	if err := db.SaveScript(s); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("%s saved script %s (sha256 %s)", s.Author, s.Name, s.sha256())
+	writeJson(w, map[string]interface{}{"error": false, "script": s.toJSON(false)})
+}
+
+// runScriptHandler handles POST /run_script?name=NAME&target=AGENTS, it
+// sends run_script task with script from library and parameters from
+// request body to agents.
+func runScriptHandler(w http.ResponseWriter, r *http.Request) {
+	token, _, ok := checkAdminRole(w, r, nil)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "/run_script only supports POST")
+		return
+	}
+
+	targetsStr := r.URL.Query().Get("target")
+	if targetsStr == "" {
+		writeError(w, http.StatusBadRequest, "Missing target parameter")
+		return
+	}
+	timeout, ok := parseTaskTimeout(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid timeout value")
+		return
+	}
+
+	s, err := db.GetScript(r.URL.Query().Get("name"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "No such script")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	params := map[string]interface{}{}
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(buf) != 0 {
+		if err := json.Unmarshal(buf, &params); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+	}
+
+	task := map[string]interface{}{
+		"type":   "run_script",
+		"script": s.Body,
+		"sha256": s.sha256(),
+	}
+	if s.Interpreter != "" {
+		task["interpreter"] = s.Interpreter
+	}
+	for k, v := range params {
+		if !contains(scriptParams, k) {
+			writeError(w, http.StatusBadRequest, "Unknown parameter: "+k)
+			return
+		}
+		task[k] = v
+	}
+
+	targets := strings.Split(targetsStr, ",")
+	log.Printf("%s runs script %s on %s", tokenPrefix(token), s.Name, targetsStr)
+	queueTask(w, r, token, targets, task, timeout)
+}
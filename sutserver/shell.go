@@ -0,0 +1,669 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+	"github.com/gorilla/websocket"
+)
+
+// Interactive shell sessions: admin connects to GET /shell using
+// WebSocket, server queues "shell" task with session ID for agent and agent
+// connects to GET /shell_agent. Everything is relayed between these two
+// connections, input and output are recorded in asciicast v2 format.
+
+// How long to wait for agent to join session.
+const shellJoinTimeout = 30 * time.Second
+
+// Recordings are truncated to this size.
+const maxShellRecording = 16 << 20
+
+type shellSessionInfo struct {
+	ID    string `json:"id"`
+	Agent string `json:"agent"`
+	// Prefix of admin's token.
+	Admin   string `json:"admin"`
+	Role    string `json:"role"`
+	TaskID  int    `json:"task_id"`
+	Started int64  `json:"started"`
+	Ended   *int64 `json:"ended"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// pendingShell is a session waiting for agent to join.
+type pendingShell struct {
+	agent string
+	conn  chan *websocket.Conn
+}
+
+var pendingShells = make(map[string]*pendingShell)
+var pendingShellsLock sync.Mutex
+
+var shellRecordingsDir string
+
+func initShell(storageDir string) error {
+	shellRecordingsDir = serverConf.ShellRecordingsDir
+	if shellRecordingsDir == "" {
+		shellRecordingsDir = filepath.Join(storageDir, "recordings")
+	}
+	if err := os.MkdirAll(shellRecordingsDir, 0700); err != nil {
+		return err
+	}
+
+	days := serverConf.ShellLogDays
+	if days == 0 {
+		days = 90
+	}
+	go func() {
+		for {
+			pruneShellSessions(time.Now().AddDate(0, 0, -days))
+			time.Sleep(time.Hour)
+		}
+	}()
+	return nil
+}
+
+func pruneShellSessions(before time.Time) {
+	ids, err := db.StaleShellSessions(before.Unix())
+	if err != nil {
+		log.Println("Failed to prune shell sessions:", err)
+		return
+	}
+	for _, id := range ids {
+		if err := os.Remove(shellRecordingPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove shell session recording:", err)
+			continue
+		}
+		if err := db.RemShellSession(id); err != nil {
+			log.Println("Failed to prune shell sessions:", err)
+			return
+		}
+	}
+}
+
+func shellRecordingPath(id string) string {
+	return filepath.Join(shellRecordingsDir, id+".cast")
+}
+
+// WebSocket tickets are used to authenticate WebSocket requests from
+// browsers, which can't set headers for them. Session token is not accepted
+// in URL because URLs end up in logs, ticket can be used only once and
+// expires quickly.
+const wsTicketTTL = 30 * time.Second
+
+type wsTicket struct {
+	sid     string
+	expires time.Time
+}
+
+var wsTickets = make(map[string]wsTicket)
+var wsTicketsLock sync.Mutex
+
+// wsTicketHandler issues ticket for session passed in Authorization header.
+func wsTicketHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "/ws_ticket only supports POST")
+		return
+	}
+
+	rawTicket := make([]byte, 16)
+	if _, err := rand.Read(rawTicket); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ticket := hex.EncodeToString(rawTicket)
+	expires := time.Now().Add(wsTicketTTL)
+
+	wsTicketsLock.Lock()
+	for id, t := range wsTickets {
+		if time.Now().After(t.expires) {
+			delete(wsTickets, id)
+		}
+	}
+	wsTickets[ticket] = wsTicket{sid: r.Header.Get("Authorization"), expires: expires}
+	wsTicketsLock.Unlock()
+
+	writeJson(w, map[string]interface{}{"error": false, "ticket": ticket, "expires": expires.Unix()})
+}
+
+// useWSTicket returns session ID ticket was issued for and invalidates
+// ticket. Empty string is returned if ticket is unknown or expired.
+func useWSTicket(ticket string) string {
+	wsTicketsLock.Lock()
+	defer wsTicketsLock.Unlock()
+	t, prs := wsTickets[ticket]
+	if !prs {
+		return ""
+	}
+	delete(wsTickets, ticket)
+	if time.Now().After(t.expires) {
+		return ""
+	}
+	return t.sid
+}
+
+// checkAdminRole checks that request comes from admin with one of roles
+// (any admin if roles is empty) and returns token and role of that admin.
+// Browsers can't set headers for WebSocket requests, so ticket (see
+// wsTicketHandler) can be passed in "ticket" query parameter instead.
+func checkAdminRole(w http.ResponseWriter, r *http.Request, roles []string) (token, role string, ok bool) {
+	sid := r.Header.Get("Authorization")
+	if sid == "" {
+		if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+			sid = useWSTicket(ticket)
+		}
+	}
+	if !db.CheckSession(sid) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return "", "", false
+	}
+	token, role, err := db.SessionAdmin(sid)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return "", "", false
+	}
+	if len(roles) == 0 {
+		return token, role, true
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return token, role, true
+		}
+	}
+	writeError(w, http.StatusForbidden, "Not allowed for your role")
+	return "", "", false
+}
+
+// checkShellRole is checkAdminRole for shell sessions. Unlike other features,
+// shell sessions are not available to anybody if ShellRoles is empty.
+func checkShellRole(w http.ResponseWriter, r *http.Request) (token, role string, ok bool) {
+	token, role, ok = checkAdminRole(w, r, serverConf.ShellRoles)
+	if ok && len(serverConf.ShellRoles) == 0 {
+		writeError(w, http.StatusForbidden, "Shell sessions are disabled, set shell_roles in server config to enable them")
+		return "", "", false
+	}
+	return token, role, ok
+}
+
+// tokenPrefix returns part of admin token that can be logged.
+func tokenPrefix(token string) string {
+	if len(token) > 6 {
+		return token[:6]
+	}
+	return token
+}
+
+// shellConn serializes writes to WebSocket connection.
+type shellConn struct {
+	c    *websocket.Conn
+	lock sync.Mutex
+}
+
+func (conn *shellConn) write(kind int, data []byte) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.c.WriteMessage(kind, data)
+}
+
+func (conn *shellConn) writeMsg(msg agent.ShellMessage) error {
+	blob, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return conn.write(websocket.TextMessage, blob)
+}
+
+func (conn *shellConn) close(reason string) {
+	conn.lock.Lock()
+	conn.c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(time.Second))
+	conn.lock.Unlock()
+	conn.c.Close()
+}
+
+// shellRecording writes session output in asciicast v2 format.
+type shellRecording struct {
+	lock      sync.Mutex
+	f         *os.File
+	start     time.Time
+	size      int
+	truncated bool
+}
+
+func newShellRecording(id, title string, cols, rows int, start time.Time) (*shellRecording, error) {
+	f, err := os.OpenFile(shellRecordingPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rec := &shellRecording{f: f, start: start}
+	header, err := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": start.Unix(),
+		"title":     title,
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rec.write(header)
+	return rec, nil
+}
+
+func (rec *shellRecording) write(line []byte) {
+	if rec.size+len(line)+1 > maxShellRecording {
+		if !rec.truncated {
+			rec.truncated = true
+			marker, _ := json.Marshal([]interface{}{time.Since(rec.start).Seconds(), "m", "recording truncated"})
+			rec.f.Write(append(marker, '\n'))
+		}
+		return
+	}
+	rec.size += len(line) + 1
+	if _, err := rec.f.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to write shell session recording:", err)
+	}
+}
+
+// event records input ("i"), output ("o") or resize ("r") event.
+func (rec *shellRecording) event(code, data string) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	line, err := json.Marshal([]interface{}{time.Since(rec.start).Seconds(), code, data})
+	if err != nil {
+		return
+	}
+	rec.write(line)
+}
+
+func (rec *shellRecording) close() {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if err := rec.f.Close(); err != nil {
+		log.Println("Failed to write shell session recording:", err)
+	}
+}
+
+func shellHandler(w http.ResponseWriter, r *http.Request) {
+	token, role, ok := checkShellRole(w, r)
+	if !ok {
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "Missing target parameter")
+		return
+	}
+	if !db.AgentExists(target) {
+		writeError(w, http.StatusNotFound, "Agent doesn't exists")
+		return
+	}
+	if !agentSupportsTask(target, "shell") {
+		writeError(w, http.StatusBadRequest, "Agent doesn't support shell tasks")
+		return
+	}
+	if !isAgentOnline(target) {
+		writeError(w, http.StatusConflict, "Agent is offline")
+		return
+	}
+
+	task := map[string]interface{}{"type": "shell", "cols": 80, "rows": 24}
+	for _, field := range []string{"cols", "rows"} {
+		str := r.URL.Query().Get(field)
+		if str == "" {
+			continue
+		}
+		num, err := strconv.Atoi(str)
+		if err != nil || num < 1 || num > 1000 {
+			writeError(w, http.StatusBadRequest, "Invalid "+field+" value")
+			return
+		}
+		task[field] = num
+	}
+	for _, field := range []string{"shell", "cwd"} {
+		if val := r.URL.Query().Get(field); val != "" {
+			task[field] = val
+		}
+	}
+
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	info := shellSessionInfo{
+		ID:      hex.EncodeToString(rawID),
+		Agent:   target,
+		Admin:   tokenPrefix(token),
+		Role:    role,
+		Started: time.Now().Unix(),
+	}
+	task["session"] = info.ID
+
+	pending := &pendingShell{agent: target, conn: make(chan *websocket.Conn, 1)}
+	pendingShellsLock.Lock()
+	pendingShells[info.ID] = pending
+	pendingShellsLock.Unlock()
+	defer func() {
+		pendingShellsLock.Lock()
+		delete(pendingShells, info.ID)
+		pendingShellsLock.Unlock()
+	}()
+
+	taskMetaLock.Lock()
+	tasksChan := agentTasksChan(target)
+	info.TaskID = nextTaskID
+	nextTaskID++
+	task["id"] = info.TaskID
+	// Agent reports error here if it can't start shell.
+	taskRes := make(chan map[string]interface{}, 1)
+	taskResults[target][info.TaskID] = taskRes
+	taskMetaLock.Unlock()
+	defer func() {
+		taskMetaLock.Lock()
+		delete(taskResults[target], info.TaskID)
+		taskMetaLock.Unlock()
+	}()
+
+	if err := db.AddTaskLog(info.TaskID, target, "shell"); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := db.AddShellSession(info); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	select {
+	case tasksChan <- task:
+	default:
+		db.EndShellSession(info.ID, time.Now().Unix(), "queue overflow")
+		writeError(w, http.StatusServiceUnavailable, "Queue is overflowed. Check agent.")
+		return
+	}
+
+	rawAdmin, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader already sent error response.
+		db.EndShellSession(info.ID, time.Now().Unix(), "upgrade failed")
+		return
+	}
+	admin := &shellConn{c: rawAdmin}
+	log.Println("Shell session", info.ID, "on", target, "requested by", info.Admin+"...")
+
+	var rawAgent *websocket.Conn
+	select {
+	case rawAgent = <-pending.conn:
+	case res := <-taskRes:
+		msg, _ := res["msg"].(string)
+		if msg == "" {
+			msg = "Agent finished session before joining it"
+		}
+		admin.writeMsg(agent.ShellMessage{Kind: "error", Msg: msg})
+		admin.close("")
+		db.EndShellSession(info.ID, time.Now().Unix(), "agent error")
+		return
+	case <-time.After(shellJoinTimeout):
+		// Agent will fail to join session later.
+		admin.writeMsg(agent.ShellMessage{Kind: "error", Msg: "Agent didn't join session in time"})
+		admin.close("")
+		db.EndShellSession(info.ID, time.Now().Unix(), "join timeout")
+		return
+	}
+	agentConn := &shellConn{c: rawAgent}
+
+	rec, err := newShellRecording(info.ID, target, task["cols"].(int), task["rows"].(int), time.Now())
+	if err != nil {
+		log.Println("Failed to create shell session recording:", err)
+		admin.writeMsg(agent.ShellMessage{Kind: "error", Msg: "Internal error: " + err.Error()})
+		admin.close("")
+		agentConn.close("")
+		db.EndShellSession(info.ID, time.Now().Unix(), "internal error")
+		return
+	}
+	publishEvent("shell_session", map[string]interface{}{"id": info.ID, "agent": target, "admin": info.Admin, "state": "started"})
+
+	reason := relayShell(admin, agentConn, rec)
+
+	rec.close()
+	admin.close(reason)
+	agentConn.close(reason)
+	if err := db.EndShellSession(info.ID, time.Now().Unix(), reason); err != nil {
+		log.Println("Failed to save shell session", info.ID+":", err)
+	}
+	log.Println("Shell session", info.ID, "on", target, "ended:", reason)
+	publishEvent("shell_session", map[string]interface{}{"id": info.ID, "agent": target, "admin": info.Admin, "state": "ended", "reason": reason})
+}
+
+// relayShell passes messages between admin and agent until one of them
+// disconnects or admin is idle for too long. Returns reason why session
+// ended.
+func relayShell(admin, agentConn *shellConn, rec *shellRecording) string {
+	idleTimeout := time.Duration(serverConf.ShellIdleTimeout) * time.Minute
+	if idleTimeout == 0 {
+		idleTimeout = 15 * time.Minute
+	}
+
+	var endOnce sync.Once
+	reason := ""
+	done := make(chan struct{})
+	end := func(r string) {
+		endOnce.Do(func() {
+			reason = r
+			close(done)
+		})
+	}
+
+	var lastInputLock sync.Mutex
+	lastInput := time.Now()
+
+	go func() {
+		for {
+			kind, data, err := admin.c.ReadMessage()
+			if err != nil {
+				end("admin disconnected")
+				return
+			}
+			lastInputLock.Lock()
+			lastInput = time.Now()
+			lastInputLock.Unlock()
+
+			if kind == websocket.BinaryMessage {
+				rec.event("i", string(data))
+				if err := agentConn.write(websocket.BinaryMessage, data); err != nil {
+					end("agent disconnected")
+					return
+				}
+				continue
+			}
+			msg := agent.ShellMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil || msg.Kind != "resize" {
+				continue
+			}
+			if msg.Cols < 1 || msg.Cols > 1000 || msg.Rows < 1 || msg.Rows > 1000 {
+				continue
+			}
+			rec.event("r", strconv.Itoa(msg.Cols)+"x"+strconv.Itoa(msg.Rows))
+			if err := agentConn.writeMsg(agent.ShellMessage{Kind: "resize", Cols: msg.Cols, Rows: msg.Rows}); err != nil {
+				end("agent disconnected")
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			kind, data, err := agentConn.c.ReadMessage()
+			if err != nil {
+				end("agent disconnected")
+				return
+			}
+			if kind == websocket.BinaryMessage {
+				rec.event("o", string(data))
+				if err := admin.write(websocket.BinaryMessage, data); err != nil {
+					end("admin disconnected")
+					return
+				}
+				continue
+			}
+			msg := agent.ShellMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			if msg.Kind == "exit" || msg.Kind == "error" {
+				admin.write(websocket.TextMessage, data)
+				end(msg.Kind)
+				return
+			}
+		}
+	}()
+
+	check := time.NewTicker(time.Second * 10)
+	defer check.Stop()
+	for {
+		select {
+		case <-done:
+			return reason
+		case <-check.C:
+			lastInputLock.Lock()
+			idle := time.Since(lastInput)
+			lastInputLock.Unlock()
+			if idle > idleTimeout {
+				admin.writeMsg(agent.ShellMessage{Kind: "error", Msg: "Session closed because of inactivity"})
+				end("idle timeout")
+			}
+		}
+	}
+}
+
+// shellAgentHandler accepts agent's connection to session.
+func shellAgentHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	pendingShellsLock.Lock()
+	pending := pendingShells[r.URL.Query().Get("session")]
+	if pending != nil && pending.agent == agentID {
+		// Only one connection is accepted.
+		delete(pendingShells, r.URL.Query().Get("session"))
+	} else {
+		pending = nil
+	}
+	pendingShellsLock.Unlock()
+	if pending == nil {
+		writeError(w, http.StatusNotFound, "No such session")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader already sent error response.
+		return
+	}
+	// Buffered, so never blocks. shellHandler closes connection if it
+	// doesn't need it anymore.
+	pending.conn <- conn
+}
+
+// shellSessionsHandler lists sessions from audit log (GET /shell_sessions)
+// or returns recording of one of them.
+func shellSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := checkShellRole(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/shell_sessions only supports GET")
+		return
+	}
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		info, err := db.GetShellSession(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeError(w, http.StatusNotFound, "No such session")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if r.URL.Query().Get("recording") != "1" {
+			writeJson(w, map[string]interface{}{"error": false, "session": info})
+			return
+		}
+		f, err := os.Open(shellRecordingPath(id))
+		if err != nil {
+			if os.IsNotExist(err) {
+				writeError(w, http.StatusNotFound, "Session has no recording")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.cast"`)
+		io.Copy(w, f)
+		return
+	}
+
+	limit := 100
+	if str := r.URL.Query().Get("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "Invalid limit value")
+			return
+		}
+	}
+	sessions, err := db.ShellSessions(r.URL.Query().Get("target"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, map[string]interface{}{"error": false, "sessions": sessions})
+}
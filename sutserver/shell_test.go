@@ -0,0 +1,235 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAdminSession creates admin account with role and returns session ID.
+func testAdminSession(t *testing.T, token, role string) string {
+	t.Helper()
+	if err := db.AddAccount(token); err != nil {
+		t.Fatal(err)
+	}
+	if role != "" {
+		if err := db.SetAdminRole(token, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sid, err := db.InitSession(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sid
+}
+
+// checkRoleStatus returns status code of response written by check for
+// request to url.
+func checkRoleStatus(check func(w http.ResponseWriter, r *http.Request) (string, string, bool), url string, h http.Header) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", url, nil)
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	if _, _, ok := check(w, r); ok {
+		return http.StatusOK
+	}
+	return w.Code
+}
+
+func TestWSTicket(t *testing.T) {
+	openTestDB(t)
+	sid := testAdminSession(t, "admintok", "")
+	check := func(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+		return checkAdminRole(w, r, nil)
+	}
+
+	getTicket := func() string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/ws_ticket", nil)
+		r.Header.Set("Authorization", sid)
+		wsTicketHandler(w, r)
+		resp := struct {
+			Ticket string `json:"ticket"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Ticket == "" {
+			t.Fatal("no ticket issued:", w.Code, err)
+		}
+		return resp.Ticket
+	}
+
+	// Session token is not accepted in URL.
+	if code := checkRoleStatus(check, "/shell?token="+sid, nil); code != http.StatusForbidden {
+		t.Error("token in URL accepted:", code)
+	}
+
+	ticket := getTicket()
+	if code := checkRoleStatus(check, "/shell?ticket="+ticket, nil); code != http.StatusOK {
+		t.Error("valid ticket rejected:", code)
+	}
+	if code := checkRoleStatus(check, "/shell?ticket="+ticket, nil); code != http.StatusForbidden {
+		t.Error("ticket accepted twice:", code)
+	}
+
+	ticket = getTicket()
+	wsTicketsLock.Lock()
+	tk := wsTickets[ticket]
+	tk.expires = time.Now().Add(-time.Second)
+	wsTickets[ticket] = tk
+	wsTicketsLock.Unlock()
+	if code := checkRoleStatus(check, "/shell?ticket="+ticket, nil); code != http.StatusForbidden {
+		t.Error("expired ticket accepted:", code)
+	}
+
+	// Tickets are issued only for valid sessions.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/ws_ticket", nil)
+	r.Header.Set("Authorization", "bogus")
+	wsTicketHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Error("ticket issued without session:", w.Code)
+	}
+}
+
+func TestShellRoles(t *testing.T) {
+	openTestDB(t)
+	opsSID := testAdminSession(t, "opstok", "ops")
+	otherSID := testAdminSession(t, "othertok", "")
+	defer func(prev []string) { serverConf.ShellRoles = prev }(serverConf.ShellRoles)
+
+	auth := func(sid string) http.Header {
+		return http.Header{"Authorization": []string{sid}}
+	}
+
+	// Nobody is allowed by default.
+	serverConf.ShellRoles = nil
+	if code := checkRoleStatus(checkShellRole, "/shell", auth(opsSID)); code != http.StatusForbidden {
+		t.Error("shell allowed with empty shell_roles:", code)
+	}
+
+	serverConf.ShellRoles = []string{"ops"}
+	if code := checkRoleStatus(checkShellRole, "/shell", auth(opsSID)); code != http.StatusOK {
+		t.Error("shell denied for allowed role:", code)
+	}
+	if code := checkRoleStatus(checkShellRole, "/shell", auth(otherSID)); code != http.StatusForbidden {
+		t.Error("shell allowed for other role:", code)
+	}
+}
+
+// wsPair returns server and client sides of WebSocket connection.
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return <-serverConns, client
+}
+
+func TestShellRecordsInput(t *testing.T) {
+	dir := t.TempDir()
+	defer func(prev string) { shellRecordingsDir = prev }(shellRecordingsDir)
+	shellRecordingsDir = dir
+
+	adminSrv, adminClient := wsPair(t)
+	agentSrv, agentClient := wsPair(t)
+	rec, err := newShellRecording("test", "pc1", 80, 24, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reason := make(chan string, 1)
+	go func() {
+		reason <- relayShell(&shellConn{c: adminSrv}, &shellConn{c: agentSrv}, rec)
+	}()
+
+	if err := adminClient.WriteMessage(websocket.BinaryMessage, []byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := agentClient.ReadMessage(); err != nil || string(data) != "ls\r" {
+		t.Fatal("input not relayed:", string(data), err)
+	}
+	if err := agentClient.WriteMessage(websocket.BinaryMessage, []byte("file\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := adminClient.ReadMessage(); err != nil || string(data) != "file\r\n" {
+		t.Fatal("output not relayed:", string(data), err)
+	}
+	if err := agentClient.WriteMessage(websocket.TextMessage, []byte(`{"kind":"exit","status_code":0}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-reason:
+		if r != "exit" {
+			t.Error("unexpected reason:", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session didn't end")
+	}
+	rec.close()
+
+	f, err := os.Open(shellRecordingPath("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events [][]interface{}
+	scnr := bufio.NewScanner(f)
+	scnr.Scan() // header
+	for scnr.Scan() {
+		ev := []interface{}{}
+		if err := json.Unmarshal(scnr.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatal("expected 2 events, got", events)
+	}
+	if events[0][1] != "i" || events[0][2] != "ls\r" {
+		t.Error("input not recorded:", events[0])
+	}
+	if events[1][1] != "o" || events[1][2] != "file\r\n" {
+		t.Error("output not recorded:", events[1])
+	}
+}
@@ -23,13 +23,17 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/foxcpp/sutrc/agent"
 )
 
 var taskResults = make(map[string]map[int]chan map[string]interface{})
@@ -43,8 +47,42 @@ var nextTaskID = 1
 // Should be locked if any variables above (except channel I/O) are accessed.
 var taskMetaLock sync.Mutex
 
+// taskProgress is progress of long-running task (e.g. file upload), reported
+// to admins until task result is received.
+type taskProgress struct {
+	Done int64 `json:"done"`
+	// Total is -1 if unknown.
+	Total int64 `json:"total"`
+	Stamp int64 `json:"stamp"`
+}
+
+var tasksProgress = make(map[int]taskProgress)
+var tasksProgressLock sync.Mutex
+
+// setTaskProgress saves progress of task and notifies admins using
+// "task_progress" event.
+func setTaskProgress(agentID string, taskID int, done, total int64) {
+	p := taskProgress{Done: done, Total: total, Stamp: time.Now().Unix()}
+	tasksProgressLock.Lock()
+	tasksProgress[taskID] = p
+	tasksProgressLock.Unlock()
+
+	publishEvent("task_progress", map[string]interface{}{
+		"id":     taskID,
+		"target": agentID,
+		"done":   p.Done,
+		"total":  p.Total,
+	})
+}
+
 func tasksResultHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
+	if r.Method == http.MethodGet {
+		if !checkAdminAuth(r.Header) {
+			writeError(w, http.StatusForbidden, "Authorization failure")
+			return
+		}
+		getTaskResult(w, r)
+	} else if r.Method == http.MethodPost {
 		if !checkAgentAuth(r.Header) {
 			writeError(w, http.StatusForbidden, "Authorization failure")
 			return
@@ -77,25 +115,167 @@ func tasksResultHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if _, prs := bodyJson["error"]; !prs {
-			bodyJson["error"] = false
+		if err := deliverTaskResult(agentID, id, bodyJson); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
+	} else {
+		writeError(w, http.StatusMethodNotAllowed, "/tasks_result supports only GET and POST")
+	}
+}
 
-		debugLog("Received task", id, "result from", agentID)
+// getTaskResult handles GET /task_result?id=TASKID, it allows to get result
+// of task even if waiting request timed out.
+func getTaskResult(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid id value")
+		return
+	}
 
-		// taskResults[agentID] is created on task submit if it doesn't exists.
-		taskMetaLock.Lock()
-		c := taskResults[agentID][id]
-		taskMetaLock.Unlock()
-		if c == nil {
-			// If channel doesn't exists - nobody is waiting for task result. Just drop it.
-			debugLog("Unexpected task", id, "result from", agentID)
+	entry, err := db.GetTaskLog(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "No such task")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := map[string]interface{}{
+		"error":    false,
+		"id":       entry.ID,
+		"target":   entry.Agent,
+		"type":     entry.Type,
+		"created":  entry.Created.Unix(),
+		"finished": nil,
+		"result":   nil,
+	}
+	if entry.Result != nil {
+		result := make(map[string]interface{})
+		if err := json.Unmarshal(entry.Result, &result); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		c <- bodyJson
+		resp["finished"] = entry.Finished.Unix()
+		resp["result"] = result
 	} else {
-		writeError(w, http.StatusMethodNotAllowed, "/tasks_result supports only POST")
+		tasksProgressLock.Lock()
+		if p, ok := tasksProgress[id]; ok {
+			resp["progress"] = p
+		}
+		tasksProgressLock.Unlock()
+	}
+	writeJson(w, resp)
+}
+
+// taskCancelHandler handles POST /task_cancel?id=TASKID, it asks agent to
+// abort running task.
+func taskCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "/task_cancel supports only POST")
+		return
+	}
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid id value")
+		return
+	}
+
+	entry, err := db.GetTaskLog(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "No such task")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entry.Result != nil {
+		writeError(w, http.StatusConflict, "Task is already finished")
+		return
+	}
+	if !cancelTaskOnAgent(entry.Agent, id) {
+		writeError(w, http.StatusConflict, "Agent is not connected using WebSocket, task can't be cancelled")
+		return
+	}
+	debugLog("Cancelling task", id, "on", entry.Agent)
+	writeJson(w, map[string]interface{}{"error": false})
+}
+
+// deliverTaskResult saves task result received from agent and passes it to
+// whoever waits for it. Results are accepted only once, duplicates are
+// ignored without error so agents can safely retry.
+func deliverTaskResult(agentID string, id int, result map[string]interface{}) error {
+	if _, prs := result["error"]; !prs {
+		result["error"] = false
+	}
+
+	debugLog("Received task", id, "result from", agentID)
+
+	blob, err := json.Marshal(result)
+	if err != nil {
+		return err
 	}
+	saved, err := db.SetTaskResult(id, agentID, blob)
+	if err != nil {
+		log.Println("Failed to save task", id, "result:", err)
+		return err
+	}
+	if !saved {
+		debugLog("Duplicate or unexpected task", id, "result from", agentID)
+		return nil
+	}
+
+	tasksProgressLock.Lock()
+	delete(tasksProgress, id)
+	tasksProgressLock.Unlock()
+	finishTaskOutput(id)
+
+	// taskResults[agentID] is created on task submit if it doesn't exists.
+	taskMetaLock.Lock()
+	c := taskResults[agentID][id]
+	taskMetaLock.Unlock()
+	if c == nil {
+		// If channel doesn't exists - nobody is waiting for task result,
+		// it can be retrieved using GET /task_result later.
+		debugLog("Task", id, "result from", agentID, "saved, nobody waits for it")
+		return nil
+	}
+	// Channel is buffered and result is saved only once, so it never blocks.
+	c <- result
+	return nil
+}
+
+// initTaskLog makes sure we don't reuse IDs of tasks from log and starts
+// periodic log cleanup.
+func initTaskLog() error {
+	maxID, err := db.MaxTaskID()
+	if err != nil {
+		return err
+	}
+	taskMetaLock.Lock()
+	nextTaskID = maxID + 1
+	taskMetaLock.Unlock()
+
+	days := serverConf.TaskLogDays
+	if days == 0 {
+		days = 7
+	}
+	go func() {
+		for {
+			if err := db.PruneTaskLog(time.Now().AddDate(0, 0, -days)); err != nil {
+				log.Println("Failed to prune tasks log:", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+	return nil
 }
 
 func tasksHandler(w http.ResponseWriter, r *http.Request) {
@@ -120,21 +300,46 @@ func tasksHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// agentTasksChan returns tasks queue for agent, allocating everything we need
+// if this is first time we see this agent ID.
+//
+// taskMetaLock should be held by caller.
+func agentTasksChan(agentID string) chan map[string]interface{} {
+	if _, prs := tasks[agentID]; !prs {
+		// Leave enough space to buffer few tasks in case of
+		// "lagging" agent of network.
+		tasks[agentID] = make(chan map[string]interface{}, 16)
+	}
+	if _, prs := taskResults[agentID]; !prs {
+		taskResults[agentID] = make(map[int]chan map[string]interface{})
+	}
+	return tasks[agentID]
+}
+
+// parseTaskTimeout reads time to wait for task results from 'timeout'
+// query parameter (seconds).
+func parseTaskTimeout(r *http.Request) (time.Duration, bool) {
+	timeoutStr := r.URL.Query().Get("timeout")
+	if timeoutStr == "" {
+		return 26 * time.Second, true
+	}
+	secs, err := strconv.Atoi(timeoutStr)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
 func acceptTask(w http.ResponseWriter, r *http.Request) {
 	targetsStr := r.URL.Query().Get("target")
 	if targetsStr == "" {
 		writeError(w, http.StatusBadRequest, "Missing target parameter")
 		return
 	}
-	timeoutStr := r.URL.Query().Get("timeout")
-	timeout := 26 * time.Second
-	if timeoutStr != "" {
-		secs, err := strconv.Atoi(timeoutStr)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "Invalid timeout value")
-			return
-		}
-		timeout = time.Duration(secs) * time.Second
+	timeout, ok := parseTaskTimeout(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid timeout value")
+		return
 	}
 
 	buf, err := ioutil.ReadAll(r.Body)
@@ -149,12 +354,36 @@ func acceptTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, prs := task["type"]; !prs {
+	taskType, ok := task["type"].(string)
+	if !ok {
 		writeError(w, http.StatusBadRequest, "Task type missing")
 		return
 	}
+	if taskType == "shell" || taskType == "tunnel" {
+		writeError(w, http.StatusBadRequest, taskType+" tasks are queued by server itself")
+		return
+	}
+	if _, prs := task["signed"]; prs {
+		// We can't check signature, but we can check that agents will not
+		// reject task because of type mismatch.
+		payload, err := agent.DecodeSignedTask(task)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if payload["type"] != taskType {
+			writeError(w, http.StatusBadRequest, "Task type doesn't match signed one")
+			return
+		}
+	}
 
-	targets := strings.Split(targetsStr, ",")
+	queueTask(w, r, r.Header.Get("Authorization"), strings.Split(targetsStr, ","), task, timeout)
+}
+
+// queueTask sends copy of task to each target and replies with results
+// received in timeout. token is used only for logging.
+func queueTask(w http.ResponseWriter, r *http.Request, token string, targets []string, task map[string]interface{}, timeout time.Duration) {
+	taskType := task["type"].(string)
 	responses := make([]map[string]interface{}, len(targets))
 	taskCopies := make([]map[string]interface{}, len(targets))
 	for i, target := range targets {
@@ -166,37 +395,33 @@ func acceptTask(w http.ResponseWriter, r *http.Request) {
 
 		if !db.AgentExists(target) {
 			responses[i] = map[string]interface{}{"error": true, "msg": "Agent doesn't exists"}
+			continue
+		}
+		if !agentSupportsTask(target, taskType) {
+			responses[i] = map[string]interface{}{"error": true, "msg": "Agent doesn't support " + taskType + " tasks"}
+			continue
 		}
 
 		taskMetaLock.Lock()
 
-		// This can be first time we see this Agent ID, allocate everything we need.
-		if _, prs := tasks[target]; !prs {
-			// Leave enough space to buffer few tasks in case of
-			// "lagging" agent of network.
-			tasks[target] = make(chan map[string]interface{}, 16)
-		}
-		if _, prs := taskResults[target]; !prs {
-			taskResults[target] = make(map[int]chan map[string]interface{})
-		}
+		tasksChan := agentTasksChan(target)
 
 		// "Allocate" task ID.
 		id := nextTaskID
 		nextTaskID++
 		taskCopies[i]["id"] = id
 
-		// Prepare storage for result.
-		taskResults[target][id] = make(chan map[string]interface{})
+		if err := db.AddTaskLog(id, target, taskType); err != nil {
+			taskMetaLock.Unlock()
+			responses[i] = map[string]interface{}{"error": true, "msg": "Internal error: " + err.Error()}
+			continue
+		}
 
-		tasksChan := tasks[target]
+		// Prepare storage for result.
+		taskResults[target][id] = make(chan map[string]interface{}, 1)
 		taskMetaLock.Unlock()
 
 		taskCpy["id"] = id
-		buf, err = json.Marshal(task)
-		if err != nil {
-			responses[i] = map[string]interface{}{"error": true, "msg": "Internal error: " + err.Error()}
-			return
-		}
 
 		select {
 		case tasksChan <- taskCpy:
@@ -205,14 +430,14 @@ func acceptTask(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		debugLog("Added task", id, "for", target, "from", r.Header.Get("Authorization")[:6])
+		debugLog("Added task", id, "for", target, "from", tokenPrefix(token))
 	}
 
 	for i, target := range targets {
 		if responses[i] == nil {
 			responses[i] = waitTaskResult(target, taskCopies[i], r, timeout)
-			responses[i]["target"] = target
 		}
+		responses[i]["target"] = target
 	}
 
 	writeJson(w, map[string]interface{}{"error": false, "results": responses})
@@ -230,6 +455,10 @@ func waitTaskResult(agentID string, task map[string]interface{}, r *http.Request
 			return map[string]interface{}{"error": true, "msg": "Agent deregistered"}
 		}
 		debugLog("Forwarding task", taskID, "result from", agentID, "to", r.Header.Get("Authorization")[:6])
+		taskMetaLock.Lock()
+		delete(taskResults[agentID], taskID)
+		taskMetaLock.Unlock()
+		res["task_id"] = taskID
 		return res
 	case <-time.After(timeout):
 		debugLog("Timed out while waiting for task", taskID, "result from", agentID)
@@ -241,7 +470,9 @@ func waitTaskResult(agentID string, task map[string]interface{}, r *http.Request
 			delete(task, k)
 		}
 		taskMetaLock.Unlock()
-		return map[string]interface{}{"error": true, "msg": "Time out while waiting for task result"}
+		// Task is not cancelled on agent if it's already running, result
+		// can be retrieved using GET /task_result later.
+		return map[string]interface{}{"error": true, "msg": "Time out while waiting for task result", "task_id": taskID}
 	}
 	return nil
 }
@@ -254,18 +485,14 @@ func tasksLongpool(w http.ResponseWriter, r *http.Request, timeout time.Duration
 	}
 
 	taskMetaLock.Lock()
-	// This can be first time we see this Agent ID, allocate everything we need..
-	if _, prs := tasks[agentID]; !prs {
-		// Leave enough space to buffer few tasks in case of
-		// "lagging" agent of network.
-		tasks[agentID] = make(chan map[string]interface{}, 16)
-	}
-	if _, prs := taskResults[agentID]; !prs {
-		taskResults[agentID] = make(map[int]chan map[string]interface{})
-	}
-	tasksChan := tasks[agentID]
+	tasksChan := agentTasksChan(agentID)
 	taskMetaLock.Unlock()
 
+	recordAgentInfo(agentID, r.Header)
+	if rejectOutdated(w, agentID) {
+		return
+	}
+
 	lastRequestStampLock.Lock()
 	lastRequestStamp[agentID] = time.Now()
 	lastRequestStampLock.Unlock()
@@ -303,3 +530,51 @@ func tasksLongpool(w http.ResponseWriter, r *http.Request, timeout time.Duration
 		return
 	}
 }
+
+// rejectOutdated writes error response if agent is outdated and can't be
+// updated automatically.
+func rejectOutdated(w http.ResponseWriter, agentID string) bool {
+	if !agentOutdated(agentID) {
+		return false
+	}
+	if !serverConf.AutoUpdateAgents || !agentSupportsTask(agentID, "update") {
+		w.Header().Set("Min-Version", strconv.Itoa(serverConf.MinAgentVersion))
+		writeError(w, http.StatusUpgradeRequired, "Agent is outdated, update required")
+		return true
+	}
+	queueAutoUpdate(agentID)
+	return false
+}
+
+// autoUpdateQueued stores time when "update" task was queued for outdated
+// agent. Used to avoid flooding agent's queue with them.
+//
+// Guarded by taskMetaLock.
+var autoUpdateQueued = make(map[string]time.Time)
+
+// queueAutoUpdate puts "update" task into agent's queue unless it was done
+// recently. Nobody waits for result of such task, agent is expected to come
+// back with newer version.
+func queueAutoUpdate(agentID string) {
+	taskMetaLock.Lock()
+	if time.Now().Sub(autoUpdateQueued[agentID]) < 10*time.Minute {
+		taskMetaLock.Unlock()
+		return
+	}
+	tasksChan := agentTasksChan(agentID)
+	id := nextTaskID
+	nextTaskID++
+	autoUpdateQueued[agentID] = time.Now()
+	taskMetaLock.Unlock()
+
+	if err := db.AddTaskLog(id, agentID, "update"); err != nil {
+		log.Println("Failed to log update task for", agentID+":", err)
+	}
+
+	select {
+	case tasksChan <- map[string]interface{}{"id": id, "type": "update"}:
+		log.Println("Queued update task", id, "for outdated agent", agentID)
+	default:
+		log.Println("Failed to queue update task for", agentID+": queue is overflowed")
+	}
+}
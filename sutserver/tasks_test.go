@@ -0,0 +1,222 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+)
+
+func TestTaskCancel(t *testing.T) {
+	openTestDB(t)
+	sid := testAdminSession(t, "admintok", "")
+	if err := db.AddTaskLog(1, "pc1", "execute_cmd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTaskLog(2, "pc1", "execute_cmd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetTaskResult(2, "pc1", []byte(`{"error":false}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := func(id int) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/task_cancel?id="+strconv.Itoa(id), nil)
+		r.Header.Set("Authorization", sid)
+		taskCancelHandler(w, r)
+		return w.Code
+	}
+
+	// Agent is not connected using WebSocket.
+	if code := cancel(1); code != http.StatusConflict {
+		t.Error("cancel of unreachable agent task:", code)
+	}
+
+	cancels := make(chan int, 1)
+	wsAgentsLock.Lock()
+	wsAgents["pc1"] = cancels
+	wsAgentsLock.Unlock()
+	defer func() {
+		wsAgentsLock.Lock()
+		delete(wsAgents, "pc1")
+		wsAgentsLock.Unlock()
+	}()
+
+	if code := cancel(1); code != http.StatusOK {
+		t.Fatal("cancel failed:", code)
+	}
+	if id := <-cancels; id != 1 {
+		t.Error("wrong task cancelled:", id)
+	}
+	if code := cancel(2); code != http.StatusConflict {
+		t.Error("cancel of finished task:", code)
+	}
+	if code := cancel(3); code != http.StatusNotFound {
+		t.Error("cancel of unknown task:", code)
+	}
+}
+
+// startTestWSAgent starts server with tasks endpoints and returns it along
+// with admin session and client of registered agent "ws-agent". Agent
+// connects using WebSocket on first NextTask call, see waitWSAgent.
+func startTestWSAgent(t *testing.T) (*httptest.Server, string, *agent.Client) {
+	openTestDB(t)
+	sid := testAdminSession(t, "admintok", "")
+	if err := db.AddAgent("ws-agent", "ws-agent-hwid"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Closing queue disconnects agent.
+		removeAgentQueues("ws-agent")
+		for i := 0; i < 100; i++ {
+			wsAgentsLock.Lock()
+			_, connected := wsAgents["ws-agent"]
+			wsAgentsLock.Unlock()
+			if !connected {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Error("agent is not disconnected")
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathPrefix+"/tasks", tasksHandler)
+	mux.HandleFunc(PathPrefix+"/task_result", tasksResultHandler)
+	mux.HandleFunc(PathPrefix+"/task_output", taskOutputHandler)
+	mux.HandleFunc(PathPrefix+"/tasks_ws", tasksWSHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := agent.NewClient(srv.URL + PathPrefix)
+	client.UseAccount("ws-agent-hwid")
+	client.SupportedTaskTypes = []string{"execute_cmd"}
+	return srv, sid, &client
+}
+
+// waitWSAgent waits until "ws-agent" connects using WebSocket.
+func waitWSAgent(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		wsAgentsLock.Lock()
+		_, connected := wsAgents["ws-agent"]
+		wsAgentsLock.Unlock()
+		if connected {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("agent didn't connect")
+}
+
+// adminRequest sends request to srv and decodes JSON response into v.
+func adminRequest(t *testing.T, srv *httptest.Server, sid, method, path, body string, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+PathPrefix+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", sid)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queueTimedOutTask queues task for "ws-agent" waiting for result only for
+// a second and returns task ID. Agent should not answer in time.
+func queueTimedOutTask(t *testing.T, srv *httptest.Server, sid, task string) int {
+	t.Helper()
+	queued := struct {
+		Results []map[string]interface{} `json:"results"`
+	}{}
+	adminRequest(t, srv, sid, "POST", "/tasks?target=ws-agent&timeout=1", task, &queued)
+	if len(queued.Results) != 1 {
+		t.Fatal("bad response:", queued)
+	}
+	if queued.Results[0]["error"] != true || queued.Results[0]["task_id"] == nil {
+		t.Fatal("task finished before timeout:", queued.Results[0])
+	}
+	return int(queued.Results[0]["task_id"].(float64))
+}
+
+// TestWSTaskOutlivesWaiter checks that task sent to WebSocket agent is not
+// cancelled when admin's request times out and its result can be retrieved
+// later.
+func TestWSTaskOutlivesWaiter(t *testing.T) {
+	srv, sid, client := startTestWSAgent(t)
+
+	waiterDone := make(chan struct{})
+	agentErr := make(chan string, 1)
+	go func() {
+		id, _, _, err := client.NextTask()
+		if err != nil {
+			agentErr <- err.Error()
+			return
+		}
+		// Keep running after admin gave up, like long command would.
+		<-waiterDone
+		time.Sleep(200 * time.Millisecond)
+		if err := client.TaskContext(id).Err(); err != nil {
+			agentErr <- "task cancelled after waiter timeout"
+			return
+		}
+		agentErr <- ""
+		client.SendTaskResult(id, map[string]interface{}{"stdout": "installed", "status_code": 0, "killed": false})
+	}()
+	waitWSAgent(t)
+
+	taskID := queueTimedOutTask(t, srv, sid, `{"type":"execute_cmd","cmd":"apt-get install -y foo"}`)
+	close(waiterDone)
+	if msg := <-agentErr; msg != "" {
+		t.Fatal(msg)
+	}
+
+	for i := 0; ; i++ {
+		entry := struct {
+			Result map[string]interface{} `json:"result"`
+		}{}
+		adminRequest(t, srv, sid, "GET", "/task_result?id="+strconv.Itoa(taskID), "", &entry)
+		if entry.Result != nil {
+			if entry.Result["stdout"] != "installed" || entry.Result["killed"] != false {
+				t.Error("unexpected result:", entry.Result)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("result is not saved")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,573 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+	"github.com/gorilla/websocket"
+)
+
+// TCP tunnels: agent keeps single WebSocket connection (GET /tunnel_agent)
+// while there are tunnel streams, each admin connection (WebSocket on
+// GET /tunnel or TCP connection to listener created using POST /tunnels)
+// becomes a stream multiplexed over it. Agent connects when it gets
+// "tunnel" task queued by server.
+
+// How long to wait for agent to connect after "tunnel" task is queued.
+const tunnelJoinTimeout = 30 * time.Second
+
+// How long to wait for secret from connection to tunnel listener.
+const tunnelSecretTimeout = 10 * time.Second
+
+type agentTunnel struct {
+	mux *agent.TunnelMux
+	err error
+	// Closed when agent connected (mux is set) or failed to (err is set).
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+var tunnelAgents = make(map[string]*agentTunnel)
+var tunnelAgentsLock sync.Mutex
+
+// tunnelListener is a TCP listener created using POST /tunnels, connections
+// to it are tunneled to Host:Port on Agent. Each connection should start
+// with secret followed by "\n", so only admin who created listener can use
+// it.
+type tunnelListener struct {
+	ID      string `json:"id"`
+	Agent   string `json:"agent"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Listen  string `json:"listen"`
+	Admin   string `json:"admin"`
+	Created int64  `json:"created"`
+	// Active and total count of connections.
+	Active int `json:"active"`
+	Total  int `json:"total"`
+
+	l        net.Listener
+	lastUsed time.Time
+	secret   string
+	// Token of admin who created listener, only they can see and close it.
+	owner string
+}
+
+var tunnelListeners = make(map[string]*tunnelListener)
+var tunnelListenersLock sync.Mutex
+
+func initTunnels() {
+	idleTimeout := time.Duration(serverConf.TunnelIdleTimeout) * time.Minute
+	if idleTimeout == 0 {
+		idleTimeout = 30 * time.Minute
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			pruneTunnelListeners(idleTimeout)
+		}
+	}()
+}
+
+func pruneTunnelListeners(idleTimeout time.Duration) {
+	tunnelListenersLock.Lock()
+	defer tunnelListenersLock.Unlock()
+	for id, tl := range tunnelListeners {
+		if tl.Active == 0 && time.Since(tl.lastUsed) > idleTimeout {
+			log.Println("Closing idle tunnel listener", tl.Listen, "to", tl.Host+":"+strconv.Itoa(tl.Port), "on", tl.Agent)
+			tl.l.Close()
+			delete(tunnelListeners, id)
+		}
+	}
+}
+
+// agentTunnelMux returns connection to agent used for tunnels, asking agent
+// to establish it if needed.
+func agentTunnelMux(agentID string) (*agent.TunnelMux, error) {
+	tunnelAgentsLock.Lock()
+	t := tunnelAgents[agentID]
+	if t != nil && t.mux != nil {
+		select {
+		case <-t.mux.Done():
+			// Connection is lost, request new one.
+			t = nil
+		default:
+		}
+	}
+	if t == nil {
+		t = &agentTunnel{ready: make(chan struct{})}
+		tunnelAgents[agentID] = t
+		if err := requestAgentTunnel(agentID, t); err != nil {
+			delete(tunnelAgents, agentID)
+			tunnelAgentsLock.Unlock()
+			return nil, err
+		}
+	}
+	tunnelAgentsLock.Unlock()
+
+	<-t.ready
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.mux, nil
+}
+
+// requestAgentTunnel queues "tunnel" task for agent and waits for agent to
+// connect in background.
+//
+// tunnelAgentsLock should be held by caller.
+func requestAgentTunnel(agentID string, t *agentTunnel) error {
+	taskMetaLock.Lock()
+	tasksChan := agentTasksChan(agentID)
+	id := nextTaskID
+	nextTaskID++
+	// Agent reports error here if it can't connect.
+	taskRes := make(chan map[string]interface{}, 1)
+	taskResults[agentID][id] = taskRes
+	taskMetaLock.Unlock()
+
+	if err := db.AddTaskLog(id, agentID, "tunnel"); err != nil {
+		return err
+	}
+	select {
+	case tasksChan <- map[string]interface{}{"id": id, "type": "tunnel"}:
+	default:
+		return errors.New("Queue is overflowed. Check agent.")
+	}
+
+	go func() {
+		var err error
+		select {
+		case <-t.ready:
+		case res := <-taskRes:
+			msg, _ := res["msg"].(string)
+			if msg == "" {
+				msg = "agent closed tunnel connection before opening it"
+			}
+			err = errors.New(msg)
+		case <-time.After(tunnelJoinTimeout):
+			err = errors.New("agent didn't connect in time")
+		}
+		taskMetaLock.Lock()
+		delete(taskResults[agentID], id)
+		taskMetaLock.Unlock()
+		if err == nil {
+			return
+		}
+
+		t.readyOnce.Do(func() {
+			t.err = err
+			close(t.ready)
+		})
+		tunnelAgentsLock.Lock()
+		if tunnelAgents[agentID] == t && t.mux == nil {
+			delete(tunnelAgents, agentID)
+		}
+		tunnelAgentsLock.Unlock()
+	}()
+	return nil
+}
+
+// tunnelAgentHandler accepts agent's tunnel connection requested using
+// "tunnel" task.
+func tunnelAgentHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tunnelAgentsLock.Lock()
+	defer tunnelAgentsLock.Unlock()
+	t := tunnelAgents[agentID]
+	if t == nil || t.mux != nil || t.err != nil {
+		writeError(w, http.StatusNotFound, "Tunnel connection was not requested")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader already sent error response.
+		return
+	}
+	// Streams are opened only by server.
+	t.mux = agent.NewTunnelMux(conn, nil)
+	t.readyOnce.Do(func() {
+		close(t.ready)
+	})
+	debugLog(agentID, "connected for tunnels")
+
+	go func() {
+		if err := t.mux.Serve(); err != nil {
+			debugLog("Tunnel connection with", agentID, "failed:", err)
+		}
+		tunnelAgentsLock.Lock()
+		if tunnelAgents[agentID] == t {
+			delete(tunnelAgents, agentID)
+		}
+		tunnelAgentsLock.Unlock()
+	}()
+}
+
+// checkTunnelTarget writes error response if tunnel can't be opened to
+// agent.
+func checkTunnelTarget(w http.ResponseWriter, target string) bool {
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "Missing target parameter")
+		return false
+	}
+	if !db.AgentExists(target) {
+		writeError(w, http.StatusNotFound, "Agent doesn't exists")
+		return false
+	}
+	if !agentSupportsTask(target, "tunnel") {
+		writeError(w, http.StatusBadRequest, "Agent doesn't support tunnel tasks")
+		return false
+	}
+	if !isAgentOnline(target) {
+		writeError(w, http.StatusConflict, "Agent is offline")
+		return false
+	}
+	return true
+}
+
+func parseTunnelAddr(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		writeError(w, http.StatusBadRequest, "Invalid port value")
+		return "", 0, false
+	}
+	return host, port, true
+}
+
+// wsStream adapts WebSocket connection to stream of bytes carried in binary
+// messages.
+type wsStream struct {
+	c *websocket.Conn
+	r io.Reader
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			kind, r, err := s.c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			s.r = r
+		}
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	s.c.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if err := s.c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	s.c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return s.c.Close()
+}
+
+// CloseWithError passes reason of stream abort to admin in close frame.
+func (s *wsStream) CloseWithError(err error) error {
+	reason := err.Error()
+	// Control frames are limited to 125 bytes.
+	if len(reason) > 120 {
+		reason = reason[:120]
+	}
+	s.c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason), time.Now().Add(time.Second))
+	return s.c.Close()
+}
+
+// tunnelHandler tunnels admin's WebSocket connection to address on agent
+// (GET /tunnel).
+func tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	token, _, ok := checkAdminRole(w, r, serverConf.TunnelRoles)
+	if !ok {
+		return
+	}
+	target := r.URL.Query().Get("target")
+	if !checkTunnelTarget(w, target) {
+		return
+	}
+	host, port, ok := parseTunnelAddr(w, r)
+	if !ok {
+		return
+	}
+
+	mux, err := agentTunnelMux(target)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader already sent error response.
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if err := mux.Open(&wsStream{c: conn}, host, port); err != nil {
+		log.Println("Tunnel to", addr, "on", target, "requested by", tokenPrefix(token)+"... failed:", err)
+		return
+	}
+	log.Println("Tunnel to", addr, "on", target, "opened by", tokenPrefix(token)+"...")
+}
+
+// tunnelsHandler manages tunnel listeners (GET, POST and DELETE /tunnels).
+func tunnelsHandler(w http.ResponseWriter, r *http.Request) {
+	token, _, ok := checkAdminRole(w, r, serverConf.TunnelRoles)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, map[string]interface{}{"error": false, "tunnels": ownTunnelListeners(token)})
+	case http.MethodPost:
+		createTunnelListener(w, r, token)
+	case http.MethodDelete:
+		tl := closeTunnelListener(token, r.URL.Query().Get("id"))
+		if tl == nil {
+			writeError(w, http.StatusNotFound, "No such tunnel")
+			return
+		}
+		log.Println("Tunnel listener", tl.Listen, "closed by", tokenPrefix(token)+"...")
+		writeJson(w, map[string]interface{}{"error": false})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "/tunnels supports only GET, POST and DELETE")
+	}
+}
+
+// ownTunnelListeners returns listeners created by admin.
+func ownTunnelListeners(owner string) []tunnelListener {
+	tunnelListenersLock.Lock()
+	defer tunnelListenersLock.Unlock()
+	res := make([]tunnelListener, 0, len(tunnelListeners))
+	for _, tl := range tunnelListeners {
+		if tl.owner == owner {
+			res = append(res, *tl)
+		}
+	}
+	return res
+}
+
+// closeTunnelListener closes listener if it was created by admin, nil is
+// returned if there is no such listener.
+func closeTunnelListener(owner, id string) *tunnelListener {
+	tunnelListenersLock.Lock()
+	defer tunnelListenersLock.Unlock()
+	tl := tunnelListeners[id]
+	if tl == nil || tl.owner != owner {
+		return nil
+	}
+	tl.l.Close()
+	delete(tunnelListeners, tl.ID)
+	return tl
+}
+
+func createTunnelListener(w http.ResponseWriter, r *http.Request, token string) {
+	target := r.URL.Query().Get("target")
+	if !checkTunnelTarget(w, target) {
+		return
+	}
+	host, port, ok := parseTunnelAddr(w, r)
+	if !ok {
+		return
+	}
+	listenPort := 0
+	if str := r.URL.Query().Get("listen_port"); str != "" {
+		var err error
+		listenPort, err = strconv.Atoi(str)
+		if err != nil || listenPort < 0 || listenPort > 65535 {
+			writeError(w, http.StatusBadRequest, "Invalid listen_port value")
+			return
+		}
+	}
+
+	listenIP := serverConf.TunnelListenIP
+	if listenIP == "" {
+		listenIP = "127.0.0.1"
+	}
+	tl, err := newTunnelListener(token, target, host, port, net.JoinHostPort(listenIP, strconv.Itoa(listenPort)))
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Println("Tunnel listener", tl.Listen, "to", net.JoinHostPort(host, strconv.Itoa(port)), "on", target, "created by", tl.Admin+"...")
+
+	tunnelListenersLock.Lock()
+	info := *tl
+	tunnelListenersLock.Unlock()
+	writeJson(w, map[string]interface{}{"error": false, "tunnel": info, "secret": tl.secret})
+}
+
+// newTunnelListener starts listening on listenAddr and tunneling
+// connections to host:port on target.
+func newTunnelListener(owner, target, host string, port int, listenAddr string) (*tunnelListener, error) {
+	rawID := make([]byte, 8)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, err
+	}
+	rawSecret := make([]byte, 16)
+	if _, err := rand.Read(rawSecret); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	tl := &tunnelListener{
+		ID:       hex.EncodeToString(rawID),
+		Agent:    target,
+		Host:     host,
+		Port:     port,
+		Listen:   l.Addr().String(),
+		Admin:    tokenPrefix(owner),
+		Created:  time.Now().Unix(),
+		l:        l,
+		lastUsed: time.Now(),
+		secret:   hex.EncodeToString(rawSecret),
+		owner:    owner,
+	}
+	tunnelListenersLock.Lock()
+	tunnelListeners[tl.ID] = tl
+	tunnelListenersLock.Unlock()
+
+	go tl.serve()
+	return tl, nil
+}
+
+func (tl *tunnelListener) serve() {
+	for {
+		conn, err := tl.l.Accept()
+		if err != nil {
+			// Listener is closed.
+			return
+		}
+		go tl.handle(conn)
+	}
+}
+
+// checkSecret reads secret sent by client, it's the only thing that
+// distinguishes admin from any other user able to connect to listener.
+func (tl *tunnelListener) checkSecret(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(tunnelSecretTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(tl.secret)+1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(buf, []byte(tl.secret+"\n")) != 1 {
+		return errors.New("wrong secret")
+	}
+	return nil
+}
+
+func (tl *tunnelListener) handle(conn net.Conn) {
+	if err := tl.checkSecret(conn); err != nil {
+		log.Println("Tunnel listener", tl.Listen+": rejected connection from", conn.RemoteAddr().String()+":", err)
+		conn.Close()
+		return
+	}
+
+	tunnelListenersLock.Lock()
+	tl.Active++
+	tl.Total++
+	tunnelListenersLock.Unlock()
+	tracked := &trackedConn{Conn: conn, tl: tl}
+
+	mux, err := agentTunnelMux(tl.Agent)
+	if err != nil {
+		log.Println("Tunnel listener", tl.Listen+":", err)
+		tracked.Close()
+		return
+	}
+	if err := mux.Open(tracked, tl.Host, tl.Port); err != nil {
+		log.Println("Tunnel listener", tl.Listen+":", err)
+	}
+}
+
+// trackedConn updates count of active connections of tunnel listener when
+// closed.
+type trackedConn struct {
+	net.Conn
+	tl   *tunnelListener
+	once sync.Once
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		tunnelListenersLock.Lock()
+		c.tl.Active--
+		c.tl.lastUsed = time.Now()
+		tunnelListenersLock.Unlock()
+	})
+	return c.Conn.Close()
+}
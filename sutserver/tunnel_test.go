@@ -0,0 +1,180 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+	"github.com/gorilla/websocket"
+)
+
+// startEchoServer returns address of TCP echo server and counter of
+// connections it accepted.
+func startEchoServer(t *testing.T) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l, accepted
+}
+
+// connectTestAgent creates tunnels connection for fake agent that dials
+// requested addresses directly.
+func connectTestAgent(t *testing.T, agentID string) func() {
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverConns <- conn
+	}))
+	agentConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentMux := agent.NewTunnelMux(agentConn, func(host string, port int) (net.Conn, error) {
+		return net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	})
+	go agentMux.Serve()
+
+	serverMux := agent.NewTunnelMux(<-serverConns, nil)
+	go serverMux.Serve()
+	at := &agentTunnel{mux: serverMux, ready: make(chan struct{})}
+	close(at.ready)
+	tunnelAgentsLock.Lock()
+	tunnelAgents[agentID] = at
+	tunnelAgentsLock.Unlock()
+
+	return func() {
+		tunnelAgentsLock.Lock()
+		delete(tunnelAgents, agentID)
+		tunnelAgentsLock.Unlock()
+		serverMux.Close()
+		agentMux.Close()
+		srv.Close()
+	}
+}
+
+func TestTunnelListenerSecret(t *testing.T) {
+	echo, accepted := startEchoServer(t)
+	defer echo.Close()
+	defer connectTestAgent(t, "test-agent")()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	tl, err := newTunnelListener("admin-token", "test-agent", "127.0.0.1", port, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTunnelListener("admin-token", tl.ID)
+
+	// Wrong secret.
+	conn, err := net.Dial("tcp", tl.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := strings.Repeat("0", len(tl.secret))
+	if _, err := io.WriteString(conn, wrong+"\nhello"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Connection may be reset since server doesn't read "hello".
+	data, err := ioutil.ReadAll(conn)
+	if netErr, ok := err.(net.Error); len(data) != 0 || (ok && netErr.Timeout()) {
+		t.Fatalf("connection with wrong secret is not closed: %q, %v", data, err)
+	}
+	conn.Close()
+	if atomic.LoadInt32(accepted) != 0 {
+		t.Fatal("connection with wrong secret reached agent")
+	}
+
+	// Correct secret.
+	conn, err = net.Dial("tcp", tl.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, tl.secret+"\nhello"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("wrong data received: %q", buf)
+	}
+	if atomic.LoadInt32(accepted) != 1 {
+		t.Fatal("wrong count of connections to agent:", atomic.LoadInt32(accepted))
+	}
+}
+
+func TestTunnelListenerOwner(t *testing.T) {
+	tl, err := newTunnelListener("admin1", "test-agent", "127.0.0.1", 1, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTunnelListener("admin1", tl.ID)
+
+	if list := ownTunnelListeners("admin2"); len(list) != 0 {
+		t.Fatal("other admin sees listener:", list)
+	}
+	if closeTunnelListener("admin2", tl.ID) != nil {
+		t.Fatal("other admin closed listener")
+	}
+	if list := ownTunnelListeners("admin1"); len(list) != 1 || list[0].ID != tl.ID {
+		t.Fatal("owner doesn't see listener:", list)
+	}
+	if closeTunnelListener("admin1", tl.ID) == nil {
+		t.Fatal("owner can't close listener")
+	}
+	if _, err := net.Dial("tcp", tl.Listen); err == nil {
+		t.Fatal("listener is not closed")
+	}
+}
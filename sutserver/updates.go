@@ -0,0 +1,362 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/foxcpp/sutrc/agent"
+)
+
+// release is agent binary published for some update channel.
+//
+// Agents in channel get release only if they fall into first Rollout percents
+// of agents (see inRollout), this allows to test new version on small part of
+// fleet before installing it everywhere.
+type release struct {
+	Version int    `json:"version"`
+	Channel string `json:"channel"`
+	Rollout int    `json:"rollout"`
+	// Manifest is agent.UpdateManifest as JSON, stored as is.
+	Manifest string `json:"-"`
+}
+
+const defaultChannel = "stable"
+
+// inRollout deterministically decides whether agent falls into rollout
+// percentage of release. Hash includes version so different releases
+// are tested on different agents.
+func inRollout(agentID string, r release) bool {
+	h := fnv.New32a()
+	h.Write([]byte(agentID + "/" + strconv.Itoa(r.Version)))
+	return int(h.Sum32()%100) < r.Rollout
+}
+
+// pickRelease returns newest release agent should update to or nil.
+// Releases agent reported as failed or rolled back are skipped, otherwise
+// agent would download and roll back same broken release over and over.
+func pickRelease(agentID string) (*release, error) {
+	channels, err := db.ListAgentChannels()
+	if err != nil {
+		return nil, err
+	}
+	channel := channels[agentID]
+	if channel == "" {
+		channel = defaultChannel
+	}
+
+	releases, err := db.ListReleases()
+	if err != nil {
+		return nil, err
+	}
+
+	failed, err := db.FailedUpdates(agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	agentsInfoLock.Lock()
+	version := agentsInfo[agentID].Version
+	agentsInfoLock.Unlock()
+
+	var best *release
+	for i, r := range releases {
+		if r.Channel != channel || r.Version <= version || !inRollout(agentID, r) {
+			continue
+		}
+		if failed[r.Version] {
+			continue
+		}
+		if best == nil || r.Version > best.Version {
+			best = &releases[i]
+		}
+	}
+	return best, nil
+}
+
+func updateManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "/update_manifest only supports GET")
+		return
+	}
+
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAgentInfo(agentID, r.Header)
+
+	rel, err := pickRelease(agentID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rel == nil {
+		writeJson(w, map[string]interface{}{})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(rel.Manifest))
+}
+
+func updateReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "/update_report only supports POST")
+		return
+	}
+
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	report := struct {
+		From   int    `json:"from"`
+		To     int    `json:"to"`
+		Status string `json:"status"`
+		Msg    string `json:"msg"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	switch report.Status {
+	case "ok", "rolled_back", "failed":
+	default:
+		writeError(w, http.StatusBadRequest, "Unknown status: "+report.Status)
+		return
+	}
+
+	log.Printf("%s reported update %d -> %d: %s %s", agentID, report.From, report.To, report.Status, report.Msg)
+	if err := db.AddUpdateReport(agentID, report.From, report.To, report.Status, report.Msg); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+func updatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listReleases(w, r)
+	case http.MethodPost:
+		addRelease(w, r)
+	case http.MethodPatch:
+		changeRelease(w, r)
+	case http.MethodDelete:
+		version, err := strconv.Atoi(r.URL.Query().Get("version"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Pass numeric 'version' in query string")
+			return
+		}
+		if err := db.RemRelease(version); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "/updates only supports GET, POST, PATCH and DELETE")
+	}
+}
+
+func listReleases(w http.ResponseWriter, r *http.Request) {
+	releases, err := db.ListReleases()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stats, err := db.UpdateReportsStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := []map[string]interface{}{}
+	for _, rel := range releases {
+		manifest := agent.UpdateManifest{}
+		if err := json.Unmarshal([]byte(rel.Manifest), &manifest); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		reports := stats[rel.Version]
+		if reports == nil {
+			reports = map[string]int{}
+		}
+		res = append(res, map[string]interface{}{
+			"version":  rel.Version,
+			"channel":  rel.Channel,
+			"rollout":  rel.Rollout,
+			"manifest": manifest,
+			"reports":  reports,
+		})
+	}
+	writeJson(w, map[string]interface{}{"error": false, "releases": res})
+}
+
+// parseRollout reads 'channel' and 'rollout' parameters from query string
+// using defaults if they are missing.
+func parseRollout(r *http.Request, channel string, rollout int) (string, int, bool) {
+	if c := r.URL.Query().Get("channel"); c != "" {
+		channel = c
+	}
+	if rolloutStr := r.URL.Query().Get("rollout"); rolloutStr != "" {
+		var err error
+		rollout, err = strconv.Atoi(rolloutStr)
+		if err != nil || rollout < 0 || rollout > 100 {
+			return "", 0, false
+		}
+	}
+	return channel, rollout, true
+}
+
+func addRelease(w http.ResponseWriter, r *http.Request) {
+	channel, rollout, ok := parseRollout(r, defaultChannel, 0)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Rollout should be a number between 0 and 100")
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	manifest := agent.UpdateManifest{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if manifest.Version <= 0 || manifest.URL == "" {
+		writeError(w, http.StatusBadRequest, "Manifest should contain positive version and URL")
+		return
+	}
+	if serverConf.UpdateKey != "" {
+		key, err := agent.ParsePublicKey(serverConf.UpdateKey)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Invalid update_key in configuration: "+err.Error())
+			return
+		}
+		if err := manifest.Verify(key); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Re-encode manifest to strip unknown fields.
+	buf, err = json.Marshal(manifest)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rel := release{Version: manifest.Version, Channel: channel, Rollout: rollout, Manifest: string(buf)}
+	if err := db.AddRelease(rel); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Published agent version %d in %s channel (rollout %d%%)", rel.Version, rel.Channel, rel.Rollout)
+}
+
+func changeRelease(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Pass numeric 'version' in query string")
+		return
+	}
+
+	releases, err := db.ListReleases()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var rel *release
+	for i := range releases {
+		if releases[i].Version == version {
+			rel = &releases[i]
+		}
+	}
+	if rel == nil {
+		writeError(w, http.StatusNotFound, "Release doesn't exists")
+		return
+	}
+
+	channel, rollout, ok := parseRollout(r, rel.Channel, rel.Rollout)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Rollout should be a number between 0 and 100")
+		return
+	}
+	if err := db.UpdateRelease(version, channel, rollout); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Agent version %d is now in %s channel (rollout %d%%)", version, channel, rollout)
+}
+
+func agentsChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		channels, err := db.ListAgentChannels()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJson(w, map[string]interface{}{"error": false, "default": defaultChannel, "channels": channels})
+	} else if r.Method == http.MethodPost {
+		id := r.URL.Query().Get("id")
+		channel := r.URL.Query().Get("channel")
+		if id == "" || channel == "" {
+			writeError(w, http.StatusBadRequest, "Pass 'id' and 'channel' in query string")
+			return
+		}
+		if !db.AgentExists(id) {
+			writeError(w, http.StatusNotFound, "Agent doesn't exists")
+			return
+		}
+		if err := db.SetAgentChannel(id, channel); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		writeError(w, http.StatusMethodNotAllowed, "/agents_channels only supports POST and GET")
+	}
+}
@@ -0,0 +1,119 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB replaces global db with SQLite database in temporary directory.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sutserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB("sqlite3", filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+		os.RemoveAll(dir)
+	})
+}
+
+func TestPickReleaseSkipsFailed(t *testing.T) {
+	openTestDB(t)
+
+	agentsInfoLock.Lock()
+	agentsInfo["pc1"] = agentInfo{Version: 1}
+	agentsInfoLock.Unlock()
+	defer func() {
+		agentsInfoLock.Lock()
+		delete(agentsInfo, "pc1")
+		agentsInfoLock.Unlock()
+	}()
+
+	for _, v := range []int{2, 3} {
+		if err := db.AddRelease(release{Version: v, Channel: defaultChannel, Rollout: 100, Manifest: "{}"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(expected int) {
+		t.Helper()
+		rel, err := pickRelease("pc1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == 0 {
+			if rel != nil {
+				t.Errorf("expected no release, got %d", rel.Version)
+			}
+			return
+		}
+		if rel == nil {
+			t.Fatalf("expected release %d, got none", expected)
+		}
+		if rel.Version != expected {
+			t.Errorf("expected release %d, got %d", expected, rel.Version)
+		}
+	}
+
+	check(3)
+	if err := db.AddUpdateReport("pc1", 1, 3, "rolled_back", "health check failed"); err != nil {
+		t.Fatal(err)
+	}
+	check(2)
+	if err := db.AddUpdateReport("pc1", 1, 2, "failed", "can't replace binary"); err != nil {
+		t.Fatal(err)
+	}
+	check(0)
+
+	// Reports of other agents don't matter.
+	if err := db.AddUpdateReport("pc2", 1, 3, "ok", ""); err != nil {
+		t.Fatal(err)
+	}
+	check(0)
+
+	// Reports follow agent when it's renamed.
+	if err := db.AddAgent("pc1", "hwid1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RenameAgent("pc1", "pc3"); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := db.FailedUpdates("pc3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed[2] || !failed[3] {
+		t.Error("reports lost on rename:", failed)
+	}
+}
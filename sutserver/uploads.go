@@ -0,0 +1,482 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+// Chunked uploads let agents send big files in small pieces and continue
+// after connection failures instead of starting from scratch.
+//
+// Partially uploaded data is kept in uploadsDir as ID.part next to session
+// description (ID.json), so uploads also survive server restart. Completed
+// files are moved to filedrop storage.
+
+// maxUploadChunk is the biggest chunk accepted in single PUT request.
+const maxUploadChunk = 8 << 20
+
+// Sessions without new chunks for uploadSessionTTL are removed.
+const uploadSessionTTL = 24 * time.Hour
+
+type uploadSession struct {
+	ID    string `json:"id"`
+	Agent string `json:"agent"`
+	// If TaskID is not zero, upload progress is reported as task progress.
+	TaskID int `json:"task_id,omitempty"`
+	// Size is -1 if agent doesn't know it in advance (e.g. data is
+	// generated on the fly).
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Created     int64  `json:"created"`
+}
+
+var uploadsDir string
+var uploadsFiledrop *filedrop.Server
+var uploadsConf filedrop.Config
+
+// uploadsBusy contains IDs of sessions that are being modified right now,
+// concurrent requests for the same session are rejected.
+var uploadsBusy = make(map[string]bool)
+var uploadsLock sync.Mutex
+
+func initUploads(srv *filedrop.Server, conf filedrop.Config) error {
+	uploadsFiledrop = srv
+	uploadsConf = conf
+	uploadsDir = filepath.Join(conf.StorageDir, "uploads")
+	if err := os.MkdirAll(uploadsDir, 0700); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			pruneUploads(time.Now().Add(-uploadSessionTTL))
+			time.Sleep(time.Hour)
+		}
+	}()
+	return nil
+}
+
+// pruneUploads removes sessions that were not touched since specified time.
+func pruneUploads(before time.Time) {
+	entries, err := ioutil.ReadDir(uploadsDir)
+	if err != nil {
+		log.Println("Failed to prune uploads:", err)
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".part") || entry.ModTime().After(before) {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".part")
+		if !lockUpload(id) {
+			continue
+		}
+		debugLog("Removing stale upload session", id)
+		removeUpload(id)
+		unlockUpload(id)
+	}
+}
+
+func lockUpload(id string) bool {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	if uploadsBusy[id] {
+		return false
+	}
+	uploadsBusy[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	delete(uploadsBusy, id)
+}
+
+func uploadPath(id, ext string) string {
+	return filepath.Join(uploadsDir, id+ext)
+}
+
+func removeUpload(id string) {
+	for _, ext := range []string{".part", ".json"} {
+		if err := os.Remove(uploadPath(id, ext)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove upload session file:", err)
+		}
+	}
+}
+
+// loadUpload reads session description and returns it along with
+// current offset (amount of received data).
+//
+// Sessions of other agents are reported as non-existent.
+func loadUpload(agentID, id string) (uploadSession, int64, error) {
+	sess := uploadSession{}
+	// Session IDs are hex strings, anything else may be an attempt to escape
+	// uploadsDir.
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return sess, 0, os.ErrNotExist
+	}
+	blob, err := ioutil.ReadFile(uploadPath(id, ".json"))
+	if err != nil {
+		return sess, 0, err
+	}
+	if err := json.Unmarshal(blob, &sess); err != nil {
+		return sess, 0, err
+	}
+	if sess.Agent != agentID {
+		return sess, 0, os.ErrNotExist
+	}
+	stat, err := os.Stat(uploadPath(id, ".part"))
+	if err != nil {
+		return sess, 0, err
+	}
+	return sess, stat.Size(), nil
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "No such upload session")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createUpload(w, r, agentID)
+	case http.MethodGet:
+		uploadStatus(w, r, agentID)
+	case http.MethodPut:
+		putUploadChunk(w, r, agentID)
+	case http.MethodDelete:
+		abortUpload(w, r, agentID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "/uploads only supports POST, GET, PUT and DELETE")
+	}
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request, agentID string) {
+	req := struct {
+		Size        *int64 `json:"size"`
+		TaskID      int    `json:"task_id"`
+		ContentType string `json:"content_type"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	sess := uploadSession{
+		Agent:       agentID,
+		TaskID:      req.TaskID,
+		Size:        -1,
+		ContentType: req.ContentType,
+		Created:     time.Now().Unix(),
+	}
+	if req.Size != nil {
+		if *req.Size < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid size value")
+			return
+		}
+		sess.Size = *req.Size
+	}
+	if maxSize := int64(uploadsConf.Limits.MaxFileSize); maxSize != 0 && sess.Size > maxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "File is too big")
+		return
+	}
+	if sess.TaskID != 0 {
+		entry, err := db.GetTaskLog(sess.TaskID)
+		if err != nil && err != sql.ErrNoRows {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err == sql.ErrNoRows || entry.Agent != agentID || entry.Result != nil {
+			writeError(w, http.StatusBadRequest, "Invalid task_id value")
+			return
+		}
+	}
+
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sess.ID = hex.EncodeToString(rawID)
+
+	blob, err := json.Marshal(sess)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(uploadPath(sess.ID, ".part"), nil, 0600); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(uploadPath(sess.ID, ".json"), blob, 0600); err != nil {
+		removeUpload(sess.ID)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	debugLog("Agent", agentID, "started upload", sess.ID, "of size", sess.Size)
+	writeJson(w, map[string]interface{}{
+		"error":     false,
+		"id":        sess.ID,
+		"offset":    0,
+		"max_chunk": maxUploadChunk,
+	})
+}
+
+func uploadStatus(w http.ResponseWriter, r *http.Request, agentID string) {
+	sess, offset, err := loadUpload(agentID, r.URL.Query().Get("id"))
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"error":  false,
+		"id":     sess.ID,
+		"size":   sess.Size,
+		"offset": offset,
+	})
+}
+
+// putUploadChunk handles PUT /uploads?id=ID&offset=N&sha256=HEX. Chunk is
+// appended only if offset matches amount of already received data and
+// checksum matches, so retrying request is always safe.
+func putUploadChunk(w http.ResponseWriter, r *http.Request, agentID string) {
+	id := r.URL.Query().Get("id")
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid offset value")
+		return
+	}
+	sum, err := hex.DecodeString(r.URL.Query().Get("sha256"))
+	if err != nil || len(sum) != sha256.Size {
+		writeError(w, http.StatusBadRequest, "Invalid sha256 value")
+		return
+	}
+
+	// Read chunk before locking session so slow clients don't block it.
+	chunk, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUploadChunk+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(chunk) > maxUploadChunk {
+		writeError(w, http.StatusRequestEntityTooLarge, "Chunk is too big")
+		return
+	}
+	actualSum := sha256.Sum256(chunk)
+	if !bytes.Equal(actualSum[:], sum) {
+		writeError(w, http.StatusBadRequest, "Chunk checksum mismatch")
+		return
+	}
+
+	if !lockUpload(id) {
+		writeError(w, http.StatusConflict, "Upload session is busy")
+		return
+	}
+	defer unlockUpload(id)
+
+	sess, cur, err := loadUpload(agentID, id)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if offset != cur {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  true,
+			"msg":    "Offset mismatch",
+			"offset": cur,
+		})
+		return
+	}
+	newOffset := cur + int64(len(chunk))
+	if sess.Size != -1 && newOffset > sess.Size {
+		writeError(w, http.StatusBadRequest, "Chunk exceeds declared file size")
+		return
+	}
+	if maxSize := int64(uploadsConf.Limits.MaxFileSize); maxSize != 0 && newOffset > maxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "File is too big")
+		return
+	}
+
+	file, err := os.OpenFile(uploadPath(id, ".part"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	_, err = file.Write(chunk)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		// Don't leave partially written chunk, client will retry it.
+		file.Truncate(cur)
+		file.Close()
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := file.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if sess.TaskID != 0 {
+		setTaskProgress(agentID, sess.TaskID, newOffset, sess.Size)
+	}
+	writeJson(w, map[string]interface{}{"error": false, "offset": newOffset})
+}
+
+func abortUpload(w http.ResponseWriter, r *http.Request, agentID string) {
+	id := r.URL.Query().Get("id")
+	if !lockUpload(id) {
+		writeError(w, http.StatusConflict, "Upload session is busy")
+		return
+	}
+	defer unlockUpload(id)
+
+	if _, _, err := loadUpload(agentID, id); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	removeUpload(id)
+	writeJson(w, map[string]interface{}{"error": false})
+}
+
+// uploadsFinishHandler handles POST /uploads_finish?id=ID&sha256=HEX. File
+// is checked against checksum of whole file and moved to filedrop storage.
+func uploadsFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "/uploads_finish only supports POST")
+		return
+	}
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id := r.URL.Query().Get("id")
+	sum, err := hex.DecodeString(r.URL.Query().Get("sha256"))
+	if err != nil || len(sum) != sha256.Size {
+		writeError(w, http.StatusBadRequest, "Invalid sha256 value")
+		return
+	}
+
+	if !lockUpload(id) {
+		writeError(w, http.StatusConflict, "Upload session is busy")
+		return
+	}
+	defer unlockUpload(id)
+
+	sess, offset, err := loadUpload(agentID, id)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if sess.Size != -1 && offset != sess.Size {
+		writeError(w, http.StatusBadRequest, "Upload is not complete")
+		return
+	}
+
+	file, err := os.Open(uploadPath(id, ".part"))
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		// There is no way to find out which chunk is broken, client
+		// should start from scratch.
+		removeUpload(id)
+		writeError(w, http.StatusBadRequest, "File checksum mismatch")
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	storeUntil := time.Time{}
+	if uploadsConf.Limits.MaxStoreSecs != 0 {
+		storeUntil = time.Now().Add(time.Duration(uploadsConf.Limits.MaxStoreSecs) * time.Second)
+	}
+	fileUUID, err := uploadsFiledrop.AddFile(file, sess.ContentType, uploadsConf.Limits.MaxUses, storeUntil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	file.Close()
+	removeUpload(id)
+
+	// Same logic as in filedrop for absolute URLs.
+	resURL := url.URL{Scheme: "http", Host: r.Host, Path: PathPrefix + "/filedrop/" + fileUUID}
+	if r.Header.Get("X-HTTPS-Downstream") == "1" ||
+		(r.Header.Get("X-HTTPS-Downstream") == "" && uploadsConf.HTTPSDownstream) {
+		resURL.Scheme = "https"
+	}
+
+	debugLog("Agent", agentID, "finished upload", id, "->", fileUUID)
+	writeJson(w, map[string]interface{}{"error": false, "url": resURL.String()})
+}
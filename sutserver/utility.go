@@ -23,10 +23,24 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/foxcpp/sutrc/agent"
 	"gopkg.in/yaml.v2"
 )
 
@@ -126,3 +140,182 @@ func remAccountSubcmd() {
 		fmt.Println("OK!")
 	}
 }
+
+func setRoleSubcmd() {
+	if len(os.Args) != 5 {
+		fmt.Println("Usage:", os.Args[0], "setrole CONFIGFILE TOKEN ROLE")
+		os.Exit(2)
+	}
+	db, err := openDBFromConf(os.Args[2])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	token, role := os.Args[3], os.Args[4]
+
+	if !db.CheckAuth(token) {
+		fmt.Println("Error: no such account")
+		os.Exit(1)
+	}
+	if err := db.SetAdminRole(token, role); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	} else {
+		fmt.Println("OK!")
+	}
+}
+
+func genKeySubcmd() {
+	if len(os.Args) != 3 {
+		fmt.Println("Usage:", os.Args[0], "genkey KEYFILE")
+		os.Exit(2)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(os.Args[2], []byte(base64.StdEncoding.EncodeToString(priv)), 0600); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(pub))
+}
+
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(blob)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid private key length")
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+func signUpdateSubcmd() {
+	if len(os.Args) != 6 {
+		fmt.Println("Usage:", os.Args[0], "signupdate KEYFILE BINARY VERSION URL")
+		os.Exit(2)
+	}
+	key, err := readPrivateKey(os.Args[2])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	bin, err := ioutil.ReadFile(os.Args[3])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	version, err := strconv.Atoi(os.Args[4])
+	if err != nil {
+		fmt.Println("Error: VERSION should be a number")
+		os.Exit(2)
+	}
+
+	checksum := sha256.Sum256(bin)
+	sig := ed25519.Sign(key, agent.UpdateSignedMessage(version, checksum[:]))
+	manifest, err := json.MarshalIndent(agent.UpdateManifest{
+		Version:   version,
+		URL:       os.Args[5],
+		SHA256:    hex.EncodeToString(checksum[:]),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}, "", "  ")
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(manifest))
+}
+
+func signTaskSubcmd() {
+	if len(os.Args) != 4 && len(os.Args) != 5 {
+		fmt.Println("Usage:", os.Args[0], "signtask KEYFILE KEYID [TTL] < TASKFILE")
+		os.Exit(2)
+	}
+	key, err := readPrivateKey(os.Args[2])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	ttl := time.Hour
+	if len(os.Args) == 5 {
+		ttl, err = time.ParseDuration(os.Args[4])
+		if err != nil {
+			fmt.Println("Error: invalid TTL:", err)
+			os.Exit(2)
+		}
+	}
+
+	task := make(map[string]interface{})
+	if err := json.NewDecoder(os.Stdin).Decode(&task); err != nil {
+		fmt.Println("Error: invalid task JSON:", err)
+		os.Exit(1)
+	}
+	envelope, err := agent.SignTask(task, os.Args[3], key, ttl)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	blob, err := json.Marshal(envelope)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(blob))
+}
+
+// tunnelSubcmd forwards connections to local address to tunnel listener
+// created using POST /tunnels, sending listener's secret first, so any TCP
+// client can use it.
+func tunnelSubcmd() {
+	if len(os.Args) != 5 {
+		fmt.Println("Usage:", os.Args[0], "tunnel LOCALADDR TUNNELADDR SECRET")
+		os.Exit(2)
+	}
+	l, err := net.Listen("tcp", os.Args[2])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Forwarding", l.Addr().String(), "to", os.Args[3])
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		go forwardTunnelConn(conn, os.Args[3], os.Args[4])
+	}
+}
+
+func forwardTunnelConn(conn net.Conn, tunnelAddr, secret string) {
+	defer conn.Close()
+	remote, err := net.Dial("tcp", tunnelAddr)
+	if err != nil {
+		log.Println("Failed to connect to tunnel:", err)
+		return
+	}
+	defer remote.Close()
+	if _, err := io.WriteString(remote, secret+"\n"); err != nil {
+		log.Println("Failed to connect to tunnel:", err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, conn)
+		remote.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, remote)
+	conn.(*net.TCPConn).CloseWrite()
+	<-done
+}
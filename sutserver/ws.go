@@ -0,0 +1,212 @@
+/* MIT License
+ *
+ * Copyright (c) 2018  Max Mazurov (fox.cpp) and Vladyslav Yamkovyi (Hexawolf)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/sutrc/agent"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// wsAgents stores channels used to send task cancellation requests to agents
+// connected using WebSocket.
+var wsAgents = make(map[string]chan int)
+var wsAgentsLock sync.Mutex
+
+// cancelTaskOnAgent asks agent to abort task. Returns false if agent doesn't
+// use WebSocket (or is not connected), there is no way to reach it then.
+func cancelTaskOnAgent(agentID string, taskID int) bool {
+	wsAgentsLock.Lock()
+	defer wsAgentsLock.Unlock()
+	select {
+	case wsAgents[agentID] <- taskID:
+		return true
+	default:
+		return false
+	}
+}
+
+// tasksWSHandler is alternative to longpolling on GET /tasks. Tasks, results,
+// cancellation requests and pings are sent over persistent connection as
+// agent.WSMessage objects.
+func tasksWSHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAgentAuth(r.Header) {
+		writeError(w, http.StatusForbidden, "Authorization failure")
+		return
+	}
+
+	agentID, err := db.GetAgentName(r.Header.Get("Authorization"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordAgentInfo(agentID, r.Header)
+	if rejectOutdated(w, agentID) {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader already sent error response.
+		debugLog("WebSocket upgrade failed for", agentID+":", err)
+		return
+	}
+	defer conn.Close()
+
+	taskMetaLock.Lock()
+	tasksChan := agentTasksChan(agentID)
+	taskMetaLock.Unlock()
+
+	cancels := make(chan int, 16)
+	wsAgentsLock.Lock()
+	wsAgents[agentID] = cancels
+	wsAgentsLock.Unlock()
+
+	onlineAgentsLock.Lock()
+	onlineAgents[agentID] = true
+	onlineAgentsLock.Unlock()
+	defer func() {
+		wsAgentsLock.Lock()
+		if wsAgents[agentID] == cancels {
+			delete(wsAgents, agentID)
+		}
+		wsAgentsLock.Unlock()
+
+		onlineAgentsLock.Lock()
+		onlineAgents[agentID] = false
+		onlineAgentsLock.Unlock()
+	}()
+
+	debugLog(agentID, "connected using WebSocket")
+
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	acks := make(chan int, 16)
+	go wsReader(agentID, conn, done, stop, acks)
+
+	ping := time.NewTicker(20 * time.Second)
+	defer ping.Stop()
+	for {
+		var msg agent.WSMessage
+		select {
+		case <-done:
+			debugLog(agentID, "disconnected")
+			return
+		case task, ok := <-tasksChan:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Agent deregistered"))
+				return
+			}
+			// Copy task because waitTaskResult can clear it concurrently.
+			taskMetaLock.Lock()
+			taskCpy := make(map[string]interface{}, len(task))
+			for k, v := range task {
+				taskCpy[k] = v
+			}
+			taskMetaLock.Unlock()
+			// Ignore "cancelled" tasks.
+			if len(taskCpy) == 0 {
+				continue
+			}
+			debugLog("Sending task", taskCpy["id"], "to", agentID)
+			msg = agent.WSMessage{Kind: "task", Task: taskCpy}
+
+			if err := wsSend(conn, msg); err != nil {
+				// Put task back so it will be sent when agent reconnects.
+				select {
+				case tasksChan <- task:
+				default:
+				}
+				debugLog("Failed to send task to", agentID+":", err)
+				return
+			}
+			continue
+		case id := <-cancels:
+			msg = agent.WSMessage{Kind: "cancel", ID: id}
+		case id := <-acks:
+			msg = agent.WSMessage{Kind: "ack", ID: id}
+		case <-ping.C:
+			msg = agent.WSMessage{Kind: "ping"}
+		}
+
+		if err := wsSend(conn, msg); err != nil {
+			debugLog("Failed to send message to", agentID+":", err)
+			return
+		}
+	}
+}
+
+func wsSend(conn *websocket.Conn, msg agent.WSMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.WriteJSON(msg)
+}
+
+// wsReader handles messages from agent until connection is closed. IDs of
+// saved results are sent to acks channel, writer closes stop channel when it
+// can't send anything anymore.
+func wsReader(agentID string, conn *websocket.Conn, done, stop chan struct{}, acks chan int) {
+	defer close(done)
+	for {
+		// Agent answers our pings, so we should hear from it at least
+		// every 20 seconds.
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		msg := agent.WSMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				debugLog("WebSocket read from", agentID, "failed:", err)
+			}
+			return
+		}
+
+		lastRequestStampLock.Lock()
+		lastRequestStamp[agentID] = time.Now()
+		lastRequestStampLock.Unlock()
+
+		switch msg.Kind {
+		case "result":
+			if msg.Result == nil {
+				log.Println("Empty task", msg.ID, "result from", agentID)
+				continue
+			}
+			if err := deliverTaskResult(agentID, msg.ID, msg.Result); err != nil {
+				// Agent will retry using HTTP if it has outbox.
+				continue
+			}
+			select {
+			case acks <- msg.ID:
+			case <-stop:
+				return
+			}
+		case "pong":
+		default:
+			debugLog("Unknown message kind from", agentID+":", msg.Kind)
+		}
+	}
+}